@@ -217,25 +217,27 @@ export class SlidingSync {
             let resp;
             try {
                 // these fields are always required
+                // lists are keyed by their index in this.lists
                 let reqBody = {
-                    lists: this.lists.map((al) => {
-                        let l = {
-                            ranges: al.activeRanges,
-                            filters: al.getFilters(),
-                        };
-                        // if this is the first request on this session, send sticky request data which never changes
-                        if (!currentPos) {
-                            l.required_state = REQUIRED_STATE_EVENTS_IN_LIST;
-                            l.timeline_limit = 1;
-                            l.sort = [
-                                "by_highlight_count",
-                                "by_notification_count",
-                                "by_recency",
-                            ];
-                        }
-                        return l;
-                    }),
+                    lists: {},
                 };
+                this.lists.forEach((al, index) => {
+                    let l = {
+                        ranges: al.activeRanges,
+                        filters: al.getFilters(),
+                    };
+                    // if this is the first request on this session, send sticky request data which never changes
+                    if (!currentPos) {
+                        l.required_state = REQUIRED_STATE_EVENTS_IN_LIST;
+                        l.timeline_limit = 1;
+                        l.sort = [
+                            "by_highlight_count",
+                            "by_notification_count",
+                            "by_recency",
+                        ];
+                    }
+                    reqBody.lists[String(index)] = l;
+                });
                 // check if we are (un)subscribing to a room and modify request this one time for it
                 let subscribingToRoom;
                 if (
@@ -264,9 +266,16 @@ export class SlidingSync {
                 if (subscribingToRoom) {
                     currentSub = subscribingToRoom;
                 }
-                if (!resp.lists) {
-                    resp.lists = [];
-                }
+                // convert the keyed lists back into an array which matches this.lists
+                const respLists = resp.lists || {};
+                resp.lists = this.lists.map((al, index) => {
+                    return (
+                        respLists[String(index)] || {
+                            count: al.joinedCount,
+                            ops: [],
+                        }
+                    );
+                });
                 resp.lists.forEach((l, index) => {
                     this.lists[index].joinedCount = l.count;
                 });
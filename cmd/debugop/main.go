@@ -17,16 +17,16 @@ const DELETED = "DELETED"
 var flagFile = flag.String("file", "", "Path to the logfile with instructions")
 
 var (
-	instrRegexp      = regexp.MustCompile(`^.*(SYNC|INVALIDATE|INSERT|DELETE) [0-9]+.*;`)
-	syncRegexp       = regexp.MustCompile(`SYNC ([0-9]+) ([0-9]+) ([0-9]+) (.*) ;`)
-	invalidateRegexp = regexp.MustCompile(`INVALIDATE ([0-9]+) ([0-9]+)`)
-	insertRegexp     = regexp.MustCompile(`INSERT ([0-9]+) ([0-9]+) (.*) ;`)
-	deleteRegexp     = regexp.MustCompile(`DELETE ([0-9]+) ([0-9]+)`)
+	instrRegexp      = regexp.MustCompile(`^.*(SYNC|INVALIDATE|INSERT|DELETE) \S+ [0-9]+.*;`)
+	syncRegexp       = regexp.MustCompile(`SYNC (\S+) ([0-9]+) ([0-9]+) (.*) ;`)
+	invalidateRegexp = regexp.MustCompile(`INVALIDATE (\S+) ([0-9]+)`)
+	insertRegexp     = regexp.MustCompile(`INSERT (\S+) ([0-9]+) (.*) ;`)
+	deleteRegexp     = regexp.MustCompile(`DELETE (\S+) ([0-9]+)`)
 )
 
 type Op struct {
-	Name      string
-	ListIndex string
+	Name    string
+	ListKey string
 
 	Start   string
 	End     string
@@ -40,37 +40,37 @@ func NewOpFromNoisyString(line string) *Op {
 	match := insertRegexp.FindStringSubmatch(line)
 	if match != nil {
 		return &Op{
-			Name:      "INSERT",
-			ListIndex: match[1],
-			Index:     match[2],
-			RoomID:    match[3],
+			Name:    "INSERT",
+			ListKey: match[1],
+			Index:   match[2],
+			RoomID:  match[3],
 		}
 	}
 	match = deleteRegexp.FindStringSubmatch(line)
 	if match != nil {
 		return &Op{
-			Name:      "DELETE",
-			ListIndex: match[1],
-			Index:     match[2],
+			Name:    "DELETE",
+			ListKey: match[1],
+			Index:   match[2],
 		}
 	}
 	match = invalidateRegexp.FindStringSubmatch(line)
 	if match != nil {
 		return &Op{
-			Name:      "INVALIDATE",
-			ListIndex: match[1],
-			Start:     match[2],
-			End:       match[3],
+			Name:    "INVALIDATE",
+			ListKey: match[1],
+			Start:   match[2],
+			End:     match[3],
 		}
 	}
 	match = syncRegexp.FindStringSubmatch(line)
 	if match != nil {
 		return &Op{
-			Name:      "SYNC",
-			ListIndex: match[1],
-			Start:     match[2],
-			End:       match[3],
-			RoomIDs:   strings.Split(match[4], " "),
+			Name:    "SYNC",
+			ListKey: match[1],
+			Start:   match[2],
+			End:     match[3],
+			RoomIDs: strings.Split(match[4], " "),
 		}
 	}
 	return nil
@@ -204,10 +204,10 @@ func main() {
 
 	lists := make(map[string]*List)
 	for _, op := range ops {
-		l := lists[op.ListIndex]
+		l := lists[op.ListKey]
 		if l == nil {
-			l = NewList(op.ListIndex)
-			lists[op.ListIndex] = l
+			l = NewList(op.ListKey)
+			lists[op.ListKey] = l
 		}
 		switch op.Name {
 		case "SYNC":
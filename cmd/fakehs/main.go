@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/matrix-org/sync-v3/testutils/fakehs"
+)
+
+const (
+	EnvBindAddr   = "FAKEHS_BINDADDR"
+	EnvServerName = "FAKEHS_SERVER_NAME"
+)
+
+var helpMsg = fmt.Sprintf(`
+Runs an in-memory homeserver for running the proxy and its end-to-end tests without a real homeserver.
+All state is lost when the process exits.
+
+Environment var
+%s   (Default: 0.0.0.0:8008) The interface and port to listen on.
+%s (Default: synapse) The server name in user and room IDs.
+`, EnvBindAddr, EnvServerName)
+
+func defaulting(in, dft string) string {
+	if in == "" {
+		return dft
+	}
+	return in
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		fmt.Print(helpMsg)
+		os.Exit(0)
+	}
+	bindAddr := defaulting(os.Getenv(EnvBindAddr), "0.0.0.0:8008")
+	serverName := defaulting(os.Getenv(EnvServerName), "synapse")
+	hs := fakehs.New(serverName)
+	fmt.Printf("fake homeserver %s listening on %s\n", serverName, bindAddr)
+	if err := http.ListenAndServe(bindAddr, hs.Handler()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	syncv3 "github.com/matrix-org/sync-v3"
+	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
 	"github.com/matrix-org/sync-v3/sync3/handler"
+	"github.com/rs/zerolog"
 )
 
 var GitCommit string
@@ -21,15 +27,137 @@ const (
 	EnvDB       = "SYNCV3_DB"
 	EnvBindAddr = "SYNCV3_BINDADDR"
 	EnvSecret   = "SYNCV3_SECRET"
+
+	EnvUpstreams    = "SYNCV3_UPSTREAMS"
+	EnvWellKnownURL = "SYNCV3_WELL_KNOWN_URL"
+
+	EnvMaxLists                = "SYNCV3_MAX_LISTS"
+	EnvMaxRangesPerList        = "SYNCV3_MAX_RANGES_PER_LIST"
+	EnvMaxRangeSpan            = "SYNCV3_MAX_RANGE_SPAN"
+	EnvMaxRoomSubscriptions    = "SYNCV3_MAX_ROOM_SUBSCRIPTIONS"
+	EnvMaxTimelineLimit        = "SYNCV3_MAX_TIMELINE_LIMIT"
+	EnvMaxRequiredStateEntries = "SYNCV3_MAX_REQUIRED_STATE_ENTRIES"
+
+	EnvRateLimitUser         = "SYNCV3_RATE_LIMIT_USER"
+	EnvRateLimitUserBurst    = "SYNCV3_RATE_LIMIT_USER_BURST"
+	EnvRateLimitConn         = "SYNCV3_RATE_LIMIT_CONN"
+	EnvRateLimitConnBurst    = "SYNCV3_RATE_LIMIT_CONN_BURST"
+	EnvRateLimitInitial      = "SYNCV3_RATE_LIMIT_INITIAL"
+	EnvRateLimitInitialBurst = "SYNCV3_RATE_LIMIT_INITIAL_BURST"
+	EnvRateLimitExempt       = "SYNCV3_RATE_LIMIT_EXEMPT"
+
+	EnvBumpEventTypes = "SYNCV3_BUMP_EVENT_TYPES"
+
+	EnvTokenRevalidateInterval = "SYNCV3_TOKEN_REVALIDATE_INTERVAL"
+	EnvMaxUpstreamFailures     = "SYNCV3_MAX_UPSTREAM_FAILURES"
+
+	EnvLogFormat = "SYNCV3_LOG_FORMAT"
+	EnvLogLevel  = "SYNCV3_LOG_LEVEL"
+	EnvLogLevels = "SYNCV3_LOG_LEVELS"
+	EnvDebug     = "SYNCV3_DEBUG"
+
+	EnvOTLPURL         = "SYNCV3_OTLP_URL"
+	EnvOTLPSampleRatio = "SYNCV3_OTLP_SAMPLE_RATIO"
+
+	EnvTLSCert           = "SYNCV3_TLS_CERT"
+	EnvTLSKey            = "SYNCV3_TLS_KEY"
+	EnvReadHeaderTimeout = "SYNCV3_READ_HEADER_TIMEOUT"
+	EnvIdleTimeout       = "SYNCV3_IDLE_TIMEOUT"
+	EnvAdminBindAddr     = "SYNCV3_ADMIN_BINDADDR"
+	EnvAdminClientCA     = "SYNCV3_ADMIN_CLIENT_CA"
+
+	EnvCompression              = "SYNCV3_COMPRESSION"
+	EnvCompressionMinSize       = "SYNCV3_COMPRESSION_MIN_SIZE"
+	EnvCompressionMaxConcurrent = "SYNCV3_COMPRESSION_MAX_CONCURRENT"
 )
 
 var helpMsg = fmt.Sprintf(`
 Environment var
-%s   Required. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org'
+%s   Required unless %s is set. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org'.
+                Users on servers without an upstream below are sent here.
 %s       Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING 
 %s (Default: 0.0.0.0:8008) The interface and port to listen on.
 %s   Required. A secret to use to encrypt access tokens. Must remain the same for the lifetime of the database. 
-`, EnvServer, EnvDB, EnvBindAddr, EnvSecret)
+
+Multiple homeservers. Requests for each user are sent to the homeserver for the server name in their user ID.
+%s      (Default: none) Comma-separated server name to CS API URL mappings e.g 'a.com=https://hs1.internal,b.com=https://hs2.internal'.
+%s (Default: disabled) Resolve other server names with .well-known/matrix/client from this URL, where
+                      %s is replaced with the server name e.g 'https://%s/.well-known/matrix/client'.
+New access tokens are only checked against %s, so users on other servers need a device which is already
+known to the proxy.
+
+Request limits. Requests which exceed these are rejected. Set to 0 for no limit.
+%s                 (Default: %d) The max number of lists in a request.
+%s       (Default: %d) The max number of ranges in a list.
+%s            (Default: %d) The max number of rooms in a single range.
+%s    (Default: %d) The max number of room subscriptions in a connection.
+%s        (Default: %d) The max timeline_limit.
+%s (Default: %d) The max number of required_state entries in a list or room subscription.
+
+Rate limits. Set a rate to 0 to disable it.
+%s          (Default: %v) Requests per second for each user, across all connections.
+%s    (Default: %d) The burst of requests allowed for each user.
+%s          (Default: %v) Requests per second on each connection.
+%s    (Default: %d) The burst of requests allowed on each connection.
+%s       (Default: %v) Requests per second which create a connection, for each user.
+%s (Default: %d) The burst of requests which create a connection, for each user.
+%s        Comma-separated user IDs which are never rate limited.
+
+%s (Default: %s) Comma-separated event types which clients can use in bump_event_types. Requests with other types are rejected.
+
+%s (Default: disabled) How often to check access tokens of idle connections are still valid e.g '10m'.
+%s     (Default: %d) Consecutive failed requests to a configured upstream before /health/ready reports unavailable. 0 to disable.
+
+Logging. Access tokens and message contents are redacted.
+%s (Default: text) 'json' or 'text'.
+%s  (Default: info) The log level: trace, debug, info, warn, error.
+%s (Default: none) Comma-separated per-subsystem levels e.g 'sync3/handler=trace,state=warn'.
+%s      Set to 1 to log at trace level.
+
+Tracing.
+%s          (Default: disabled) The OTLP/HTTP endpoint to send spans to e.g 'http://localhost:4318/v1/traces'.
+%s (Default: 1) The fraction of requests to trace, between 0 and 1.
+
+Serving. Send SIGHUP to reload the TLS certificate and key.
+%s             (Default: none) Path to a PEM certificate. If set with %s, serves HTTPS and HTTP/2.
+%s              (Default: none) Path to the PEM private key for the certificate.
+%s (Default: %v) How long clients have to send request headers.
+%s        (Default: %v) How long to keep idle connections open.
+%s       (Default: :6060) The interface and port for the admin (pprof) listener. Uses TLS if the server does.
+%s      (Default: none) Path to a PEM CA bundle. If set, admin clients must present a certificate signed by it.
+
+Compression. Responses are compressed with the first encoding the client accepts.
+%s                (Default: %s) Comma-separated encodings in order of preference, or 'none' to disable.
+%s       (Default: %d) Responses smaller than this many bytes are not compressed.
+%s (Default: GOMAXPROCS) The max number of responses compressed at once. Others are sent uncompressed.
+`, EnvServer, EnvUpstreams, EnvDB, EnvBindAddr, EnvSecret,
+	EnvUpstreams, EnvWellKnownURL, sync2.ServerNamePlaceholder, sync2.ServerNamePlaceholder, EnvServer,
+	EnvMaxLists, sync3.DefaultRequestLimits.MaxLists,
+	EnvMaxRangesPerList, sync3.DefaultRequestLimits.MaxRangesPerList,
+	EnvMaxRangeSpan, sync3.DefaultRequestLimits.MaxRangeSpan,
+	EnvMaxRoomSubscriptions, sync3.DefaultRequestLimits.MaxRoomSubscriptions,
+	EnvMaxTimelineLimit, sync3.DefaultRequestLimits.MaxTimelineLimit,
+	EnvMaxRequiredStateEntries, sync3.DefaultRequestLimits.MaxRequiredStateEntries,
+	EnvRateLimitUser, handler.DefaultRateLimits.UserRequestsPerSec,
+	EnvRateLimitUserBurst, handler.DefaultRateLimits.UserBurst,
+	EnvRateLimitConn, handler.DefaultRateLimits.ConnRequestsPerSec,
+	EnvRateLimitConnBurst, handler.DefaultRateLimits.ConnBurst,
+	EnvRateLimitInitial, handler.DefaultRateLimits.InitialRequestsPerSec,
+	EnvRateLimitInitialBurst, handler.DefaultRateLimits.InitialBurst,
+	EnvRateLimitExempt,
+	EnvBumpEventTypes, strings.Join(internal.DefaultBumpEventTypes, ","),
+	EnvTokenRevalidateInterval,
+	EnvMaxUpstreamFailures, handler.DefaultMaxUpstreamFailures,
+	EnvLogFormat, EnvLogLevel, EnvLogLevels, EnvDebug,
+	EnvOTLPURL, EnvOTLPSampleRatio,
+	EnvTLSCert, EnvTLSKey, EnvTLSKey,
+	EnvReadHeaderTimeout, syncv3.DefaultServerOptions.ReadHeaderTimeout,
+	EnvIdleTimeout, syncv3.DefaultServerOptions.IdleTimeout,
+	EnvAdminBindAddr, EnvAdminClientCA,
+	EnvCompression, strings.Join(internal.DefaultCompression.Encodings, ","),
+	EnvCompressionMinSize, internal.DefaultCompression.MinSize,
+	EnvCompressionMaxConcurrent,
+)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -38,6 +166,128 @@ func defaulting(in, dft string) string {
 	return in
 }
 
+// intFromEnv returns the integer value of the environment variable, or dft if it is unset.
+func intFromEnv(key string, dft int64) int64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return dft
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		fmt.Printf("%s must be an integer: %s\n", key, err)
+		os.Exit(1)
+	}
+	return i
+}
+
+// floatFromEnv returns the float value of the environment variable, or dft if it is unset.
+func floatFromEnv(key string, dft float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return dft
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		fmt.Printf("%s must be a number: %s\n", key, err)
+		os.Exit(1)
+	}
+	return f
+}
+
+// logConfigFromEnv returns the logging configuration from the environment, exiting if it is invalid.
+func logConfigFromEnv() internal.LogConfig {
+	cfg := internal.LogConfig{
+		Level: zerolog.InfoLevel,
+	}
+	switch format := os.Getenv(EnvLogFormat); format {
+	case "", "text":
+	case "json":
+		cfg.JSON = true
+	default:
+		fmt.Printf("%s must be 'json' or 'text', got '%s'\n", EnvLogFormat, format)
+		os.Exit(1)
+	}
+	if level := os.Getenv(EnvLogLevel); level != "" {
+		var err error
+		cfg.Level, err = zerolog.ParseLevel(level)
+		if err != nil {
+			fmt.Printf("%s is invalid: %s\n", EnvLogLevel, err)
+			os.Exit(1)
+		}
+	}
+	var err error
+	cfg.SubsystemLevels, err = internal.ParseSubsystemLevels(os.Getenv(EnvLogLevels))
+	if err != nil {
+		fmt.Printf("%s is invalid: %s\n", EnvLogLevels, err)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// durationFromEnv returns the duration value of the environment variable, or dft if it is unset.
+func durationFromEnv(key string, dft time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return dft
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		fmt.Printf("%s must be a duration e.g '30s': %s\n", key, err)
+		os.Exit(1)
+	}
+	return d
+}
+
+// compressionConfigFromEnv returns the compression configuration from the environment, or nil if
+// compression is disabled.
+func compressionConfigFromEnv() *internal.CompressionConfig {
+	cfg := internal.CompressionConfig{
+		Encodings:     internal.DefaultCompression.Encodings,
+		MinSize:       int(intFromEnv(EnvCompressionMinSize, int64(internal.DefaultCompression.MinSize))),
+		MaxConcurrent: int(intFromEnv(EnvCompressionMaxConcurrent, int64(internal.DefaultCompression.MaxConcurrent))),
+	}
+	switch val := os.Getenv(EnvCompression); val {
+	case "":
+	case "none":
+		return nil
+	default:
+		cfg.Encodings = nil
+		for _, enc := range strings.Split(val, ",") {
+			cfg.Encodings = append(cfg.Encodings, strings.TrimSpace(enc))
+		}
+	}
+	return &cfg
+}
+
+// upstreamConfigFromEnv returns the upstream homeservers from the environment, or nil if all requests
+// go to the destination server.
+func upstreamConfigFromEnv(destinationServer string) (*sync2.UpstreamConfig, error) {
+	upstreams := os.Getenv(EnvUpstreams)
+	wellKnownURL := os.Getenv(EnvWellKnownURL)
+	if upstreams == "" && wellKnownURL == "" {
+		return nil, nil
+	}
+	cfg := sync2.UpstreamConfig{
+		Default:      destinationServer,
+		Servers:      make(map[string]string),
+		WellKnownURL: wellKnownURL,
+	}
+	if wellKnownURL != "" && !strings.Contains(wellKnownURL, sync2.ServerNamePlaceholder) {
+		return nil, fmt.Errorf("%s must contain %s", EnvWellKnownURL, sync2.ServerNamePlaceholder)
+	}
+	if upstreams == "" {
+		return &cfg, nil
+	}
+	for _, mapping := range strings.Split(upstreams, ",") {
+		parts := strings.SplitN(strings.TrimSpace(mapping), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s: invalid mapping '%s', want server_name=url", EnvUpstreams, mapping)
+		}
+		cfg.Servers[parts[0]] = parts[1]
+	}
+	return &cfg, nil
+}
+
 func main() {
 	fmt.Printf("Sync v3 [%s] (%s)\n", version, GitCommit)
 	syncv3.Version = fmt.Sprintf("%s (%s)", version, GitCommit)
@@ -45,26 +295,107 @@ func main() {
 	flagPostgres := os.Getenv(EnvDB)
 	flagSecret := os.Getenv(EnvSecret)
 	flagBindAddr := defaulting(os.Getenv(EnvBindAddr), "0.0.0.0:8008")
-	if flagDestinationServer == "" || flagPostgres == "" || flagSecret == "" {
+	if (flagDestinationServer == "" && os.Getenv(EnvUpstreams) == "") || flagPostgres == "" || flagSecret == "" {
 		fmt.Print(helpMsg)
-		fmt.Printf("\n%s and %s and %s must be set\n", EnvServer, EnvBindAddr, EnvSecret)
+		fmt.Printf("\n%s (or %s) and %s and %s must be set\n", EnvServer, EnvUpstreams, EnvDB, EnvSecret)
+		os.Exit(1)
+	}
+	upstreamCfg, err := upstreamConfigFromEnv(flagDestinationServer)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	internal.ConfigureLogging(logConfigFromEnv())
+	if otlpURL := os.Getenv(EnvOTLPURL); otlpURL != "" {
+		_, err := internal.ConfigureTracing(context.Background(), internal.TracingConfig{
+			EndpointURL:    otlpURL,
+			SampleRatio:    floatFromEnv(EnvOTLPSampleRatio, 1),
+			ServiceVersion: syncv3.Version,
+		})
+		if err != nil {
+			fmt.Printf("failed to configure tracing: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	serverOpts := syncv3.ServerOptions{
+		TLSCertFile:       os.Getenv(EnvTLSCert),
+		TLSKeyFile:        os.Getenv(EnvTLSKey),
+		ReadHeaderTimeout: durationFromEnv(EnvReadHeaderTimeout, syncv3.DefaultServerOptions.ReadHeaderTimeout),
+		IdleTimeout:       durationFromEnv(EnvIdleTimeout, syncv3.DefaultServerOptions.IdleTimeout),
+	}
+	if (serverOpts.TLSCertFile == "") != (serverOpts.TLSKeyFile == "") {
+		fmt.Printf("%s and %s must be set together\n", EnvTLSCert, EnvTLSKey)
 		os.Exit(1)
 	}
 	// pprof
+	adminOpts := serverOpts
+	adminOpts.TLSClientCAFile = os.Getenv(EnvAdminClientCA)
 	go func() {
-		if err := http.ListenAndServe(":6060", nil); err != nil {
+		if err := syncv3.ListenAndServe(defaulting(os.Getenv(EnvAdminBindAddr), ":6060"), http.DefaultServeMux, adminOpts); err != nil {
 			panic(err)
 		}
 	}()
-	h, err := handler.NewSync3Handler(&sync2.HTTPClient{
-		Client: &http.Client{
-			Timeout: 5 * time.Minute,
-		},
+	httpClient := &http.Client{
+		Timeout: 5 * time.Minute,
+	}
+	var v2Client sync2.Client = &sync2.HTTPClient{
+		Client:            httpClient,
 		DestinationServer: flagDestinationServer,
-	}, flagPostgres, flagSecret, os.Getenv("SYNCV3_DEBUG") == "1")
+	}
+	if upstreamCfg != nil {
+		v2Client = sync2.NewRoutingClient(httpClient, *upstreamCfg)
+	}
+	if bumpEventTypes := os.Getenv(EnvBumpEventTypes); bumpEventTypes != "" {
+		var eventTypes []string
+		for _, evType := range strings.Split(bumpEventTypes, ",") {
+			eventTypes = append(eventTypes, strings.TrimSpace(evType))
+		}
+		internal.SetBumpEventTypes(eventTypes)
+	}
+	h, err := handler.NewSync3Handler(v2Client, flagPostgres, flagSecret, os.Getenv(EnvDebug) == "1")
 	if err != nil {
 		panic(err)
 	}
+	h.Limits = sync3.RequestLimits{
+		MaxLists:                int(intFromEnv(EnvMaxLists, int64(sync3.DefaultRequestLimits.MaxLists))),
+		MaxRangesPerList:        int(intFromEnv(EnvMaxRangesPerList, int64(sync3.DefaultRequestLimits.MaxRangesPerList))),
+		MaxRangeSpan:            intFromEnv(EnvMaxRangeSpan, sync3.DefaultRequestLimits.MaxRangeSpan),
+		MaxRoomSubscriptions:    int(intFromEnv(EnvMaxRoomSubscriptions, int64(sync3.DefaultRequestLimits.MaxRoomSubscriptions))),
+		MaxTimelineLimit:        intFromEnv(EnvMaxTimelineLimit, sync3.DefaultRequestLimits.MaxTimelineLimit),
+		MaxRequiredStateEntries: int(intFromEnv(EnvMaxRequiredStateEntries, int64(sync3.DefaultRequestLimits.MaxRequiredStateEntries))),
+	}
+	var exemptUserIDs []string
+	if exempt := os.Getenv(EnvRateLimitExempt); exempt != "" {
+		for _, userID := range strings.Split(exempt, ",") {
+			exemptUserIDs = append(exemptUserIDs, strings.TrimSpace(userID))
+		}
+	}
+	h.RateLimiter = handler.NewRateLimiter(handler.RateLimitConfig{
+		UserRequestsPerSec:    floatFromEnv(EnvRateLimitUser, handler.DefaultRateLimits.UserRequestsPerSec),
+		UserBurst:             int(intFromEnv(EnvRateLimitUserBurst, int64(handler.DefaultRateLimits.UserBurst))),
+		ConnRequestsPerSec:    floatFromEnv(EnvRateLimitConn, handler.DefaultRateLimits.ConnRequestsPerSec),
+		ConnBurst:             int(intFromEnv(EnvRateLimitConnBurst, int64(handler.DefaultRateLimits.ConnBurst))),
+		InitialRequestsPerSec: floatFromEnv(EnvRateLimitInitial, handler.DefaultRateLimits.InitialRequestsPerSec),
+		InitialBurst:          int(intFromEnv(EnvRateLimitInitialBurst, int64(handler.DefaultRateLimits.InitialBurst))),
+		ExemptUserIDs:         exemptUserIDs,
+	})
+	h.MaxUpstreamFailures = intFromEnv(EnvMaxUpstreamFailures, handler.DefaultMaxUpstreamFailures)
+	h.Compressor = nil
+	if compressionCfg := compressionConfigFromEnv(); compressionCfg != nil {
+		h.Compressor, err = internal.NewCompressor(*compressionCfg)
+		if err != nil {
+			fmt.Printf("%s is invalid: %s\n", EnvCompression, err)
+			os.Exit(1)
+		}
+	}
+	if val := os.Getenv(EnvTokenRevalidateInterval); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			fmt.Printf("%s must be a positive duration: %s\n", EnvTokenRevalidateInterval, val)
+			os.Exit(1)
+		}
+		h.StartTokenRevalidation(interval)
+	}
 	go h.StartV2Pollers()
-	syncv3.RunSyncV3Server(h, flagBindAddr, flagDestinationServer)
+	syncv3.RunSyncV3Server(h, flagBindAddr, flagDestinationServer, serverOpts)
 }
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// CompressionConfig configures response compression.
+type CompressionConfig struct {
+	// The encodings to use, in order of preference. Used to break ties when the client has no preference.
+	Encodings []string
+	// Responses smaller than this many bytes are not compressed, as the saving is not worth the CPU.
+	MinSize int
+	// The max number of responses being compressed at once. When reached, responses are sent uncompressed
+	// rather than waiting. 0 means GOMAXPROCS.
+	MaxConcurrent int
+}
+
+var DefaultCompression = CompressionConfig{
+	Encodings: []string{EncodingZstd, EncodingBrotli, EncodingGzip},
+	MinSize:   1024,
+}
+
+// encoder is a compressor which can be reused for another response by calling Reset.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Compressor writes compressed HTTP responses, using whichever encoding the client prefers.
+// Encoders are pooled and the number of concurrent compressions is bounded, so the CPU and memory
+// cost of compression is bounded.
+type Compressor struct {
+	encodings []string
+	minSize   int
+	pools     map[string]*sync.Pool
+	sem       chan struct{}
+}
+
+// NewCompressor makes a compressor. Returns an error if the config contains an unknown encoding.
+func NewCompressor(cfg CompressionConfig) (*Compressor, error) {
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = runtime.GOMAXPROCS(0)
+	}
+	c := &Compressor{
+		encodings: cfg.Encodings,
+		minSize:   cfg.MinSize,
+		pools:     make(map[string]*sync.Pool, len(cfg.Encodings)),
+		sem:       make(chan struct{}, maxConcurrent),
+	}
+	for _, enc := range cfg.Encodings {
+		var newEncoder func() interface{}
+		switch enc {
+		case EncodingZstd:
+			newEncoder = func() interface{} {
+				// the concurrency is bounded by the semaphore, so don't use extra goroutines per response
+				e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+				return e
+			}
+		case EncodingBrotli:
+			newEncoder = func() interface{} {
+				return brotli.NewWriterLevel(nil, 4)
+			}
+		case EncodingGzip:
+			newEncoder = func() interface{} {
+				w, _ := gzip.NewWriterLevel(nil, 5)
+				return w
+			}
+		default:
+			return nil, fmt.Errorf("unknown compression encoding '%s'", enc)
+		}
+		c.pools[enc] = &sync.Pool{New: newEncoder}
+	}
+	return c, nil
+}
+
+// Write the response body, compressing it if the client accepts one of the configured encodings.
+// A nil Compressor never compresses. Set any other headers such as Content-Type before calling this.
+func (c *Compressor) Write(w http.ResponseWriter, req *http.Request, statusCode int, body []byte) error {
+	w.Header().Add("Vary", "Accept-Encoding")
+	enc := c.encodingFor(req, len(body))
+	if enc != "" {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		default:
+			// too many responses are being compressed already
+			enc = ""
+		}
+	}
+	if enc == "" {
+		w.WriteHeader(statusCode)
+		_, err := w.Write(body)
+		return err
+	}
+	w.Header().Set("Content-Encoding", enc)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(statusCode)
+	pool := c.pools[enc]
+	e := pool.Get().(encoder)
+	e.Reset(w)
+	_, err := e.Write(body)
+	if closeErr := e.Close(); err == nil {
+		err = closeErr
+	}
+	// don't hold onto the response writer while pooled
+	e.Reset(ioutil.Discard)
+	pool.Put(e)
+	return err
+}
+
+// encodingFor returns the encoding to use for this request, or "" to not compress.
+func (c *Compressor) encodingFor(req *http.Request, size int) string {
+	if c == nil || size < c.minSize {
+		return ""
+	}
+	return NegotiateEncoding(req.Header.Get("Accept-Encoding"), c.encodings)
+}
+
+// NegotiateEncoding returns the encoding in 'supported' with the highest q-value in the Accept-Encoding
+// header, breaking ties using the order of 'supported'. Returns "" if none of them are acceptable.
+func NegotiateEncoding(acceptEncoding string, supported []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		segments := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(segments[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range segments[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		qvalues[coding] = q
+	}
+	var best string
+	var bestQ float64
+	for _, enc := range supported {
+		q, ok := qvalues[enc]
+		if !ok {
+			q = qvalues["*"]
+		}
+		if q > bestQ {
+			best = enc
+			bestQ = q
+		}
+	}
+	return best
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+	testCases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", EncodingGzip},
+		{"gzip, deflate, br", EncodingBrotli},
+		{"gzip, br, zstd", EncodingZstd},
+		{"GZIP", EncodingGzip},
+		{"zstd;q=0.5, gzip", EncodingGzip},
+		{"zstd;q=0, br;q=0, gzip;q=0", ""},
+		{"*", EncodingZstd},
+		{"*;q=0.1, br", EncodingBrotli},
+		{"*, zstd;q=0", EncodingBrotli},
+		{"gzip;q=bad, br;q=0.2", EncodingBrotli},
+	}
+	for _, tc := range testCases {
+		got := NegotiateEncoding(tc.acceptEncoding, supported)
+		if got != tc.want {
+			t.Errorf("NegotiateEncoding(%q): got %q want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestCompressorWrite(t *testing.T) {
+	c, err := NewCompressor(DefaultCompression)
+	if err != nil {
+		t.Fatalf("NewCompressor: %s", err)
+	}
+	body := bytes.Repeat([]byte(`{"type":"m.room.member","state_key":"@alice:localhost"}`), 100)
+	decoders := map[string]func(r io.Reader) (io.Reader, error){
+		EncodingZstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+		EncodingGzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	}
+	// do each encoding twice so pooled encoders are reused
+	for i := 0; i < 2; i++ {
+		for enc, newDecoder := range decoders {
+			req := httptest.NewRequest("POST", "/", nil)
+			req.Header.Set("Accept-Encoding", enc)
+			w := httptest.NewRecorder()
+			if err = c.Write(w, req, 200, body); err != nil {
+				t.Fatalf("Write: %s", err)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != enc {
+				t.Fatalf("got Content-Encoding %q want %q", got, enc)
+			}
+			if w.Body.Len() >= len(body) {
+				t.Errorf("%s: compressed body is %d bytes, uncompressed is %d", enc, w.Body.Len(), len(body))
+			}
+			r, err := newDecoder(w.Body)
+			if err != nil {
+				t.Fatalf("%s: failed to make decoder: %s", enc, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: failed to decompress: %s", enc, err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("%s: decompressed body does not match", enc)
+			}
+		}
+	}
+
+	// small bodies and clients which don't accept compression get the body as-is
+	assertUncompressed := func(acceptEncoding string, body []byte) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		if err = c.Write(w, req, 200, body); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("got Content-Encoding %q want none", got)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("missing Vary header")
+		}
+		if !bytes.Equal(w.Body.Bytes(), body) {
+			t.Errorf("body was modified")
+		}
+	}
+	assertUncompressed("gzip", []byte(`{}`))
+	assertUncompressed("", body)
+
+	// when every slot is in use, responses are sent uncompressed rather than waiting
+	for i := 0; i < cap(c.sem); i++ {
+		c.sem <- struct{}{}
+	}
+	assertUncompressed("gzip", body)
+
+	// a nil compressor never compresses
+	var nilCompressor *Compressor
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err = nilCompressor.Write(w, req, http.StatusTeapot, body); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if w.Code != http.StatusTeapot || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("nil compressor: got code %d encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	if _, err = NewCompressor(CompressionConfig{Encodings: []string{"deflate"}}); err == nil {
+		t.Errorf("NewCompressor with an unknown encoding returned no error")
+	}
+}
@@ -2,6 +2,8 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 
 	"github.com/rs/zerolog"
 )
@@ -14,6 +16,7 @@ var (
 
 // logging metadata for a single request
 type data struct {
+	requestID            string
 	userID               string
 	since                int64
 	next                 int64
@@ -26,13 +29,31 @@ type data struct {
 // prepare a request context so it can contain syncv3 info
 func RequestContext(ctx context.Context) context.Context {
 	d := &data{
-		since:    -1,
-		next:     -1,
-		numRooms: -1,
+		requestID: newRequestID(),
+		since:     -1,
+		next:      -1,
+		numRooms:  -1,
 	}
 	return context.WithValue(ctx, ctxData, d)
 }
 
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestID returns the ID of the request with this context, or the empty string if there isn't one.
+func RequestID(ctx context.Context) string {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return ""
+	}
+	return d.(*data).requestID
+}
+
 // add the user ID to this request context. Need to have called RequestContext first.
 func SetRequestContextUserID(ctx context.Context, userID string) {
 	d := ctx.Value(ctxData)
@@ -63,6 +84,9 @@ func DecorateLogger(ctx context.Context, l *zerolog.Event) *zerolog.Event {
 		return l
 	}
 	da := d.(*data)
+	if da.requestID != "" {
+		l = l.Str("req", da.requestID)
+	}
 	if da.userID != "" {
 		l = l.Str("u", da.userID)
 	}
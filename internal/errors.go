@@ -5,18 +5,33 @@ import (
 	"fmt"
 	"os"
 	"runtime"
-
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = NewLogger("internal")
+
+// Matrix error codes returned to clients in the 'errcode' field of error responses.
+const (
+	ErrCodeUnknown = "M_UNKNOWN"
+	// The 'pos' is not known to the server e.g the session expired. The client should start a new session.
+	ErrCodeUnknownPos = "M_UNKNOWN_POS"
+	// The access token was rejected by the upstream homeserver.
+	ErrCodeUnknownToken = "M_UNKNOWN_TOKEN"
+	ErrCodeMissingToken = "M_MISSING_TOKEN"
+	ErrCodeBadJSON      = "M_BAD_JSON"
+	ErrCodeInvalidParam = "M_INVALID_PARAM"
+	// The client is being rate limited. See HandlerError.RetryAfterMs.
+	ErrCodeLimitExceeded = "M_LIMIT_EXCEEDED"
+)
 
 type HandlerError struct {
 	StatusCode int
 	Err        error
+	// The Matrix error code to send to the client. Defaults to M_UNKNOWN.
+	ErrCode string
+	// For M_UNKNOWN_TOKEN: true if the client should soft logout rather than discard its session.
+	SoftLogout bool
+	// For M_LIMIT_EXCEEDED: how long the client should wait before retrying.
+	RetryAfterMs int64
 }
 
 func (e *HandlerError) Error() string {
@@ -24,11 +39,22 @@ func (e *HandlerError) Error() string {
 }
 
 type jsonError struct {
-	Err string `json:"error"`
+	Err          string `json:"error"`
+	ErrCode      string `json:"errcode"`
+	SoftLogout   bool   `json:"soft_logout,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
-	je := jsonError{e.Error()}
+	je := jsonError{
+		Err:          e.Error(),
+		ErrCode:      e.ErrCode,
+		SoftLogout:   e.SoftLogout,
+		RetryAfterMs: e.RetryAfterMs,
+	}
+	if je.ErrCode == "" {
+		je.ErrCode = ErrCodeUnknown
+	}
 	b, _ := json.Marshal(je)
 	return b
 }
@@ -1,10 +1,46 @@
 package internal
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
 )
 
+func TestHandlerErrorJSON(t *testing.T) {
+	testCases := []struct {
+		herr HandlerError
+		want map[string]interface{}
+	}{
+		{
+			herr: HandlerError{StatusCode: 500, Err: fmt.Errorf("oops")},
+			want: map[string]interface{}{"error": "HTTP 500 : oops", "errcode": "M_UNKNOWN"},
+		},
+		{
+			herr: HandlerError{StatusCode: 400, Err: fmt.Errorf("session expired"), ErrCode: ErrCodeUnknownPos},
+			want: map[string]interface{}{"error": "HTTP 400 : session expired", "errcode": "M_UNKNOWN_POS"},
+		},
+		{
+			herr: HandlerError{StatusCode: 401, Err: fmt.Errorf("bad token"), ErrCode: ErrCodeUnknownToken, SoftLogout: true},
+			want: map[string]interface{}{"error": "HTTP 401 : bad token", "errcode": "M_UNKNOWN_TOKEN", "soft_logout": true},
+		},
+		{
+			herr: HandlerError{StatusCode: 429, Err: fmt.Errorf("slow down"), ErrCode: ErrCodeLimitExceeded, RetryAfterMs: 1500},
+			want: map[string]interface{}{"error": "HTTP 429 : slow down", "errcode": "M_LIMIT_EXCEEDED", "retry_after_ms": float64(1500)},
+		},
+	}
+	for _, tc := range testCases {
+		var got map[string]interface{}
+		if err := json.Unmarshal(tc.herr.JSON(), &got); err != nil {
+			t.Fatalf("JSON() returned invalid JSON: %s", err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("JSON(): got %v want %v", got, tc.want)
+		}
+	}
+}
+
 func TestAssertion(t *testing.T) {
 	os.Setenv("SYNCV3_DEBUG", "1")
 	shouldPanic := true
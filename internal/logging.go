@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// LogConfig configures the logging for every subsystem.
+type LogConfig struct {
+	// Output newline-delimited JSON instead of human readable text.
+	JSON bool
+	// The level for subsystems without an override.
+	Level zerolog.Level
+	// Per-subsystem level overrides, keyed by subsystem name e.g "sync3/handler".
+	SubsystemLevels map[string]zerolog.Level
+}
+
+var (
+	logConfigMu = &sync.RWMutex{}
+	logConfig   = LogConfig{
+		Level: zerolog.InfoLevel,
+	}
+	// where logs are written, guarded by logConfigMu
+	logOutput io.Writer = os.Stderr
+	// logOutput as human readable text. Built once per output as ConsoleWriters are expensive to make.
+	logConsole io.Writer = newConsoleWriter(os.Stderr)
+)
+
+func newConsoleWriter(out io.Writer) io.Writer {
+	return zerolog.ConsoleWriter{
+		Out:        out,
+		TimeFormat: "15:04:05",
+	}
+}
+
+// setLogOutput changes where logs are written.
+func setLogOutput(out io.Writer) {
+	logConfigMu.Lock()
+	defer logConfigMu.Unlock()
+	logOutput = out
+	logConsole = newConsoleWriter(out)
+}
+
+// ConfigureLogging sets the logging configuration for all loggers, including loggers which have
+// already been made with NewLogger.
+func ConfigureLogging(cfg LogConfig) {
+	logConfigMu.Lock()
+	defer logConfigMu.Unlock()
+	logConfig = cfg
+	setGlobalLevel()
+}
+
+// SetLogLevel sets the level for subsystems without an override.
+func SetLogLevel(level zerolog.Level) {
+	logConfigMu.Lock()
+	defer logConfigMu.Unlock()
+	logConfig.Level = level
+	setGlobalLevel()
+}
+
+// must hold logConfigMu. The global level is the most verbose level in use, so zerolog can skip building
+// events which no subsystem would write.
+func setGlobalLevel() {
+	level := logConfig.Level
+	for _, l := range logConfig.SubsystemLevels {
+		if l < level {
+			level = l
+		}
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// ParseSubsystemLevels parses a comma-separated list of subsystem=level pairs
+// e.g "sync3/handler=trace,state=warn".
+func ParseSubsystemLevels(s string) (map[string]zerolog.Level, error) {
+	levels := make(map[string]zerolog.Level)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		segments := strings.SplitN(pair, "=", 2)
+		if len(segments) != 2 {
+			return nil, fmt.Errorf("invalid subsystem level '%s': want subsystem=level", pair)
+		}
+		level, err := zerolog.ParseLevel(strings.TrimSpace(segments[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level for subsystem '%s': %s", segments[0], err)
+		}
+		levels[strings.TrimSpace(segments[0])] = level
+	}
+	return levels, nil
+}
+
+// NewLogger returns a logger for this subsystem. The output format and level are controlled by
+// ConfigureLogging, and sensitive data such as access tokens and message contents is redacted.
+func NewLogger(subsystem string) zerolog.Logger {
+	return zerolog.New(&subsystemWriter{subsystem: subsystem}).With().Timestamp().Str("subsystem", subsystem).Logger()
+}
+
+type subsystemWriter struct {
+	subsystem string
+}
+
+func (w *subsystemWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *subsystemWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	logConfigMu.RLock()
+	minLevel, ok := logConfig.SubsystemLevels[w.subsystem]
+	if !ok {
+		minLevel = logConfig.Level
+	}
+	out := logConsole
+	if logConfig.JSON {
+		out = logOutput
+	}
+	logConfigMu.RUnlock()
+	if level != zerolog.NoLevel && level < minLevel {
+		return len(p), nil
+	}
+	_, err := out.Write(Redact(p))
+	return len(p), err
+}
+
+var redactions = []struct {
+	// the regexp is only run if the line contains one of these, as regexps are slow and most lines
+	// contain nothing to redact.
+	hints []string
+	re    *regexp.Regexp
+	repl  string
+}{
+	// Authorization headers
+	{[]string{"Bearer"}, regexp.MustCompile(`(Bearer\s+)[^\s"\\]+`), "${1}<redacted>"},
+	// access tokens in query parameters
+	{[]string{"access_token="}, regexp.MustCompile(`(access_token=)[^&\s"\\]+`), "${1}<redacted>"},
+	// access tokens and message contents in JSON objects
+	{redactedJSONKeys, regexp.MustCompile(`("(?:access_token|body|formatted_body|ciphertext)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"<redacted>"`},
+	// ...and in JSON objects which have been logged as strings. The end of an escaped value can't be found
+	// reliably, so redact to the end of the enclosing string.
+	{redactedJSONKeys, regexp.MustCompile(`(\\"(?:access_token|body|formatted_body|ciphertext)\\"\s*:\s*)\\"(?:\\"|[^"])*"`), `${1}\"<redacted>\""`},
+}
+
+// the JSON keys whose values are redacted. "body" also matches "formatted_body".
+var redactedJSONKeys = []string{"access_token", "body", "ciphertext"}
+
+// Redact removes access tokens and message contents from a log line.
+func Redact(line []byte) []byte {
+	for _, r := range redactions {
+		if !containsAny(line, r.hints) {
+			continue
+		}
+		line = r.re.ReplaceAll(line, []byte(r.repl))
+	}
+	return line
+}
+
+func containsAny(line []byte, substrs []string) bool {
+	for _, s := range substrs {
+		if bytes.Contains(line, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
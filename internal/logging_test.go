@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRedact(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   `{"level":"info","message":"hello"}`,
+			want: `{"level":"info","message":"hello"}`,
+		},
+		{
+			in:   `{"header":"Bearer syt_secret","message":"hello"}`,
+			want: `{"header":"Bearer <redacted>","message":"hello"}`,
+		},
+		{
+			in:   `{"url":"https://hs/sync?access_token=syt_secret&since=s1","message":"hello"}`,
+			want: `{"url":"https://hs/sync?access_token=<redacted>&since=s1","message":"hello"}`,
+		},
+		{
+			in:   `{"event":{"content":{"body":"secret \"stuff\"","msgtype":"m.text"}},"message":"hello"}`,
+			want: `{"event":{"content":{"body":"<redacted>","msgtype":"m.text"}},"message":"hello"}`,
+		},
+		{
+			in:   `{"event":"{\"content\":{\"body\":\"secret \\\"stuff\\\"\",\"msgtype\":\"m.text\"}}","message":"hello"}`,
+			want: `{"event":"{\"content\":{\"body\":\"<redacted>\"","message":"hello"}`,
+		},
+	}
+	for _, tc := range testCases {
+		got := string(Redact([]byte(tc.in)))
+		if got != tc.want {
+			t.Errorf("Redact(%s)\ngot  %s\nwant %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseSubsystemLevels(t *testing.T) {
+	levels, err := ParseSubsystemLevels("sync3/handler=trace, state=warn,")
+	if err != nil {
+		t.Fatalf("ParseSubsystemLevels returned error: %s", err)
+	}
+	if len(levels) != 2 || levels["sync3/handler"] != zerolog.TraceLevel || levels["state"] != zerolog.WarnLevel {
+		t.Errorf("ParseSubsystemLevels: got %v", levels)
+	}
+	for _, invalid := range []string{"state", "state=loud"} {
+		if _, err = ParseSubsystemLevels(invalid); err == nil {
+			t.Errorf("ParseSubsystemLevels(%s): want error, got none", invalid)
+		}
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	var buf bytes.Buffer
+	setLogOutput(&buf)
+	defer func() {
+		setLogOutput(os.Stderr)
+		ConfigureLogging(LogConfig{Level: zerolog.InfoLevel})
+	}()
+	ConfigureLogging(LogConfig{
+		JSON:  true,
+		Level: zerolog.InfoLevel,
+		SubsystemLevels: map[string]zerolog.Level{
+			"verbose": zerolog.TraceLevel,
+			"quiet":   zerolog.WarnLevel,
+		},
+	})
+	verbose := NewLogger("verbose")
+	quiet := NewLogger("quiet")
+	other := NewLogger("other")
+	verbose.Trace().Msg("verbose trace")
+	quiet.Info().Msg("quiet info")
+	quiet.Warn().Msg("quiet warn")
+	other.Debug().Msg("other debug")
+	other.Info().Msg("other info")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{"verbose trace", "quiet warn", "other info"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines want %d: %v", len(lines), len(want), lines)
+	}
+	for i := range want {
+		if !strings.Contains(lines[i], `"message":"`+want[i]+`"`) {
+			t.Errorf("line %d: got %s want message %s", i, lines[i], want[i])
+		}
+	}
+}
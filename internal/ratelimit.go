@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a set of token buckets keyed off an arbitrary string e.g a user ID. Each bucket holds up
+// to 'burst' tokens and is refilled at 'rate' tokens per second. Each request consumes a token. Buckets
+// which are full are forgotten, so memory usage is proportional to the number of recently active keys.
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      *sync.Mutex
+	buckets map[string]*tokenBucket
+	// when buckets were last swept for full buckets
+	lastSweep time.Time
+	// for tests
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(ratePerSec float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    ratePerSec,
+		burst:   float64(burst),
+		mu:      &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow consumes a token for this key. Returns true if the request is allowed. If it is not allowed,
+// returns how long the caller needs to wait for a token to become available.
+func (r *RateLimiter) Allow(key string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.lastSweep) > time.Minute {
+		r.sweep(now)
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{
+			tokens: r.burst,
+			last:   now,
+		}
+		r.buckets[key] = b
+	}
+	b.refill(now, r.rate, r.burst)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / r.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes buckets which have refilled, as they are indistinguishable from new buckets.
+func (r *RateLimiter) sweep(now time.Time) {
+	for key, b := range r.buckets {
+		b.refill(now, r.rate, r.burst)
+		if b.tokens >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
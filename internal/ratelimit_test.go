@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := NewRateLimiter(2, 3) // 2 req/s, burst 3
+	rl.now = func() time.Time {
+		return now
+	}
+	// the burst is allowed immediately
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("alice"); !ok {
+			t.Fatalf("request %d was not allowed", i)
+		}
+	}
+	ok, wait := rl.Allow("alice")
+	if ok {
+		t.Fatalf("request over the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("got wait %v want 500ms", wait)
+	}
+	// other keys have their own bucket
+	if ok, _ := rl.Allow("bob"); !ok {
+		t.Fatalf("bob was rate limited by alice's requests")
+	}
+
+	// tokens refill over time
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := rl.Allow("alice"); !ok {
+		t.Fatalf("request was not allowed after refilling")
+	}
+	if ok, _ := rl.Allow("alice"); ok {
+		t.Fatalf("request was allowed before refilling")
+	}
+
+	// buckets never refill beyond the burst, and full buckets are swept
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("alice"); !ok {
+			t.Fatalf("request %d was not allowed after a long time", i)
+		}
+	}
+	if ok, _ := rl.Allow("alice"); ok {
+		t.Fatalf("bucket refilled beyond the burst")
+	}
+	if _, exists := rl.buckets["bob"]; exists {
+		t.Errorf("full bucket for bob was not swept")
+	}
+}
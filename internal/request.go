@@ -13,20 +13,29 @@ type RequiredStateMap struct {
 	stateKeysForWildcardEventType   []string
 	eventTypeToStateKeys            map[string][]string
 	allState                        bool
+	lazyLoading                     bool
 }
 
 func NewRequiredStateMap(eventTypesWithWildcardStateKeys map[string]struct{},
 	stateKeysForWildcardEventType []string,
 	eventTypeToStateKeys map[string][]string,
-	allState bool) *RequiredStateMap {
+	allState, lazyLoading bool) *RequiredStateMap {
 	return &RequiredStateMap{
 		eventTypesWithWildcardStateKeys: eventTypesWithWildcardStateKeys,
 		stateKeysForWildcardEventType:   stateKeysForWildcardEventType,
 		eventTypeToStateKeys:            eventTypeToStateKeys,
 		allState:                        allState,
+		lazyLoading:                     lazyLoading,
 	}
 }
 
+// IsLazyLoading returns true if m.room.member events should be lazily loaded, that is only the membership
+// events for the senders of events in the timeline should be returned. The caller is responsible for
+// including these events as they depend on the timeline, which Include knows nothing about.
+func (rsm *RequiredStateMap) IsLazyLoading() bool {
+	return rsm.lazyLoading
+}
+
 func (rsm *RequiredStateMap) Include(evType, stateKey string) bool {
 	if rsm.allState {
 		return true
@@ -52,9 +61,17 @@ func (rsm *RequiredStateMap) Include(evType, stateKey string) bool {
 	return false
 }
 
+// NeedsAllState returns true if all room state has to be loaded to work out which events to include,
+// which is the case for [*,*] and for wildcard event types.
+func (rsm *RequiredStateMap) NeedsAllState() bool {
+	return rsm.allState || len(rsm.stateKeysForWildcardEventType) > 0
+}
+
 // work out what to ask the storage layer: if we have wildcard event types we need to pull all
 // room state and cannot only pull out certain event types. If we have wildcard state keys we
 // need to use an empty list for state keys.
+//
+// If lazy loading, the m.room.member state keys for the timeline senders need to be added by the caller.
 func (rsm *RequiredStateMap) QueryStateMap() map[string][]string {
 	queryStateMap := make(map[string][]string)
 	if len(rsm.stateKeysForWildcardEventType) == 0 { // no wildcard event types
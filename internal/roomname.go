@@ -10,15 +10,51 @@ type RoomMetadata struct {
 	RoomID               string
 	Heroes               []Hero
 	NameEvent            string // the content of m.room.name, NOT the calculated name
+	AvatarEvent          string // the content of m.room.avatar, NOT the calculated avatar
+	Topic                string
 	CanonicalAlias       string
+	HistoryVisibility    string // the content of m.room.history_visibility
 	JoinCount            int
 	InviteCount          int
 	LastMessageTimestamp uint64
 	Encrypted            bool
 	UpgradedRoomID       *string
+	PredecessorRoomID    *string
 	RoomType             *string
 	// if this room is a space, which rooms are m.space.child state events. This is the same for all users hence is global.
 	ChildSpaceRooms map[string]struct{}
+	// the parent space from a canonical m.space.parent event in this room, or "" if there is none.
+	// There should only be one, but if there are several the lowest room ID is picked to be deterministic.
+	CanonicalParentSpace string
+	// every parent space with a canonical m.space.parent event in this room. Use SetParentSpace to modify.
+	CanonicalParentSpaces map[string]struct{}
+	// the timestamp of the latest event of each event type in this room. Used to work out recency
+	// for lists which only care about certain types of event e.g. bump_event_types.
+	LastEventTimestamps map[string]uint64
+}
+
+// IsWorldReadable returns true if anyone can read this room's history without joining it.
+func (m *RoomMetadata) IsWorldReadable() bool {
+	return m.HistoryVisibility == "world_readable"
+}
+
+// SetParentSpace updates the canonical parent space of this room when an m.space.parent event for
+// this parent space is seen.
+func (m *RoomMetadata) SetParentSpace(parentRoomID string, isCanonical bool) {
+	if isCanonical {
+		if m.CanonicalParentSpaces == nil {
+			m.CanonicalParentSpaces = make(map[string]struct{})
+		}
+		m.CanonicalParentSpaces[parentRoomID] = struct{}{}
+	} else {
+		delete(m.CanonicalParentSpaces, parentRoomID)
+	}
+	m.CanonicalParentSpace = ""
+	for roomID := range m.CanonicalParentSpaces {
+		if m.CanonicalParentSpace == "" || roomID < m.CanonicalParentSpace {
+			m.CanonicalParentSpace = roomID
+		}
+	}
 }
 
 // SameRoomName checks if the fields relevant for room names have changed between the two metadatas.
@@ -32,6 +68,24 @@ func (m *RoomMetadata) SameRoomName(other *RoomMetadata) bool {
 		sameHeroes(m.Heroes, other.Heroes))
 }
 
+// SameRoomAvatar checks if the fields relevant for room avatars have changed between the two metadatas.
+// Returns true if there are no changes.
+func (m *RoomMetadata) SameRoomAvatar(other *RoomMetadata) bool {
+	if m.AvatarEvent != other.AvatarEvent || len(m.Heroes) != len(other.Heroes) {
+		return false
+	}
+	for i := range m.Heroes {
+		if m.Heroes[i].Avatar != other.Heroes[i].Avatar {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *RoomMetadata) SameTopic(other *RoomMetadata) bool {
+	return m.Topic == other.Topic
+}
+
 func (m *RoomMetadata) SameJoinCount(other *RoomMetadata) bool {
 	return m.JoinCount == other.JoinCount
 }
@@ -64,13 +118,85 @@ func (m *RoomMetadata) RemoveHero(userID string) {
 	}
 }
 
+// BumpTimestamp returns the timestamp of the latest event in this room with one of the given event types.
+// If no event types are given, returns the timestamp of the latest event in the room. If no events of
+// these types have been seen, returns the room creation timestamp, so that other events never bump the room.
+func (m *RoomMetadata) BumpTimestamp(eventTypes []string) uint64 {
+	if len(eventTypes) == 0 {
+		return m.LastMessageTimestamp
+	}
+	var ts uint64
+	for _, evType := range eventTypes {
+		if evTs := m.LastEventTimestamps[evType]; evTs > ts {
+			ts = evTs
+		}
+	}
+	if ts == 0 {
+		return m.LastEventTimestamps["m.room.create"]
+	}
+	return ts
+}
+
+// DefaultBumpEventTypes are the event types whose timestamps are tracked by default for bump_event_types.
+var DefaultBumpEventTypes = []string{
+	"m.room.message", "m.room.encrypted", "m.sticker", "m.call.invite", "m.poll.start", "m.beacon_info",
+	"m.room.member", "m.room.name", "m.room.topic", "m.room.avatar",
+}
+
+var trackedBumpEventTypes = bumpEventTypeSet(DefaultBumpEventTypes)
+
+func bumpEventTypeSet(eventTypes []string) map[string]struct{} {
+	set := map[string]struct{}{
+		// always tracked, as this is the fallback when no bump event has been seen
+		"m.room.create": {},
+	}
+	for _, evType := range eventTypes {
+		set[evType] = struct{}{}
+	}
+	return set
+}
+
+// SetBumpEventTypes sets the event types whose timestamps are tracked in RoomMetadata.LastEventTimestamps.
+// Requests with other event types in a list's bump_event_types are rejected. Must be called before any room metadata is loaded.
+func SetBumpEventTypes(eventTypes []string) {
+	trackedBumpEventTypes = bumpEventTypeSet(eventTypes)
+}
+
+// BumpEventTypes returns the event types whose timestamps are tracked, including m.room.create.
+func BumpEventTypes() []string {
+	result := make([]string, 0, len(trackedBumpEventTypes))
+	for evType := range trackedBumpEventTypes {
+		result = append(result, evType)
+	}
+	return result
+}
+
+// IsBumpEventType returns true if timestamps are tracked for this event type.
+func IsBumpEventType(eventType string) bool {
+	_, ok := trackedBumpEventTypes[eventType]
+	return ok
+}
+
 func (m *RoomMetadata) IsSpace() bool {
 	return m.RoomType != nil && *m.RoomType == "m.space"
 }
 
 type Hero struct {
-	ID   string
-	Name string
+	ID     string `json:"user_id"`
+	Name   string `json:"displayname,omitempty"`
+	Avatar string `json:"avatar_url,omitempty"`
+}
+
+// CalculateAvatar returns the avatar for this room. If the room has an m.room.avatar then it is used,
+// else DMs use the avatar of the other user in the room. Returns an empty string if there is no avatar.
+func CalculateAvatar(metadata *RoomMetadata, isDM bool) string {
+	if metadata.AvatarEvent != "" {
+		return metadata.AvatarEvent
+	}
+	if isDM && len(metadata.Heroes) == 1 {
+		return metadata.Heroes[0].Avatar
+	}
+	return ""
 }
 
 func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) string {
@@ -247,3 +247,80 @@ func TestCalculateRoomName(t *testing.T) {
 		}
 	}
 }
+
+func TestCalculateAvatar(t *testing.T) {
+	testCases := []struct {
+		avatarEvent string
+		isDM        bool
+		heroes      []Hero
+		wantAvatar  string
+	}{
+		// room avatar
+		{
+			avatarEvent: "mxc://localhost/room",
+			wantAvatar:  "mxc://localhost/room",
+		},
+		// room avatar takes precedence over the DM avatar
+		{
+			avatarEvent: "mxc://localhost/room",
+			isDM:        true,
+			heroes:      []Hero{{ID: "@bob:localhost", Avatar: "mxc://localhost/bob"}},
+			wantAvatar:  "mxc://localhost/room",
+		},
+		// DMs use the other user's avatar
+		{
+			isDM:       true,
+			heroes:     []Hero{{ID: "@bob:localhost", Avatar: "mxc://localhost/bob"}},
+			wantAvatar: "mxc://localhost/bob",
+		},
+		// non-DMs don't use hero avatars
+		{
+			heroes:     []Hero{{ID: "@bob:localhost", Avatar: "mxc://localhost/bob"}},
+			wantAvatar: "",
+		},
+		// DMs with more than one other user don't use hero avatars
+		{
+			isDM: true,
+			heroes: []Hero{
+				{ID: "@bob:localhost", Avatar: "mxc://localhost/bob"},
+				{ID: "@charlie:localhost", Avatar: "mxc://localhost/charlie"},
+			},
+			wantAvatar: "",
+		},
+	}
+	for _, tc := range testCases {
+		gotAvatar := CalculateAvatar(&RoomMetadata{
+			AvatarEvent: tc.avatarEvent,
+			Heroes:      tc.heroes,
+		}, tc.isDM)
+		if gotAvatar != tc.wantAvatar {
+			t.Errorf("got %s want %s for test case: %+v", gotAvatar, tc.wantAvatar, tc)
+		}
+	}
+}
+
+func TestSetParentSpace(t *testing.T) {
+	var m RoomMetadata
+	steps := []struct {
+		parent      string
+		isCanonical bool
+		want        string
+	}{
+		{parent: "!b", isCanonical: true, want: "!b"},
+		// the lowest room ID wins regardless of ordering
+		{parent: "!c", isCanonical: true, want: "!b"},
+		{parent: "!a", isCanonical: true, want: "!a"},
+		// removing a non-canonical parent is a no-op
+		{parent: "!d", isCanonical: false, want: "!a"},
+		// removing the current parent falls back to the next lowest
+		{parent: "!a", isCanonical: false, want: "!b"},
+		{parent: "!b", isCanonical: false, want: "!c"},
+		{parent: "!c", isCanonical: false, want: ""},
+	}
+	for i, step := range steps {
+		m.SetParentSpace(step.parent, step.isCanonical)
+		if m.CanonicalParentSpace != step.want {
+			t.Errorf("step %d: SetParentSpace(%s, %v) got %q want %q", i, step.parent, step.isCanonical, m.CanonicalParentSpace, step.want)
+		}
+	}
+}
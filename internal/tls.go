@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// CertReloader serves a TLS certificate which can be reloaded from disk without restarting, e.g when
+// the certificate is renewed.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       *sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// NewCertReloader loads the certificate and key. Returns an error if they cannot be loaded.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		mu:       &sync.RWMutex{},
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload the certificate and key from disk. If they cannot be loaded, the previous certificate is kept.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s and key %s: %s", r.certFile, r.keyFile, err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// ReloadOnSIGHUP reloads the certificate whenever the process receives SIGHUP.
+func (r *CertReloader) ReloadOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := r.Reload(); err != nil {
+				logger.Err(err).Msg("failed to reload TLS certificate, keeping the old one")
+				continue
+			}
+			logger.Info().Str("cert", r.certFile).Msg("reloaded TLS certificate")
+		}
+	}()
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a TLS config which serves the certificate from the reloader and supports HTTP/2.
+// If clientCAFile is set, clients must present a certificate signed by one of the CAs in the file.
+func TLSConfig(r *CertReloader, clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate and key for this common name, returning the paths.
+func writeSelfSignedCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCertReloader")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir, "first")
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+	assertCommonName := func(want string) {
+		t.Helper()
+		cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("GetCertificate: %s", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("ParseCertificate: %s", err)
+		}
+		if leaf.Subject.CommonName != want {
+			t.Errorf("got certificate for %s want %s", leaf.Subject.CommonName, want)
+		}
+	}
+	assertCommonName("first")
+
+	// the new certificate is served after reloading
+	writeSelfSignedCert(t, dir, "second")
+	if err = reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	assertCommonName("second")
+
+	// a broken certificate is rejected and the old one is kept
+	if err = ioutil.WriteFile(certFile, []byte("not a cert"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err = reloader.Reload(); err == nil {
+		t.Errorf("Reload of a broken certificate returned no error")
+	}
+	assertCommonName("second")
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTLSConfig")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir, "server")
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+	cfg, err := TLSConfig(reloader, "")
+	if err != nil {
+		t.Fatalf("TLSConfig: %s", err)
+	}
+	if cfg.ClientAuth != tls.NoClientCert || cfg.NextProtos[0] != "h2" {
+		t.Errorf("TLSConfig without a client CA: got client auth %v protos %v", cfg.ClientAuth, cfg.NextProtos)
+	}
+	// the self-signed cert doubles as a CA
+	cfg, err = TLSConfig(reloader, certFile)
+	if err != nil {
+		t.Fatalf("TLSConfig: %s", err)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil {
+		t.Errorf("TLSConfig with a client CA does not require client certs")
+	}
+	if _, err = TLSConfig(reloader, keyFile); err == nil {
+		t.Errorf("TLSConfig with a client CA file containing no certs returned no error")
+	}
+}
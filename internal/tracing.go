@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/trace"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Tasks and spans are recorded with both runtime/trace, for use with `go tool trace`, and OpenTelemetry
+// for distributed tracing. OpenTelemetry spans are no-ops until ConfigureTracing is called.
+var tracer = otel.Tracer("github.com/matrix-org/sync-v3")
+
+// TracingConfig configures exporting OpenTelemetry spans.
+type TracingConfig struct {
+	// The OTLP/HTTP endpoint to send spans to e.g "http://localhost:4318/v1/traces".
+	EndpointURL string
+	// The fraction of traces to sample, between 0 and 1. Traces which are sampled by the caller are always sampled.
+	SampleRatio float64
+	// The version reported in the service.version attribute.
+	ServiceVersion string
+}
+
+// ConfigureTracing starts exporting spans via OTLP. Call the returned function on shutdown to flush
+// any buffered spans.
+func ConfigureTracing(ctx context.Context, cfg TracingConfig) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.EndpointURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %s", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "sliding-sync"),
+			attribute.String("service.version", cfg.ServiceVersion),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// ExtractTraceContext returns a context which continues the trace in the request headers, if any.
+func ExtractTraceContext(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// TraceTask is a top-level unit of work, such as handling a request or doing a v2 poll.
+type TraceTask struct {
+	task *trace.Task
+	span oteltrace.Span
+}
+
+// StartTask starts a task. Call End when the task is done.
+func StartTask(ctx context.Context, name string) (context.Context, *TraceTask) {
+	ctx, task := trace.NewTask(ctx, name)
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, &TraceTask{
+		task: task,
+		span: span,
+	}
+}
+
+func (t *TraceTask) SetAttribute(key string, value interface{}) {
+	setAttribute(t.span, key, value)
+}
+
+func (t *TraceTask) SetError(err error) {
+	setError(t.span, err)
+}
+
+func (t *TraceTask) End() {
+	t.span.End()
+	t.task.End()
+}
+
+// TraceSpan is a unit of work within a task. Spans must be ended on the goroutine which started them.
+type TraceSpan struct {
+	region *trace.Region
+	span   oteltrace.Span
+}
+
+// StartSpan starts a span which is a child of any task or span in the context. Call End when the span is done.
+func StartSpan(ctx context.Context, name string) (context.Context, *TraceSpan) {
+	region := trace.StartRegion(ctx, name)
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, &TraceSpan{
+		region: region,
+		span:   span,
+	}
+}
+
+func (s *TraceSpan) SetAttribute(key string, value interface{}) {
+	setAttribute(s.span, key, value)
+}
+
+func (s *TraceSpan) SetError(err error) {
+	setError(s.span, err)
+}
+
+func (s *TraceSpan) End() {
+	s.span.End()
+	s.region.End()
+}
+
+// SetTraceAttribute sets an attribute on the current span in the context.
+func SetTraceAttribute(ctx context.Context, key string, value interface{}) {
+	setAttribute(oteltrace.SpanFromContext(ctx), key, value)
+}
+
+// Logf logs a message against the task in the context, and records it as an event on the current span.
+func Logf(ctx context.Context, category, format string, args ...interface{}) {
+	trace.Logf(ctx, category, format, args...)
+	oteltrace.SpanFromContext(ctx).AddEvent(fmt.Sprintf(format, args...), oteltrace.WithAttributes(
+		attribute.String("category", category),
+	))
+}
+
+func setAttribute(span oteltrace.Span, key string, value interface{}) {
+	if !span.IsRecording() {
+		return
+	}
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	span.SetAttributes(kv)
+}
+
+func setError(span oteltrace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Test that spans are exported to an OTLP collector, and that traces are continued from request headers.
+func TestTracingExportsSpans(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("collector got request to %s", req.URL.Path)
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer collector.Close()
+	prevProvider := otel.GetTracerProvider()
+	prevPropagator := otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+
+	shutdown, err := ConfigureTracing(context.Background(), TracingConfig{
+		EndpointURL: collector.URL + "/v1/traces",
+		SampleRatio: 0, // the caller's sampling decision is respected
+	})
+	if err != nil {
+		t.Fatalf("ConfigureTracing: %s", err)
+	}
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, task := StartTask(ExtractTraceContext(context.Background(), header), "task")
+	spanCtx, span := StartSpan(ctx, "span")
+	span.SetAttribute("num_rooms", 5)
+	if got := oteltrace.SpanContextFromContext(spanCtx).TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("span did not continue the trace from the headers: got trace ID %s", got)
+	}
+	span.End()
+	task.End()
+
+	// an unsampled trace is not exported
+	header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	_, task = StartTask(ExtractTraceContext(context.Background(), header), "unsampled")
+	task.End()
+
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) == 0 {
+		t.Fatalf("collector received no spans")
+	}
+	var all []byte
+	for _, b := range bodies {
+		all = append(all, b...)
+	}
+	for _, name := range []string{"task", "span", "num_rooms"} {
+		if !bytes.Contains(all, []byte(name)) {
+			t.Errorf("exported spans do not contain %q", name)
+		}
+	}
+	if bytes.Contains(all, []byte("unsampled")) {
+		t.Errorf("unsampled trace was exported")
+	}
+	// make sure the propagator was set
+	if _, ok := otel.GetTextMapPropagator().(propagation.TraceContext); !ok {
+		t.Errorf("trace context propagator was not set")
+	}
+}
@@ -24,6 +24,7 @@ type AccountDataTable struct{}
 func NewAccountDataTable(db *sqlx.DB) *AccountDataTable {
 	// make sure tables are made
 	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_user_data_seq;
 	CREATE TABLE IF NOT EXISTS syncv3_account_data (
 		user_id TEXT NOT NULL,
 		room_id TEXT NOT NULL, -- optional if global
@@ -31,6 +32,9 @@ func NewAccountDataTable(db *sqlx.DB) *AccountDataTable {
 		data BYTEA NOT NULL,
 		UNIQUE(user_id, room_id, type)
 	);
+	-- the position in the user data stream when this account data last changed
+	ALTER TABLE syncv3_account_data ADD COLUMN IF NOT EXISTS stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_user_data_seq');
+	CREATE INDEX IF NOT EXISTS syncv3_account_data_stream_id_idx ON syncv3_account_data(stream_id);
 	`)
 	return &AccountDataTable{}
 }
@@ -51,11 +55,14 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 	for _, ad := range keys {
 		dedupedAccountData = append(dedupedAccountData, *ad)
 	}
+	if err := lockUserDataStreamForWrite(txn); err != nil {
+		return nil, err
+	}
 	chunks := sqlutil.Chunkify(4, MaxPostgresParameters, AccountDataChunker(dedupedAccountData))
 	for _, chunk := range chunks {
 		_, err := txn.NamedExec(`
 		INSERT INTO syncv3_account_data (user_id, room_id, type, data)
-        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data`, chunk)
+        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, stream_id = nextval('syncv3_user_data_seq')`, chunk)
 		if err != nil {
 			return nil, err
 		}
@@ -90,6 +97,14 @@ func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, roomIDs ...st
 	return
 }
 
+// SelectSince returns all global and room account data for this user which changed after the user data
+// stream position `from`, up to and including `to`.
+func (t *AccountDataTable) SelectSince(txn *sqlx.Tx, userID string, from, to int64) (datas []AccountData, err error) {
+	err = txn.Select(&datas, `SELECT user_id, room_id, type, data FROM syncv3_account_data
+	WHERE user_id=$1 AND stream_id > $2 AND stream_id <= $3`, userID, from, to)
+	return
+}
+
 type AccountDataChunker []AccountData
 
 func (c AccountDataChunker) Len() int {
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnectionsTable stores a snapshot of each sliding sync connection, keyed off the connection ID.
+// Snapshots are opaque to this table: they are written by sync3 after every response so a connection
+// can be resumed if the proxy restarts, rather than forcing the client to start again from scratch.
+type ConnectionsTable struct {
+	db *sqlx.DB
+}
+
+func NewConnectionsTable(db *sqlx.DB) *ConnectionsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_connections (
+		conn_id TEXT NOT NULL PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		-- JSON object. The serialised sync3.ConnSnapshot
+		snapshot BYTEA NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return &ConnectionsTable{db}
+}
+
+// Upsert the snapshot for this connection, replacing any existing snapshot.
+func (t *ConnectionsTable) Upsert(connID, userID string, snapshot []byte) error {
+	_, err := t.db.Exec(
+		`INSERT INTO syncv3_connections(conn_id, user_id, snapshot, updated_at) VALUES($1,$2,$3,CURRENT_TIMESTAMP)
+		ON CONFLICT (conn_id) DO UPDATE SET user_id = $2, snapshot = $3, updated_at = CURRENT_TIMESTAMP`,
+		connID, userID, snapshot,
+	)
+	return err
+}
+
+// Select the snapshot for this connection, along with the user ID and when it was last updated.
+// Returns a nil snapshot if there is no snapshot for this connection.
+func (t *ConnectionsTable) Select(connID string) (userID string, snapshot []byte, updatedAt time.Time, err error) {
+	err = t.db.QueryRow(
+		`SELECT user_id, snapshot, updated_at FROM syncv3_connections WHERE conn_id = $1`, connID,
+	).Scan(&userID, &snapshot, &updatedAt)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (t *ConnectionsTable) Delete(connID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_connections WHERE conn_id = $1`, connID)
+	return err
+}
+
+// DeleteOlderThan removes snapshots which have not been updated since the given time, as the
+// connections they represent have expired.
+func (t *ConnectionsTable) DeleteOlderThan(cutoff time.Time) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_connections WHERE updated_at < $1`, cutoff)
+	return err
+}
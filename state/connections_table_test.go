@@ -0,0 +1,61 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestConnectionsTable(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewConnectionsTable(db)
+	alice := "@alice:localhost"
+	connID := "TestConnectionsTable_conn"
+	snapshotA := []byte(`{"pos":1}`)
+	snapshotB := []byte(`{"pos":2}`)
+
+	// unknown connections return no snapshot
+	_, snapshot, _, err := table.Select(connID)
+	assertNoError(t, err)
+	if snapshot != nil {
+		t.Fatalf("Select: got snapshot %s for unknown conn, want nil", string(snapshot))
+	}
+
+	assertNoError(t, table.Upsert(connID, alice, snapshotA))
+	userID, snapshot, updatedAt, err := table.Select(connID)
+	assertNoError(t, err)
+	if userID != alice || !bytes.Equal(snapshot, snapshotA) {
+		t.Errorf("Select: got (%s, %s) want (%s, %s)", userID, string(snapshot), alice, string(snapshotA))
+	}
+	if updatedAt.IsZero() {
+		t.Errorf("Select: updated_at was not set")
+	}
+
+	// clobber the snapshot
+	assertNoError(t, table.Upsert(connID, alice, snapshotB))
+	_, snapshot, _, err = table.Select(connID)
+	assertNoError(t, err)
+	if !bytes.Equal(snapshot, snapshotB) {
+		t.Errorf("Select: got %s want %s", string(snapshot), string(snapshotB))
+	}
+
+	// recently updated snapshots are not expired
+	assertNoError(t, table.DeleteOlderThan(time.Now().Add(-time.Hour)))
+	_, snapshot, _, err = table.Select(connID)
+	assertNoError(t, err)
+	if snapshot == nil {
+		t.Errorf("DeleteOlderThan: removed a snapshot which was not old")
+	}
+
+	assertNoError(t, table.Delete(connID))
+	_, snapshot, _, err = table.Select(connID)
+	assertNoError(t, err)
+	if snapshot != nil {
+		t.Errorf("Delete: snapshot still exists")
+	}
+}
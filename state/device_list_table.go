@@ -0,0 +1,114 @@
+package state
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sync-v3/sqlutil"
+)
+
+const (
+	DeviceListChanged = "changed"
+	DeviceListLeft    = "left"
+)
+
+// DeviceListTable stores device_lists changes for devices, so they can be returned in v2 /sync responses
+// between two positions. Rows are kept until the device acknowledges them, so a client which retries a
+// request with the same since token gets the same changes again.
+type DeviceListTable struct {
+	db *sqlx.DB
+}
+
+func NewDeviceListTable(db *sqlx.DB) *DeviceListTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_device_list_updates_seq;
+	CREATE TABLE IF NOT EXISTS syncv3_device_list_updates (
+		position BIGINT NOT NULL PRIMARY KEY DEFAULT nextval('syncv3_device_list_updates_seq'),
+		device_id TEXT NOT NULL,
+		-- the user whose devices changed
+		target_user_id TEXT NOT NULL,
+		-- 'changed' or 'left'
+		target_state TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_device_list_updates_device_idx ON syncv3_device_list_updates(device_id, position);
+	`)
+	return &DeviceListTable{db}
+}
+
+// Insert device list changes for this device. Changes are inserted one device at a time by the pollers, so
+// positions become visible in order.
+func (t *DeviceListTable) Insert(deviceID string, changed, left []string) error {
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		for _, state := range []struct {
+			userIDs []string
+			state   string
+		}{{changed, DeviceListChanged}, {left, DeviceListLeft}} {
+			if len(state.userIDs) == 0 {
+				continue
+			}
+			_, err := txn.Exec(
+				`INSERT INTO syncv3_device_list_updates(device_id, target_user_id, target_state)
+				SELECT $1, unnest($2::TEXT[]), $3`,
+				deviceID, pq.StringArray(state.userIDs), state.state,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SelectHighestPosition returns the position of the latest change for any device.
+func (t *DeviceListTable) SelectHighestPosition() (pos int64, err error) {
+	var result sql.NullInt64
+	err = t.db.QueryRow(`SELECT MAX(position) FROM syncv3_device_list_updates`).Scan(&result)
+	if result.Valid {
+		pos = result.Int64
+	}
+	return
+}
+
+// Select the device list changes for this device after `from`, up to and including `to`. If a user changed
+// more than once, their latest state is returned.
+func (t *DeviceListTable) Select(deviceID string, from, to int64) (changed, left []string, err error) {
+	rows, err := t.db.Query(
+		`SELECT target_user_id, target_state FROM syncv3_device_list_updates
+		WHERE device_id = $1 AND position > $2 AND position <= $3 ORDER BY position ASC`,
+		deviceID, from, to,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	// user ID -> latest state, and the order users were first seen in so results are stable
+	states := make(map[string]string)
+	var userIDs []string
+	for rows.Next() {
+		var userID, state string
+		if err := rows.Scan(&userID, &state); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := states[userID]; !ok {
+			userIDs = append(userIDs, userID)
+		}
+		states[userID] = state
+	}
+	for _, userID := range userIDs {
+		switch states[userID] {
+		case DeviceListChanged:
+			changed = append(changed, userID)
+		case DeviceListLeft:
+			left = append(left, userID)
+		}
+	}
+	return changed, left, rows.Err()
+}
+
+// DeleteUpToAndIncluding deletes device list changes for this device which the client has acknowledged.
+func (t *DeviceListTable) DeleteUpToAndIncluding(deviceID string, toIncl int64) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_device_list_updates WHERE device_id = $1 AND position <= $2`, deviceID, toIncl)
+	return err
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestDeviceListTable(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewDeviceListTable(db)
+	deviceID := "TestDeviceListTable"
+	otherDeviceID := "TestDeviceListTable_other"
+
+	from, err := table.SelectHighestPosition()
+	assertNoError(t, err)
+	assertNoError(t, table.Insert(deviceID, []string{"@alice:localhost", "@bob:localhost"}, []string{"@charlie:localhost"}))
+	assertNoError(t, table.Insert(otherDeviceID, []string{"@doris:localhost"}, nil))
+	// bob leaves after changing, so only the latest state is returned
+	assertNoError(t, table.Insert(deviceID, nil, []string{"@bob:localhost"}))
+	to, err := table.SelectHighestPosition()
+	assertNoError(t, err)
+	if to <= from {
+		t.Fatalf("SelectHighestPosition: got %d want > %d", to, from)
+	}
+
+	// reading is non-destructive, so a retried request gets the same changes
+	for i := 0; i < 2; i++ {
+		changed, left, err := table.Select(deviceID, from, to)
+		assertNoError(t, err)
+		if want := []string{"@alice:localhost"}; !reflect.DeepEqual(changed, want) {
+			t.Errorf("changed: got %v want %v", changed, want)
+		}
+		if want := []string{"@bob:localhost", "@charlie:localhost"}; !reflect.DeepEqual(left, want) {
+			t.Errorf("left: got %v want %v", left, want)
+		}
+	}
+	changed, left, err := table.Select(deviceID, to, to)
+	assertNoError(t, err)
+	if len(changed) != 0 || len(left) != 0 {
+		t.Errorf("Select after to: got changed=%v left=%v want nothing", changed, left)
+	}
+
+	// acknowledging changes only deletes them for this device
+	assertNoError(t, table.DeleteUpToAndIncluding(deviceID, to))
+	changed, left, err = table.Select(deviceID, from, to)
+	assertNoError(t, err)
+	if len(changed) != 0 || len(left) != 0 {
+		t.Errorf("Select after delete: got changed=%v left=%v want nothing", changed, left)
+	}
+	changed, _, err = table.Select(otherDeviceID, from, to)
+	assertNoError(t, err)
+	if want := []string{"@doris:localhost"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("other device changed: got %v want %v", changed, want)
+	}
+}
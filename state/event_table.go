@@ -199,7 +199,7 @@ func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (ev
 		wanted = len(ids)
 	}
 	return t.selectAny(txn, wanted, `
-	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership FROM syncv3_events
+	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, event_replaces_nid FROM syncv3_events
 	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
 }
 
@@ -249,6 +249,19 @@ func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, repl
 	return err
 }
 
+// SelectNextBeforeSnapshotID returns the before_state_snapshot_id of the first event in this room after
+// the event NID given, which is the state after that event. Returns 0 if there are no later events.
+func (t *EventTable) SelectNextBeforeSnapshotID(txn *sqlx.Tx, roomID string, eventNID int64) (snapshotID int64, err error) {
+	err = txn.QueryRow(
+		`SELECT before_state_snapshot_id FROM syncv3_events WHERE room_id = $1 AND event_nid > $2 AND before_state_snapshot_id != 0
+		ORDER BY event_nid ASC LIMIT 1`, roomID, eventNID,
+	).Scan(&snapshotID)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 // query the latest events in each of the room IDs given, using highestNID as the highest event.
 func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
@@ -300,6 +313,29 @@ func (t *EventTable) selectLatestEventInAllRooms() ([]Event, error) {
 	return result, nil
 }
 
+// Select the latest event of each of the given event types in every room. Only the room ID, type and JSON
+// are returned. Uses syncv3_events_type_room_nid_idx.
+func (t *EventTable) selectLatestEventOfEachTypeInAllRooms(eventTypes []string) ([]Event, error) {
+	result := []Event{}
+	rows, err := t.db.Query(
+		`SELECT room_id, event_type, event FROM syncv3_events WHERE event_nid in (
+			SELECT MAX(event_nid) FROM syncv3_events WHERE event_type = ANY($1) GROUP BY event_type, room_id
+		)`, pq.StringArray(eventTypes),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.RoomID, &ev.Type, &ev.JSON); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	return result, nil
+}
+
 // Select all events between the bounds matching the type, state_key given.
 // Used to work out which rooms the user was joined to at a given point in time.
 func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
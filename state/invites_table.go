@@ -1,9 +1,11 @@
 package state
 
 import (
+	"database/sql"
 	"encoding/json"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sync-v3/sqlutil"
 )
 
 // InvitesTable stores invites for each user.
@@ -30,6 +32,7 @@ type InvitesTable struct {
 func NewInvitesTable(db *sqlx.DB) *InvitesTable {
 	// make sure tables are made
 	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_user_data_seq;
 	CREATE TABLE IF NOT EXISTS syncv3_invites (
 		room_id TEXT NOT NULL,
 		user_id TEXT NOT NULL,
@@ -37,6 +40,9 @@ func NewInvitesTable(db *sqlx.DB) *InvitesTable {
 		invite_state BYTEA NOT NULL,
 		UNIQUE(user_id, room_id)
 	);
+	-- the position in the user data stream when this invite last changed
+	ALTER TABLE syncv3_invites ADD COLUMN IF NOT EXISTS stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_user_data_seq');
+	CREATE INDEX IF NOT EXISTS syncv3_invites_stream_id_idx ON syncv3_invites(stream_id);
 	`)
 	return &InvitesTable{db}
 }
@@ -51,12 +57,27 @@ func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []jso
 	if err != nil {
 		return err
 	}
-	_, err = t.db.Exec(
-		`INSERT INTO syncv3_invites(user_id, room_id, invite_state) VALUES($1,$2,$3)
-		ON CONFLICT (user_id, room_id) DO UPDATE SET invite_state = $3`,
-		userID, roomID, blob,
-	)
-	return err
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		if err := lockUserDataStreamForWrite(txn); err != nil {
+			return err
+		}
+		_, err := txn.Exec(
+			`INSERT INTO syncv3_invites(user_id, room_id, invite_state) VALUES($1,$2,$3)
+			ON CONFLICT (user_id, room_id) DO UPDATE SET invite_state = $3, stream_id = nextval('syncv3_user_data_seq')`,
+			userID, roomID, blob,
+		)
+		return err
+	})
+}
+
+// Select the invite_state for this user in this room, or nil if the user is not invited.
+func (t *InvitesTable) SelectInvite(userID, roomID string) ([]json.RawMessage, error) {
+	rows, err := t.db.Query(`SELECT room_id, invite_state FROM syncv3_invites WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	invites, err := scanInvites(rows)
+	return invites[roomID], err
 }
 
 // Select all invites for this user. Returns a map of room ID to invite_state (json array).
@@ -65,6 +86,23 @@ func (t *InvitesTable) SelectAllInvitesForUser(userID string) (map[string][]json
 	if err != nil {
 		return nil, err
 	}
+	return scanInvites(rows)
+}
+
+// Select invites for this user which changed after the user data stream position `from`, up to and including `to`.
+// Returns a map of room ID to invite_state (json array).
+func (t *InvitesTable) SelectInvitesSince(userID string, from, to int64) (map[string][]json.RawMessage, error) {
+	rows, err := t.db.Query(
+		`SELECT room_id, invite_state FROM syncv3_invites WHERE user_id = $1 AND stream_id > $2 AND stream_id <= $3`,
+		userID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanInvites(rows)
+}
+
+func scanInvites(rows *sql.Rows) (map[string][]json.RawMessage, error) {
 	defer rows.Close()
 	result := make(map[string][]json.RawMessage)
 	var roomID string
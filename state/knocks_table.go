@@ -0,0 +1,85 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// KnocksTable stores outstanding knocks for each user. Knocks are handled in the same way as invites:
+// the stripped state in 'knock_state' is kept separate from the normal event flow so we don't leak
+// room data to users who are not joined to the room. See InvitesTable for more information.
+// When a knock is accepted or rejected, the knock is removed from this table.
+type KnocksTable struct {
+	db *sqlx.DB
+}
+
+func NewKnocksTable(db *sqlx.DB) *KnocksTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_knocks (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		-- JSON array. The contents of 'rooms.knock.$room_id.knock_state.events'
+		knock_state BYTEA NOT NULL,
+		UNIQUE(user_id, room_id)
+	);
+	`)
+	return &KnocksTable{db}
+}
+
+func (t *KnocksTable) RemoveKnock(userID, roomID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_knocks WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+	return err
+}
+
+func (t *KnocksTable) InsertKnock(userID, roomID string, knockRoomState []json.RawMessage) error {
+	blob, err := json.Marshal(knockRoomState)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.Exec(
+		`INSERT INTO syncv3_knocks(user_id, room_id, knock_state) VALUES($1,$2,$3)
+		ON CONFLICT (user_id, room_id) DO UPDATE SET knock_state = $3`,
+		userID, roomID, blob,
+	)
+	return err
+}
+
+// Select the knock_state for this user in this room, or nil if the user has not knocked.
+func (t *KnocksTable) SelectKnock(userID, roomID string) ([]json.RawMessage, error) {
+	var blob []byte
+	err := t.db.QueryRow(`SELECT knock_state FROM syncv3_knocks WHERE user_id = $1 AND room_id = $2`, userID, roomID).Scan(&blob)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var knockState []json.RawMessage
+	err = json.Unmarshal(blob, &knockState)
+	return knockState, err
+}
+
+// Select all knocks for this user. Returns a map of room ID to knock_state (json array).
+func (t *KnocksTable) SelectAllKnocksForUser(userID string) (map[string][]json.RawMessage, error) {
+	rows, err := t.db.Query(`SELECT room_id, knock_state FROM syncv3_knocks WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]json.RawMessage)
+	var roomID string
+	var blob json.RawMessage
+	for rows.Next() {
+		if err := rows.Scan(&roomID, &blob); err != nil {
+			return nil, err
+		}
+		var knockState []json.RawMessage
+		if err := json.Unmarshal(blob, &knockState); err != nil {
+			return nil, err
+		}
+		result[roomID] = knockState
+	}
+	return result, nil
+}
@@ -0,0 +1,56 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestKnocksTable(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewKnocksTable(db)
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomA := "!TestKnocksTableA:localhost"
+	roomB := "!TestKnocksTableB:localhost"
+	knockStateA := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	knockStateB := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"baz":"quuz"}`)}
+
+	assertNoError(t, table.InsertKnock(alice, roomA, knockStateA))
+	assertNoError(t, table.InsertKnock(alice, roomB, knockStateB))
+	assertNoError(t, table.InsertKnock(bob, roomA, knockStateB))
+
+	knocks, err := table.SelectAllKnocksForUser(alice)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(knocks, map[string][]json.RawMessage{roomA: knockStateA, roomB: knockStateB}) {
+		t.Errorf("SelectAllKnocksForUser: got %s", jsonArrStr(append(knocks[roomA], knocks[roomB]...)))
+	}
+
+	// clobber alice's knock in room A
+	assertNoError(t, table.InsertKnock(alice, roomA, knockStateB))
+	knocks, err = table.SelectAllKnocksForUser(alice)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(knocks[roomA], knockStateB) {
+		t.Errorf("room %s got %s want %s", roomA, jsonArrStr(knocks[roomA]), jsonArrStr(knockStateB))
+	}
+
+	// retire knocks
+	assertNoError(t, table.RemoveKnock(alice, roomA))
+	assertNoError(t, table.RemoveKnock(bob, roomA))
+	assertNoError(t, table.RemoveKnock("no one", roomA))
+	knocks, err = table.SelectAllKnocksForUser(alice)
+	assertNoError(t, err)
+	if len(knocks) != 1 || !reflect.DeepEqual(knocks[roomB], knockStateB) {
+		t.Errorf("SelectAllKnocksForUser: got %d knocks, want only %s", len(knocks), roomB)
+	}
+	knocks, err = table.SelectAllKnocksForUser(bob)
+	assertNoError(t, err)
+	if len(knocks) != 0 {
+		t.Errorf("SelectAllKnocksForUser: got %d knocks, want 0", len(knocks))
+	}
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sync-v3/sqlutil"
+)
+
+// LeftRoom is a room which a user has left.
+type LeftRoom struct {
+	// the m.room.member event which caused the user to leave. May be empty if unknown.
+	LeaveEvent json.RawMessage
+	// The snapshot of the room state just after the user left, or 0 if the user was not joined to the
+	// room when they left e.g they rejected an invite.
+	SnapshotID int64
+	// The stripped invite_state or knock_state, if the user left without ever joining the room.
+	StrippedState []json.RawMessage
+}
+
+// LeftRoomsTable stores rooms which each user has left, along with the leave event. If the user was
+// joined to the room, the ID of the room state snapshot at the point the user left is stored, which
+// allows left rooms to be returned in lists without leaking room state which the user is no longer
+// allowed to see. If the user was never joined, e.g they rejected an invite, only the stripped
+// invite or knock state is stored, as that is all the user was ever allowed to see.
+// When the user rejoins the room, the row is removed.
+type LeftRoomsTable struct {
+	db *sqlx.DB
+}
+
+func NewLeftRoomsTable(db *sqlx.DB) *LeftRoomsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_user_data_seq;
+	CREATE TABLE IF NOT EXISTS syncv3_left_rooms (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		-- the m.room.member event which caused the user to leave. May be empty if unknown.
+		leave_event BYTEA NOT NULL,
+		-- JSON array. The state of the room after the leave event. NULL if snapshot_id or stripped_state is used instead.
+		state_snapshot BYTEA,
+		UNIQUE(user_id, room_id)
+	);
+	-- the position in the user data stream when the user left the room
+	ALTER TABLE syncv3_left_rooms ADD COLUMN IF NOT EXISTS stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_user_data_seq');
+	CREATE INDEX IF NOT EXISTS syncv3_left_rooms_stream_id_idx ON syncv3_left_rooms(stream_id);
+	-- the room state snapshot after the leave event, or 0 if the user was not joined when they left
+	ALTER TABLE syncv3_left_rooms ADD COLUMN IF NOT EXISTS snapshot_id BIGINT NOT NULL DEFAULT 0;
+	-- JSON array. The stripped invite or knock state if the user was never joined.
+	ALTER TABLE syncv3_left_rooms ADD COLUMN IF NOT EXISTS stripped_state BYTEA;
+	ALTER TABLE syncv3_left_rooms ALTER COLUMN state_snapshot DROP NOT NULL;
+	`)
+	return &LeftRoomsTable{db}
+}
+
+func (t *LeftRoomsTable) InsertLeftRoom(userID, roomID string, leftRoom LeftRoom) error {
+	var strippedState []byte
+	if leftRoom.StrippedState != nil {
+		var err error
+		strippedState, err = json.Marshal(leftRoom.StrippedState)
+		if err != nil {
+			return err
+		}
+	}
+	leaveEvent := leftRoom.LeaveEvent
+	if leaveEvent == nil {
+		leaveEvent = []byte{}
+	}
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		if err := lockUserDataStreamForWrite(txn); err != nil {
+			return err
+		}
+		_, err := txn.Exec(
+			`INSERT INTO syncv3_left_rooms(user_id, room_id, leave_event, snapshot_id, stripped_state) VALUES($1,$2,$3,$4,$5)
+			ON CONFLICT (user_id, room_id) DO UPDATE SET leave_event = $3, snapshot_id = $4, stripped_state = $5,
+			stream_id = nextval('syncv3_user_data_seq')`,
+			userID, roomID, []byte(leaveEvent), leftRoom.SnapshotID, strippedState,
+		)
+		return err
+	})
+}
+
+func (t *LeftRoomsTable) RemoveLeftRoom(userID, roomID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_left_rooms WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+	return err
+}
+
+// Select all left rooms for this user. Returns a map of room ID to left room.
+func (t *LeftRoomsTable) SelectAllLeftRoomsForUser(userID string) (map[string]LeftRoom, error) {
+	rows, err := t.db.Query(
+		`SELECT room_id, leave_event, snapshot_id, stripped_state FROM syncv3_left_rooms WHERE user_id = $1`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]LeftRoom)
+	for rows.Next() {
+		var roomID string
+		var leftRoom LeftRoom
+		var leaveEvent, strippedState []byte
+		if err := rows.Scan(&roomID, &leaveEvent, &leftRoom.SnapshotID, &strippedState); err != nil {
+			return nil, err
+		}
+		leftRoom.LeaveEvent = leaveEvent
+		if strippedState != nil {
+			if err := json.Unmarshal(strippedState, &leftRoom.StrippedState); err != nil {
+				return nil, err
+			}
+		}
+		result[roomID] = leftRoom
+	}
+	return result, nil
+}
+
+// Select rooms which this user left after the user data stream position `from`, up to and including `to`.
+// Returns a map of room ID to leave event.
+func (t *LeftRoomsTable) SelectLeftRoomsSince(userID string, from, to int64) (map[string]json.RawMessage, error) {
+	rows, err := t.db.Query(
+		`SELECT room_id, leave_event FROM syncv3_left_rooms WHERE user_id = $1 AND stream_id > $2 AND stream_id <= $3`,
+		userID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var roomID string
+		var leaveEvent []byte
+		if err := rows.Scan(&roomID, &leaveEvent); err != nil {
+			return nil, err
+		}
+		result[roomID] = leaveEvent
+	}
+	return result, nil
+}
+
+// Select the state snapshot IDs for these left rooms. Returns a map of room ID to snapshot ID. Rooms which
+// the user has not left, or was not joined to when they left, are not included.
+func (t *LeftRoomsTable) SelectLeftRoomSnapshotIDs(txn *sqlx.Tx, userID string, roomIDs []string) (map[string]int64, error) {
+	rows, err := txn.Query(
+		`SELECT room_id, snapshot_id FROM syncv3_left_rooms WHERE user_id = $1 AND room_id = ANY($2) AND snapshot_id != 0`,
+		userID, pq.StringArray(roomIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int64)
+	for rows.Next() {
+		var roomID string
+		var snapshotID int64
+		if err := rows.Scan(&roomID, &snapshotID); err != nil {
+			return nil, err
+		}
+		result[roomID] = snapshotID
+	}
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestLeftRoomsTable(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewLeftRoomsTable(db)
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomA := "!TestLeftRoomsTableA:localhost"
+	roomB := "!TestLeftRoomsTableB:localhost"
+	leaveA := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"leave"}}`)
+	leaveB := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"leave"}}`)
+	inviteStateB := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"baz":"quuz"}`)}
+
+	leftA := LeftRoom{
+		LeaveEvent: leaveA,
+		SnapshotID: 42,
+	}
+	// alice rejected an invite to room B
+	leftB := LeftRoom{
+		LeaveEvent:    leaveB,
+		StrippedState: inviteStateB,
+	}
+	assertNoError(t, table.InsertLeftRoom(alice, roomA, leftA))
+	assertNoError(t, table.InsertLeftRoom(alice, roomB, leftB))
+	assertNoError(t, table.InsertLeftRoom(bob, roomA, LeftRoom{SnapshotID: 43}))
+
+	got, err := table.SelectAllLeftRoomsForUser(alice)
+	assertNoError(t, err)
+	want := map[string]LeftRoom{
+		roomA: leftA,
+		roomB: leftB,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectAllLeftRoomsForUser: got %v want %v", got, want)
+	}
+
+	// only rooms the user was joined to have snapshots
+	txn := db.MustBegin()
+	gotSnapshots, err := table.SelectLeftRoomSnapshotIDs(txn, alice, []string{roomA, roomB, "!unknown:localhost"})
+	assertNoError(t, err)
+	wantSnapshots := map[string]int64{
+		roomA: 42,
+	}
+	if !reflect.DeepEqual(gotSnapshots, wantSnapshots) {
+		t.Errorf("SelectLeftRoomSnapshotIDs: got %v want %v", gotSnapshots, wantSnapshots)
+	}
+
+	// other users are unaffected
+	gotSnapshots, err = table.SelectLeftRoomSnapshotIDs(txn, bob, []string{roomA})
+	assertNoError(t, err)
+	if gotSnapshots[roomA] != 43 {
+		t.Errorf("SelectLeftRoomSnapshotIDs: got %v want %v", gotSnapshots[roomA], 43)
+	}
+	assertNoError(t, txn.Rollback())
+
+	// rejoining removes the room
+	assertNoError(t, table.RemoveLeftRoom(alice, roomA))
+	got, err = table.SelectAllLeftRoomsForUser(alice)
+	assertNoError(t, err)
+	if _, exists := got[roomA]; exists || len(got) != 1 {
+		t.Errorf("SelectAllLeftRoomsForUser: got %v want only %v", got, roomB)
+	}
+}
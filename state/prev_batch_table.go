@@ -0,0 +1,69 @@
+package state
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PrevBatchTable stores prev_batch tokens from each upstream homeserver, when requests are routed to
+// several homeservers. Tokens can only be used against the homeserver which issued them, but events are
+// stored once regardless of which homeserver sent them, so the prev_batch in syncv3_events is only used
+// when there is a single upstream.
+type PrevBatchTable struct {
+	db *sqlx.DB
+}
+
+func NewPrevBatchTable(db *sqlx.DB) *PrevBatchTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_prev_batches (
+		-- the base URL of the homeserver which issued the token
+		upstream TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		-- the first event in the timeline which the token was sent with
+		event_nid BIGINT NOT NULL,
+		prev_batch TEXT NOT NULL,
+		UNIQUE(upstream, room_id, event_nid)
+	);
+	`)
+	return &PrevBatchTable{db}
+}
+
+// Insert a prev_batch token issued by this upstream for the timeline starting at this event. Does nothing
+// if the event is unknown or already has a token from this upstream.
+func (t *PrevBatchTable) Insert(upstream, roomID, eventID, prevBatch string) error {
+	_, err := t.db.Exec(
+		`INSERT INTO syncv3_prev_batches(upstream, room_id, event_nid, prev_batch)
+		SELECT $1, room_id, event_nid, $4 FROM syncv3_events WHERE room_id = $2 AND event_id = $3
+		ON CONFLICT (upstream, room_id, event_nid) DO NOTHING`,
+		upstream, roomID, eventID, prevBatch,
+	)
+	return err
+}
+
+// Select the closest prev batch token issued by this upstream for the provided event NID. Returns the
+// empty string if there is no closest.
+func (t *PrevBatchTable) SelectClosestPrevBatch(upstream, roomID string, eventNID int64) (prevBatch string, err error) {
+	err = t.db.QueryRow(
+		`SELECT prev_batch FROM syncv3_prev_batches WHERE upstream = $1 AND room_id = $2 AND event_nid >= $3
+		ORDER BY event_nid ASC LIMIT 1`, upstream, roomID, eventNID,
+	).Scan(&prevBatch)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SelectClosestPrevBatchByID is the same as SelectClosestPrevBatch but works on event IDs not NIDs
+func (t *PrevBatchTable) SelectClosestPrevBatchByID(upstream, roomID, eventID string) (prevBatch string, err error) {
+	err = t.db.QueryRow(
+		`SELECT prev_batch FROM syncv3_prev_batches WHERE upstream = $1 AND room_id = $2 AND event_nid >= (
+			SELECT event_nid FROM syncv3_events WHERE event_id = $3
+		) ORDER BY event_nid ASC LIMIT 1`, upstream, roomID, eventID,
+	).Scan(&prevBatch)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
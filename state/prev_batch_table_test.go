@@ -0,0 +1,65 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestPrevBatchTable(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	eventsTable := NewEventTable(db)
+	table := NewPrevBatchTable(db)
+	roomID := "!TestPrevBatchTable:localhost"
+	upstreamA := "https://a.localhost"
+	upstreamB := "https://b.localhost"
+	events := []Event{
+		{ID: "$TestPrevBatchTableA", RoomID: roomID, JSON: []byte(`{"type":"my_type"}`)},
+		{ID: "$TestPrevBatchTableB", RoomID: roomID, JSON: []byte(`{"type":"my_type"}`)},
+		{ID: "$TestPrevBatchTableC", RoomID: roomID, JSON: []byte(`{"type":"my_type"}`)},
+	}
+	txn := db.MustBegin()
+	idToNID, err := eventsTable.Insert(txn, events, true)
+	if err != nil {
+		t.Fatalf("failed to insert events: %s", err)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatalf("failed to commit insert: %s", err)
+	}
+
+	// each upstream has its own tokens for the same events
+	assertNoError(t, table.Insert(upstreamA, roomID, events[1].ID, "a_pb"))
+	assertNoError(t, table.Insert(upstreamB, roomID, events[2].ID, "b_pc"))
+	// the first token for an event is kept
+	assertNoError(t, table.Insert(upstreamA, roomID, events[1].ID, "a_pb2"))
+	// unknown events are ignored
+	assertNoError(t, table.Insert(upstreamA, roomID, "$unknown", "a_unknown"))
+
+	testCases := []struct {
+		upstream string
+		index    int
+		want     string
+	}{
+		{upstreamA, 0, "a_pb"},
+		{upstreamA, 1, "a_pb"},
+		{upstreamA, 2, ""},
+		{upstreamB, 0, "b_pc"},
+		{upstreamB, 2, "b_pc"},
+		{"https://c.localhost", 0, ""},
+	}
+	for _, tc := range testCases {
+		got, err := table.SelectClosestPrevBatch(tc.upstream, roomID, int64(idToNID[events[tc.index].ID]))
+		assertNoError(t, err)
+		if got != tc.want {
+			t.Errorf("SelectClosestPrevBatch(%s, %d): got %q want %q", tc.upstream, tc.index, got, tc.want)
+		}
+		got, err = table.SelectClosestPrevBatchByID(tc.upstream, roomID, events[tc.index].ID)
+		assertNoError(t, err)
+		if got != tc.want {
+			t.Errorf("SelectClosestPrevBatchByID(%s, %d): got %q want %q", tc.upstream, tc.index, got, tc.want)
+		}
+	}
+}
@@ -108,6 +108,12 @@ func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string
 	return
 }
 
+// SelectSpaces returns the room IDs in roomIDs which are spaces.
+func (t *RoomsTable) SelectSpaces(txn *sqlx.Tx, roomIDs []string) (spaceRoomIDs []string, err error) {
+	err = txn.Select(&spaceRoomIDs, `SELECT room_id FROM syncv3_rooms WHERE room_id = ANY($1) AND type = 'm.space'`, pq.StringArray(roomIDs))
+	return
+}
+
 // Return the snapshot for this room AFTER the latest event has been applied.
 func (t *RoomsTable) CurrentAfterSnapshotID(txn *sqlx.Tx, roomID string) (snapshotID int64, err error) {
 	err = txn.QueryRow(`SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id=$1`, roomID).Scan(&snapshotID)
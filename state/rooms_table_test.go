@@ -176,6 +176,13 @@ func TestRoomsTable(t *testing.T) {
 	if info.Type == nil || *info.Type != spaceType {
 		t.Fatalf("set type to %s but retrieved %v", spaceType, info.Type)
 	}
+	spaces, err := table.SelectSpaces(txn, []string{spaceRoomID, both, "!unknown:localhost"})
+	if err != nil {
+		t.Fatalf("SelectSpaces: %s", err)
+	}
+	if len(spaces) != 1 || spaces[0] != spaceRoomID {
+		t.Fatalf("SelectSpaces: got %v want [%s]", spaces, spaceRoomID)
+	}
 
 	// check LatestNIDs
 	nidMap, err := table.LatestNIDs(txn, []string{tombstonedRoomID, untombstonedRoomID})
@@ -34,11 +34,16 @@ func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 	}
 	switch ev.Type {
 	case "m.space.child":
+		// the spec calls this field 'order' but older clients send 'ordering'
+		ordering := event.Get("content.order").Str
+		if ordering == "" {
+			ordering = event.Get("content.ordering").Str
+		}
 		return &SpaceRelation{
 			Parent:      ev.RoomID,
 			Child:       ev.StateKey,
 			Relation:    RelationMSpaceChild,
-			Ordering:    event.Get("content.ordering").Str,
+			Ordering:    ordering,
 			IsSuggested: event.Get("content.suggested").Bool(),
 		}, !event.Get("content.via").IsArray()
 	case "m.space.parent":
@@ -4,8 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"runtime/trace"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
@@ -13,14 +11,10 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/sqlutil"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("state")
 
 // Max number of parameters in a single SQL command
 const MaxPostgresParameters = 65535
@@ -33,6 +27,11 @@ type Storage struct {
 	UnreadTable      *UnreadTable
 	AccountDataTable *AccountDataTable
 	InvitesTable     *InvitesTable
+	LeftRoomsTable   *LeftRoomsTable
+	KnocksTable      *KnocksTable
+	ConnectionsTable *ConnectionsTable
+	PrevBatchTable   *PrevBatchTable
+	DeviceListTable  *DeviceListTable
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -56,6 +55,11 @@ func NewStorage(postgresURI string) *Storage {
 		EventsTable:      acc.eventsTable,
 		AccountDataTable: NewAccountDataTable(db),
 		InvitesTable:     NewInvitesTable(db),
+		LeftRoomsTable:   NewLeftRoomsTable(db),
+		KnocksTable:      NewKnocksTable(db),
+		ConnectionsTable: NewConnectionsTable(db),
+		PrevBatchTable:   NewPrevBatchTable(db),
+		DeviceListTable:  NewDeviceListTable(db),
 	}
 }
 
@@ -67,6 +71,64 @@ func (s *Storage) LatestTypingID() (int64, error) {
 	return s.TypingTable.SelectHighestID()
 }
 
+// The advisory lock class used by writers to the user data stream. Each writer locks (class, backend pid) so
+// readers can find and wait for in-flight writers without stopping new ones from starting.
+const userDataStreamLockClass = 0x73796e63
+
+// lockUserDataStreamForWrite must be called in every transaction which allocates a position in the user data
+// stream, before the position is allocated. It is released when the transaction ends.
+func lockUserDataStreamForWrite(txn *sqlx.Tx) error {
+	_, err := txn.Exec(`SELECT pg_advisory_xact_lock($1, pg_backend_pid())`, userDataStreamLockClass)
+	return err
+}
+
+// LatestUserDataID returns the latest position in the user data stream, which orders changes to
+// account data, invites and left rooms.
+//
+// Positions are allocated from a sequence before the writing transaction commits, so a lower position
+// can become visible after a higher one. To avoid returning a position which skips over rows which are
+// not visible yet, this reads the latest allocated position then waits for the writers which were in
+// flight at that point, as only they can hold a lower position. Writers which start afterwards get higher
+// positions so are neither waited for nor blocked.
+func (s *Storage) LatestUserDataID() (id int64, err error) {
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		if err := txn.QueryRow(
+			`SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM syncv3_user_data_seq`,
+		).Scan(&id); err != nil {
+			return err
+		}
+		var writerPIDs []int64
+		if err := txn.Select(&writerPIDs, `SELECT objid FROM pg_locks
+			WHERE locktype = 'advisory' AND classid = $1 AND objsubid = 2 AND granted AND pid <> pg_backend_pid()`,
+			userDataStreamLockClass,
+		); err != nil {
+			return err
+		}
+		for _, pid := range writerPIDs {
+			// blocks until that writer's transaction ends, then unlocks straight away so the next transaction
+			// on that connection isn't held up
+			if _, err := txn.Exec(`SELECT pg_advisory_lock_shared($1, $2)`, userDataStreamLockClass, pid); err != nil {
+				return err
+			}
+			if _, err := txn.Exec(`SELECT pg_advisory_unlock_shared($1, $2)`, userDataStreamLockClass, pid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// AccountDatasSince returns all account data for this user which changed after the user data stream
+// position `from`, up to and including `to`.
+func (s *Storage) AccountDatasSince(userID string, from, to int64) (datas []AccountData, err error) {
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		datas, err = s.AccountDataTable.SelectSince(txn, userID, from, to)
+		return err
+	})
+	return
+}
+
 func (s *Storage) AccountData(userID, roomID, eventType string) (data *AccountData, err error) {
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
 		data, err = s.AccountDataTable.Select(txn, userID, eventType, roomID)
@@ -169,10 +231,24 @@ func (s *Storage) MetadataForAllRooms() (map[string]internal.RoomMetadata, error
 		metadata.RoomID = ev.RoomID
 		result[ev.RoomID] = metadata
 	}
+	// work out latest timestamps for each tracked event type, for bump_event_types
+	events, err = s.accumulator.eventsTable.selectLatestEventOfEachTypeInAllRooms(internal.BumpEventTypes())
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		metadata := result[ev.RoomID]
+		if metadata.LastEventTimestamps == nil {
+			metadata.LastEventTimestamps = make(map[string]uint64)
+		}
+		metadata.LastEventTimestamps[ev.Type] = gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint()
+		result[ev.RoomID] = metadata
+	}
 
-	// Select the name / canonical alias for all rooms
+	// Select the name / canonical alias / avatar / topic / history visibility / space parents for all rooms
 	roomIDToStateEvents, err := s.currentStateEventsInAllRooms([]string{
-		"m.room.name", "m.room.canonical_alias",
+		"m.room.name", "m.room.canonical_alias", "m.room.avatar", "m.room.topic", "m.room.history_visibility",
+		"m.space.parent",
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to load state events for all rooms: %s", err)
@@ -184,6 +260,16 @@ func (s *Storage) MetadataForAllRooms() (map[string]internal.RoomMetadata, error
 				metadata.NameEvent = gjson.ParseBytes(ev.JSON).Get("content.name").Str
 			} else if ev.Type == "m.room.canonical_alias" && ev.StateKey == "" {
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
+			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
+				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			} else if ev.Type == "m.room.topic" && ev.StateKey == "" {
+				metadata.Topic = gjson.ParseBytes(ev.JSON).Get("content.topic").Str
+			} else if ev.Type == "m.room.history_visibility" && ev.StateKey == "" {
+				metadata.HistoryVisibility = gjson.ParseBytes(ev.JSON).Get("content.history_visibility").Str
+			} else if ev.Type == "m.space.parent" && ev.StateKey != "" {
+				content := gjson.ParseBytes(ev.JSON).Get("content")
+				isCanonical := content.Get("canonical").Bool() && content.Get("via").IsArray()
+				metadata.SetParentSpace(ev.StateKey, isCanonical)
 			}
 		}
 		result[roomID] = metadata
@@ -226,8 +312,9 @@ func (s *Storage) MetadataForAllRooms() (map[string]internal.RoomMetadata, error
 		seen[key] = true
 		metadata := result[roomID]
 		metadata.Heroes = append(metadata.Heroes, internal.Hero{
-			ID:   targetUser,
-			Name: ev.Get("content.displayname").Str,
+			ID:     targetUser,
+			Name:   ev.Get("content.displayname").Str,
+			Avatar: ev.Get("content.avatar_url").Str,
 		})
 		result[roomID] = metadata
 	}
@@ -243,6 +330,7 @@ func (s *Storage) MetadataForAllRooms() (map[string]internal.RoomMetadata, error
 		metadata := result[info.ID]
 		metadata.Encrypted = info.IsEncrypted
 		metadata.UpgradedRoomID = info.UpgradedRoomID
+		metadata.PredecessorRoomID = info.PredecessorRoomID
 		metadata.RoomType = info.Type
 		result[info.ID] = metadata
 		if metadata.IsSpace() {
@@ -311,7 +399,8 @@ func (s *Storage) Initialise(roomID string, state []json.RawMessage) (bool, erro
 // If the list of state keys is empty then all events matching that event type will be returned. If the map is empty entirely, then all room state
 // will be returned.
 func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (roomToEvents map[string][]Event, err error) {
-	defer trace.StartRegion(ctx, "RoomStateAfterEventPosition").End()
+	_, span := internal.StartSpan(ctx, "RoomStateAfterEventPosition")
+	defer span.End()
 	roomToEvents = make(map[string][]Event, len(roomIDs))
 	roomIndex := make(map[string]int, len(roomIDs))
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
@@ -474,14 +563,252 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	return
 }
 
-func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
+// LatestEventsInRooms returns the latest `limit` events visible to this user in each room, up to and
+// including `to`, along with a prev_batch token for each room from the user's upstream homeserver.
+func (s *Storage) LatestEventsInRooms(ctx context.Context, userID, upstream string, roomIDs []string, to int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
+	_, span := internal.StartSpan(ctx, "LatestEventsInRooms")
+	defer span.End()
+	span.SetAttribute("num_rooms", len(roomIDs))
 	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
 	if err != nil {
+		span.SetError(err)
 		return nil, nil, err
 	}
-	result := make(map[string][]json.RawMessage, len(roomIDs))
-	prevBatches := make(map[string]string, len(roomIDs))
+	events, prevBatches, err := s.latestEventsInRanges(upstream, roomIDToRanges, limit)
+	span.SetError(err)
+	return events, prevBatches, err
+}
+
+// RoomTimeline is a section of a room timeline.
+type RoomTimeline struct {
+	// The events in the section, oldest first.
+	Events []json.RawMessage
+	// The NID of the first event in Events.
+	FirstNID int64
+	// True if there were more events in the section than the limit.
+	Limited   bool
+	PrevBatch string
+}
+
+// VisibleTimelinesBetween returns the latest `limit` events visible to this user in each room, between
+// from (exclusive) and to (inclusive). Rooms without any visible events are not included. Invited rooms
+// are included with just the invite event, so callers should check the user's membership. The prev_batch
+// tokens are for the upstream homeserver of the user, as per ClosestPrevBatch.
+func (s *Storage) VisibleTimelinesBetween(ctx context.Context, userID, upstream string, from, to int64, limit int) (map[string]RoomTimeline, error) {
+	_, span := internal.StartSpan(ctx, "VisibleTimelinesBetween")
+	defer span.End()
+	roomIDToRanges, err := s.VisibleEventNIDsBetween(userID, from, to)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	result := make(map[string]RoomTimeline, len(roomIDToRanges))
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		for roomID, ranges := range roomIDToRanges {
+			// ask for one extra event so we know if the timeline is limited
+			var events []Event
+			for i := len(ranges) - 1; i >= 0 && len(events) <= limit; i-- {
+				r := ranges[i]
+				// the ranges include `from`, which the caller has already seen
+				if r[0] <= from {
+					r[0] = from + 1
+				}
+				if r[0] > r[1] {
+					continue
+				}
+				// the most recent event will be first
+				evs, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit+1-len(events))
+				if err != nil {
+					return fmt.Errorf("room %s failed to SelectLatestEventsBetween: %s", roomID, err)
+				}
+				events = append(events, evs...)
+			}
+			if len(events) == 0 {
+				continue
+			}
+			var timeline RoomTimeline
+			if len(events) > limit {
+				timeline.Limited = true
+				events = events[:limit]
+			}
+			timeline.Events = make([]json.RawMessage, len(events))
+			for i, ev := range events {
+				timeline.Events[len(events)-1-i] = ev.JSON
+			}
+			timeline.FirstNID = events[len(events)-1].NID
+			prevBatch, err := s.ClosestPrevBatch(upstream, roomID, timeline.FirstNID)
+			if err != nil {
+				return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
+			}
+			timeline.PrevBatch = prevBatch
+			result[roomID] = timeline
+		}
+		return nil
+	})
+	span.SetError(err)
+	return result, err
+}
+
+// StateBeforeEvents returns the room state before the given event in each room, keyed by room ID. If the
+// event NID is 0, or the event was part of the room state when the room was first seen, the current room
+// state is returned instead.
+func (s *Storage) StateBeforeEvents(ctx context.Context, roomIDToEventNID map[string]int64) (map[string][]json.RawMessage, error) {
+	_, span := internal.StartSpan(ctx, "StateBeforeEvents")
+	defer span.End()
+	span.SetAttribute("num_rooms", len(roomIDToEventNID))
+	result := make(map[string][]json.RawMessage, len(roomIDToEventNID))
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		roomIDToSnapshotID := make(map[string]int64, len(roomIDToEventNID))
+		var eventNIDs []int64
+		for roomID, nid := range roomIDToEventNID {
+			if nid != 0 {
+				eventNIDs = append(eventNIDs, nid)
+			}
+			roomIDToSnapshotID[roomID] = 0
+		}
+		if len(eventNIDs) > 0 {
+			events, err := s.EventsTable.SelectByNIDs(txn, true, eventNIDs)
+			if err != nil {
+				return fmt.Errorf("failed to select events: %s", err)
+			}
+			for _, ev := range events {
+				roomIDToSnapshotID[ev.RoomID] = ev.BeforeStateSnapshotID
+			}
+		}
+		for roomID, snapshotID := range roomIDToSnapshotID {
+			var err error
+			if snapshotID == 0 {
+				snapshotID, err = s.accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+				if err != nil {
+					return fmt.Errorf("failed to select current snapshot for room %s: %s", roomID, err)
+				}
+				if snapshotID == 0 {
+					continue
+				}
+			}
+			snapshot, err := s.accumulator.snapshotTable.Select(txn, snapshotID)
+			if err != nil {
+				return fmt.Errorf("failed to select snapshot %d: %s", snapshotID, err)
+			}
+			stateEvents, err := s.EventsTable.SelectByNIDs(txn, true, snapshot.Events)
+			if err != nil {
+				return fmt.Errorf("failed to select state events in snapshot %d: %s", snapshotID, err)
+			}
+			state := make([]json.RawMessage, len(stateEvents))
+			for i := range stateEvents {
+				state[i] = stateEvents[i].JSON
+			}
+			result[roomID] = state
+		}
+		return nil
+	})
+	span.SetError(err)
+	return result, err
+}
+
+// LeftRoomSnapshotID returns the ID of the snapshot of the room state just after the given leave event, if
+// the user was joined to the room just before it. Returns 0 if the leave event is unknown or the user was not
+// joined, e.g they rejected an invite or withdrew a knock, as the user was never allowed to see the room state.
+func (s *Storage) LeftRoomSnapshotID(userID, leaveEventID string) (snapshotID int64, err error) {
 	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		events, err := s.EventsTable.SelectByIDs(txn, false, []string{leaveEventID})
+		if err != nil {
+			return fmt.Errorf("failed to select leave event: %s", err)
+		}
+		if len(events) == 0 || events[0].StateKey != userID {
+			return nil
+		}
+		leaveEvent := events[0]
+		if leaveEvent.BeforeStateSnapshotID == 0 || leaveEvent.ReplacesNID == 0 {
+			// either part of the initial room state so we don't know what came before, or the user had no
+			// membership in the room before this event
+			return nil
+		}
+		prevMembership, err := s.EventsTable.SelectByNIDs(txn, true, []int64{leaveEvent.ReplacesNID})
+		if err != nil {
+			return fmt.Errorf("failed to select previous membership: %s", err)
+		}
+		if gjson.GetBytes(prevMembership[0].JSON, "content.membership").Str != "join" {
+			return nil
+		}
+		// every state event makes a new snapshot, which is the before snapshot of the next event
+		snapshotID, err = s.EventsTable.SelectNextBeforeSnapshotID(txn, leaveEvent.RoomID, leaveEvent.NID)
+		if err != nil {
+			return fmt.Errorf("failed to select snapshot after leave event: %s", err)
+		}
+		if snapshotID == 0 {
+			// the leave event is the latest event in the room
+			snapshotID, err = s.accumulator.roomsTable.CurrentAfterSnapshotID(txn, leaveEvent.RoomID)
+		}
+		return err
+	})
+	return
+}
+
+// LeftRoomState returns the state of these rooms just after the user left them, keyed by room ID. Rooms which
+// the user was not joined to when they left are not included.
+func (s *Storage) LeftRoomState(ctx context.Context, userID string, roomIDs []string) (map[string][]json.RawMessage, error) {
+	_, span := internal.StartSpan(ctx, "LeftRoomState")
+	defer span.End()
+	result := make(map[string][]json.RawMessage, len(roomIDs))
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		roomIDToSnapshotID, err := s.LeftRoomsTable.SelectLeftRoomSnapshotIDs(txn, userID, roomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select left room snapshots: %s", err)
+		}
+		for roomID, snapshotID := range roomIDToSnapshotID {
+			snapshot, err := s.accumulator.snapshotTable.Select(txn, snapshotID)
+			if err != nil {
+				return fmt.Errorf("failed to select snapshot %d: %s", snapshotID, err)
+			}
+			stateEvents, err := s.EventsTable.SelectByNIDs(txn, true, snapshot.Events)
+			if err != nil {
+				return fmt.Errorf("failed to select state events in snapshot %d: %s", snapshotID, err)
+			}
+			state := make([]json.RawMessage, len(stateEvents))
+			for i := range stateEvents {
+				state[i] = stateEvents[i].JSON
+			}
+			result[roomID] = state
+		}
+		return nil
+	})
+	span.SetError(err)
+	return result, err
+}
+
+// PreviewEventsInRooms returns the latest `limit` events in each room up to and including `to`, regardless
+// of the membership of any user. Only call this for rooms with world_readable history visibility. The
+// prev_batch tokens are for this upstream homeserver, as per ClosestPrevBatch.
+func (s *Storage) PreviewEventsInRooms(upstream string, roomIDs []string, to int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
+	roomIDToRanges := make(map[string][][2]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		roomIDToRanges[roomID] = [][2]int64{{1, to}}
+	}
+	return s.latestEventsInRanges(upstream, roomIDToRanges, limit)
+}
+
+// ClosestPrevBatch returns the closest prev_batch token for this event NID, or the empty string if there
+// is none. If upstream is set, only tokens issued by that upstream homeserver are returned.
+func (s *Storage) ClosestPrevBatch(upstream, roomID string, eventNID int64) (string, error) {
+	if upstream == "" {
+		return s.EventsTable.SelectClosestPrevBatch(roomID, eventNID)
+	}
+	return s.PrevBatchTable.SelectClosestPrevBatch(upstream, roomID, eventNID)
+}
+
+// ClosestPrevBatchByID is the same as ClosestPrevBatch but works on event IDs not NIDs
+func (s *Storage) ClosestPrevBatchByID(upstream, roomID, eventID string) (string, error) {
+	if upstream == "" {
+		return s.EventsTable.SelectClosestPrevBatchByID(roomID, eventID)
+	}
+	return s.PrevBatchTable.SelectClosestPrevBatchByID(upstream, roomID, eventID)
+}
+
+func (s *Storage) latestEventsInRanges(upstream string, roomIDToRanges map[string][][2]int64, limit int) (map[string][]json.RawMessage, map[string]string, error) {
+	result := make(map[string][]json.RawMessage, len(roomIDToRanges))
+	prevBatches := make(map[string]string, len(roomIDToRanges))
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
 		for roomID, ranges := range roomIDToRanges {
 			var earliestEventNID int64
 			var roomEvents []json.RawMessage
@@ -507,7 +834,7 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 			}
 			if earliestEventNID != 0 {
 				// the oldest event needs a prev batch token, so find one now
-				prevBatch, err := s.EventsTable.SelectClosestPrevBatch(roomID, earliestEventNID)
+				prevBatch, err := s.ClosestPrevBatch(upstream, roomID, earliestEventNID)
 				if err != nil {
 					return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
 				}
@@ -711,6 +1038,55 @@ func (s *Storage) AllJoinedMembers() (map[string][]string, error) {
 	return result, nil
 }
 
+// JoinedSpaceChildren returns the m.space.child relations of every space the user is joined to, keyed
+// by the space room ID. Spaces without children are included with no relations.
+func (s *Storage) JoinedSpaceChildren(userID string) (map[string][]SpaceRelation, error) {
+	latestNID, err := s.LatestEventNID()
+	if err != nil {
+		return nil, err
+	}
+	joinedRoomIDs, err := s.JoinedRoomsAfterPosition(userID, latestNID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]SpaceRelation)
+	err = sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		spaceRoomIDs, err := s.accumulator.roomsTable.SelectSpaces(txn, joinedRoomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select spaces: %s", err)
+		}
+		for _, spaceRoomID := range spaceRoomIDs {
+			result[spaceRoomID] = nil
+		}
+		return s.spaceChildren(txn, spaceRoomIDs, result)
+	})
+	return result, err
+}
+
+// SpaceChildren returns the m.space.child relations of the given spaces, keyed by the space room ID.
+func (s *Storage) SpaceChildren(spaceRoomIDs []string) (map[string][]SpaceRelation, error) {
+	result := make(map[string][]SpaceRelation, len(spaceRoomIDs))
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) error {
+		return s.spaceChildren(txn, spaceRoomIDs, result)
+	})
+	return result, err
+}
+
+func (s *Storage) spaceChildren(txn *sqlx.Tx, spaceRoomIDs []string, result map[string][]SpaceRelation) error {
+	spaceToRelations, err := s.accumulator.spacesTable.SelectChildren(txn, spaceRoomIDs)
+	if err != nil {
+		return fmt.Errorf("failed to select space children: %s", err)
+	}
+	for spaceRoomID, relations := range spaceToRelations {
+		for _, r := range relations {
+			if r.Relation == RelationMSpaceChild {
+				result[spaceRoomID] = append(result[spaceRoomID], r)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) ([]string, error) {
 	// fetch all the membership events up to and including pos
 	membershipEvents, err := s.accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, 0, pos)
@@ -748,3 +1124,8 @@ func (s *Storage) joinedRoomsAfterPositionWithEvents(membershipEvents []Event, u
 func (s *Storage) Teardown() {
 	s.accumulator.db.Close()
 }
+
+// Ping checks that the database is reachable.
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.accumulator.db.PingContext(ctx)
+}
@@ -220,6 +220,11 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 		if gotHI.JoinCount != wantHI.JoinCount {
 			t.Errorf("hero info for %s got %d joined users, want %d", roomID, gotHI.JoinCount, wantHI.JoinCount)
 		}
+		for _, evType := range []string{"m.room.create", "m.room.member"} {
+			if gotHI.LastEventTimestamps[evType] == 0 {
+				t.Errorf("hero info for %s missing last event timestamp for %s", roomID, evType)
+			}
+		}
 	}
 }
 
@@ -538,6 +543,68 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 	}
 }
 
+// Test that the state for a left room is the state just after the leave event, and only exists if the user was joined.
+func TestStorageLeftRoomSnapshotID(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	roomID := "!TestStorageLeftRoomSnapshotID:localhost"
+	alice := "@aliceTestStorageLeftRoomSnapshotID:localhost"
+	bob := "@bobTestStorageLeftRoomSnapshotID:localhost"
+	charlie := "@charlieTestStorageLeftRoomSnapshotID:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	})
+	assertNoError(t, err)
+	bobLeave := testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "leave"})
+	charlieInvite := testutils.NewStateEvent(t, "m.room.member", charlie, alice, map[string]interface{}{"membership": "invite"})
+	charlieReject := testutils.NewStateEvent(t, "m.room.member", charlie, charlie, map[string]interface{}{"membership": "leave"})
+	topic := testutils.NewStateEvent(t, "m.room.topic", "", alice, map[string]interface{}{"topic": "secret"})
+	_, _, err = store.Accumulate(roomID, "", []json.RawMessage{
+		bobLeave, charlieInvite, charlieReject, topic,
+	})
+	assertNoError(t, err)
+
+	bobSnapshotID, err := store.LeftRoomSnapshotID(bob, gjson.GetBytes(bobLeave, "event_id").Str)
+	assertNoError(t, err)
+	if bobSnapshotID == 0 {
+		t.Fatalf("LeftRoomSnapshotID: got no snapshot for a joined user")
+	}
+	// charlie was never joined so gets no snapshot
+	charlieSnapshotID, err := store.LeftRoomSnapshotID(charlie, gjson.GetBytes(charlieReject, "event_id").Str)
+	assertNoError(t, err)
+	if charlieSnapshotID != 0 {
+		t.Fatalf("LeftRoomSnapshotID: got snapshot %d for a user who was never joined", charlieSnapshotID)
+	}
+	// the event must be the user's own membership event
+	aliceSnapshotID, err := store.LeftRoomSnapshotID(alice, gjson.GetBytes(bobLeave, "event_id").Str)
+	assertNoError(t, err)
+	if aliceSnapshotID != 0 {
+		t.Fatalf("LeftRoomSnapshotID: got snapshot %d for another user's leave event", aliceSnapshotID)
+	}
+
+	assertNoError(t, store.LeftRoomsTable.InsertLeftRoom(bob, roomID, LeftRoom{
+		LeaveEvent: bobLeave,
+		SnapshotID: bobSnapshotID,
+	}))
+	roomIDToState, err := store.LeftRoomState(context.Background(), bob, []string{roomID})
+	assertNoError(t, err)
+	var gotBobLeave bool
+	for _, ev := range roomIDToState[roomID] {
+		switch gjson.GetBytes(ev, "type").Str {
+		case "m.room.topic":
+			t.Errorf("LeftRoomState: included state sent after the user left: %s", string(ev))
+		case "m.room.member":
+			if gjson.GetBytes(ev, "state_key").Str == bob {
+				gotBobLeave = gjson.GetBytes(ev, "event_id").Str == gjson.GetBytes(bobLeave, "event_id").Str
+			}
+		}
+	}
+	if !gotBobLeave {
+		t.Errorf("LeftRoomState: did not include the leave event, got %v", roomIDToState[roomID])
+	}
+}
+
 func verifyRange(t *testing.T, result map[string][][2]int64, roomID string, wantRanges [][2]int64) {
 	t.Helper()
 	gotRanges := result[roomID]
@@ -553,3 +620,48 @@ func verifyRange(t *testing.T, result map[string][][2]int64, roomID string, want
 		}
 	}
 }
+
+func TestStorageLatestUserDataIDWaitsForInFlightWriters(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	alice := "@aliceTestStorageLatestUserDataIDWaitsForInFlightWriters:localhost"
+	// an in-flight writer which has allocated a position but not committed yet
+	txn := store.accumulator.db.MustBegin()
+	assertNoError(t, lockUserDataStreamForWrite(txn))
+	_, err := txn.Exec(`INSERT INTO syncv3_invites(user_id, room_id, invite_state) VALUES($1, '!a:localhost', '[]')`, alice)
+	assertNoError(t, err)
+
+	readDone := make(chan int64)
+	go func() {
+		id, err := store.LatestUserDataID()
+		assertNoError(t, err)
+		readDone <- id
+	}()
+	// writers which start after the read are not blocked by it
+	writeDone := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assertNoError(t, store.InvitesTable.InsertInvite(alice, "!b:localhost", []json.RawMessage{}))
+		close(writeDone)
+	}()
+	select {
+	case <-writeDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writer was blocked by LatestUserDataID")
+	}
+	select {
+	case id := <-readDone:
+		t.Fatalf("LatestUserDataID returned %d before the in-flight writer committed", id)
+	default:
+	}
+	var streamID int64
+	assertNoError(t, txn.QueryRow(`SELECT stream_id FROM syncv3_invites WHERE user_id = $1 AND room_id = '!a:localhost'`, alice).Scan(&streamID))
+	assertNoError(t, txn.Commit())
+	select {
+	case id := <-readDone:
+		if id < streamID {
+			t.Errorf("LatestUserDataID: got %d want >= %d", id, streamID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("LatestUserDataID did not return after the in-flight writer committed")
+	}
+}
@@ -61,3 +61,26 @@ func (t *TypingTable) Typing(roomID string, fromStreamIDExcl, toStreamIDIncl int
 	}
 	return userIDsArray, latest, err
 }
+
+// TypingInRooms returns the users typing in each of these rooms, for rooms whose typing notifications
+// changed after fromStreamIDExcl up to and including toStreamIDIncl.
+func (t *TypingTable) TypingInRooms(roomIDs []string, fromStreamIDExcl, toStreamIDIncl int64) (map[string][]string, error) {
+	rows, err := t.db.Query(
+		`SELECT room_id, user_ids FROM syncv3_typing WHERE room_id = ANY($1) AND stream_id > $2 AND stream_id <= $3`,
+		pq.StringArray(roomIDs), fromStreamIDExcl, toStreamIDIncl,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]string)
+	for rows.Next() {
+		var roomID string
+		var userIDs pq.StringArray
+		if err := rows.Scan(&roomID, &userIDs); err != nil {
+			return nil, err
+		}
+		result[roomID] = userIDs
+	}
+	return result, nil
+}
@@ -2,8 +2,15 @@ package state
 
 import (
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sync-v3/sqlutil"
 )
 
+// UnreadCounts is a pair of highlight and notification counts
+type UnreadCounts struct {
+	HighlightCount    int
+	NotificationCount int
+}
+
 // UnreadTable stores unread counts per-user
 type UnreadTable struct {
 	db *sqlx.DB
@@ -19,6 +26,14 @@ func NewUnreadTable(db *sqlx.DB) *UnreadTable {
 		highlight_count BIGINT NOT NULL DEFAULT 0,
 		UNIQUE(user_id, room_id)
 	);
+	CREATE TABLE IF NOT EXISTS syncv3_unread_threads (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		thread_id TEXT NOT NULL,
+		notification_count BIGINT NOT NULL DEFAULT 0,
+		highlight_count BIGINT NOT NULL DEFAULT 0,
+		UNIQUE(user_id, room_id, thread_id)
+	);
 	`)
 	return &UnreadTable{db}
 }
@@ -74,3 +89,45 @@ func (t *UnreadTable) UpdateUnreadCounters(userID, roomID string, highlightCount
 	}
 	return err
 }
+
+func (t *UnreadTable) SelectAllNonZeroThreadCountsForUser(userID string, callback func(roomID, threadID string, highlightCount, notificationCount int)) error {
+	rows, err := t.db.Query(
+		`SELECT room_id, thread_id, notification_count, highlight_count FROM syncv3_unread_threads WHERE user_id=$1 AND (notification_count > 0 OR highlight_count > 0)`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, threadID string
+		var highlightCount int
+		var notifCount int
+		if err := rows.Scan(&roomID, &threadID, &notifCount, &highlightCount); err != nil {
+			return err
+		}
+		callback(roomID, threadID, highlightCount, notifCount)
+	}
+	return nil
+}
+
+// UpdateThreadUnreadCounters replaces all the per-thread unread counts for this user in this room. Threads
+// which are not present in threadCounts are treated as having no unread events.
+func (t *UnreadTable) UpdateThreadUnreadCounters(userID, roomID string, threadCounts map[string]UnreadCounts) error {
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		_, err := txn.Exec(`DELETE FROM syncv3_unread_threads WHERE user_id=$1 AND room_id=$2`, userID, roomID)
+		if err != nil {
+			return err
+		}
+		for threadID, counts := range threadCounts {
+			_, err = txn.Exec(
+				`INSERT INTO syncv3_unread_threads(room_id, user_id, thread_id, notification_count, highlight_count) VALUES($1, $2, $3, $4, $5)`,
+				roomID, userID, threadID, counts.NotificationCount, counts.HighlightCount,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
@@ -64,6 +65,72 @@ func TestUnreadTable(t *testing.T) {
 	}
 }
 
+func TestUnreadTableThreads(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewUnreadTable(db)
+	userID := "@alice:localhost"
+	roomA := "!TestUnreadTableThreadsA:localhost"
+	roomB := "!TestUnreadTableThreadsB:localhost"
+
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomA, map[string]UnreadCounts{
+		"$thread1": {HighlightCount: 1, NotificationCount: 2},
+		"$thread2": {HighlightCount: 0, NotificationCount: 3},
+	}))
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomB, map[string]UnreadCounts{
+		"$thread3": {HighlightCount: 0, NotificationCount: 0},
+	}))
+	assertThreadUnread(t, table, userID, map[string]map[string]UnreadCounts{
+		roomA: {
+			"$thread1": {HighlightCount: 1, NotificationCount: 2},
+			"$thread2": {HighlightCount: 0, NotificationCount: 3},
+		},
+	})
+
+	// updates replace the entire set of threads for the room
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomA, map[string]UnreadCounts{
+		"$thread2": {HighlightCount: 0, NotificationCount: 1},
+	}))
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomB, map[string]UnreadCounts{
+		"$thread3": {HighlightCount: 4, NotificationCount: 4},
+	}))
+	assertThreadUnread(t, table, userID, map[string]map[string]UnreadCounts{
+		roomA: {
+			"$thread2": {HighlightCount: 0, NotificationCount: 1},
+		},
+		roomB: {
+			"$thread3": {HighlightCount: 4, NotificationCount: 4},
+		},
+	})
+
+	// empty maps clear all threads
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomA, map[string]UnreadCounts{}))
+	assertThreadUnread(t, table, userID, map[string]map[string]UnreadCounts{
+		roomB: {
+			"$thread3": {HighlightCount: 4, NotificationCount: 4},
+		},
+	})
+}
+
+func assertThreadUnread(t *testing.T, table *UnreadTable, userID string, want map[string]map[string]UnreadCounts) {
+	t.Helper()
+	got := make(map[string]map[string]UnreadCounts)
+	assertNoError(t, table.SelectAllNonZeroThreadCountsForUser(userID, func(roomID, threadID string, highlightCount, notificationCount int) {
+		if got[roomID] == nil {
+			got[roomID] = make(map[string]UnreadCounts)
+		}
+		got[roomID][threadID] = UnreadCounts{
+			HighlightCount:    highlightCount,
+			NotificationCount: notificationCount,
+		}
+	}))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectAllNonZeroThreadCountsForUser: got %+v want %+v", got, want)
+	}
+}
+
 func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantHighight, wantNotif int) {
 	t.Helper()
 	gotHighlight, gotNotif, err := table.SelectUnreadCounters(userID, roomID)
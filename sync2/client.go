@@ -14,8 +14,24 @@ import (
 const AccountDataGlobalRoom = ""
 
 type Client interface {
-	WhoAmI(accessToken string) (string, error)
-	DoSyncV2(accessToken, since string, isFirst bool) (*SyncResponse, int, error)
+	// The server name is the homeserver the client says the access token is from, or empty if unknown.
+	// It is only used to pick an upstream: the returned user ID is always from the upstream.
+	WhoAmI(serverName, accessToken string) (string, error)
+	// The user ID is the user the access token belongs to, as returned by WhoAmI.
+	DoSyncV2(userID, accessToken, since string, isFirst bool) (*SyncResponse, int, error)
+}
+
+// HTTPError is returned when the upstream homeserver responds with a non-200 status code.
+type HTTPError struct {
+	Endpoint   string
+	StatusCode int
+	// The Matrix error code in the response body, if any.
+	ErrCode    string
+	SoftLogout bool
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s returned HTTP %d", e.Endpoint, e.StatusCode)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -25,7 +41,7 @@ type HTTPClient struct {
 	DestinationServer string
 }
 
-func (v *HTTPClient) WhoAmI(accessToken string) (string, error) {
+func (v *HTTPClient) WhoAmI(serverName, accessToken string) (string, error) {
 	req, err := http.NewRequest("GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
 	if err != nil {
 		return "", err
@@ -36,31 +52,40 @@ func (v *HTTPClient) WhoAmI(accessToken string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
-	}
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return "", err
 	}
+	if res.StatusCode != 200 {
+		return "", &HTTPError{
+			Endpoint:   "/whoami",
+			StatusCode: res.StatusCode,
+			ErrCode:    gjson.GetBytes(body, "errcode").Str,
+			SoftLogout: gjson.GetBytes(body, "soft_logout").Bool(),
+		}
+	}
 	return gjson.GetBytes(body, "user_id").Str, nil
 }
 
 // DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
 // or an error. Set isFirst=true on the first sync to force a timeout=0 sync to ensure snapiness.
-func (v *HTTPClient) DoSyncV2(accessToken, since string, isFirst bool) (*SyncResponse, int, error) {
+func (v *HTTPClient) DoSyncV2(userID, accessToken, since string, isFirst bool) (*SyncResponse, int, error) {
 	qps := "?"
 	if isFirst { // first time syncing in this process
 		qps += "timeout=0"
 	} else {
 		qps += "timeout=30000"
 	}
+	// always ask for per-thread unread counts, as the filter applies on a per-request basis
 	if since != "" {
 		qps += "&since=" + since
+		qps += "&filter=" + url.QueryEscape(
+			`{"room":{"timeline":{"unread_thread_notifications":true}}}`,
+		)
 	} else {
 		qps += "&filter=" + url.QueryEscape(
-			`{"room":{"timeline":{"limit":1}}}`,
+			`{"room":{"timeline":{"limit":1,"unread_thread_notifications":true}}}`,
 		)
 	}
 	req, err := http.NewRequest(
@@ -107,6 +132,7 @@ type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' or 'peek' key.
@@ -116,6 +142,9 @@ type SyncV2JoinResponse struct {
 	Ephemeral           EventsResponse      `json:"ephemeral"`
 	AccountData         EventsResponse      `json:"account_data"`
 	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
+	// thread root event ID -> unread counts for that thread. If set, UnreadNotifications only
+	// applies to the main timeline.
+	UnreadThreadNotifications map[string]UnreadNotifications `json:"unread_thread_notifications,omitempty"`
 }
 
 type UnreadNotifications struct {
@@ -138,6 +167,11 @@ type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
@@ -0,0 +1,54 @@
+package sync2
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// HealthTrackingClient wraps a Client and counts the number of consecutive requests which failed
+// because the upstream server was unreachable or returned a server error. Client errors such as a
+// rejected access token mean the upstream server is working, so do not count as failures.
+type HealthTrackingClient struct {
+	Client
+	consecutiveFailures int64
+}
+
+func NewHealthTrackingClient(client Client) *HealthTrackingClient {
+	return &HealthTrackingClient{
+		Client: client,
+	}
+}
+
+func (c *HealthTrackingClient) WhoAmI(serverName, accessToken string) (string, error) {
+	userID, err := c.Client.WhoAmI(serverName, accessToken)
+	statusCode := 200
+	if err != nil {
+		statusCode = 0
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			statusCode = httpErr.StatusCode
+		}
+	}
+	c.record(statusCode)
+	return userID, err
+}
+
+func (c *HealthTrackingClient) DoSyncV2(userID, accessToken, since string, isFirst bool) (*SyncResponse, int, error) {
+	res, statusCode, err := c.Client.DoSyncV2(userID, accessToken, since, isFirst)
+	c.record(statusCode)
+	return res, statusCode, err
+}
+
+// ConsecutiveFailures returns the number of failed requests to the upstream server since the last
+// successful request.
+func (c *HealthTrackingClient) ConsecutiveFailures() int64 {
+	return atomic.LoadInt64(&c.consecutiveFailures)
+}
+
+func (c *HealthTrackingClient) record(statusCode int) {
+	if statusCode == 0 || statusCode >= 500 {
+		atomic.AddInt64(&c.consecutiveFailures, 1)
+	} else {
+		atomic.StoreInt64(&c.consecutiveFailures, 0)
+	}
+}
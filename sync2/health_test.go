@@ -0,0 +1,41 @@
+package sync2
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHealthTrackingClient(t *testing.T) {
+	statusCode := 0
+	client := NewHealthTrackingClient(&mockClient{
+		fn: func(authHeader, since string) (*SyncResponse, int, error) {
+			if statusCode == 200 {
+				return &SyncResponse{}, 200, nil
+			}
+			return nil, statusCode, fmt.Errorf("returned HTTP %d", statusCode)
+		},
+	})
+	assertFailures := func(want int64) {
+		t.Helper()
+		if got := client.ConsecutiveFailures(); got != want {
+			t.Errorf("ConsecutiveFailures: got %d want %d", got, want)
+		}
+	}
+	// network errors and server errors are failures
+	client.DoSyncV2("@alice:localhost", "token", "", false)
+	statusCode = 502
+	client.DoSyncV2("@alice:localhost", "token", "", false)
+	assertFailures(2)
+	// client errors mean the server is up
+	statusCode = 401
+	client.DoSyncV2("@alice:localhost", "token", "", false)
+	assertFailures(0)
+	statusCode = 500
+	client.DoSyncV2("@alice:localhost", "token", "", false)
+	assertFailures(1)
+	// as do successful whoami calls
+	if _, err := client.WhoAmI("", "token"); err != nil {
+		t.Fatalf("WhoAmI returned error: %s", err)
+	}
+	assertFailures(0)
+}
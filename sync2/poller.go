@@ -1,10 +1,13 @@
 package sync2
 
 import (
+	"context"
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/matrix-org/sync-v3/internal"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
@@ -15,18 +18,27 @@ var timeSleep = time.Sleep
 // V2DataReceiver is the receiver for all the v2 sync data the poller gets
 type V2DataReceiver interface {
 	UpdateDeviceSince(deviceID, since string)
-	Accumulate(roomID, prevBatch string, timeline []json.RawMessage)
+	// The user ID is the user whose poller received the timeline.
+	Accumulate(userID, roomID, prevBatch string, timeline []json.RawMessage)
 	Initialise(roomID string, state []json.RawMessage)
 	SetTyping(roomID string, userIDs []string)
 	// Add messages for this device. If an error is returned, the poll loop is terminated as continuing
 	// would implicitly acknowledge these messages.
 	AddToDeviceMessages(userID, deviceID string, msgs []json.RawMessage)
 
-	UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int)
+	UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]UnreadNotifications)
 
 	OnAccountData(userID, roomID string, events []json.RawMessage)
 	OnInvite(userID, roomID string, inviteState []json.RawMessage)
-	OnLeftRoom(userID, roomID string)
+	OnKnock(userID, roomID string, knockState []json.RawMessage)
+	// Called when the user leaves a room. The leave event is the user's m.room.member event, if one exists.
+	OnLeftRoom(userID, roomID string, leaveEvent json.RawMessage)
+	// Called when the poller for this device receives device_lists changes. They are also kept in the
+	// poller until fetched via E2EEFetcher.
+	OnE2EEData(userID, deviceID string, changed, left []string)
+	// Called when the poller for this device stops because the access token was rejected e.g the device
+	// was logged out.
+	OnTerminated(userID, deviceID string)
 }
 
 // Fetcher which PollerMap satisfies used by the E2EE extension
@@ -92,7 +104,7 @@ func (h *PollerMap) LatestE2EEData(deviceID string) (otkCounts map[string]int, f
 	h.pollerMu.Lock()
 	poller := h.Pollers[deviceID]
 	h.pollerMu.Unlock()
-	if poller == nil || poller.Terminated {
+	if poller == nil || poller.Terminated() {
 		// possible if we have 2 devices for the same user, we just need to
 		// wait a bit for the 2nd device's v2 /sync to return
 		return
@@ -103,6 +115,25 @@ func (h *PollerMap) LatestE2EEData(deviceID string) (otkCounts map[string]int, f
 	return
 }
 
+// LatestOTKCounts is the same as LatestE2EEData but leaves device list changes in the poller.
+func (h *PollerMap) LatestOTKCounts(deviceID string) (otkCounts map[string]int, fallbackKeyTypes []string) {
+	h.pollerMu.Lock()
+	poller := h.Pollers[deviceID]
+	h.pollerMu.Unlock()
+	if poller == nil || poller.Terminated() {
+		return
+	}
+	return poller.OTKCounts(), poller.FallbackKeyTypes()
+}
+
+// Terminated returns true if the poller for this device stopped because the access token was rejected.
+func (h *PollerMap) Terminated(deviceID string) bool {
+	h.pollerMu.Lock()
+	poller := h.Pollers[deviceID]
+	h.pollerMu.Unlock()
+	return poller != nil && poller.Terminated()
+}
+
 // EnsurePolling makes sure there is a poller for this user, making one if need be.
 // Blocks until at least 1 sync is done if and only if the poller was just created.
 // This ensures that calls to the database will return data.
@@ -110,7 +141,14 @@ func (h *PollerMap) LatestE2EEData(deviceID string) (otkCounts map[string]int, f
 // Note that we will immediately return if there is a poller for the same user but a different device.
 // We do this to allow for logins on clients to be snappy fast, even though they won't yet have the
 // to-device msgs to decrypt E2EE roms.
-func (h *PollerMap) EnsurePolling(accessToken, userID, deviceID, v2since string, logger zerolog.Logger) {
+//
+// requestID is the ID of the request which needs the poller, if any. It is logged when the poller is started
+// or waited for, but is not part of the poller's logger as pollers outlive the request.
+func (h *PollerMap) EnsurePolling(accessToken, userID, deviceID, v2since, requestID string, logger zerolog.Logger) {
+	reqLogger := logger
+	if requestID != "" {
+		reqLogger = logger.With().Str("req", requestID).Logger()
+	}
 	h.pollerMu.Lock()
 	if !h.executorRunning {
 		h.executorRunning = true
@@ -118,14 +156,16 @@ func (h *PollerMap) EnsurePolling(accessToken, userID, deviceID, v2since string,
 	}
 	poller, ok := h.Pollers[deviceID]
 	// a poller exists and hasn't been terminated so we don't need to do anything
-	if ok && !poller.Terminated {
+	if ok && !poller.Terminated() {
 		h.pollerMu.Unlock()
+		reqLogger.Debug().Str("user", userID).Msg("using existing poller")
 		// this existing poller may not have completed the initial sync yet, so we need to make sure
 		// it has before we return.
-		poller.WaitUntilInitialSync()
+		poller.waitUntilInitialSyncOrTerminated()
 		return
 	}
 	// replace the poller
+	reqLogger.Info().Str("user", userID).Bool("replacing_terminated", ok).Msg("starting poller")
 	poller = NewPoller(userID, accessToken, deviceID, h.v2Client, h, h.txnCache, logger)
 	go poller.Poll(v2since)
 	h.Pollers[deviceID] = poller
@@ -137,16 +177,16 @@ func (h *PollerMap) EnsurePolling(accessToken, userID, deviceID, v2since string,
 		if deviceID == pollerDeviceID {
 			continue
 		}
-		if poller.userID == userID && !poller.Terminated {
+		if poller.userID == userID && !poller.Terminated() {
 			needToWait = false
 		}
 	}
 
 	h.pollerMu.Unlock()
 	if needToWait {
-		poller.WaitUntilInitialSync()
+		poller.waitUntilInitialSyncOrTerminated()
 	} else {
-		logger.Info().Str("user", userID).Msg("a poller exists for this user; not waiting for this device to do an initial sync")
+		reqLogger.Info().Str("user", userID).Msg("a poller exists for this user; not waiting for this device to do an initial sync")
 	}
 }
 
@@ -159,11 +199,11 @@ func (h *PollerMap) execute() {
 func (h *PollerMap) UpdateDeviceSince(deviceID, since string) {
 	h.callbacks.UpdateDeviceSince(deviceID, since)
 }
-func (h *PollerMap) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) {
+func (h *PollerMap) Accumulate(userID, roomID, prevBatch string, timeline []json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
-		h.callbacks.Accumulate(roomID, prevBatch, timeline)
+		h.callbacks.Accumulate(userID, roomID, prevBatch, timeline)
 		wg.Done()
 	}
 	wg.Wait()
@@ -196,11 +236,41 @@ func (h *PollerMap) OnInvite(userID, roomID string, inviteState []json.RawMessag
 	wg.Wait()
 }
 
-func (h *PollerMap) OnLeftRoom(userID, roomID string) {
+func (h *PollerMap) OnKnock(userID, roomID string, knockState []json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnKnock(userID, roomID, knockState)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
+func (h *PollerMap) OnTerminated(userID, deviceID string) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnTerminated(userID, deviceID)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
+func (h *PollerMap) OnE2EEData(userID, deviceID string, changed, left []string) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
-		h.callbacks.OnLeftRoom(userID, roomID)
+		h.callbacks.OnE2EEData(userID, deviceID, changed, left)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
+func (h *PollerMap) OnLeftRoom(userID, roomID string, leaveEvent json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnLeftRoom(userID, roomID, leaveEvent)
 		wg.Done()
 	}
 	wg.Wait()
@@ -212,11 +282,11 @@ func (h *PollerMap) AddToDeviceMessages(userID, deviceID string, msgs []json.Raw
 	h.callbacks.AddToDeviceMessages(userID, deviceID, msgs)
 }
 
-func (h *PollerMap) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
+func (h *PollerMap) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]UnreadNotifications) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
-		h.callbacks.UpdateUnreadCounts(roomID, userID, highlightCount, notifCount)
+		h.callbacks.UpdateUnreadCounts(roomID, userID, highlightCount, notifCount, threadCounts)
 		wg.Done()
 	}
 	wg.Wait()
@@ -250,9 +320,12 @@ type Poller struct {
 	otkCounts         map[string]int
 	deviceListChanges map[string]string // latest user_id -> state e.g "@alice" -> "left"
 
-	// flag set to true when poll() returns due to expired access tokens
-	Terminated bool
+	// set to 1 when poll() returns due to expired access tokens, accessed atomically
+	terminated int32
 	wg         *sync.WaitGroup
+	// closed when the initial sync is done or the poller is terminated, whichever happens first
+	done     chan struct{}
+	doneOnce *sync.Once
 }
 
 func NewPoller(userID, accessToken, deviceID string, client Client, receiver V2DataReceiver, txnCache *TransactionIDCache, logger zerolog.Logger) *Poller {
@@ -264,20 +337,38 @@ func NewPoller(userID, accessToken, deviceID string, client Client, receiver V2D
 		deviceID:          deviceID,
 		client:            client,
 		receiver:          receiver,
-		Terminated:        false,
 		logger:            logger,
 		e2eeMu:            &sync.Mutex{},
 		deviceListChanges: make(map[string]string),
 		wg:                &wg,
 		txnCache:          txnCache,
+		done:              make(chan struct{}),
+		doneOnce:          &sync.Once{},
 	}
 }
 
+// Terminated returns true if the poll loop stopped because the access token was invalidated.
+func (p *Poller) Terminated() bool {
+	return atomic.LoadInt32(&p.terminated) == 1
+}
+
 // Blocks until the initial sync has been done on this poller.
 func (p *Poller) WaitUntilInitialSync() {
 	p.wg.Wait()
 }
 
+// Blocks until the initial sync has been done on this poller, or the poller was terminated. Check
+// Terminated to find out which.
+func (p *Poller) waitUntilInitialSyncOrTerminated() {
+	<-p.done
+}
+
+func (p *Poller) markDone() {
+	p.doneOnce.Do(func() {
+		close(p.done)
+	})
+}
+
 // Poll will block forever, repeatedly calling v2 sync. Do this in a goroutine.
 // Returns if the access token gets invalidated or if there was a fatal error processing v2 responses.
 // Use WaitUntilInitialSync() to wait until the first poll has been processed.
@@ -294,8 +385,16 @@ func (p *Poller) Poll(since string) {
 			p.logger.Warn().Str("duration", waitTime.String()).Int("fail-count", failCount).Msg("Poller: waiting before next poll")
 			timeSleep(waitTime)
 		}
-		resp, statusCode, err := p.client.DoSyncV2(p.accessToken, since, firstTime)
+		ctx, task := internal.StartTask(context.Background(), "poll")
+		task.SetAttribute("user", p.userID)
+		_, span := internal.StartSpan(ctx, "DoSyncV2")
+		resp, statusCode, err := p.client.DoSyncV2(p.userID, p.accessToken, since, firstTime)
+		span.SetAttribute("status", statusCode)
+		span.SetError(err)
+		span.End()
 		if err != nil {
+			task.SetError(err)
+			task.End()
 			// check if temporary
 			if statusCode != 401 {
 				p.logger.Warn().Int("code", statusCode).Err(err).Msg("Poller: sync v2 poll returned temporary error")
@@ -303,7 +402,9 @@ func (p *Poller) Poll(since string) {
 				continue
 			} else {
 				p.logger.Warn().Msg("Poller: access token has been invalidated, terminating loop")
-				p.Terminated = true
+				atomic.StoreInt32(&p.terminated, 1)
+				p.receiver.OnTerminated(p.userID, p.deviceID)
+				p.markDone()
 				return
 			}
 		}
@@ -313,16 +414,18 @@ func (p *Poller) Poll(since string) {
 		failCount = 0
 		p.parseE2EEData(resp)
 		p.parseGlobalAccountData(resp)
-		p.parseRoomsResponse(resp)
+		p.parseRoomsResponse(ctx, resp)
 		p.parseToDeviceMessages(resp)
 
 		since = resp.NextBatch
 		// persist the since token (TODO: this could get slow if we hammer the DB too much)
 		p.receiver.UpdateDeviceSince(p.deviceID, since)
+		task.End()
 
 		if firstTime {
 			firstTime = false
 			p.wg.Done()
+			p.markDone()
 		}
 	}
 }
@@ -364,6 +467,9 @@ func (p *Poller) parseToDeviceMessages(res *SyncResponse) {
 }
 
 func (p *Poller) parseE2EEData(res *SyncResponse) {
+	if len(res.DeviceLists.Changed) > 0 || len(res.DeviceLists.Left) > 0 {
+		p.receiver.OnE2EEData(p.userID, p.deviceID, res.DeviceLists.Changed, res.DeviceLists.Left)
+	}
 	p.e2eeMu.Lock()
 	defer p.e2eeMu.Unlock()
 	// we don't actively push this to v3 loops, we let them lazily fetch it via calls to
@@ -400,7 +506,30 @@ func (p *Poller) updateTxnIDCache(timeline []json.RawMessage) {
 	}
 }
 
-func (p *Poller) parseRoomsResponse(res *SyncResponse) {
+// findLeaveEvent returns the most recent m.room.member event for this user in the leave section of
+// the response, or nil if there is none.
+func (p *Poller) findLeaveEvent(roomData SyncV2LeaveResponse) json.RawMessage {
+	events := make([]json.RawMessage, 0, len(roomData.State.Events)+len(roomData.Timeline.Events))
+	events = append(events, roomData.State.Events...)
+	events = append(events, roomData.Timeline.Events...)
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := gjson.ParseBytes(events[i])
+		if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == p.userID {
+			return events[i]
+		}
+	}
+	return nil
+}
+
+func (p *Poller) accumulate(ctx context.Context, roomID, prevBatch string, timeline []json.RawMessage) {
+	_, span := internal.StartSpan(ctx, "Accumulate")
+	defer span.End()
+	span.SetAttribute("room", roomID)
+	span.SetAttribute("num_events", len(timeline))
+	p.receiver.Accumulate(p.userID, roomID, prevBatch, timeline)
+}
+
+func (p *Poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) {
 	stateCalls := 0
 	timelineCalls := 0
 	typingCalls := 0
@@ -410,9 +539,11 @@ func (p *Poller) parseRoomsResponse(res *SyncResponse) {
 			p.receiver.Initialise(roomID, roomData.State.Events)
 		}
 		// process unread counts before events else we might push the event without including said event in the count
-		if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil {
+		if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil ||
+			roomData.UnreadThreadNotifications != nil {
 			p.receiver.UpdateUnreadCounts(
 				roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount,
+				roomData.UnreadThreadNotifications,
 			)
 		}
 		// process account data
@@ -422,7 +553,7 @@ func (p *Poller) parseRoomsResponse(res *SyncResponse) {
 		if len(roomData.Timeline.Events) > 0 {
 			timelineCalls++
 			p.updateTxnIDCache(roomData.Timeline.Events)
-			p.receiver.Accumulate(roomID, roomData.Timeline.PrevBatch, roomData.Timeline.Events)
+			p.accumulate(ctx, roomID, roomData.Timeline.PrevBatch, roomData.Timeline.Events)
 		}
 		for _, ephEvent := range roomData.Ephemeral.Events {
 			if gjson.GetBytes(ephEvent, "type").Str == "m.typing" {
@@ -444,13 +575,16 @@ func (p *Poller) parseRoomsResponse(res *SyncResponse) {
 	for roomID, roomData := range res.Rooms.Leave {
 		// TODO: do we care about state?
 		if len(roomData.Timeline.Events) > 0 {
-			p.receiver.Accumulate(roomID, roomData.Timeline.PrevBatch, roomData.Timeline.Events)
+			p.accumulate(ctx, roomID, roomData.Timeline.PrevBatch, roomData.Timeline.Events)
 		}
-		p.receiver.OnLeftRoom(p.userID, roomID)
+		p.receiver.OnLeftRoom(p.userID, roomID, p.findLeaveEvent(roomData))
 	}
 	for roomID, roomData := range res.Rooms.Invite {
 		p.receiver.OnInvite(p.userID, roomID, roomData.InviteState.Events)
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		p.receiver.OnKnock(p.userID, roomID, roomData.KnockState.Events)
+	}
 	var l *zerolog.Event
 	if len(res.Rooms.Invite) > 1 || len(res.Rooms.Join) > 1 {
 		l = p.logger.Info()
@@ -458,7 +592,7 @@ func (p *Poller) parseRoomsResponse(res *SyncResponse) {
 		l = p.logger.Debug()
 	}
 	l.Ints(
-		"rooms [invite,join,leave]", []int{len(res.Rooms.Invite), len(res.Rooms.Join), len(res.Rooms.Leave)},
+		"rooms [invite,join,leave,knock]", []int{len(res.Rooms.Invite), len(res.Rooms.Join), len(res.Rooms.Leave), len(res.Rooms.Knock)},
 	).Ints(
 		"storage [states,timelines,typing]", []int{stateCalls, timelineCalls, typingCalls},
 	).Int("to_device", len(res.ToDevice.Events)).Msg("Poller: accumulated data")
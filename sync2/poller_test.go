@@ -1,10 +1,12 @@
 package sync2
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -31,11 +33,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 			joinResp.State.Events = roomState
 			return &SyncResponse{
 				NextBatch: nextSince,
-				Rooms: struct {
-					Join   map[string]SyncV2JoinResponse   `json:"join"`
-					Invite map[string]SyncV2InviteResponse `json:"invite"`
-					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-				}{
+				Rooms: SyncRoomsResponse{
 					Join: map[string]SyncV2JoinResponse{
 						roomID: joinResp,
 					},
@@ -71,6 +69,75 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that if the access token is rejected on the initial sync, the receiver is told and EnsurePolling
+// callers waiting for the initial sync are unblocked.
+func TestPollerTerminatedOnInitialSync(t *testing.T) {
+	deviceID := "FOOBAR"
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	poller := NewPoller("@alice:localhost", "Authorization: hello world", deviceID, client, accumulator, txnIDCache, zerolog.New(os.Stderr))
+	go poller.Poll("")
+	waited := make(chan struct{})
+	go func() {
+		poller.waitUntilInitialSyncOrTerminated()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("WaitUntilInitialSync did not return after the poller was terminated")
+	}
+	if !poller.Terminated() {
+		t.Errorf("poller was not terminated")
+	}
+	if len(accumulator.terminatedDeviceIDs) != 1 || accumulator.terminatedDeviceIDs[0] != deviceID {
+		t.Errorf("OnTerminated: got %v want [%s]", accumulator.terminatedDeviceIDs, deviceID)
+	}
+}
+
+// Check that the ID of the request which starts a poller is logged, but isn't added to the poller's logs.
+func TestPollerMapLogsRequestID(t *testing.T) {
+	deviceID := "FOOBAR"
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	var buf lockedBuffer
+	pm := NewPollerMap(client, accumulator)
+	pm.EnsurePolling("Authorization: hello world", "@alice:localhost", deviceID, "", "req_id", zerolog.New(&buf))
+	var startedLine bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, "starting poller") {
+			startedLine = true
+			if !strings.Contains(line, `"req":"req_id"`) {
+				t.Errorf("starting poller log line is missing the request ID: %s", line)
+			}
+		} else if strings.Contains(line, "req_id") {
+			t.Errorf("poller log line includes the request ID: %s", line)
+		}
+	}
+	if !startedLine {
+		t.Errorf("no log line for starting the poller: %s", buf.String())
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	deviceID := "FOOBAR"
@@ -115,11 +182,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 		joinResp.Timeline.Events = roomTimelineResponses[sinceInt]
 		return &SyncResponse{
 			NextBatch: fmt.Sprintf("%d", sinceInt+1),
-			Rooms: struct {
-				Join   map[string]SyncV2JoinResponse   `json:"join"`
-				Invite map[string]SyncV2InviteResponse `json:"invite"`
-				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-			}{
+			Rooms: SyncRoomsResponse{
 				Join: map[string]SyncV2JoinResponse{
 					roomID: joinResp,
 				},
@@ -230,20 +293,21 @@ type mockClient struct {
 	fn func(authHeader, since string) (*SyncResponse, int, error)
 }
 
-func (c *mockClient) DoSyncV2(authHeader, since string, isFirst bool) (*SyncResponse, int, error) {
+func (c *mockClient) DoSyncV2(userID, authHeader, since string, isFirst bool) (*SyncResponse, int, error) {
 	return c.fn(authHeader, since)
 }
-func (c *mockClient) WhoAmI(authHeader string) (string, error) {
+func (c *mockClient) WhoAmI(serverName, authHeader string) (string, error) {
 	return "@alice:localhost", nil
 }
 
 type mockDataReceiver struct {
-	states          map[string][]json.RawMessage
-	timelines       map[string][]json.RawMessage
-	deviceIDToSince map[string]string
+	states              map[string][]json.RawMessage
+	timelines           map[string][]json.RawMessage
+	deviceIDToSince     map[string]string
+	terminatedDeviceIDs []string
 }
 
-func (a *mockDataReceiver) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) {
+func (a *mockDataReceiver) Accumulate(userID, roomID, prevBatch string, timeline []json.RawMessage) {
 	a.timelines[roomID] = append(a.timelines[roomID], timeline...)
 }
 func (a *mockDataReceiver) Initialise(roomID string, state []json.RawMessage) {
@@ -257,11 +321,16 @@ func (s *mockDataReceiver) UpdateDeviceSince(deviceID, since string) {
 func (s *mockDataReceiver) AddToDeviceMessages(userID, deviceID string, msgs []json.RawMessage) {
 }
 
-func (s *mockDataReceiver) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
+func (s *mockDataReceiver) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]UnreadNotifications) {
 }
 func (s *mockDataReceiver) OnAccountData(userID, roomID string, events []json.RawMessage) {}
 func (s *mockDataReceiver) OnInvite(userID, roomID string, inviteState []json.RawMessage) {}
-func (s *mockDataReceiver) OnLeftRoom(userID, roomID string)                              {}
+func (s *mockDataReceiver) OnKnock(userID, roomID string, knockState []json.RawMessage)   {}
+func (s *mockDataReceiver) OnLeftRoom(userID, roomID string, leaveEvent json.RawMessage)  {}
+func (s *mockDataReceiver) OnE2EEData(userID, deviceID string, changed, left []string)    {}
+func (s *mockDataReceiver) OnTerminated(userID, deviceID string) {
+	s.terminatedDeviceIDs = append(s.terminatedDeviceIDs, deviceID)
+}
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
 	client := &mockClient{
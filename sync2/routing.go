@@ -0,0 +1,241 @@
+package sync2
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ServerNamePlaceholder is replaced with the server name in UpstreamConfig.WellKnownURL.
+const ServerNamePlaceholder = "{server_name}"
+
+// UpstreamConfig configures which homeserver requests for each user are sent to.
+type UpstreamConfig struct {
+	// The base URL of the client-server API to use for server names which are not otherwise known.
+	// May be empty, in which case users on unknown servers are rejected.
+	Default string
+	// Server name -> base URL of the client-server API for that server.
+	Servers map[string]string
+	// If set, server names which are not in Servers are resolved by fetching this URL and using the
+	// m.homeserver.base_url in the response, as per .well-known/matrix/client. ServerNamePlaceholder is
+	// replaced with the server name, e.g https://{server_name}/.well-known/matrix/client
+	WellKnownURL string
+}
+
+// WellKnownFailureTTL is how long a failed .well-known lookup is cached for, during which users on that
+// server name are sent to the default upstream, if any.
+const WellKnownFailureTTL = 5 * time.Minute
+
+// RoutingClient is a Client which sends requests to the homeserver of the user, based on the server
+// name in their user ID. This allows one proxy to serve users on several homeservers.
+//
+// Rooms which users on several homeservers are joined to are stored once, as events are deduplicated
+// by event ID regardless of which poller sent them. prev_batch tokens are stored per upstream, as
+// they can only be used against the homeserver which issued them.
+type RoutingClient struct {
+	client *http.Client
+	cfg    UpstreamConfig
+
+	mu sync.Mutex
+	// base URL -> client for that upstream, which tracks the health of each upstream separately
+	upstreams map[string]*HealthTrackingClient
+	// server name -> base URL, for servers resolved via .well-known
+	discovered map[string]string
+	// server name -> when to retry, for servers which failed to resolve via .well-known
+	failedLookups map[string]time.Time
+}
+
+func NewRoutingClient(client *http.Client, cfg UpstreamConfig) *RoutingClient {
+	c := &RoutingClient{
+		client:        client,
+		cfg:           cfg,
+		upstreams:     make(map[string]*HealthTrackingClient),
+		discovered:    make(map[string]string),
+		failedLookups: make(map[string]time.Time),
+	}
+	if cfg.Default != "" {
+		c.cfg.Default = strings.TrimSuffix(cfg.Default, "/")
+	}
+	c.cfg.Servers = make(map[string]string, len(cfg.Servers))
+	for serverName, baseURL := range cfg.Servers {
+		c.cfg.Servers[serverName] = strings.TrimSuffix(baseURL, "/")
+	}
+	return c
+}
+
+// Servers returns the base URL for every server name which is known, either from the config or
+// from .well-known lookups.
+func (c *RoutingClient) Servers() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	servers := make(map[string]string, len(c.cfg.Servers)+len(c.discovered))
+	for serverName, baseURL := range c.discovered {
+		servers[serverName] = baseURL
+	}
+	for serverName, baseURL := range c.cfg.Servers {
+		servers[serverName] = baseURL
+	}
+	return servers
+}
+
+// ConsecutiveFailures returns the number of failed requests to each configured upstream since the
+// last successful request to it, keyed by base URL. Upstreams resolved via .well-known are not
+// included, as anyone can make the proxy talk to them.
+func (c *RoutingClient) ConsecutiveFailures() map[string]int64 {
+	result := make(map[string]int64)
+	for _, baseURL := range c.configured() {
+		result[baseURL] = c.upstream(baseURL).ConsecutiveFailures()
+	}
+	return result
+}
+
+// UpstreamForUser returns the base URL of the homeserver for this user.
+func (c *RoutingClient) UpstreamForUser(userID string) (string, error) {
+	serverName := ServerName(userID)
+	if serverName == "" {
+		return "", fmt.Errorf("malformed user ID: %s", userID)
+	}
+	return c.upstreamForServerName(serverName)
+}
+
+// ServerName returns the server name in this user ID, or the empty string if the user ID is malformed.
+func ServerName(userID string) string {
+	i := strings.Index(userID, ":")
+	if i == -1 {
+		return ""
+	}
+	return userID[i+1:]
+}
+
+func (c *RoutingClient) upstreamForServerName(serverName string) (string, error) {
+	if baseURL, ok := c.cfg.Servers[serverName]; ok {
+		return baseURL, nil
+	}
+	c.mu.Lock()
+	baseURL, ok := c.discovered[serverName]
+	retryAt, failed := c.failedLookups[serverName]
+	c.mu.Unlock()
+	if ok {
+		return baseURL, nil
+	}
+	if c.cfg.WellKnownURL != "" && (!failed || time.Now().After(retryAt)) {
+		baseURL, err := c.lookupWellKnown(serverName)
+		c.mu.Lock()
+		if err == nil {
+			c.discovered[serverName] = baseURL
+			delete(c.failedLookups, serverName)
+		} else {
+			c.failedLookups[serverName] = time.Now().Add(WellKnownFailureTTL)
+		}
+		c.mu.Unlock()
+		if err == nil {
+			return baseURL, nil
+		}
+		log.Warn().Err(err).Str("server_name", serverName).Msg("failed to resolve upstream via .well-known")
+	}
+	if c.cfg.Default != "" {
+		return c.cfg.Default, nil
+	}
+	return "", fmt.Errorf("no upstream homeserver for server name %s", serverName)
+}
+func (c *RoutingClient) lookupWellKnown(serverName string) (string, error) {
+	res, err := c.client.Get(strings.Replace(c.cfg.WellKnownURL, ServerNamePlaceholder, serverName, -1))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf(".well-known returned HTTP %d", res.StatusCode)
+	}
+	// .well-known responses are small, so don't read more than this
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	baseURL := gjson.GetBytes(body, `m\.homeserver.base_url`).Str
+	if baseURL == "" {
+		return "", fmt.Errorf(".well-known is missing m.homeserver.base_url")
+	}
+	return strings.TrimSuffix(baseURL, "/"), nil
+}
+
+// WhoAmI asks the homeserver for this server name who the access token belongs to. The server name is
+// that of the user the token was last seen for, if any. Tokens which have not been seen before have no
+// server name, and are only sent to the default upstream: they are never sent to other upstreams to see
+// which one accepts them. The user must belong to the upstream which accepted the token.
+func (c *RoutingClient) WhoAmI(serverName, accessToken string) (string, error) {
+	baseURL := c.cfg.Default
+	if serverName != "" {
+		var err error
+		if baseURL, err = c.upstreamForServerName(serverName); err != nil {
+			return "", err
+		}
+	} else if baseURL == "" {
+		return "", fmt.Errorf("no default upstream homeserver for new access tokens")
+	}
+	userID, err := c.upstream(baseURL).WhoAmI(serverName, accessToken)
+	if err != nil {
+		return "", err
+	}
+	userBaseURL, err := c.UpstreamForUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if userBaseURL != baseURL {
+		return "", fmt.Errorf("user %s belongs to %s but the token was accepted by %s", userID, userBaseURL, baseURL)
+	}
+	return userID, nil
+}
+
+// DoSyncV2 performs a sync v2 request against the homeserver of this user.
+func (c *RoutingClient) DoSyncV2(userID, accessToken, since string, isFirst bool) (*SyncResponse, int, error) {
+	baseURL, err := c.UpstreamForUser(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.upstream(baseURL).DoSyncV2(userID, accessToken, since, isFirst)
+}
+
+// configured returns every upstream in the config in a stable order, default first. Upstreams resolved
+// via .well-known are not included.
+func (c *RoutingClient) configured() []string {
+	seen := make(map[string]bool)
+	var result []string
+	if c.cfg.Default != "" {
+		result = append(result, c.cfg.Default)
+		seen[c.cfg.Default] = true
+	}
+	serverNames := make([]string, 0, len(c.cfg.Servers))
+	for serverName := range c.cfg.Servers {
+		serverNames = append(serverNames, serverName)
+	}
+	sort.Strings(serverNames)
+	for _, serverName := range serverNames {
+		if baseURL := c.cfg.Servers[serverName]; !seen[baseURL] {
+			result = append(result, baseURL)
+			seen[baseURL] = true
+		}
+	}
+	return result
+}
+
+func (c *RoutingClient) upstream(baseURL string) *HealthTrackingClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upstream, ok := c.upstreams[baseURL]
+	if !ok {
+		upstream = NewHealthTrackingClient(&HTTPClient{
+			Client:            c.client,
+			DestinationServer: baseURL,
+		})
+		c.upstreams[baseURL] = upstream
+	}
+	return upstream
+}
@@ -0,0 +1,140 @@
+package sync2
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// runFakeUpstream runs a homeserver which accepts these access tokens, counting requests made to it.
+func runFakeUpstream(t *testing.T, tokenToUser map[string]string, numRequests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*numRequests++
+		userID := tokenToUser[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+		if userID == "" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN"}`))
+			return
+		}
+		switch req.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(fmt.Sprintf(`{"user_id":"%s"}`, userID)))
+		case "/_matrix/client/r0/sync":
+			w.Write([]byte(`{"next_batch":"` + userID + `"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestRoutingClient(t *testing.T) {
+	var numA, numB, numC int
+	hsA := runFakeUpstream(t, map[string]string{"a_token": "@alice:a"}, &numA)
+	defer hsA.Close()
+	hsB := runFakeUpstream(t, map[string]string{"b_token": "@bob:b"}, &numB)
+	defer hsB.Close()
+	hsC := runFakeUpstream(t, map[string]string{"c_token": "@charlie:c"}, &numC)
+	defer hsC.Close()
+	numWellKnown := 0
+	wellKnown := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		numWellKnown++
+		if req.URL.Path != "/c/.well-known/matrix/client" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"m.homeserver":{"base_url":"` + hsC.URL + `/"}}`))
+	}))
+	defer wellKnown.Close()
+	// a configured upstream which is down
+	hsDown := httptest.NewServer(http.NotFoundHandler())
+	hsDown.Close()
+
+	client := NewRoutingClient(http.DefaultClient, UpstreamConfig{
+		Servers: map[string]string{
+			"a":    hsA.URL,
+			"b":    hsB.URL + "/",
+			"down": hsDown.URL,
+		},
+		WellKnownURL: wellKnown.URL + "/" + ServerNamePlaceholder + "/.well-known/matrix/client",
+	})
+
+	// without a default, new tokens are rejected without being sent anywhere
+	if _, err := client.WhoAmI("", "a_token"); err == nil {
+		t.Fatalf("WhoAmI for new token without a default: want error")
+	}
+	if numA != 0 || numB != 0 || numC != 0 {
+		t.Errorf("WhoAmI for new token: got %d, %d, %d requests, want none", numA, numB, numC)
+	}
+	// tokens for known users only go to the upstream for the user's server name
+	userID, err := client.WhoAmI("a", "a_token")
+	if err != nil || userID != "@alice:a" {
+		t.Fatalf("WhoAmI with server name: got %s %v want @alice:a", userID, err)
+	}
+	if numA != 1 || numB != 0 {
+		t.Errorf("WhoAmI with server name: got %d requests to A, %d to B, want 1, 0", numA, numB)
+	}
+	// tokens which the upstream rejects are rejected as unauthorised
+	_, err = client.WhoAmI("a", "unknown_token")
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.StatusCode != 401 {
+		t.Errorf("WhoAmI for unknown token: got %v want HTTP 401", err)
+	}
+	// the user must belong to the upstream which accepted the token
+	if _, err = client.WhoAmI("a", "b_token"); err == nil {
+		t.Errorf("WhoAmI for token on another upstream: want error")
+	}
+
+	// syncs are routed by the user's server name, including servers resolved via .well-known
+	numA, numB = 0, 0
+	for _, tc := range []struct{ userID, token string }{{"@alice:a", "a_token"}, {"@bob:b", "b_token"}, {"@charlie:c", "c_token"}} {
+		res, code, err := client.DoSyncV2(tc.userID, tc.token, "", true)
+		if err != nil || code != 200 || res.NextBatch != tc.userID {
+			t.Errorf("DoSyncV2 for %s: got %v %d %v", tc.userID, res, code, err)
+		}
+	}
+	if numA != 1 || numB != 1 || numC != 1 {
+		t.Errorf("DoSyncV2: got %d, %d, %d requests, want 1 to each upstream", numA, numB, numC)
+	}
+	if got := client.Servers()["c"]; got != hsC.URL {
+		t.Errorf("Servers: got %s for c want %s", got, hsC.URL)
+	}
+
+	if userID, err = client.WhoAmI("c", "c_token"); err != nil || userID != "@charlie:c" {
+		t.Errorf("WhoAmI with discovered server name: got %s %v want @charlie:c", userID, err)
+	}
+
+	// users on unknown servers are rejected without a default, and failed lookups are cached
+	numWellKnown = 0
+	for i := 0; i < 2; i++ {
+		if _, _, err = client.DoSyncV2("@dave:d", "d_token", "", true); err == nil {
+			t.Errorf("DoSyncV2 for unknown server: want error")
+		}
+	}
+	if numWellKnown != 1 {
+		t.Errorf("DoSyncV2 for unknown server: got %d .well-known requests, want 1", numWellKnown)
+	}
+
+	// the health of each configured upstream is tracked separately
+	client.DoSyncV2("@eve:down", "e_token", "", true)
+	failures := client.ConsecutiveFailures()
+	if len(failures) != 3 || failures[hsA.URL] != 0 || failures[hsB.URL] != 0 || failures[hsDown.URL] == 0 {
+		t.Errorf("ConsecutiveFailures: got %v want failures for %s only", failures, hsDown.URL)
+	}
+
+	// new tokens are only sent to the default upstream
+	client = NewRoutingClient(http.DefaultClient, UpstreamConfig{
+		Default: hsA.URL,
+		Servers: map[string]string{"b": hsB.URL},
+	})
+	numA, numB = 0, 0
+	if userID, err = client.WhoAmI("", "a_token"); err != nil || userID != "@alice:a" {
+		t.Errorf("WhoAmI for new token: got %s %v want @alice:a", userID, err)
+	}
+	if _, err = client.WhoAmI("", "b_token"); err == nil {
+		t.Errorf("WhoAmI for new token on another upstream: want error")
+	}
+	if numA != 2 || numB != 0 {
+		t.Errorf("WhoAmI for new tokens: got %d requests to A, %d to B, want 2, 0", numA, numB)
+	}
+}
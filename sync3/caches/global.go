@@ -3,14 +3,12 @@ package caches
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sort"
 	"sync"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
@@ -39,12 +37,12 @@ type EventData struct {
 	// Flag set when this event should force the room contents to be resent e.g
 	// state res, initial join, etc
 	ForceInitial bool
+
+	// Flag set when the receiving user is not joined to this room but is previewing it
+	IsPreview bool
 }
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("sync3/caches")
 
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
@@ -59,6 +57,13 @@ type GlobalCache struct {
 	// hence you must lock this with `mu` before r/w
 	roomIDToMetadata   map[string]*internal.RoomMetadata
 	roomIDToMetadataMu *sync.RWMutex
+	// the inverse of RoomMetadata.ChildSpaceRooms: child room ID -> set of parent space room IDs.
+	// Protected by roomIDToMetadataMu.
+	childToParentSpaces map[string]map[string]struct{}
+	// parent room ID -> child room ID -> number of edges between them, for both m.space.child events and
+	// canonical m.space.parent events. The inverse of the edges AncestorSpaces follows, so the rooms beneath
+	// a space can be found without looking at every room. Protected by roomIDToMetadataMu.
+	parentToChildRooms map[string]map[string]int
 
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
@@ -66,9 +71,11 @@ type GlobalCache struct {
 
 func NewGlobalCache(store *state.Storage) *GlobalCache {
 	return &GlobalCache{
-		roomIDToMetadataMu: &sync.RWMutex{},
-		store:              store,
-		roomIDToMetadata:   make(map[string]*internal.RoomMetadata),
+		roomIDToMetadataMu:  &sync.RWMutex{},
+		store:               store,
+		roomIDToMetadata:    make(map[string]*internal.RoomMetadata),
+		childToParentSpaces: make(map[string]map[string]struct{}),
+		parentToChildRooms:  make(map[string]map[string]int),
 	}
 }
 
@@ -76,6 +83,9 @@ func (c *GlobalCache) OnRegistered(_ int64) error {
 	return nil
 }
 
+// OnSpaceGraphChanged does nothing as the global cache updates the space graph when it sees the event.
+func (c *GlobalCache) OnSpaceGraphChanged(roomID string) {}
+
 // Load the current room metadata for the given room IDs. Races unless you call this in a dispatcher loop.
 // Always returns copies of the room metadata so ownership can be passed to other threads.
 // Keeps the ordering of the room IDs given.
@@ -96,11 +106,133 @@ func (c *GlobalCache) LoadRooms(roomIDs ...string) map[string]*internal.RoomMeta
 		for i := range sr.Heroes {
 			srCopy.Heroes[i] = sr.Heroes[i]
 		}
+		// same goes for the event timestamps, which are modified on every event
+		srCopy.LastEventTimestamps = make(map[string]uint64, len(sr.LastEventTimestamps))
+		for evType, ts := range sr.LastEventTimestamps {
+			srCopy.LastEventTimestamps[evType] = ts
+		}
+		if sr.CanonicalParentSpaces != nil {
+			srCopy.CanonicalParentSpaces = make(map[string]struct{}, len(sr.CanonicalParentSpaces))
+			for parentRoomID := range sr.CanonicalParentSpaces {
+				srCopy.CanonicalParentSpaces[parentRoomID] = struct{}{}
+			}
+		}
 		result[roomID] = &srCopy
 	}
 	return result
 }
 
+// AncestorSpaces returns every space this room is a part of, either directly or via sub-spaces. Parents are
+// found via m.space.child events in the parent space, or a canonical m.space.parent event in the room itself.
+func (c *GlobalCache) AncestorSpaces(roomID string) map[string]struct{} {
+	c.roomIDToMetadataMu.RLock()
+	defer c.roomIDToMetadataMu.RUnlock()
+	result := make(map[string]struct{})
+	queue := []string{roomID}
+	visit := func(parentRoomID string) {
+		if parentRoomID == roomID {
+			return // cycle back to the starting room
+		}
+		if _, seen := result[parentRoomID]; seen {
+			return
+		}
+		result[parentRoomID] = struct{}{}
+		queue = append(queue, parentRoomID)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for parentRoomID := range c.childToParentSpaces[current] {
+			visit(parentRoomID)
+		}
+		if metadata := c.roomIDToMetadata[current]; metadata != nil && metadata.CanonicalParentSpace != "" {
+			visit(metadata.CanonicalParentSpace)
+		}
+	}
+	return result
+}
+
+// Descendants returns every room beneath this space, either directly or via sub-spaces. This is the inverse of
+// AncestorSpaces.
+func (c *GlobalCache) Descendants(roomID string) []string {
+	c.roomIDToMetadataMu.RLock()
+	defer c.roomIDToMetadataMu.RUnlock()
+	var result []string
+	seen := map[string]struct{}{roomID: {}}
+	queue := []string{roomID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for childRoomID := range c.parentToChildRooms[current] {
+			if _, ok := seen[childRoomID]; ok {
+				continue
+			}
+			seen[childRoomID] = struct{}{}
+			result = append(result, childRoomID)
+			queue = append(queue, childRoomID)
+		}
+	}
+	return result
+}
+
+func (c *GlobalCache) setSpaceChild(parentRoomID, childRoomID string, isDeleted bool) {
+	parents := c.childToParentSpaces[childRoomID]
+	_, exists := parents[parentRoomID]
+	if isDeleted {
+		if !exists {
+			return
+		}
+		delete(parents, parentRoomID)
+		if len(parents) == 0 {
+			delete(c.childToParentSpaces, childRoomID)
+		}
+		c.removeSpaceEdge(parentRoomID, childRoomID)
+		return
+	}
+	if exists {
+		return
+	}
+	if parents == nil {
+		parents = make(map[string]struct{})
+		c.childToParentSpaces[childRoomID] = parents
+	}
+	parents[parentRoomID] = struct{}{}
+	c.addSpaceEdge(parentRoomID, childRoomID)
+}
+
+// setCanonicalParentSpace updates the space edges when the canonical parent of this room changes.
+func (c *GlobalCache) setCanonicalParentSpace(roomID, prevParentRoomID, parentRoomID string) {
+	if prevParentRoomID == parentRoomID {
+		return
+	}
+	if prevParentRoomID != "" {
+		c.removeSpaceEdge(prevParentRoomID, roomID)
+	}
+	if parentRoomID != "" {
+		c.addSpaceEdge(parentRoomID, roomID)
+	}
+}
+
+func (c *GlobalCache) addSpaceEdge(parentRoomID, childRoomID string) {
+	children := c.parentToChildRooms[parentRoomID]
+	if children == nil {
+		children = make(map[string]int)
+		c.parentToChildRooms[parentRoomID] = children
+	}
+	children[childRoomID]++
+}
+
+func (c *GlobalCache) removeSpaceEdge(parentRoomID, childRoomID string) {
+	children := c.parentToChildRooms[parentRoomID]
+	children[childRoomID]--
+	if children[childRoomID] <= 0 {
+		delete(children, childRoomID)
+	}
+	if len(children) == 0 {
+		delete(c.parentToChildRooms, parentRoomID)
+	}
+}
+
 // Load all current joined room metadata for the user given. Returns the absolute database position along
 // with the results. TODO: remove with LoadRoomState?
 func (c *GlobalCache) LoadJoinedRooms(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
@@ -121,12 +253,37 @@ func (c *GlobalCache) LoadJoinedRooms(userID string) (pos int64, joinedRooms map
 }
 
 // TODO: remove? Doesn't touch global cache fields
-func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap) map[string][]json.RawMessage {
+// Load the room state for the given rooms. If the required state map is lazy loading members, the membership
+// events for the users in roomToUsersInTimeline will also be returned for each room.
+func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
 	if c.store == nil {
 		return nil
 	}
+	ctx, span := internal.StartSpan(ctx, "LoadRoomState")
+	defer span.End()
+	span.SetAttribute("num_rooms", len(roomIDs))
 	resultMap := make(map[string][]json.RawMessage, len(roomIDs))
-	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, requiredStateMap.QueryStateMap())
+	queryStateMap := requiredStateMap.QueryStateMap()
+	if !requiredStateMap.NeedsAllState() {
+		// if we are only pulling out certain state events, add in the lazy members. The query is shared across
+		// all rooms so we need to union the users together, then filter per-room below.
+		if requiredStateMap.IsLazyLoading() {
+			memberStateKeys, exists := queryStateMap["m.room.member"]
+			if !exists || memberStateKeys != nil { // nil means all members are already being fetched
+				for _, userIDs := range roomToUsersInTimeline {
+					memberStateKeys = append(memberStateKeys, userIDs...)
+				}
+				if len(memberStateKeys) > 0 {
+					queryStateMap["m.room.member"] = memberStateKeys
+				}
+			}
+		}
+		// an empty query map means all state to the storage layer, so don't query if nothing was requested
+		if len(queryStateMap) == 0 {
+			return resultMap
+		}
+	}
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, queryStateMap)
 	if err != nil {
 		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Msg("failed to load room state")
 		return nil
@@ -136,6 +293,13 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 		for _, ev := range stateEvents {
 			if requiredStateMap.Include(ev.Type, ev.StateKey) {
 				result = append(result, ev.JSON)
+			} else if requiredStateMap.IsLazyLoading() && ev.Type == "m.room.member" {
+				for _, userID := range roomToUsersInTimeline[roomID] {
+					if ev.StateKey == userID {
+						result = append(result, ev.JSON)
+						break
+					}
+				}
 			}
 		}
 		resultMap[roomID] = result
@@ -176,6 +340,10 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 		internal.Assert("room ID is set", metadata.RoomID != "")
 		internal.Assert("last message timestamp exists", metadata.LastMessageTimestamp > 1)
 		c.roomIDToMetadata[roomID] = &metadata
+		for childRoomID := range metadata.ChildSpaceRooms {
+			c.setSpaceChild(roomID, childRoomID, false)
+		}
+		c.setCanonicalParentSpace(roomID, "", metadata.CanonicalParentSpace)
 	}
 	return nil
 }
@@ -193,15 +361,31 @@ func (c *GlobalCache) OnNewEvent(
 	metadata := c.roomIDToMetadata[ed.RoomID]
 	if metadata == nil {
 		metadata = &internal.RoomMetadata{
-			RoomID:          ed.RoomID,
-			ChildSpaceRooms: make(map[string]struct{}),
+			RoomID:              ed.RoomID,
+			ChildSpaceRooms:     make(map[string]struct{}),
+			LastEventTimestamps: make(map[string]uint64),
 		}
 	}
+	if metadata.LastEventTimestamps == nil {
+		metadata.LastEventTimestamps = make(map[string]uint64)
+	}
 	switch ed.EventType {
 	case "m.room.name":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.NameEvent = ed.Content.Get("name").Str
 		}
+	case "m.room.avatar":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.AvatarEvent = ed.Content.Get("url").Str
+		}
+	case "m.room.topic":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.Topic = ed.Content.Get("topic").Str
+		}
+	case "m.room.history_visibility":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.HistoryVisibility = ed.Content.Get("history_visibility").Str
+		}
 	case "m.room.encryption":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.Encrypted = true
@@ -225,6 +409,10 @@ func (c *GlobalCache) OnNewEvent(
 			if roomType.Exists() && roomType.Type == gjson.String {
 				metadata.RoomType = &roomType.Str
 			}
+			predecessorRoomID := ed.Content.Get("predecessor.room_id").Str
+			if predecessorRoomID != "" {
+				metadata.PredecessorRoomID = &predecessorRoomID
+			}
 		}
 	case "m.space.child": // only track space child changes for now, not parents
 		if ed.StateKey != nil {
@@ -234,6 +422,14 @@ func (c *GlobalCache) OnNewEvent(
 			} else {
 				metadata.ChildSpaceRooms[*ed.StateKey] = struct{}{}
 			}
+			c.setSpaceChild(ed.RoomID, *ed.StateKey, isDeleted)
+		}
+	case "m.space.parent":
+		if ed.StateKey != nil {
+			isCanonical := ed.Content.Get("canonical").Bool() && ed.Content.Get("via").IsArray()
+			prevParentRoomID := metadata.CanonicalParentSpace
+			metadata.SetParentSpace(*ed.StateKey, isCanonical)
+			c.setCanonicalParentSpace(ed.RoomID, prevParentRoomID, metadata.CanonicalParentSpace)
 		}
 	case "m.room.member":
 		if ed.StateKey != nil {
@@ -254,6 +450,13 @@ func (c *GlobalCache) OnNewEvent(
 						logger.Err(err).Str("user", *ed.StateKey).Str("room", ed.RoomID).Msg("failed to remove accepted invite")
 					}
 				}
+				if membership == "join" && eventJSON.Get("unsigned.prev_content.membership").Str == "knock" {
+					// knock -> join, retire any outstanding knocks
+					err := c.store.KnocksTable.RemoveKnock(*ed.StateKey, ed.RoomID)
+					if err != nil {
+						logger.Err(err).Str("user", *ed.StateKey).Str("room", ed.RoomID).Msg("failed to remove accepted knock")
+					}
+				}
 			}
 			if len(metadata.Heroes) < 6 && (membership == "join" || membership == "invite") {
 				// try to find the existing hero e.g they changed their display name
@@ -261,19 +464,24 @@ func (c *GlobalCache) OnNewEvent(
 				for i := range metadata.Heroes {
 					if metadata.Heroes[i].ID == *ed.StateKey {
 						metadata.Heroes[i].Name = ed.Content.Get("displayname").Str
+						metadata.Heroes[i].Avatar = ed.Content.Get("avatar_url").Str
 						found = true
 						break
 					}
 				}
 				if !found {
 					metadata.Heroes = append(metadata.Heroes, internal.Hero{
-						ID:   *ed.StateKey,
-						Name: ed.Content.Get("displayname").Str,
+						ID:     *ed.StateKey,
+						Name:   ed.Content.Get("displayname").Str,
+						Avatar: ed.Content.Get("avatar_url").Str,
 					})
 				}
 			}
 		}
 	}
 	metadata.LastMessageTimestamp = ed.Timestamp
+	if internal.IsBumpEventType(ed.EventType) {
+		metadata.LastEventTimestamps[ed.EventType] = ed.Timestamp
+	}
 	c.roomIDToMetadata[ed.RoomID] = metadata
 }
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"reflect"
+	"sort"
 	"testing"
 
+	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
 	"github.com/matrix-org/sync-v3/sync3"
 	"github.com/matrix-org/sync-v3/sync3/caches"
@@ -49,9 +52,10 @@ func TestGlobalCacheLoadState(t *testing.T) {
 	}
 	globalCache := caches.NewGlobalCache(store)
 	testCases := []struct {
-		name          string
-		requiredState [][2]string
-		wantEvents    map[string][]json.RawMessage
+		name                  string
+		requiredState         [][2]string
+		roomToUsersInTimeline map[string][]string
+		wantEvents            map[string][]json.RawMessage
 	}{
 		{
 			name: "single required state returns a single event",
@@ -153,6 +157,53 @@ func TestGlobalCacheLoadState(t *testing.T) {
 				roomID2: {moreEvents[3]},
 			},
 		},
+		{
+			name: "lazy loading returns the members in the timeline for each room",
+			requiredState: [][2]string{
+				{"m.room.create", ""}, {"m.room.member", "$LAZY"},
+			},
+			roomToUsersInTimeline: map[string][]string{
+				roomID:  {bob},
+				roomID2: {charlie},
+			},
+			wantEvents: map[string][]json.RawMessage{
+				roomID:  {events[0], events[3]},
+				roomID2: {moreEvents[0], moreEvents[4]},
+			},
+		},
+		{
+			name: "lazy loading on its own only returns the members in the timeline",
+			requiredState: [][2]string{
+				{"m.room.member", "$LAZY"},
+			},
+			roomToUsersInTimeline: map[string][]string{
+				roomID: {bob},
+			},
+			wantEvents: map[string][]json.RawMessage{
+				roomID: {events[3]},
+			},
+		},
+		{
+			name: "lazy loading with no timeline members returns nothing",
+			requiredState: [][2]string{
+				{"m.room.member", "$LAZY"},
+			},
+			wantEvents: map[string][]json.RawMessage{
+				roomID: {},
+			},
+		},
+		{
+			name: "lazy loading with $ME returns the user's own membership",
+			requiredState: [][2]string{
+				{"m.room.member", "$LAZY"}, {"m.room.member", "$ME"},
+			},
+			roomToUsersInTimeline: map[string][]string{
+				roomID: {bob},
+			},
+			wantEvents: map[string][]json.RawMessage{
+				roomID: {events[1], events[3]},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -163,7 +214,7 @@ func TestGlobalCacheLoadState(t *testing.T) {
 			rs := sync3.RoomSubscription{
 				RequiredState: tc.requiredState,
 			}
-			gotMap := globalCache.LoadRoomState(ctx, roomIDs, latest, rs.RequiredStateMap())
+			gotMap := globalCache.LoadRoomState(ctx, roomIDs, latest, rs.RequiredStateMap(alice), tc.roomToUsersInTimeline)
 			for _, roomID := range roomIDs {
 				got := gotMap[roomID]
 				wantEvents := tc.wantEvents[roomID]
@@ -180,3 +231,47 @@ func TestGlobalCacheLoadState(t *testing.T) {
 		})
 	}
 }
+
+func TestGlobalCacheAncestorSpaces(t *testing.T) {
+	spaceType := "m.space"
+	// A -> B -> C -> room, D -> A, C has a canonical parent E, and B -> A is a cycle.
+	globalCache := caches.NewGlobalCache(nil)
+	err := globalCache.Startup(map[string]internal.RoomMetadata{
+		"!A":    {RoomID: "!A", RoomType: &spaceType, LastMessageTimestamp: 2, ChildSpaceRooms: map[string]struct{}{"!B": {}}},
+		"!B":    {RoomID: "!B", RoomType: &spaceType, LastMessageTimestamp: 2, ChildSpaceRooms: map[string]struct{}{"!C": {}, "!A": {}}},
+		"!C":    {RoomID: "!C", RoomType: &spaceType, LastMessageTimestamp: 2, ChildSpaceRooms: map[string]struct{}{"!room": {}}, CanonicalParentSpace: "!E"},
+		"!D":    {RoomID: "!D", RoomType: &spaceType, LastMessageTimestamp: 2, ChildSpaceRooms: map[string]struct{}{"!A": {}}},
+		"!room": {RoomID: "!room", LastMessageTimestamp: 2},
+	})
+	if err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	testCases := []struct {
+		roomID          string
+		want            []string
+		wantDescendants []string
+	}{
+		{roomID: "!room", want: []string{"!A", "!B", "!C", "!D", "!E"}},
+		{roomID: "!C", want: []string{"!A", "!B", "!D", "!E"}, wantDescendants: []string{"!room"}},
+		{roomID: "!A", want: []string{"!B", "!D"}, wantDescendants: []string{"!B", "!C", "!room"}},
+		{roomID: "!D", want: []string{}, wantDescendants: []string{"!A", "!B", "!C", "!room"}},
+		{roomID: "!E", want: []string{}, wantDescendants: []string{"!C", "!room"}},
+	}
+	for _, tc := range testCases {
+		got := globalCache.AncestorSpaces(tc.roomID)
+		if len(got) != len(tc.want) {
+			t.Errorf("AncestorSpaces(%s) got %v want %v", tc.roomID, got, tc.want)
+			continue
+		}
+		for _, w := range tc.want {
+			if _, ok := got[w]; !ok {
+				t.Errorf("AncestorSpaces(%s) got %v want %v", tc.roomID, got, tc.want)
+			}
+		}
+		gotDescendants := globalCache.Descendants(tc.roomID)
+		sort.Strings(gotDescendants)
+		if !reflect.DeepEqual(gotDescendants, tc.wantDescendants) {
+			t.Errorf("Descendants(%s) got %v want %v", tc.roomID, gotDescendants, tc.wantDescendants)
+		}
+	}
+}
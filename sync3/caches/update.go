@@ -25,10 +25,28 @@ type InviteUpdate struct {
 	InviteData InviteData
 }
 
+type KnockUpdate struct {
+	RoomUpdate
+	KnockData InviteData
+}
+
 type LeftRoomUpdate struct {
 	RoomUpdate
 }
 
+// SpaceGraphUpdate is sent when the parents of a room change, so the spaces this room and the rooms beneath it
+// are in may have changed. It is sent to users joined to any of those rooms, even if they aren't joined to the
+// space which changed.
+type SpaceGraphUpdate struct {
+	RoomID string
+}
+
+// RetiredInviteUpdate is sent when an invite is hidden without the user leaving the room, e.g because
+// the inviter has been ignored. The room should be removed from all lists.
+type RetiredInviteUpdate struct {
+	RoomUpdate
+}
+
 type UnreadCountUpdate struct {
 	RoomUpdate
 	HasCountDecreased bool
@@ -1,6 +1,7 @@
 package caches
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -9,6 +10,7 @@ import (
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
 	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
@@ -18,18 +20,28 @@ const (
 )
 
 type UserRoomData struct {
-	IsDM              bool
-	IsInvite          bool
-	HasLeft           bool
+	IsDM     bool
+	IsInvite bool
+	IsKnock  bool
+	HasLeft  bool
+	// The unread counts for the main timeline. If the upstream server supports threads, these
+	// exclude events in threads, which are tracked in ThreadUnreadCounts instead.
 	NotificationCount int
 	HighlightCount    int
+	// thread root event ID -> unread counts for that thread
+	ThreadUnreadCounts map[string]state.UnreadCounts
 	// (event_id, last_event_id) -> closest prev_batch
 	// We mux in last_event_id so we can invalidate prev batch tokens for the same event ID when a new timeline event
 	// comes in, without having to do a SQL query.
-	PrevBatches       *lru.Cache
-	Timeline          []json.RawMessage
-	Invite            *InviteData
-	CanonicalisedName string // stripped leading symbols like #, all in lower case
+	PrevBatches *lru.Cache
+	Timeline    []json.RawMessage
+	Invite      *InviteData
+	Knock       *InviteData // knock_state is processed in the same way as invite_state
+	// Set if HasLeft and the user was not joined to the room when they left e.g they rejected an invite.
+	// The user may only see the invite or knock in LeftInvite, if there was one.
+	LeftWithoutJoining bool
+	LeftInvite         *InviteData
+	CanonicalisedName  string // stripped leading symbols like #, all in lower case
 	// Set of spaces this room is a part of, from the perspective of this user. This is NOT global room data
 	// as the set of spaces may be different for different users.
 	Spaces map[string]struct{}
@@ -38,6 +50,30 @@ type UserRoomData struct {
 	Tags map[string]float64
 }
 
+// TotalHighlightCount returns the highlight count for this room. Counts from threads are
+// included if includeThreads is true.
+func (u UserRoomData) TotalHighlightCount(includeThreads bool) int {
+	count := u.HighlightCount
+	if includeThreads {
+		for _, c := range u.ThreadUnreadCounts {
+			count += c.HighlightCount
+		}
+	}
+	return count
+}
+
+// TotalNotificationCount returns the notification count for this room. Counts from threads are
+// included if includeThreads is true.
+func (u UserRoomData) TotalNotificationCount(includeThreads bool) int {
+	count := u.NotificationCount
+	if includeThreads {
+		for _, c := range u.ThreadUnreadCounts {
+			count += c.NotificationCount
+		}
+	}
+	return count
+}
+
 func NewUserRoomData() UserRoomData {
 	l, _ := lru.New(64) // 64 tokens least recently used evicted
 	return UserRoomData{
@@ -47,6 +83,17 @@ func NewUserRoomData() UserRoomData {
 	}
 }
 
+// LeftRoomMetadata returns the room metadata which can be shown for a room the user left without joining,
+// which is at most what was in the invite or knock.
+func (u UserRoomData) LeftRoomMetadata(roomID string) *internal.RoomMetadata {
+	if u.LeftInvite != nil {
+		return u.LeftInvite.RoomMetadata()
+	}
+	return &internal.RoomMetadata{
+		RoomID: roomID,
+	}
+}
+
 // fetch the prev batch for this timeline
 func (u UserRoomData) PrevBatch() (string, bool) {
 	if len(u.Timeline) == 0 {
@@ -73,7 +120,7 @@ func (u UserRoomData) SetPrevBatch(eventID string, pb string) {
 	u.PrevBatches.Add(eventID+eventID, pb)
 }
 
-// Subset of data from internal.RoomMetadata which we can glean from invite_state.
+// Subset of data from internal.RoomMetadata which we can glean from invite_state (or knock_state).
 // Processed in the same way as joined rooms!
 type InviteData struct {
 	roomID               string
@@ -81,6 +128,8 @@ type InviteData struct {
 	Heroes               []internal.Hero
 	InviteEvent          *EventData
 	NameEvent            string // the content of m.room.name, NOT the calculated name
+	AvatarEvent          string // the content of m.room.avatar, NOT the calculated avatar
+	Topic                string
 	CanonicalAlias       string
 	LastMessageTimestamp uint64
 	Encrypted            bool
@@ -115,14 +164,19 @@ func NewInviteData(userID, roomID string, inviteState []json.RawMessage) *Invite
 				id.IsDM = j.Get("is_direct").Bool()
 			} else if target == j.Get("sender").Str {
 				id.Heroes = append(id.Heroes, internal.Hero{
-					ID:   target,
-					Name: j.Get("content.displayname").Str,
+					ID:     target,
+					Name:   j.Get("content.displayname").Str,
+					Avatar: j.Get("content.avatar_url").Str,
 				})
 			}
 		case "m.room.name":
 			id.NameEvent = j.Get("content.name").Str
 		case "m.room.canonical_alias":
 			id.CanonicalAlias = j.Get("content.alias").Str
+		case "m.room.avatar":
+			id.AvatarEvent = j.Get("content.url").Str
+		case "m.room.topic":
+			id.Topic = j.Get("content.topic").Str
 		case "m.room.encryption":
 			id.Encrypted = true
 		}
@@ -141,6 +195,8 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 		RoomID:               i.roomID,
 		Heroes:               i.Heroes,
 		NameEvent:            i.NameEvent,
+		AvatarEvent:          i.AvatarEvent,
+		Topic:                i.Topic,
 		CanonicalAlias:       i.CanonicalAlias,
 		InviteCount:          1,
 		JoinCount:            1,
@@ -163,31 +219,82 @@ type UserCacheListener interface {
 type UserCache struct {
 	LazyRoomDataOverride func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData
 	UserID               string
-	roomToData           map[string]UserRoomData
-	roomToDataMu         *sync.RWMutex
-	listeners            map[int]UserCacheListener
-	listenersMu          *sync.Mutex
-	id                   int
-	store                *state.Storage
-	globalCache          *GlobalCache
-	txnIDs               sync2.TransactionIDFetcher
-	latestPos            int64
+	// The base URL of the user's homeserver if requests are routed to several homeservers, so prev_batch
+	// tokens from other homeservers are not returned. Empty if there is a single upstream.
+	Upstream     string
+	roomToData   map[string]UserRoomData
+	roomToDataMu *sync.RWMutex
+	listeners    map[int]UserCacheListener
+	listenersMu  *sync.Mutex
+	id           int
+	store        *state.Storage
+	globalCache  *GlobalCache
+	txnIDs       sync2.TransactionIDFetcher
+	latestPos    int64
+	// set of users in m.ignored_user_list
+	ignoredUsers   map[string]struct{}
+	ignoredUsersMu *sync.RWMutex
+	// logs with the user ID so they can be correlated with requests and pollers for this user
+	logger zerolog.Logger
 }
 
 func NewUserCache(userID string, globalCache *GlobalCache, store *state.Storage, txnIDs sync2.TransactionIDFetcher) *UserCache {
 	uc := &UserCache{
-		UserID:       userID,
-		roomToDataMu: &sync.RWMutex{},
-		roomToData:   make(map[string]UserRoomData),
-		listeners:    make(map[int]UserCacheListener),
-		listenersMu:  &sync.Mutex{},
-		store:        store,
-		globalCache:  globalCache,
-		txnIDs:       txnIDs,
+		UserID:         userID,
+		roomToDataMu:   &sync.RWMutex{},
+		roomToData:     make(map[string]UserRoomData),
+		listeners:      make(map[int]UserCacheListener),
+		ignoredUsers:   make(map[string]struct{}),
+		ignoredUsersMu: &sync.RWMutex{},
+		listenersMu:    &sync.Mutex{},
+		store:          store,
+		globalCache:    globalCache,
+		txnIDs:         txnIDs,
+		logger:         logger.With().Str("u", userID).Logger(),
 	}
 	return uc
 }
 
+// ShouldIgnore returns true if this user is in the m.ignored_user_list for this user.
+func (c *UserCache) ShouldIgnore(userID string) bool {
+	c.ignoredUsersMu.RLock()
+	defer c.ignoredUsersMu.RUnlock()
+	_, ignored := c.ignoredUsers[userID]
+	return ignored
+}
+
+// filterIgnoredEvents returns the events which were not sent by ignored users. The input slice is not
+// modified, as it may be a cached timeline.
+func (c *UserCache) filterIgnoredEvents(events []json.RawMessage) []json.RawMessage {
+	var filtered []json.RawMessage
+	for i, ev := range events {
+		if c.ShouldIgnore(gjson.GetBytes(ev, "sender").Str) {
+			if filtered == nil {
+				filtered = append(make([]json.RawMessage, 0, len(events)), events[:i]...)
+			}
+			continue
+		}
+		if filtered != nil {
+			filtered = append(filtered, ev)
+		}
+	}
+	if filtered == nil {
+		return events
+	}
+	return filtered
+}
+
+// filterTimeline returns a copy of the room data with events from ignored users removed from the
+// timeline. The prev batch token of the unfiltered timeline is kept.
+func (c *UserCache) filterTimeline(urd UserRoomData) UserRoomData {
+	prevBatch, hasPrevBatch := urd.PrevBatch()
+	urd.Timeline = c.filterIgnoredEvents(urd.Timeline)
+	if hasPrevBatch && len(urd.Timeline) > 0 {
+		urd.SetPrevBatch(gjson.GetBytes(urd.Timeline[0], "event_id").Str, prevBatch)
+	}
+	return urd
+}
+
 func (c *UserCache) Subsribe(ucl UserCacheListener) (id int) {
 	c.listenersMu.Lock()
 	defer c.listenersMu.Unlock()
@@ -260,7 +367,7 @@ func (c *UserCache) OnRegistered(_ int64) error {
 	return nil
 }
 
-func (c *UserCache) LazyLoadTimelines(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData {
+func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData {
 	if c.LazyRoomDataOverride != nil {
 		return c.LazyRoomDataOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
@@ -293,9 +400,9 @@ func (c *UserCache) LazyLoadTimelines(loadPos int64, roomIDs []string, maxTimeli
 					_, ok := urd.PrevBatch()
 					if !ok {
 						eventID := gjson.ParseBytes(timeline[0]).Get("event_id").Str
-						prevBatch, err := c.store.EventsTable.SelectClosestPrevBatchByID(roomID, eventID)
+						prevBatch, err := c.store.ClosestPrevBatchByID(c.Upstream, roomID, eventID)
 						if err != nil {
-							logger.Err(err).Str("room", roomID).Str("event_id", eventID).Msg("failed to get prev batch token for room")
+							c.logger.Err(err).Str("room", roomID).Str("event_id", eventID).Msg("failed to get prev batch token for room")
 						}
 						urd.SetPrevBatch(eventID, prevBatch)
 					}
@@ -305,9 +412,10 @@ func (c *UserCache) LazyLoadTimelines(loadPos int64, roomIDs []string, maxTimeli
 				u := NewUserRoomData()
 				u.NotificationCount = urd.NotificationCount
 				u.HighlightCount = urd.HighlightCount
+				u.ThreadUnreadCounts = urd.ThreadUnreadCounts
 				u.Timeline = timeline
 				u.PrevBatches = urd.PrevBatches
-				result[roomID] = u
+				result[roomID] = c.filterTimeline(u)
 			} else {
 				// refetch from the db
 				lazyRoomIDs = append(lazyRoomIDs, roomID)
@@ -322,9 +430,9 @@ func (c *UserCache) LazyLoadTimelines(loadPos int64, roomIDs []string, maxTimeli
 	if len(lazyRoomIDs) == 0 {
 		return result
 	}
-	roomIDToEvents, roomIDToPrevBatch, err := c.store.LatestEventsInRooms(c.UserID, lazyRoomIDs, loadPos, maxTimelineEvents)
+	roomIDToEvents, roomIDToPrevBatch, err := c.store.LatestEventsInRooms(ctx, c.UserID, c.Upstream, lazyRoomIDs, loadPos, maxTimelineEvents)
 	if err != nil {
-		logger.Err(err).Strs("rooms", lazyRoomIDs).Msg("failed to get LatestEventsInRooms")
+		c.logger.Err(err).Strs("rooms", lazyRoomIDs).Msg("failed to get LatestEventsInRooms")
 		return nil
 	}
 	c.roomToDataMu.Lock()
@@ -333,19 +441,40 @@ func (c *UserCache) LazyLoadTimelines(loadPos int64, roomIDs []string, maxTimeli
 		if !ok {
 			urd = NewUserRoomData()
 		}
+		// cache the unfiltered timeline so it stays as long as the limit, then filter what we return
 		urd.Timeline = events
 		if len(events) > 0 {
 			eventID := gjson.ParseBytes(events[0]).Get("event_id").Str
 			urd.SetPrevBatch(eventID, roomIDToPrevBatch[roomID])
 		}
-
-		result[roomID] = urd
 		c.roomToData[roomID] = urd
+		result[roomID] = c.filterTimeline(urd)
 	}
 	c.roomToDataMu.Unlock()
 	return result
 }
 
+// LoadPreviewTimelines loads timelines for rooms the user is previewing but not joined to. The returned
+// data is not cached as the user has no membership in these rooms.
+func (c *UserCache) LoadPreviewTimelines(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData {
+	result := make(map[string]UserRoomData, len(roomIDs))
+	roomIDToEvents, roomIDToPrevBatch, err := c.store.PreviewEventsInRooms(c.Upstream, roomIDs, loadPos, maxTimelineEvents)
+	if err != nil {
+		c.logger.Err(err).Strs("rooms", roomIDs).Msg("failed to get PreviewEventsInRooms")
+		return result
+	}
+	for roomID, events := range roomIDToEvents {
+		urd := NewUserRoomData()
+		urd.Timeline = c.filterIgnoredEvents(events)
+		if len(urd.Timeline) > 0 {
+			eventID := gjson.ParseBytes(urd.Timeline[0]).Get("event_id").Str
+			urd.SetPrevBatch(eventID, roomIDToPrevBatch[roomID])
+		}
+		result[roomID] = urd
+	}
+	return result
+}
+
 func (c *UserCache) LoadRoomData(roomID string) UserRoomData {
 	c.roomToDataMu.RLock()
 	defer c.roomToDataMu.RUnlock()
@@ -380,7 +509,7 @@ func (c *UserCache) newRoomUpdate(roomID string) RoomUpdate {
 	if globalRooms == nil || globalRooms[roomID] == nil {
 		// this can happen when we join a room we didn't know about because we process unread counts
 		// before the timeline events. Warn and send a stub
-		logger.Warn().Str("room", roomID).Msg("UserCache update: room doesn't exist in global cache yet, generating stub")
+		c.logger.Warn().Str("room", roomID).Msg("UserCache update: room doesn't exist in global cache yet, generating stub")
 		r = &internal.RoomMetadata{
 			RoomID: roomID,
 		}
@@ -408,6 +537,40 @@ func (c *UserCache) Invites() map[string]UserRoomData {
 	return invites
 }
 
+// Knocks returns the rooms this user has knocked on and is waiting for a response.
+func (c *UserCache) Knocks() map[string]UserRoomData {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	knocks := make(map[string]UserRoomData)
+	for roomID, urd := range c.roomToData {
+		if !urd.IsKnock || urd.Knock == nil {
+			continue
+		}
+		knocks[roomID] = urd
+	}
+	return knocks
+}
+
+// LeftRooms returns the rooms this user has left.
+func (c *UserCache) LeftRooms() map[string]UserRoomData {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	leftRooms := make(map[string]UserRoomData)
+	for roomID, urd := range c.roomToData {
+		if !urd.HasLeft {
+			continue
+		}
+		leftRooms[roomID] = urd
+	}
+	return leftRooms
+}
+
+// LeftRoomState returns the state of these rooms at the point the user left them. Rooms the user
+// was not joined to when they left are not included.
+func (c *UserCache) LeftRoomState(ctx context.Context, roomIDs []string) (map[string][]json.RawMessage, error) {
+	return c.store.LeftRoomState(ctx, c.UserID, roomIDs)
+}
+
 // AnnotateWithTransactionIDs should be called just prior to returning events to the client. This
 // will modify the events to insert the correct transaction IDs if needed. This is required because
 // events are globally scoped, so if Alice sends a message, Bob might receive it first on his v2 loop
@@ -420,7 +583,7 @@ func (c *UserCache) AnnotateWithTransactionIDs(events []json.RawMessage) []json.
 		if txnID != "" {
 			newJSON, err := sjson.SetBytes(events[i], "unsigned.transaction_id", txnID)
 			if err != nil {
-				logger.Err(err).Str("user", c.UserID).Msg("AnnotateWithTransactionIDs: sjson failed")
+				c.logger.Err(err).Msg("AnnotateWithTransactionIDs: sjson failed")
 			} else {
 				events[i] = newJSON
 			}
@@ -433,19 +596,22 @@ func (c *UserCache) AnnotateWithTransactionIDs(events []json.RawMessage) []json.
 // Listener functions called by v2 pollers are below
 // =================================================
 
-func (c *UserCache) OnUnreadCounts(roomID string, highlightCount, notifCount *int) {
+func (c *UserCache) OnUnreadCounts(roomID string, highlightCount, notifCount *int, threadCounts map[string]state.UnreadCounts) {
 	data := c.LoadRoomData(roomID)
-	hasCountDecreased := false
+	prevHighlightCount := data.TotalHighlightCount(true)
+	prevNotifCount := data.TotalNotificationCount(true)
 	if highlightCount != nil {
-		hasCountDecreased = *highlightCount < data.HighlightCount
 		data.HighlightCount = *highlightCount
 	}
 	if notifCount != nil {
-		if !hasCountDecreased {
-			hasCountDecreased = *notifCount < data.NotificationCount
-		}
 		data.NotificationCount = *notifCount
 	}
+	// a nil map means the thread counts were not sent so are unchanged
+	if threadCounts != nil {
+		data.ThreadUnreadCounts = threadCounts
+	}
+	hasCountDecreased := data.TotalHighlightCount(true) < prevHighlightCount ||
+		data.TotalNotificationCount(true) < prevNotifCount
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = data
 	c.roomToDataMu.Unlock()
@@ -460,6 +626,17 @@ func (c *UserCache) OnUnreadCounts(roomID string, highlightCount, notifCount *in
 	}
 }
 
+// OnSpaceGraphChanged is called when the parents of a room change, for a room which this user is joined to or
+// which is beneath a room they are joined to.
+func (c *UserCache) OnSpaceGraphChanged(roomID string) {
+	up := &SpaceGraphUpdate{
+		RoomID: roomID,
+	}
+	for _, l := range c.listeners {
+		l.OnUpdate(up)
+	}
+}
+
 func (c *UserCache) OnSpaceUpdate(parentRoomID, childRoomID string, isDeleted bool, eventData *EventData) {
 	if eventData.LatestPos > 0 && eventData.LatestPos < c.latestPos {
 		// this is possible when we race when seeding spaces on init with live data
@@ -487,12 +664,27 @@ func (c *UserCache) OnSpaceUpdate(parentRoomID, childRoomID string, isDeleted bo
 }
 
 func (c *UserCache) OnNewEvent(eventData *EventData) {
+	// messages from ignored users are never sent to listeners. State events still need to be processed as they
+	// may change the room. Events from ignored users are filtered from the timeline when it is loaded.
+	isIgnored := c.ShouldIgnore(gjson.GetBytes(eventData.Event, "sender").Str)
+	if eventData.IsPreview {
+		if !isIgnored || eventData.StateKey != nil {
+			c.onPreviewEvent(eventData)
+		}
+		return
+	}
 	// add this to our tracked timelines if we have one
 	urd := c.LoadRoomData(eventData.RoomID)
 	if len(urd.Timeline) > 0 {
 		// we're tracking timelines, add this message too
 		urd.Timeline = append(urd.Timeline, eventData.Event)
 	}
+	if isIgnored && eventData.StateKey == nil {
+		c.roomToDataMu.Lock()
+		c.roomToData[eventData.RoomID] = urd
+		c.roomToDataMu.Unlock()
+		return
+	}
 	// reset the IsInvite field when the user actually joins/rejects the invite
 	if urd.IsInvite && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
 		urd.IsInvite = eventData.Content.Get("membership").Str == "invite"
@@ -500,6 +692,21 @@ func (c *UserCache) OnNewEvent(eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	// reset the IsKnock field when the user is let in
+	if urd.IsKnock && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		urd.IsKnock = eventData.Content.Get("membership").Str == "knock"
+		if !urd.IsKnock {
+			urd.Knock = nil
+		}
+	}
+	// reset the HasLeft field when the user rejoins the room
+	if urd.HasLeft && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		urd.HasLeft = eventData.Content.Get("membership").Str != "join"
+		if !urd.HasLeft {
+			urd.LeftWithoutJoining = false
+			urd.LeftInvite = nil
+		}
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
@@ -520,14 +727,45 @@ func (c *UserCache) OnNewEvent(eventData *EventData) {
 	}
 }
 
+// onPreviewEvent notifies listeners about an event in a room the user is previewing. The user has no
+// membership in the room so none of their per-room data is touched.
+func (c *UserCache) onPreviewEvent(eventData *EventData) {
+	metadata := &internal.RoomMetadata{
+		RoomID: eventData.RoomID,
+	}
+	if globalRooms := c.globalCache.LoadRooms(eventData.RoomID); globalRooms[eventData.RoomID] != nil {
+		metadata = globalRooms[eventData.RoomID]
+	}
+	urd := NewUserRoomData()
+	update := &RoomEventUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID:         eventData.RoomID,
+			globalRoomData: metadata,
+			userRoomData:   &urd,
+		},
+		EventData: eventData,
+	}
+	for _, l := range c.listeners {
+		l.OnRoomUpdate(update)
+	}
+}
+
 func (c *UserCache) OnInvite(roomID string, inviteStateEvents []json.RawMessage) {
 	inviteData := NewInviteData(c.UserID, roomID, inviteStateEvents)
 	if inviteData == nil {
 		return // malformed invite
 	}
+	if c.ShouldIgnore(gjson.GetBytes(inviteData.InviteEvent.Event, "sender").Str) {
+		return // invites from ignored users are never shown
+	}
 
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = true
+	urd.IsKnock = false
+	urd.Knock = nil
+	urd.HasLeft = false
+	urd.LeftWithoutJoining = false
+	urd.LeftInvite = nil
 	urd.HighlightCount = InvitesAreHighlightsValue
 	urd.IsDM = inviteData.IsDM
 	urd.Invite = inviteData
@@ -550,21 +788,112 @@ func (c *UserCache) OnInvite(roomID string, inviteStateEvents []json.RawMessage)
 	}
 }
 
-func (c *UserCache) OnLeftRoom(roomID string) {
+func (c *UserCache) OnKnock(roomID string, knockStateEvents []json.RawMessage) {
+	knockData := NewInviteData(c.UserID, roomID, knockStateEvents)
+	if knockData == nil {
+		return // malformed knock
+	}
+
 	urd := c.LoadRoomData(roomID)
+	urd.IsKnock = true
+	urd.HasLeft = false
+	urd.LeftWithoutJoining = false
+	urd.LeftInvite = nil
+	urd.Knock = knockData
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = urd
+	c.roomToDataMu.Unlock()
+
+	up := &KnockUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID: roomID,
+			// do NOT pull from the global cache as the user isn't joined to the room yet
+			globalRoomData: knockData.RoomMetadata(),
+			userRoomData:   &urd,
+		},
+		KnockData: *knockData,
+	}
+	for _, l := range c.listeners {
+		l.OnRoomUpdate(up)
+	}
+}
+
+// MarkLeftRooms flags these rooms as left without notifying listeners. Used when loading the cache.
+func (c *UserCache) MarkLeftRooms(leftRooms map[string]state.LeftRoom) {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for roomID, leftRoom := range leftRooms {
+		urd, ok := c.roomToData[roomID]
+		if !ok {
+			urd = NewUserRoomData()
+		}
+		urd.HasLeft = true
+		urd.LeftWithoutJoining = leftRoom.SnapshotID == 0
+		urd.LeftInvite = nil
+		if urd.LeftWithoutJoining && leftRoom.StrippedState != nil {
+			urd.LeftInvite = NewInviteData(c.UserID, roomID, leftRoom.StrippedState)
+		}
+		c.roomToData[roomID] = urd
+	}
+}
+
+// OnLeftRoom is called when the user leaves the room. If the user was not joined to the room, e.g they
+// rejected an invite, then only the invite or knock is retained and the room metadata is not loaded.
+func (c *UserCache) OnLeftRoom(roomID string, wasJoined bool) {
+	urd := c.LoadRoomData(roomID)
+	urd.LeftWithoutJoining = !wasJoined
+	urd.LeftInvite = nil
+	if !wasJoined {
+		if urd.Invite != nil {
+			urd.LeftInvite = urd.Invite
+		} else if urd.Knock != nil {
+			urd.LeftInvite = urd.Knock
+		}
+	}
 	urd.IsInvite = false
+	urd.IsKnock = false
 	urd.HasLeft = true
 	urd.Invite = nil
+	urd.Knock = nil
 	urd.HighlightCount = 0
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
 	c.roomToDataMu.Unlock()
 
+	var roomUpdate RoomUpdate
+	if !wasJoined {
+		roomUpdate = &roomUpdateCache{
+			roomID: roomID,
+			// do NOT pull from the global cache as the user was never joined: don't leak additional data!!!
+			globalRoomData: urd.LeftRoomMetadata(roomID),
+			userRoomData:   &urd,
+		}
+	} else {
+		// the user was joined so is allowed to see the room metadata up to this point
+		roomUpdate = c.newRoomUpdate(roomID)
+	}
 	up := &LeftRoomUpdate{
+		RoomUpdate: roomUpdate,
+	}
+	for _, l := range c.listeners {
+		l.OnRoomUpdate(up)
+	}
+}
+
+// retireInvite removes the invite for this room without marking the room as left.
+func (c *UserCache) retireInvite(roomID string) {
+	urd := c.LoadRoomData(roomID)
+	urd.IsInvite = false
+	urd.Invite = nil
+	urd.HighlightCount = 0
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = urd
+	c.roomToDataMu.Unlock()
+
+	up := &RetiredInviteUpdate{
 		RoomUpdate: &roomUpdateCache{
 			roomID: roomID,
-			// do NOT pull from the global cache as it is a snapshot of the room at the point of
-			// the invite: don't leak additional data!!!
+			// do NOT pull from the global cache as the user was only invited: don't leak additional data!!!
 			globalRoomData: &internal.RoomMetadata{
 				RoomID: roomID,
 			},
@@ -576,6 +905,56 @@ func (c *UserCache) OnLeftRoom(roomID string) {
 	}
 }
 
+// onIgnoredUserList replaces the set of ignored users and re-filters any cached data which may be affected.
+func (c *UserCache) onIgnoredUserList(ignoredUsers gjson.Result) {
+	newIgnoredUsers := make(map[string]struct{})
+	ignoredUsers.ForEach(func(k, _ gjson.Result) bool {
+		newIgnoredUsers[k.Str] = struct{}{}
+		return true
+	})
+	c.ignoredUsersMu.Lock()
+	hasUnignored := false
+	for userID := range c.ignoredUsers {
+		if _, exists := newIgnoredUsers[userID]; !exists {
+			hasUnignored = true
+			break
+		}
+	}
+	c.ignoredUsers = newIgnoredUsers
+	c.ignoredUsersMu.Unlock()
+
+	// Cached timelines are unfiltered, so events from newly ignored or unignored users are filtered
+	// correctly when the timelines are next loaded.
+	var retiredInvites []string
+	c.roomToDataMu.RLock()
+	for roomID, urd := range c.roomToData {
+		if urd.IsInvite && urd.Invite != nil && c.ShouldIgnore(gjson.GetBytes(urd.Invite.InviteEvent.Event, "sender").Str) {
+			retiredInvites = append(retiredInvites, roomID)
+		}
+	}
+	c.roomToDataMu.RUnlock()
+
+	// hide invites from newly ignored users. The user hasn't left these rooms, so don't mark them as left.
+	for _, roomID := range retiredInvites {
+		c.retireInvite(roomID)
+	}
+
+	// bring back invites from users who are no longer ignored
+	if hasUnignored && c.store != nil {
+		invites, err := c.store.InvitesTable.SelectAllInvitesForUser(c.UserID)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to reload invites after ignored user list changed")
+			return
+		}
+		for roomID, inviteState := range invites {
+			if c.LoadRoomData(roomID).IsInvite {
+				continue
+			}
+			c.OnInvite(roomID, inviteState)
+		}
+	}
+}
+
 func (c *UserCache) OnAccountData(datas []state.AccountData) {
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
@@ -609,6 +988,8 @@ func (c *UserCache) OnAccountData(datas []state.AccountData) {
 				c.roomToData[dmRoomID] = u
 			}
 			c.roomToDataMu.Unlock()
+		} else if d.Type == "m.ignored_user_list" && d.RoomID == state.AccountDataGlobalRoom {
+			c.onIgnoredUserList(gjson.ParseBytes(d.Data).Get("content.ignored_users"))
 		} else if d.Type == "m.tag" {
 			content := gjson.ParseBytes(d.Data).Get("content.tags")
 			if tagUpdates[d.RoomID] == nil {
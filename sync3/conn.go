@@ -2,9 +2,12 @@ package sync3
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/matrix-org/sync-v3/internal"
 )
@@ -25,6 +28,9 @@ type ConnHandler interface {
 	UserID() string
 	Destroy()
 	Alive() bool
+	// Snapshot returns the state of the connection after the last call to OnIncomingRequest.
+	// The Pos is filled in by the Conn.
+	Snapshot() ConnSnapshot
 }
 
 // Conn is an abstraction of a long-poll connection. It automatically handles the position values
@@ -47,20 +53,63 @@ type Conn struct {
 	// - Everything after that is new and unseen, and the first element is the one we want to return.
 	serverResponses []Response
 	lastPos         int64
+	// the position this connection was resumed from, which is accepted despite not being in serverResponses.
+	// Cleared once a response has been sent.
+	resumedPos int64
 
 	// ensure only 1 incoming request is handled per connection
 	mu                       *sync.Mutex
 	cancelOutstandingRequest func()
+
+	// the serialised ConnSnapshot as of the last response, guarded by snapshotMu as it is read
+	// whilst other requests may be in-flight.
+	snapshot   []byte
+	snapshotMu *sync.Mutex
+
+	// unix nanoseconds of the last incoming request, accessed atomically
+	lastRequestNano int64
+
+	// set to 1 when this connection is removed from the ConnMap, accessed atomically
+	closed int32
 }
 
 func NewConn(connID ConnID, h ConnHandler) *Conn {
 	return &Conn{
-		ConnID:  connID,
-		handler: h,
-		mu:      &sync.Mutex{},
+		ConnID:          connID,
+		handler:         h,
+		mu:              &sync.Mutex{},
+		snapshotMu:      &sync.Mutex{},
+		lastRequestNano: time.Now().UnixNano(),
 	}
 }
 
+// Resume this connection from the given position, which was sent to the client by a previous Conn with
+// the same ConnID. The next request with this position will be processed rather than rejected.
+func (c *Conn) Resume(pos int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPos = pos
+	c.resumedPos = pos
+}
+
+// Snapshot returns the serialised ConnSnapshot as of the last response, or nil if no response has been sent.
+func (c *Conn) Snapshot() []byte {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	return c.snapshot
+}
+
+// LastRequestTime returns when the client last made a request on this connection.
+func (c *Conn) LastRequestTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastRequestNano))
+}
+
+// Closed returns true if this connection has been removed from the ConnMap, after which it can never
+// be used again.
+func (c *Conn) Closed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
 func (c *Conn) UserID() string {
 	return c.handler.UserID()
 }
@@ -91,6 +140,7 @@ func (c *Conn) isOutstanding(pos int64) bool {
 
 // OnIncomingRequest advances the clients position in the stream, returning the response position and data.
 func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Response, herr *internal.HandlerError) {
+	atomic.StoreInt64(&c.lastRequestNano, time.Now().UnixNano())
 	if c.cancelOutstandingRequest != nil {
 		c.cancelOutstandingRequest()
 	}
@@ -104,15 +154,17 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 	isFirstRequest := req.pos == 0
 	isRetransmit := !isFirstRequest && c.lastClientRequest.pos == req.pos
 	isSameRequest := !isFirstRequest && c.lastClientRequest.Same(req)
+	isResumed := !isFirstRequest && c.resumedPos == req.pos
 
 	// if there is a position and it isn't something we've told the client nor a retransmit, they
 	// are playing games
-	if !isFirstRequest && !isRetransmit && !c.isOutstanding(req.pos) {
+	if !isFirstRequest && !isRetransmit && !isResumed && !c.isOutstanding(req.pos) {
 		// the client made up a position, reject them
 		logger.Trace().Int64("pos", req.pos).Msg("unknown pos")
 		return nil, &internal.HandlerError{
 			StatusCode: 400,
 			Err:        fmt.Errorf("unknown position: %d", req.pos),
+			ErrCode:    internal.ErrCodeUnknownPos,
 		}
 	}
 
@@ -184,12 +236,14 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 	// assign the last client request now _after_ we have processed the request so we don't incorrectly
 	// cache errors or panics and result in getting wedged or tightlooping.
 	c.lastClientRequest = *req
+	c.resumedPos = 0
 	// this position is the highest stored pos +1
 	resp.Pos = fmt.Sprintf("%d", c.lastPos+1)
 	resp.TxnID = req.TxnID
 	// buffer it
 	c.serverResponses = append(c.serverResponses, *resp)
 	c.lastPos = resp.PosInt()
+	c.takeSnapshot()
 	if nextUnACKedResponse == nil {
 		nextUnACKedResponse = resp
 	}
@@ -197,3 +251,18 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 	// return the oldest value
 	return nextUnACKedResponse, nil
 }
+
+// takeSnapshot serialises the state of the connection. Must be called with c.mu held, as the handler
+// may otherwise be modifying its state.
+func (c *Conn) takeSnapshot() {
+	snapshot := c.handler.Snapshot()
+	snapshot.Pos = c.lastPos
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		logger.Err(err).Str("conn", c.ConnID.String()).Msg("failed to serialise connection snapshot")
+		return
+	}
+	c.snapshotMu.Lock()
+	c.snapshot = data
+	c.snapshotMu.Unlock()
+}
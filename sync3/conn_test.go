@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"strconv"
 	"sync"
@@ -23,6 +24,9 @@ func (c *connHandlerMock) UserID() string {
 }
 func (c *connHandlerMock) Destroy()    {}
 func (c *connHandlerMock) Alive() bool { return true }
+func (c *connHandlerMock) Snapshot() ConnSnapshot {
+	return ConnSnapshot{UserID: "dummy"}
+}
 
 // Test that Conn can send and receive requests based on positions
 func TestConn(t *testing.T) {
@@ -34,8 +38,8 @@ func TestConn(t *testing.T) {
 	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
 		count += 1
 		return &Response{
-			Lists: []ResponseList{
-				{
+			Lists: map[string]ResponseList{
+				"a": {
 					Count: count,
 				},
 			},
@@ -48,14 +52,14 @@ func TestConn(t *testing.T) {
 	})
 	assertNoError(t, err)
 	assertPos(t, resp.Pos, 1)
-	assertInt(t, resp.Lists[0].Count, 101)
+	assertInt(t, resp.Lists["a"].Count, 101)
 
 	// happy case, pos=1
 	resp, err = c.OnIncomingRequest(ctx, &Request{
 		pos: 1,
 	})
 	assertPos(t, resp.Pos, 2)
-	assertInt(t, resp.Lists[0].Count, 102)
+	assertInt(t, resp.Lists["a"].Count, 102)
 	assertNoError(t, err)
 	// bogus position returns a 400
 	_, err = c.OnIncomingRequest(ctx, &Request{
@@ -80,10 +84,10 @@ func TestConnBlocking(t *testing.T) {
 	}
 	ch := make(chan string)
 	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
-		if req.Lists[0].Sort[0] == "hi" {
+		if req.Lists["a"].Sort[0] == "hi" {
 			time.Sleep(10 * time.Millisecond)
 		}
-		ch <- req.Lists[0].Sort[0]
+		ch <- req.Lists["a"].Sort[0]
 		return &Response{}, nil
 	}})
 
@@ -95,8 +99,8 @@ func TestConnBlocking(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		c.OnIncomingRequest(ctx, &Request{
-			Lists: []RequestList{
-				{
+			Lists: map[string]RequestList{
+				"a": {
 					Sort: []string{"hi"},
 				},
 			},
@@ -106,8 +110,8 @@ func TestConnBlocking(t *testing.T) {
 		defer wg.Done()
 		time.Sleep(1 * time.Millisecond) // this req happens 2nd
 		c.OnIncomingRequest(ctx, &Request{
-			Lists: []RequestList{
-				{
+			Lists: map[string]RequestList{
+				"a": {
 					Sort: []string{"hi2"},
 				},
 			},
@@ -135,37 +139,37 @@ func TestConnRetries(t *testing.T) {
 	callCount := 0
 	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
 		callCount += 1
-		return &Response{Lists: []ResponseList{
-			{
+		return &Response{Lists: map[string]ResponseList{
+			"a": {
 				Count: 20,
 			},
 		}}, nil
 	}})
 	resp, err := c.OnIncomingRequest(ctx, &Request{})
 	assertPos(t, resp.Pos, 1)
-	assertInt(t, resp.Lists[0].Count, 20)
+	assertInt(t, resp.Lists["a"].Count, 20)
 	assertInt(t, callCount, 1)
 	assertNoError(t, err)
 	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1})
 	assertPos(t, resp.Pos, 2)
-	assertInt(t, resp.Lists[0].Count, 20)
+	assertInt(t, resp.Lists["a"].Count, 20)
 	assertInt(t, callCount, 2)
 	assertNoError(t, err)
 	// retry! Shouldn't invoke handler again
 	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1})
 	assertPos(t, resp.Pos, 2)
-	assertInt(t, resp.Lists[0].Count, 20)
+	assertInt(t, resp.Lists["a"].Count, 20)
 	assertInt(t, callCount, 2) // this doesn't increment
 	assertNoError(t, err)
 	// retry! but with modified request body, so should invoke handler again but return older data (buffered)
 	resp, err = c.OnIncomingRequest(ctx, &Request{
-		pos: 1, Lists: []RequestList{
-			{
+		pos: 1, Lists: map[string]RequestList{
+			"a": {
 				Sort: []string{SortByName},
 			},
 		}})
 	assertPos(t, resp.Pos, 2)
-	assertInt(t, resp.Lists[0].Count, 20)
+	assertInt(t, resp.Lists["a"].Count, 20)
 	assertInt(t, callCount, 3) // this doesn't increment
 	assertNoError(t, err)
 }
@@ -178,8 +182,8 @@ func TestConnBufferRes(t *testing.T) {
 	callCount := 0
 	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
 		callCount += 1
-		return &Response{Lists: []ResponseList{
-			{
+		return &Response{Lists: map[string]ResponseList{
+			"a": {
 				Count: callCount,
 			},
 		}}, nil
@@ -187,24 +191,24 @@ func TestConnBufferRes(t *testing.T) {
 	resp, err := c.OnIncomingRequest(ctx, &Request{})
 	assertNoError(t, err)
 	assertPos(t, resp.Pos, 1)
-	assertInt(t, resp.Lists[0].Count, 1)
+	assertInt(t, resp.Lists["a"].Count, 1)
 	assertInt(t, callCount, 1)
 	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1})
 	assertNoError(t, err)
 	assertPos(t, resp.Pos, 2)
-	assertInt(t, resp.Lists[0].Count, 2)
+	assertInt(t, resp.Lists["a"].Count, 2)
 	assertInt(t, callCount, 2)
 	// retry with modified request data, should invoke handler again!
 	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "a"})
 	assertNoError(t, err)
 	assertPos(t, resp.Pos, 2)
-	assertInt(t, resp.Lists[0].Count, 2)
+	assertInt(t, resp.Lists["a"].Count, 2)
 	assertInt(t, callCount, 3) // this DOES increment, the response is buffered and not returned yet.
 	// retry with same request body, so should NOT invoke handler again and return buffered response
 	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 2, TxnID: "a"})
 	assertNoError(t, err)
 	assertPos(t, resp.Pos, 3)
-	assertInt(t, resp.Lists[0].Count, 3)
+	assertInt(t, resp.Lists["a"].Count, 3)
 	assertInt(t, callCount, 3)
 }
 
@@ -281,8 +285,8 @@ func TestConnBufferRememberInflight(t *testing.T) {
 	callCount := 0
 	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
 		callCount += 1
-		return &Response{Lists: []ResponseList{
-			{
+		return &Response{Lists: map[string]ResponseList{
+			"a": {
 				Count: callCount,
 			},
 		}}, nil
@@ -358,11 +362,60 @@ func TestConnBufferRememberInflight(t *testing.T) {
 			assertNoError(t, err)
 		}
 		assertPos(t, resp.Pos, step.wantResPos)
-		assertInt(t, resp.Lists[0].Count, step.wantResCount)
+		assertInt(t, resp.Lists["a"].Count, step.wantResCount)
 		assertInt(t, callCount, step.wantCallCount)
 	}
 }
 
+// Test that a resumed Conn accepts the position it was resumed from, carries on from that position
+// and snapshots its state after each response.
+func TestConnResume(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	isInitialCalls := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		if isInitial {
+			isInitialCalls++
+		}
+		return &Response{}, nil
+	}})
+	if c.Snapshot() != nil {
+		t.Fatalf("Snapshot: got %s before any responses, want nil", string(c.Snapshot()))
+	}
+	c.Resume(5)
+
+	// unknown positions are still rejected
+	_, err := c.OnIncomingRequest(ctx, &Request{pos: 4})
+	if err == nil || err.StatusCode != 400 {
+		t.Fatalf("OnIncomingRequest with unknown pos: got %v want 400", err)
+	}
+
+	resp, err := c.OnIncomingRequest(ctx, &Request{pos: 5})
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 6)
+	assertInt(t, isInitialCalls, 0)
+
+	var snapshot ConnSnapshot
+	if err := json.Unmarshal(c.Snapshot(), &snapshot); err != nil {
+		t.Fatalf("Snapshot: failed to unmarshal: %s", err)
+	}
+	assertInt(t, int(snapshot.Pos), 6)
+	if snapshot.UserID != "dummy" {
+		t.Errorf("Snapshot: got user %s want dummy", snapshot.UserID)
+	}
+
+	// the resumed position is no longer accepted once the client has advanced
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 6})
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 7)
+	_, err = c.OnIncomingRequest(ctx, &Request{pos: 5})
+	if err == nil {
+		t.Fatalf("OnIncomingRequest with old resumed pos: want error, got none")
+	}
+}
+
 func assertPos(t *testing.T, pos string, wantPos int) {
 	t.Helper()
 	gotPos, err := strconv.Atoi(pos)
@@ -2,11 +2,15 @@ package sync3
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
 )
 
+// ConnTTL is how long a connection can be idle before it is expired.
+const ConnTTL = 30 * time.Minute // TODO: customisable
+
 // ConnMap stores a collection of Conns.
 type ConnMap struct {
 	cache *ttlcache.Cache
@@ -15,17 +19,23 @@ type ConnMap struct {
 	userIDToConn map[string][]*Conn
 	connIDToConn map[string]*Conn
 
+	// called whenever a connection is closed, for whatever reason. May be nil.
+	onClose func(conn *Conn)
+
 	mu *sync.Mutex
 }
 
-func NewConnMap() *ConnMap {
+// NewConnMap makes a new ConnMap. onClose is called whenever a connection is closed, including when it is
+// replaced, expires or its buffer fills up, so must not call back into the ConnMap. onClose may be nil.
+func NewConnMap(onClose func(conn *Conn)) *ConnMap {
 	cm := &ConnMap{
 		userIDToConn: make(map[string][]*Conn),
 		connIDToConn: make(map[string]*Conn),
 		cache:        ttlcache.NewCache(),
+		onClose:      onClose,
 		mu:           &sync.Mutex{},
 	}
-	cm.cache.SetTTL(30 * time.Minute) // TODO: customisable
+	cm.cache.SetTTL(ConnTTL)
 	cm.cache.SetExpirationCallback(cm.closeConnExpires)
 	return cm
 }
@@ -63,17 +73,34 @@ func (m *ConnMap) CreateConn(cid ConnID, newConnHandler func() ConnHandler) (*Co
 	return conn, true
 }
 
+// AllConns returns every connection.
+func (m *ConnMap) AllConns() []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := make([]*Conn, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 func (m *ConnMap) CloseConn(connID ConnID) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	conn := m.Conn(connID)
 	m.closeConn(conn)
+	// remove it from the cache too, else it will be returned by Conn() until it expires
+	m.cache.Remove(connID.String())
 }
 
 func (m *ConnMap) closeConnExpires(connID string, value interface{}) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	conn := value.(*Conn)
+	// the conn may have already been closed via CloseConn or replaced by CreateConn
+	if m.connIDToConn[connID] != conn {
+		return
+	}
 	m.closeConn(conn)
 }
 
@@ -97,6 +124,10 @@ func (m *ConnMap) closeConn(conn *Conn) {
 		}
 	}
 	m.userIDToConn[h.UserID()] = conns
+	atomic.StoreInt32(&conn.closed, 1)
 	// remove user cache listeners etc
 	h.Destroy()
+	if m.onClose != nil {
+		m.onClose(conn)
+	}
 }
@@ -0,0 +1,36 @@
+package sync3
+
+import (
+	"context"
+	"testing"
+)
+
+// Test that closing a connection removes it from the map, so it cannot be used again.
+func TestConnMapCloseConn(t *testing.T) {
+	var closed []*Conn
+	m := NewConnMap(func(conn *Conn) {
+		closed = append(closed, conn)
+	})
+	cid := ConnID{DeviceID: "d"}
+	conn, _ := m.CreateConn(cid, func() ConnHandler {
+		return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			return &Response{}, nil
+		}}
+	})
+	if got := m.Conn(cid); got != conn {
+		t.Fatalf("Conn: got %v want %v", got, conn)
+	}
+	if conns := m.AllConns(); len(conns) != 1 || conns[0] != conn {
+		t.Fatalf("AllConns: got %v want [%v]", conns, conn)
+	}
+	m.CloseConn(cid)
+	if got := m.Conn(cid); got != nil {
+		t.Fatalf("Conn: got %v after CloseConn, want nil", got)
+	}
+	if !conn.Closed() || len(closed) != 1 || closed[0] != conn {
+		t.Fatalf("CloseConn: want the close callback to be called with %v, got %v", conn, closed)
+	}
+	if conns := m.AllConns(); len(conns) != 0 {
+		t.Fatalf("AllConns: got %v after CloseConn, want none", conns)
+	}
+}
@@ -2,24 +2,22 @@ package sync3
 
 import (
 	"encoding/json"
-	"os"
 	"sync"
 
+	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/sync3/caches"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("sync3")
 
 const DispatcherAllUsers = "-"
 
 type Receiver interface {
 	OnNewEvent(event *caches.EventData)
 	OnRegistered(latestPos int64) error
+	// Called when the parents of this room change, after OnNewEvent has been called for the event.
+	OnSpaceGraphChanged(roomID string)
 }
 
 // Dispatches live events to caches
@@ -28,6 +26,10 @@ type Dispatcher struct {
 	userToReceiver   map[string]Receiver
 	userToReceiverMu *sync.RWMutex
 	latestPos        int64
+
+	// room ID -> user ID -> number of connections previewing this room
+	roomToPreviewers   map[string]map[string]int
+	roomToPreviewersMu *sync.RWMutex
 }
 
 func NewDispatcher() *Dispatcher {
@@ -36,6 +38,9 @@ func NewDispatcher() *Dispatcher {
 		userToReceiver:   make(map[string]Receiver),
 		userToReceiverMu: &sync.RWMutex{},
 		latestPos:        0,
+
+		roomToPreviewers:   make(map[string]map[string]int),
+		roomToPreviewersMu: &sync.RWMutex{},
 	}
 }
 
@@ -43,6 +48,55 @@ func (d *Dispatcher) IsUserJoined(userID, roomID string) bool {
 	return d.jrt.IsUserJoined(userID, roomID)
 }
 
+// JoinedUsersForRoom returns the users who are joined to this room.
+func (d *Dispatcher) JoinedUsersForRoom(roomID string) []string {
+	return d.jrt.JoinedUsersForRoom(roomID)
+}
+
+// AddPreviewer registers interest in live events for a room the user is not joined to.
+// Calls are reference counted, so every AddPreviewer must be paired with a RemovePreviewer.
+func (d *Dispatcher) AddPreviewer(userID, roomID string) {
+	d.roomToPreviewersMu.Lock()
+	defer d.roomToPreviewersMu.Unlock()
+	users := d.roomToPreviewers[roomID]
+	if users == nil {
+		users = make(map[string]int)
+		d.roomToPreviewers[roomID] = users
+	}
+	users[userID]++
+}
+
+// RemovePreviewer removes interest previously registered via AddPreviewer.
+func (d *Dispatcher) RemovePreviewer(userID, roomID string) {
+	d.roomToPreviewersMu.Lock()
+	defer d.roomToPreviewersMu.Unlock()
+	users := d.roomToPreviewers[roomID]
+	if users == nil {
+		return
+	}
+	users[userID]--
+	if users[userID] <= 0 {
+		delete(users, userID)
+	}
+	if len(users) == 0 {
+		delete(d.roomToPreviewers, roomID)
+	}
+}
+
+func (d *Dispatcher) previewersForRoom(roomID string) []string {
+	d.roomToPreviewersMu.RLock()
+	defer d.roomToPreviewersMu.RUnlock()
+	users := d.roomToPreviewers[roomID]
+	if len(users) == 0 {
+		return nil
+	}
+	userIDs := make([]string, 0, len(users))
+	for userID := range users {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
 // Load joined members into the dispatcher.
 // MUST BE CALLED BEFORE V2 POLL LOOPS START.
 func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
@@ -173,4 +227,48 @@ func (d *Dispatcher) onNewEvent(
 			}
 		}
 	}
+
+	// previewers of this room who aren't joined and haven't already been told about this event
+	for _, userID := range d.previewersForRoom(ed.RoomID) {
+		if userID == targetUser || d.jrt.IsUserJoined(userID, ed.RoomID) {
+			continue
+		}
+		l := d.userToReceiver[userID]
+		if l != nil {
+			edd := *ed
+			edd.IsPreview = true
+			l.OnNewEvent(&edd)
+		}
+	}
+
+	if ed.StateKey != nil && (ed.EventType == "m.space.child" || ed.EventType == "m.space.parent") {
+		d.notifySpaceGraphChanged(ed)
+	}
+}
+
+// notifySpaceGraphChanged tells users joined to the room whose parents changed, or to any room beneath it,
+// that the spaces those rooms are in may have changed. They may not be joined to the room with the event.
+// m.space.child events change the parents of the child room in the state key, whereas m.space.parent
+// events change the parents of the room they are sent in. Must be called with userToReceiverMu held.
+func (d *Dispatcher) notifySpaceGraphChanged(ed *caches.EventData) {
+	changedRoomID := ed.RoomID
+	if ed.EventType == "m.space.child" {
+		changedRoomID = *ed.StateKey
+	}
+	affectedRoomIDs := []string{changedRoomID}
+	if graph, ok := d.userToReceiver[DispatcherAllUsers].(SpaceGraph); ok {
+		affectedRoomIDs = append(affectedRoomIDs, graph.Descendants(changedRoomID)...)
+	}
+	notified := make(map[string]struct{})
+	for _, roomID := range affectedRoomIDs {
+		for _, userID := range d.jrt.JoinedUsersForRoom(roomID) {
+			if _, ok := notified[userID]; ok {
+				continue
+			}
+			notified[userID] = struct{}{}
+			if l := d.userToReceiver[userID]; l != nil {
+				l.OnSpaceGraphChanged(changedRoomID)
+			}
+		}
+	}
 }
@@ -1,18 +1,13 @@
 package extensions
 
 import (
-	"os"
-
+	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
 	"github.com/matrix-org/sync-v3/sync2"
 	"github.com/matrix-org/sync-v3/sync3/caches"
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("sync3/extensions")
 
 type Request struct {
 	UserID      string
@@ -20,6 +15,7 @@ type Request struct {
 	ToDevice    *ToDeviceRequest    `json:"to_device"`
 	E2EE        *E2EERequest        `json:"e2ee"`
 	AccountData *AccountDataRequest `json:"account_data"`
+	Spaces      *SpacesRequest      `json:"spaces"`
 }
 
 func (r Request) ApplyDelta(next *Request) Request {
@@ -32,6 +28,9 @@ func (r Request) ApplyDelta(next *Request) Request {
 	if next.AccountData != nil {
 		r.AccountData = r.AccountData.ApplyDelta(next.AccountData)
 	}
+	if next.Spaces != nil {
+		r.Spaces = r.Spaces.ApplyDelta(next.Spaces)
+	}
 	return r
 }
 
@@ -39,12 +38,14 @@ type Response struct {
 	ToDevice    *ToDeviceResponse    `json:"to_device,omitempty"`
 	E2EE        *E2EEResponse        `json:"e2ee,omitempty"`
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
+	Spaces      *SpacesResponse      `json:"spaces,omitempty"`
 }
 
 func (e Response) HasData(isInitial bool) bool {
 	return (e.ToDevice != nil && e.ToDevice.HasData(isInitial)) ||
 		(e.E2EE != nil && e.E2EE.HasData(isInitial)) ||
-		(e.AccountData != nil && e.AccountData.HasData(isInitial))
+		(e.AccountData != nil && e.AccountData.HasData(isInitial)) ||
+		(e.Spaces != nil && e.Spaces.HasData(isInitial))
 }
 
 type HandlerInterface interface {
@@ -61,6 +62,16 @@ func (h *Handler) HandleLiveUpdate(update caches.Update, req Request, res *Respo
 	if req.AccountData != nil && req.AccountData.Enabled {
 		res.AccountData = ProcessLiveAccountData(update, h.Store, updateWillReturnResponse, req.UserID, req.AccountData)
 	}
+	if req.Spaces != nil && req.Spaces.Enabled {
+		// merge with any existing response as many updates can be processed before returning
+		if spacesRes := ProcessLiveSpaces(update, h.Store, req.UserID, req.Spaces); spacesRes != nil {
+			if res.Spaces == nil {
+				res.Spaces = spacesRes
+			} else {
+				res.Spaces.merge(spacesRes)
+			}
+		}
+	}
 }
 
 func (h *Handler) Handle(req Request, listRoomIDs map[string]struct{}, isInitial bool) (res Response) {
@@ -73,5 +84,8 @@ func (h *Handler) Handle(req Request, listRoomIDs map[string]struct{}, isInitial
 	if req.AccountData != nil && req.AccountData.Enabled {
 		res.AccountData = ProcessAccountData(h.Store, listRoomIDs, req.UserID, isInitial, req.AccountData)
 	}
+	if req.Spaces != nil && req.Spaces.Enabled {
+		res.Spaces = ProcessSpaces(h.Store, req.UserID, isInitial, req.Spaces)
+	}
 	return
 }
@@ -0,0 +1,146 @@
+package extensions
+
+import (
+	"sort"
+
+	"github.com/matrix-org/sync-v3/state"
+	"github.com/matrix-org/sync-v3/sync3/caches"
+)
+
+// Client created request params
+type SpacesRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (r SpacesRequest) ApplyDelta(next *SpacesRequest) *SpacesRequest {
+	r.Enabled = next.Enabled
+	return &r
+}
+
+// Server response
+type SpacesResponse struct {
+	// space room ID -> ordered children. Only spaces the user is joined to are included.
+	Spaces map[string][]SpaceChild `json:"spaces,omitempty"`
+	// spaces the user has left or been banned from since the last response
+	Left []string `json:"left,omitempty"`
+}
+
+type SpaceChild struct {
+	RoomID    string `json:"room_id"`
+	Order     string `json:"order,omitempty"`
+	Suggested bool   `json:"suggested,omitempty"`
+}
+
+func (r *SpacesResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Spaces) > 0 || len(r.Left) > 0
+}
+
+// merge a later response into this one, as many updates can be processed before returning.
+func (r *SpacesResponse) merge(later *SpacesResponse) {
+	for spaceRoomID, children := range later.Spaces {
+		r.Spaces[spaceRoomID] = children
+		r.Left = removeString(r.Left, spaceRoomID)
+	}
+	for _, spaceRoomID := range later.Left {
+		delete(r.Spaces, spaceRoomID)
+		r.Left = append(removeString(r.Left, spaceRoomID), spaceRoomID)
+	}
+}
+
+func removeString(list []string, s string) []string {
+	result := list[:0]
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Sort children by their 'order' (children without one go last), then suggested rooms first, then room ID.
+func spaceChildren(relations []state.SpaceRelation) []SpaceChild {
+	children := make([]SpaceChild, len(relations))
+	for i, r := range relations {
+		children[i] = SpaceChild{
+			RoomID:    r.Child,
+			Order:     r.Ordering,
+			Suggested: r.IsSuggested,
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if a.Order != b.Order {
+			if a.Order == "" || b.Order == "" {
+				return a.Order != ""
+			}
+			return a.Order < b.Order
+		}
+		if a.Suggested != b.Suggested {
+			return a.Suggested
+		}
+		return a.RoomID < b.RoomID
+	})
+	return children
+}
+
+func spacesResponse(spaceToRelations map[string][]state.SpaceRelation) *SpacesResponse {
+	res := &SpacesResponse{
+		Spaces: make(map[string][]SpaceChild, len(spaceToRelations)),
+	}
+	for spaceRoomID, relations := range spaceToRelations {
+		res.Spaces[spaceRoomID] = spaceChildren(relations)
+	}
+	return res
+}
+
+func ProcessLiveSpaces(up caches.Update, store *state.Storage, userID string, req *SpacesRequest) (res *SpacesResponse) {
+	update, ok := up.(*caches.RoomEventUpdate)
+	if !ok || update.EventData.StateKey == nil {
+		return nil
+	}
+	ed := update.EventData
+	if ed.EventType == "m.room.member" && *ed.StateKey == userID && update.GlobalRoomMetadata().IsSpace() {
+		if membership := ed.Content.Get("membership").Str; membership == "leave" || membership == "ban" {
+			// the user left a space, so its children are no longer sent
+			return &SpacesResponse{
+				Spaces: make(map[string][]SpaceChild),
+				Left:   []string{ed.RoomID},
+			}
+		}
+	}
+	switch {
+	case ed.EventType == "m.space.child" && update.RoomID() == ed.RoomID:
+		// the children of a space have changed. This update is also sent for the child room, so only
+		// process the update for the space itself.
+	case ed.EventType == "m.room.member" && *ed.StateKey == userID && ed.Content.Get("membership").Str == "join" &&
+		update.GlobalRoomMetadata().IsSpace():
+		// the user joined a space
+	default:
+		return nil
+	}
+	spaceToRelations, err := store.SpaceChildren([]string{ed.RoomID})
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("space", ed.RoomID).Msg("failed to fetch space children")
+		return nil
+	}
+	res = spacesResponse(spaceToRelations)
+	if _, exists := res.Spaces[ed.RoomID]; !exists {
+		res.Spaces[ed.RoomID] = []SpaceChild{}
+	}
+	return res
+}
+
+func ProcessSpaces(store *state.Storage, userID string, isInitial bool, req *SpacesRequest) (res *SpacesResponse) {
+	if !isInitial {
+		return nil
+	}
+	spaceToRelations, err := store.JoinedSpaceChildren(userID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Msg("failed to fetch space hierarchy")
+		return nil
+	}
+	return spacesResponse(spaceToRelations)
+}
@@ -3,16 +3,20 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"runtime/trace"
+	"fmt"
+	"sync"
 
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/sync3"
 	"github.com/matrix-org/sync-v3/sync3/caches"
 	"github.com/matrix-org/sync-v3/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
 type JoinChecker interface {
 	IsUserJoined(userID, roomID string) bool
+	AddPreviewer(userID, roomID string)
+	RemovePreviewer(userID, roomID string)
 }
 
 // ConnState tracks all high-level connection state for this connection, like the combined request
@@ -27,6 +31,15 @@ type ConnState struct {
 	// Confirmed room subscriptions. Entries in this list have been checked for things like
 	// "is the user joined to this room?" whereas subscriptions in muxedReq are untrusted.
 	roomSubscriptions map[string]sync3.RoomSubscription // room_id -> subscription
+	// Confirmed room subscriptions for world_readable rooms the user is not joined to. Guarded by
+	// previewRoomsMu as the connection can be destroyed whilst a request is being processed.
+	previewRooms   map[string]struct{}
+	previewRoomsMu *sync.Mutex
+	// set when the connection is destroyed, after which no more rooms can be previewed. Guarded by previewRoomsMu.
+	destroyed bool
+
+	// Which room members have been sent to the client when lazy loading members.
+	lazyCache *LazyCache
 
 	loadPosition int64
 
@@ -39,6 +52,13 @@ type ConnState struct {
 	joinChecker JoinChecker
 
 	extensionsHandler extensions.HandlerInterface
+
+	// set if this connection is being resumed from a snapshot, until the first request is processed
+	resumeFrom *sync3.ConnSnapshot
+
+	// room subscriptions are sticky, so the total number needs to be limited as well as the number
+	// per request. 0 means no limit.
+	maxRoomSubscriptions int
 }
 
 func NewConnState(
@@ -51,7 +71,10 @@ func NewConnState(
 		userID:            userID,
 		deviceID:          deviceID,
 		roomSubscriptions: make(map[string]sync3.RoomSubscription),
-		lists:             sync3.NewInternalRequestLists(),
+		previewRooms:      make(map[string]struct{}),
+		previewRoomsMu:    &sync.Mutex{},
+		lazyCache:         NewLazyCache(),
+		lists:             sync3.NewInternalRequestLists(globalCache),
 		extensionsHandler: ex,
 		joinChecker:       joinChecker,
 	}
@@ -63,6 +86,12 @@ func NewConnState(
 	return cs
 }
 
+// Resume this connection from a snapshot taken by a previous connection, e.g before the server restarted.
+// The next request will return what has changed since the snapshot rather than starting from scratch.
+func (s *ConnState) Resume(snapshot *sync3.ConnSnapshot) {
+	s.resumeFrom = snapshot
+}
+
 // load the initial joined room list, unfiltered and unsorted, and cache up the fields we care about
 // like the room name. We have synchronisation issues here similar to the ConnMap's initial Load.
 // However, unlike the ConnMap, we cannot just say "don't start any v2 poll loops yet". To keep things
@@ -90,6 +119,34 @@ func (s *ConnState) load() error {
 		}
 		i++
 	}
+	leftRooms := s.userCache.LeftRooms()
+	leftRoomIDs := make([]string, 0, len(leftRooms))
+	for roomID, urd := range leftRooms {
+		if urd.LeftWithoutJoining {
+			continue
+		}
+		leftRoomIDs = append(leftRoomIDs, roomID)
+	}
+	leftRoomMetadatas := s.globalCache.LoadRooms(leftRoomIDs...)
+	for roomID, urd := range leftRooms {
+		var metadata *internal.RoomMetadata
+		if urd.LeftWithoutJoining {
+			// we were never joined to this room e.g rejected invites, so only use what was in the invite
+			metadata = urd.LeftRoomMetadata(roomID)
+		} else {
+			metadata = leftRoomMetadatas[roomID]
+			if metadata == nil {
+				metadata = &internal.RoomMetadata{
+					RoomID: roomID,
+				}
+			}
+		}
+		metadata.RemoveHero(s.userID)
+		rooms = append(rooms, sync3.RoomConnMetadata{
+			RoomMetadata: *metadata,
+			UserRoomData: urd,
+		})
+	}
 	invites := s.userCache.Invites()
 	for _, urd := range invites {
 		metadata := urd.Invite.RoomMetadata()
@@ -98,6 +155,14 @@ func (s *ConnState) load() error {
 			UserRoomData: urd,
 		})
 	}
+	knocks := s.userCache.Knocks()
+	for _, urd := range knocks {
+		metadata := urd.Knock.RoomMetadata()
+		rooms = append(rooms, sync3.RoomConnMetadata{
+			RoomMetadata: *metadata,
+			UserRoomData: urd,
+		})
+	}
 
 	for _, r := range rooms {
 		s.lists.SetRoom(r)
@@ -108,12 +173,12 @@ func (s *ConnState) load() error {
 
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
-	ctx, task := trace.NewTask(ctx, "OnIncomingRequest")
-	defer task.End()
+	ctx, span := internal.StartSpan(ctx, "OnIncomingRequest")
+	defer span.End()
 	if s.loadPosition == 0 {
-		region := trace.StartRegion(ctx, "load")
+		_, loadSpan := internal.StartSpan(ctx, "load")
 		s.load()
-		region.End()
+		loadSpan.End()
 	}
 	return s.onIncomingRequest(ctx, req, isInitial)
 }
@@ -122,9 +187,28 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 // be on their own goroutine, the requests are linearised for us by Conn so it is safe to modify ConnState without
 // additional locking mechanisms.
 func (s *ConnState) onIncomingRequest(ctx context.Context, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
-	// ApplyDelta works fine if s.muxedReq is nil
-	var delta *sync3.RequestDelta
-	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	// a resumed connection carries on from the snapshot request
+	prevReq := s.muxedReq
+	if s.resumeFrom != nil {
+		prevReq = &s.resumeFrom.Request
+	}
+	// ApplyDelta works fine if prevReq is nil
+	muxedReq, delta := prevReq.ApplyDelta(req)
+	if s.maxRoomSubscriptions > 0 && len(muxedReq.RoomSubscriptions) > s.maxRoomSubscriptions {
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("too many room subscriptions: %d > %d", len(muxedReq.RoomSubscriptions), s.maxRoomSubscriptions),
+			ErrCode:    internal.ErrCodeInvalidParam,
+		}
+	}
+	// the request has been accepted, so the snapshot can be restored. If it was rejected, the snapshot is
+	// kept for the next request.
+	resumeFrom := s.resumeFrom
+	s.resumeFrom = nil
+	if resumeFrom != nil {
+		s.restore(resumeFrom)
+	}
+	s.muxedReq = muxedReq
 
 	// associate extensions context
 	ex := s.muxedReq.Extensions
@@ -138,6 +222,10 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *sync3.Request, i
 	s.buildRoomSubscriptions(builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
 	respLists := s.buildListSubscriptions(ctx, builder, delta.Lists)
+	if resumeFrom != nil {
+		// works out what changed whilst the connection was down
+		s.buildResumedRooms(builder, resumeFrom, respLists)
+	}
 
 	// pull room data and set changes on the response
 	response := &sync3.Response{
@@ -151,26 +239,104 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *sync3.Request, i
 	}
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
 	// is being notified about (e.g. for room account data)
-	region := trace.StartRegion(ctx, "extensions")
-	response.Extensions = s.extensionsHandler.Handle(ex, includedRoomIDs, isInitial)
-	region.End()
+	_, span := internal.StartSpan(ctx, "extensions")
+	// extensions are sent from scratch when resuming, for the same reasons as rooms are
+	response.Extensions = s.extensionsHandler.Handle(ex, includedRoomIDs, isInitial || resumeFrom != nil)
+	span.End()
 
 	// do live tracking if we have nothing to tell the client yet
-	region = trace.StartRegion(ctx, "liveUpdate")
-	s.live.liveUpdate(ctx, req, ex, isInitial, response)
-	region.End()
+	liveCtx, span := internal.StartSpan(ctx, "liveUpdate")
+	s.live.liveUpdate(liveCtx, req, ex, isInitial, response)
+	span.End()
 
 	// counts are AFTER events are applied, hence after liveUpdate
-	for i := range response.Lists {
-		response.Lists[i].Count = s.lists.Count(i)
+	for listKey := range response.Lists {
+		l := response.Lists[listKey]
+		l.Count = s.lists.Count(listKey)
+		response.Lists[listKey] = l
 	}
 
 	return response, nil
 }
 
-func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listIndex int, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
-	defer trace.StartRegion(ctx, "onIncomingListRequest").End()
-	roomList, overwritten := s.lists.AssignList(listIndex, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+// restore the lists and room subscriptions in the snapshot, as if this connection had processed the
+// snapshot request. Room subscriptions are checked again as the user may have left rooms since.
+func (s *ConnState) restore(snapshot *sync3.ConnSnapshot) {
+	req := snapshot.Request
+	s.muxedReq = &req
+	for listKey := range req.Lists {
+		reqList := req.Lists[listKey]
+		s.lists.AssignList(listKey, &reqList, sync3.Overwrite)
+	}
+	s.buildRoomSubscriptions(NewRoomsBuilder(), snapshot.RoomSubscriptions, nil)
+}
+
+// buildResumedRooms SYNCs the ranges and room subscriptions which were left untouched by the resuming
+// request. The snapshot doesn't record which account data, receipts, unread counts or lazily loaded
+// members the client has seen, so every room which was visible to the client is sent again in full.
+func (s *ConnState) buildResumedRooms(builder *RoomsBuilder, snapshot *sync3.ConnSnapshot, respLists map[string]sync3.ResponseList) {
+	for listKey, reqList := range s.muxedReq.Lists {
+		list := s.lists.Get(listKey)
+		prevReqList, exists := snapshot.Request.Lists[listKey]
+		if list == nil || !exists || prevReqList.SortOrderChanged(&reqList) || prevReqList.FiltersChanged(&reqList) {
+			// the list has been SYNCed from scratch already
+			continue
+		}
+		ranges, prevRanges := reqList.Ranges, prevReqList.Ranges
+		if reqList.ShouldGetAllRooms() {
+			ranges = sync3.SliceRanges{{0, list.Len() - 1}}
+			prevRanges = ranges
+		}
+		subID := builder.AddSubscription(reqList.RoomSubscription)
+		resList := respLists[listKey]
+		for _, r := range ranges {
+			if !containsRange(prevRanges, r) {
+				// this is a new range so has been SYNCed already
+				continue
+			}
+			roomIDs := roomIDsInRange(list, r)
+			resList.Ops = append(resList.Ops, &sync3.ResponseOpRange{
+				Operation: sync3.OpSync,
+				Range:     r[:],
+				RoomIDs:   roomIDs,
+			})
+			builder.AddRoomsToSubscription(subID, roomIDs)
+		}
+		respLists[listKey] = resList
+	}
+	for _, roomID := range snapshot.RoomSubscriptions {
+		sub, ok := s.roomSubscriptions[roomID]
+		if !ok {
+			continue
+		}
+		subID := builder.AddSubscription(sub)
+		builder.AddRoomsToSubscription(subID, []string{roomID})
+	}
+}
+
+func containsRange(ranges sync3.SliceRanges, r [2]int64) bool {
+	for i := range ranges {
+		if ranges[i] == r {
+			return true
+		}
+	}
+	return false
+}
+
+// roomIDsInRange returns the room IDs in the range r of the list.
+func roomIDsInRange(list *sync3.FilteredSortableRooms, r [2]int64) []string {
+	subslice := sync3.SliceRanges{r}.SliceInto(list)
+	if len(subslice) == 0 {
+		return nil
+	}
+	return subslice[0].(*sync3.SortableRooms).RoomIDs()
+}
+
+func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
+	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
+	defer span.End()
+	span.SetAttribute("list", listKey)
+	roomList, overwritten := s.lists.AssignList(listKey, nextReqList, sync3.DoNotOverwrite)
 
 	if nextReqList.ShouldGetAllRooms() {
 		if overwritten || prevReqList.FiltersChanged(nextReqList) {
@@ -225,11 +391,13 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		}
 		if filtersChanged {
 			// we need to re-create the list as the rooms may have completely changed
-			roomList, _ = s.lists.AssignList(listIndex, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
+			roomList, _ = s.lists.AssignList(listKey, nextReqList, sync3.Overwrite)
 		}
+		roomList.SetBumpEventTypes(nextReqList.BumpEventTypes)
+		roomList.SetExcludeThreadCounts(nextReqList.ShouldExcludeThreadCounts())
 		// resort as either we changed the sort order or we added/removed a bunch of rooms
 		if err := roomList.Sort(nextReqList.Sort); err != nil {
-			logger.Err(err).Int("index", listIndex).Msg("cannot sort list")
+			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
 		}
 		addedRanges = nextReqList.Ranges
 		removedRanges = nil
@@ -274,26 +442,31 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	}
 }
 
-func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBuilder, listDeltas []sync3.RequestListDelta) []sync3.ResponseList {
-	result := make([]sync3.ResponseList, len(s.muxedReq.Lists))
+func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBuilder, listDeltas map[string]sync3.RequestListDelta) map[string]sync3.ResponseList {
+	result := make(map[string]sync3.ResponseList, len(s.muxedReq.Lists))
 	// loop each list and handle each independently
-	for i := range listDeltas {
-		if listDeltas[i].Curr == nil {
+	for listKey, listDelta := range listDeltas {
+		if listDelta.Curr == nil {
 			// they deleted this list
-			logger.Debug().Int("index", i).Msg("list deleted")
-			s.lists.DeleteList(i)
+			logger.Debug().Str("key", listKey).Msg("list deleted")
+			s.lists.DeleteList(listKey)
 			continue
 		}
-		result[i] = s.onIncomingListRequest(ctx, builder, i, listDeltas[i].Prev, listDeltas[i].Curr)
+		result[listKey] = s.onIncomingListRequest(ctx, builder, listKey, listDelta.Prev, listDelta.Curr)
 	}
 	return result
 }
 
 func (s *ConnState) buildRoomSubscriptions(builder *RoomsBuilder, subs, unsubs []string) {
 	for _, roomID := range subs {
-		// check that the user is allowed to see these rooms as they can set arbitrary room IDs
+		// check that the user is allowed to see these rooms as they can set arbitrary room IDs.
+		// Users who aren't joined can still preview world_readable rooms.
+		isPreview := false
 		if !s.joinChecker.IsUserJoined(s.userID, roomID) {
-			continue
+			if !s.isWorldReadable(roomID) {
+				continue
+			}
+			isPreview = true
 		}
 
 		sub, ok := s.muxedReq.RoomSubscriptions[roomID]
@@ -303,73 +476,336 @@ func (s *ConnState) buildRoomSubscriptions(builder *RoomsBuilder, subs, unsubs [
 			)
 			continue
 		}
+		if isPreview {
+			s.startPreviewing(roomID)
+		}
 		s.roomSubscriptions[roomID] = sub
 		subID := builder.AddSubscription(sub)
 		builder.AddRoomsToSubscription(subID, []string{roomID})
 	}
 	for _, roomID := range unsubs {
 		delete(s.roomSubscriptions, roomID)
+		s.stopPreviewing(roomID)
 	}
 }
 
+func (s *ConnState) isWorldReadable(roomID string) bool {
+	metadata := s.globalCache.LoadRooms(roomID)[roomID]
+	return metadata != nil && metadata.IsWorldReadable()
+}
+
+func (s *ConnState) isPreviewing(roomID string) bool {
+	s.previewRoomsMu.Lock()
+	defer s.previewRoomsMu.Unlock()
+	_, ok := s.previewRooms[roomID]
+	return ok
+}
+
+func (s *ConnState) startPreviewing(roomID string) {
+	s.previewRoomsMu.Lock()
+	defer s.previewRoomsMu.Unlock()
+	if _, ok := s.previewRooms[roomID]; ok || s.destroyed {
+		return
+	}
+	s.previewRooms[roomID] = struct{}{}
+	s.joinChecker.AddPreviewer(s.userID, roomID)
+}
+
+func (s *ConnState) stopPreviewing(roomID string) {
+	s.previewRoomsMu.Lock()
+	defer s.previewRoomsMu.Unlock()
+	s.stopPreviewingLocked(roomID)
+}
+
+// must hold previewRoomsMu
+func (s *ConnState) stopPreviewingLocked(roomID string) {
+	if _, ok := s.previewRooms[roomID]; !ok {
+		return
+	}
+	delete(s.previewRooms, roomID)
+	s.joinChecker.RemovePreviewer(s.userID, roomID)
+}
+
 func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscription) map[string]sync3.Room {
-	defer trace.StartRegion(ctx, "buildRooms").End()
+	ctx, span := internal.StartSpan(ctx, "buildRooms")
+	defer span.End()
+	span.SetAttribute("num_subscriptions", len(builtSubs))
 	result := make(map[string]sync3.Room)
 	for _, bs := range builtSubs {
 		rooms := s.getInitialRoomData(ctx, bs.RoomSubscription, bs.RoomIDs...)
 		for roomID, room := range rooms {
 			result[roomID] = room
 		}
+		if bs.RoomSubscription.IncludeOldRooms == nil {
+			continue
+		}
+		oldRoomIDs := s.oldRoomIDs(bs.RoomIDs)
+		if len(oldRoomIDs) == 0 {
+			continue
+		}
+		oldRooms := s.getInitialRoomData(ctx, *bs.RoomSubscription.IncludeOldRooms, oldRoomIDs...)
+		for roomID, room := range oldRooms {
+			if _, exists := result[roomID]; !exists {
+				result[roomID] = room
+			}
+		}
+	}
+	return result
+}
+
+// oldRoomIDs walks the predecessor chain of each room, returning the rooms which were upgraded and
+// which the user was joined to. The walk stops at the first room the user was never joined to.
+func (s *ConnState) oldRoomIDs(roomIDs []string) []string {
+	seen := make(map[string]struct{}, len(roomIDs))
+	for _, roomID := range roomIDs {
+		seen[roomID] = struct{}{}
+	}
+	var result []string
+	for _, roomID := range roomIDs {
+		for {
+			metadata := s.globalCache.LoadRooms(roomID)[roomID]
+			if metadata == nil || metadata.PredecessorRoomID == nil {
+				break
+			}
+			roomID = *metadata.PredecessorRoomID
+			if _, ok := seen[roomID]; ok {
+				break
+			}
+			seen[roomID] = struct{}{}
+			if !s.wasJoined(roomID) {
+				break
+			}
+			result = append(result, roomID)
+		}
+	}
+	return result
+}
+
+// wasJoined returns true if the user is joined to the room, or was joined to the room when they left it.
+// Rooms the user was only invited to or knocked on are excluded.
+func (s *ConnState) wasJoined(roomID string) bool {
+	if s.joinChecker.IsUserJoined(s.userID, roomID) {
+		return true
+	}
+	urd := s.userCache.LoadRoomData(roomID)
+	return urd.HasLeft && !urd.LeftWithoutJoining
+}
+
+// leftRoomState returns the required state for rooms the user has left, based on the state when
+// they left the room. Lazily loaded members are included if they were in the room at that point.
+func (s *ConnState) leftRoomState(ctx context.Context, roomIDs []string, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
+	result := make(map[string][]json.RawMessage, len(roomIDs))
+	roomIDToSnapshot, err := s.userCache.LeftRoomState(ctx, roomIDs)
+	if err != nil {
+		logger.Err(err).Str("user", s.userID).Strs("rooms", roomIDs).Msg("failed to load left room state")
+		return result
+	}
+	for roomID, snapshot := range roomIDToSnapshot {
+		lazyUserIDs := make(map[string]struct{}, len(roomToUsersInTimeline[roomID]))
+		for _, userID := range roomToUsersInTimeline[roomID] {
+			lazyUserIDs[userID] = struct{}{}
+		}
+		var stateEvents []json.RawMessage
+		for _, ev := range snapshot {
+			parsed := gjson.ParseBytes(ev)
+			evType := parsed.Get("type").Str
+			stateKey := parsed.Get("state_key").Str
+			_, isLazyMember := lazyUserIDs[stateKey]
+			if requiredStateMap.Include(evType, stateKey) || (evType == "m.room.member" && isLazyMember) {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+		result[roomID] = stateEvents
 	}
 	return result
 }
 
 func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, roomIDs ...string) map[string]sync3.Room {
+	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
+	defer span.End()
+	span.SetAttribute("num_rooms", len(roomIDs))
 	rooms := make(map[string]sync3.Room, len(roomIDs))
 	// We want to grab the user room data and the room metadata for each room ID.
-	roomIDToUserRoomData := s.userCache.LazyLoadTimelines(s.loadPosition, roomIDs, int(roomSub.TimelineLimit))
+	// Previewed rooms aren't visible via the user's membership so are loaded separately.
+	var memberRoomIDs, previewRoomIDs []string
+	for _, roomID := range roomIDs {
+		if s.isPreviewing(roomID) {
+			previewRoomIDs = append(previewRoomIDs, roomID)
+		} else {
+			memberRoomIDs = append(memberRoomIDs, roomID)
+		}
+	}
+	roomIDToUserRoomData := s.userCache.LazyLoadTimelines(ctx, s.loadPosition, memberRoomIDs, int(roomSub.TimelineLimit))
+	if len(previewRoomIDs) > 0 {
+		if roomIDToUserRoomData == nil {
+			roomIDToUserRoomData = make(map[string]caches.UserRoomData, len(previewRoomIDs))
+		}
+		for roomID, urd := range s.userCache.LoadPreviewTimelines(s.loadPosition, previewRoomIDs, int(roomSub.TimelineLimit)) {
+			roomIDToUserRoomData[roomID] = urd
+		}
+	}
 	roomMetadatas := s.globalCache.LoadRooms(roomIDs...)
-	roomIDToState := s.globalCache.LoadRoomState(ctx, roomIDs, s.loadPosition, roomSub.RequiredStateMap())
-
+	requiredStateMap := roomSub.RequiredStateMap(s.userID)
+	var roomToUsersInTimeline map[string][]string
+	if requiredStateMap.IsLazyLoading() {
+		roomToUsersInTimeline = make(map[string][]string, len(roomIDToUserRoomData))
+		for roomID, urd := range roomIDToUserRoomData {
+			roomToUsersInTimeline[roomID] = s.lazyMembersToLoad(roomID, urd.Timeline)
+		}
+	}
+	roomIDToState := s.globalCache.LoadRoomState(ctx, roomIDs, s.loadPosition, requiredStateMap, roomToUsersInTimeline)
+	// left rooms use the state at the point the user left, so we don't leak newer state. Rooms the
+	// user was never joined to have no state beyond what was in the invite.
+	var leftRoomIDs []string
+	for _, roomID := range roomIDs {
+		if urd, ok := roomIDToUserRoomData[roomID]; ok && urd.HasLeft {
+			leftRoomIDs = append(leftRoomIDs, roomID)
+			delete(roomIDToState, roomID)
+		}
+	}
+	if len(leftRoomIDs) > 0 {
+		for roomID, stateEvents := range s.leftRoomState(ctx, leftRoomIDs, requiredStateMap, roomToUsersInTimeline) {
+			roomIDToState[roomID] = stateEvents
+		}
+	}
 	for _, roomID := range roomIDs {
 		userRoomData, ok := roomIDToUserRoomData[roomID]
 		if !ok {
 			userRoomData = caches.NewUserRoomData()
 		}
 		metadata := roomMetadatas[roomID]
-		var inviteState []json.RawMessage
+		var inviteState, knockState []json.RawMessage
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
-		// we happen to have this room in the global cache we will do.
+		// we happen to have this room in the global cache we will do. The same applies to knocks.
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+		} else if userRoomData.IsKnock {
+			metadata = userRoomData.Knock.RoomMetadata()
+			knockState = userRoomData.Knock.InviteState
+		} else if userRoomData.HasLeft && userRoomData.LeftWithoutJoining {
+			metadata = userRoomData.LeftRoomMetadata(roomID)
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
-		if !userRoomData.IsInvite {
+		if !userRoomData.IsInvite && !userRoomData.IsKnock {
 			requiredState = roomIDToState[roomID]
 		}
+		if roomToUsersInTimeline != nil {
+			s.addLazyMembersSent(roomID, requiredState)
+		}
 		prevBatch, _ := userRoomData.PrevBatch()
+		var avatar, topic *string
+		if a := internal.CalculateAvatar(metadata, userRoomData.IsDM); a != "" {
+			avatar = &a
+		}
+		if metadata.Topic != "" {
+			topic = &metadata.Topic
+		}
 		rooms[roomID] = sync3.Room{
-			Name:              internal.CalculateRoomName(metadata, 5), // TODO: customisable?
-			NotificationCount: int64(userRoomData.NotificationCount),
-			HighlightCount:    int64(userRoomData.HighlightCount),
-			Timeline:          s.userCache.AnnotateWithTransactionIDs(userRoomData.Timeline),
-			RequiredState:     requiredState,
-			InviteState:       inviteState,
-			Initial:           true,
-			IsDM:              userRoomData.IsDM,
-			JoinedCount:       metadata.JoinCount,
-			InvitedCount:      metadata.InviteCount,
-			PrevBatch:         prevBatch,
+			Name:                      internal.CalculateRoomName(metadata, 5), // TODO: customisable?
+			Avatar:                    avatar,
+			Topic:                     topic,
+			Heroes:                    metadata.Heroes,
+			NotificationCount:         int64(userRoomData.NotificationCount),
+			HighlightCount:            int64(userRoomData.HighlightCount),
+			UnreadThreadNotifications: sync3.NewUnreadThreadNotifications(&userRoomData),
+			Timeline:                  s.userCache.AnnotateWithTransactionIDs(userRoomData.Timeline),
+			RequiredState:             requiredState,
+			InviteState:               inviteState,
+			KnockState:                knockState,
+			Initial:                   true,
+			IsDM:                      userRoomData.IsDM,
+			JoinedCount:               metadata.JoinCount,
+			InvitedCount:              metadata.InviteCount,
+			PrevBatch:                 prevBatch,
+			Timestamp:                 s.lists.BumpTimestamp(roomID, metadata),
 		}
 	}
 	return rooms
 }
 
+// Return the senders of the given timeline events whose membership events have not yet been sent to
+// the client.
+func (s *ConnState) lazyMembersToLoad(roomID string, timeline []json.RawMessage) []string {
+	var userIDs []string
+	seen := make(map[string]struct{}, len(timeline))
+	for _, ev := range timeline {
+		sender := gjson.GetBytes(ev, "sender").Str
+		if sender == "" {
+			continue
+		}
+		if _, exists := seen[sender]; exists {
+			continue
+		}
+		seen[sender] = struct{}{}
+		if !s.lazyCache.IsSet(roomID, sender) {
+			userIDs = append(userIDs, sender)
+		}
+	}
+	return userIDs
+}
+
+// Remember the members whose membership events are in this required state, so they aren't sent again.
+// Members are only remembered once they are actually sent, as invites, knocks and left rooms return
+// less state than was asked for.
+func (s *ConnState) addLazyMembersSent(roomID string, requiredState []json.RawMessage) {
+	for _, ev := range requiredState {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str == "m.room.member" {
+			s.lazyCache.Add(roomID, parsed.Get("state_key").Str)
+		}
+	}
+}
+
+// Return true if the client wants to lazy load members for this room, based on the room subscription
+// and the lists which contain this room.
+func (s *ConnState) isLazyLoading(roomID string) bool {
+	if sub, exists := s.roomSubscriptions[roomID]; exists {
+		if sub.RequiredStateMap(s.userID).IsLazyLoading() {
+			return true
+		}
+	}
+	for listKey, reqList := range s.muxedReq.Lists {
+		list := s.lists.Get(listKey)
+		if list == nil {
+			continue
+		}
+		if _, exists := list.IndexOf(roomID); !exists {
+			continue
+		}
+		if reqList.RequiredStateMap(s.userID).IsLazyLoading() {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot returns the state of this connection so it can be resumed later. See Resume.
+func (s *ConnState) Snapshot() sync3.ConnSnapshot {
+	snapshot := sync3.ConnSnapshot{
+		UserID: s.userID,
+	}
+	if s.muxedReq == nil {
+		return snapshot
+	}
+	snapshot.Request = *s.muxedReq
+	for roomID := range s.roomSubscriptions {
+		snapshot.RoomSubscriptions = append(snapshot.RoomSubscriptions, roomID)
+	}
+	return snapshot
+}
+
 // Called when the connection is torn down
 func (s *ConnState) Destroy() {
 	s.userCache.Unsubscribe(s.userCacheID)
+	// Destroy is not called with the conn lock held, so may race with an incoming request
+	s.previewRoomsMu.Lock()
+	defer s.previewRoomsMu.Unlock()
+	s.destroyed = true
+	for roomID := range s.previewRooms {
+		s.stopPreviewingLocked(roomID)
+	}
 }
 
 func (s *ConnState) Alive() bool {
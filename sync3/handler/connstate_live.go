@@ -3,13 +3,13 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"runtime/trace"
 	"time"
 
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/sync3"
 	"github.com/matrix-org/sync-v3/sync3/caches"
 	"github.com/matrix-org/sync-v3/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
 var (
@@ -74,14 +74,14 @@ func (s *connStateLive) liveUpdate(
 		select {
 		case <-ctx.Done(): // client has given up
 			logger.Trace().Str("user", s.userID).Msg("liveUpdate: client gave up")
-			trace.Logf(ctx, "liveUpdate", "context cancelled")
+			internal.Logf(ctx, "liveUpdate", "context cancelled")
 			return
 		case <-time.After(timeLeftToWait): // we've timed out
 			logger.Trace().Str("user", s.userID).Msg("liveUpdate: timed out")
-			trace.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
+			internal.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
 			return
 		case update := <-s.updates:
-			trace.Logf(ctx, "liveUpdate", "process live update")
+			internal.Logf(ctx, "liveUpdate", "process live update")
 			updateWillReturnResponse := s.processLiveUpdate(ctx, update, response)
 			// pass event to extensions AFTER processing
 			s.extensionsHandler.HandleLiveUpdate(update, ex, &response.Extensions, updateWillReturnResponse, isInitial)
@@ -115,10 +115,12 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 
 	// do per-list updates (e.g resorting, adding/removing rooms which no longer match filter)
 	for _, listDelta := range delta.Lists {
-		index := listDelta.ListIndex
-		list := s.lists.Get(index)
-		reqList := s.muxedReq.Lists[index]
-		updates := s.processLiveUpdateForList(ctx, builder, up, listDelta.Op, &reqList, list, &response.Lists[index])
+		listKey := listDelta.ListKey
+		list := s.lists.Get(listKey)
+		reqList := s.muxedReq.Lists[listKey]
+		resList := response.Lists[listKey]
+		updates := s.processLiveUpdateForList(ctx, builder, up, listDelta.Op, &reqList, list, &resList)
+		response.Lists[listKey] = resList
 		if updates {
 			hasUpdates = true
 		}
@@ -133,11 +135,15 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		r := response.Rooms[roomUpdate.RoomID()]
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
+		r.UnreadThreadNotifications = sync3.NewUnreadThreadNotifications(userRoomData)
+		r.Timestamp = s.lists.BumpTimestamp(roomUpdate.RoomID(), roomUpdate.GlobalRoomMetadata())
 		roomEventUpdate, _ := up.(*caches.RoomEventUpdate)
-		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
+		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil &&
+			!s.userCache.ShouldIgnore(gjson.GetBytes(roomEventUpdate.EventData.Event, "sender").Str) {
 			r.Timeline = append(r.Timeline, s.userCache.AnnotateWithTransactionIDs([]json.RawMessage{
 				roomEventUpdate.EventData.Event,
 			})...)
+			r.RequiredState = append(r.RequiredState, s.lazyLoadSender(ctx, roomEventUpdate)...)
 		}
 		response.Rooms[roomUpdate.RoomID()] = r
 	}
@@ -154,10 +160,24 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		// off a list.
 		thisRoom, exists := response.Rooms[roomUpdate.RoomID()]
 		if exists {
+			// copy the metadata as we need to remove ourselves from the heroes, and the heroes slice is
+			// shared with the connection's room metadata.
+			metadata := *roomUpdate.GlobalRoomMetadata()
+			metadata.Heroes = append([]internal.Hero{}, metadata.Heroes...)
+			metadata.RemoveHero(s.userID)
 			if delta.RoomNameChanged {
-				metadata := roomUpdate.GlobalRoomMetadata()
-				metadata.RemoveHero(s.userID)
-				thisRoom.Name = internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+				thisRoom.Name = internal.CalculateRoomName(&metadata, 5) // TODO: customisable?
+			}
+			if delta.RoomNameChanged || delta.RoomAvatarChanged {
+				thisRoom.Heroes = metadata.Heroes
+			}
+			if delta.RoomAvatarChanged {
+				avatar := internal.CalculateAvatar(&metadata, roomUpdate.UserRoomMetadata().IsDM)
+				thisRoom.Avatar = &avatar
+			}
+			if delta.TopicChanged {
+				topic := metadata.Topic
+				thisRoom.Topic = &topic
 			}
 			if delta.InviteCountChanged {
 				thisRoom.InvitedCount = roomUpdate.GlobalRoomMetadata().InviteCount
@@ -168,14 +188,72 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
 	}
+
+	// the space graph changed, so the room whose parents changed and the rooms beneath it may have moved in or
+	// out of spaces
+	if spaceUpdate, ok := up.(*caches.SpaceGraphUpdate); ok {
+		for _, roomID := range s.lists.RefreshAncestorSpaces(spaceUpdate.RoomID) {
+			if s.processLiveUpdate(ctx, &connRoomUpdate{r: s.lists.Room(roomID)}, response) {
+				hasUpdates = true
+			}
+		}
+	}
+
+	// the user joined or left an upgraded room, so the old room may need to move in or out of lists
+	if delta.StalePredecessorRoomID != "" {
+		pred := s.lists.Room(delta.StalePredecessorRoomID)
+		if s.processLiveUpdate(ctx, &connRoomUpdate{r: pred}, response) {
+			hasUpdates = true
+		}
+	}
 	return hasUpdates
 }
 
+// connRoomUpdate is a caches.RoomUpdate for a room using the data this connection already has.
+type connRoomUpdate struct {
+	r *sync3.RoomConnMetadata
+}
+
+func (u *connRoomUpdate) RoomID() string {
+	return u.r.RoomID
+}
+func (u *connRoomUpdate) GlobalRoomMetadata() *internal.RoomMetadata {
+	return &u.r.RoomMetadata
+}
+func (u *connRoomUpdate) UserRoomMetadata() *caches.UserRoomData {
+	return &u.r.UserRoomData
+}
+
+// If the client is lazy loading members in this room, return the membership event for the sender of this
+// event if the client hasn't been sent it already.
+func (s *connStateLive) lazyLoadSender(ctx context.Context, up *caches.RoomEventUpdate) []json.RawMessage {
+	roomID := up.RoomID()
+	if !s.isLazyLoading(roomID) {
+		return nil
+	}
+	userIDs := s.lazyMembersToLoad(roomID, []json.RawMessage{up.EventData.Event})
+	if len(userIDs) == 0 {
+		return nil
+	}
+	memberSub := sync3.RoomSubscription{
+		RequiredState: [][2]string{{"m.room.member", userIDs[0]}},
+	}
+	roomIDToState := s.globalCache.LoadRoomState(ctx, []string{roomID}, s.loadPosition, memberSub.RequiredStateMap(s.userID), nil)
+	s.addLazyMembersSent(roomID, roomIDToState[roomID])
+	return roomIDToState[roomID]
+}
+
 func (s *connStateLive) processUpdatesForSubscriptions(builder *RoomsBuilder, up caches.Update) (hasUpdates bool) {
 	rup, ok := up.(caches.RoomUpdate)
 	if !ok {
 		return false
 	}
+	if s.isPreviewUpdate(up) && !rup.GlobalRoomMetadata().IsWorldReadable() {
+		// the room is no longer world_readable, so the user can no longer preview it
+		s.stopPreviewing(rup.RoomID())
+		delete(s.roomSubscriptions, rup.RoomID())
+		return false
+	}
 	// if we have an existing confirmed subscription for this room, then there's nothing to do.
 	if _, exists := s.roomSubscriptions[rup.RoomID()]; exists {
 		return true // this room exists as a subscription so we'll handle it correctly
@@ -197,7 +275,13 @@ func (s *connStateLive) processUpdatesForSubscriptions(builder *RoomsBuilder, up
 // this function does any updates which apply to the connection, regardless of which lists/subs exist.
 func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *RoomsBuilder, up caches.Update) (delta sync3.RoomDelta) {
 	rup, ok := up.(caches.RoomUpdate)
-	if ok {
+	if ok && s.isPreviewUpdate(up) {
+		// previewed rooms are not part of any list, so don't add them to the lists.
+		rup = nil
+	}
+	if _, isRetiredInvite := up.(*caches.RetiredInviteUpdate); isRetiredInvite {
+		delta = s.lists.RemoveRoom(rup.RoomID())
+	} else if rup != nil {
 		delta = s.lists.SetRoom(sync3.RoomConnMetadata{
 			RoomMetadata: *rup.GlobalRoomMetadata(),
 			UserRoomData: *rup.UserRoomMetadata(),
@@ -215,6 +299,11 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	return
 }
 
+func (s *connStateLive) isPreviewUpdate(up caches.Update) bool {
+	roomEventUpdate, ok := up.(*caches.RoomEventUpdate)
+	return ok && roomEventUpdate.EventData.IsPreview
+}
+
 func (s *connStateLive) processLiveUpdateForList(
 	ctx context.Context, builder *RoomsBuilder, up caches.Update, listOp sync3.ListOp,
 	reqList *sync3.RequestList, intList *sync3.FilteredSortableRooms, resList *sync3.ResponseList,
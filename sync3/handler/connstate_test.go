@@ -31,6 +31,9 @@ func (t *NopJoinTracker) IsUserJoined(userID, roomID string) bool {
 	return true
 }
 
+func (t *NopJoinTracker) AddPreviewer(userID, roomID string)    {}
+func (t *NopJoinTracker) RemovePreviewer(userID, roomID string) {}
+
 type NopTransactionFetcher struct{}
 
 func (t *NopTransactionFetcher) TransactionIDForEvent(userID, eventID string) (txnID string) {
@@ -109,7 +112,7 @@ func TestConnStateInitial(t *testing.T) {
 		t.Fatalf("UserID returned wrong value, got %v want %v", cs.UserID(), userID)
 	}
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 9},
@@ -137,8 +140,8 @@ func TestConnStateInitial(t *testing.T) {
 				Timeline: []json.RawMessage{timeline[roomA.RoomID]},
 			},
 		},
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: 3,
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpRange{
@@ -161,7 +164,7 @@ func TestConnStateInitial(t *testing.T) {
 
 	// request again for the diff
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 9},
@@ -177,8 +180,8 @@ func TestConnStateInitial(t *testing.T) {
 				Timeline: []json.RawMessage{newEvent},
 			},
 		},
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: 3,
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpSingle{
@@ -201,7 +204,7 @@ func TestConnStateInitial(t *testing.T) {
 		newEvent,
 	}, 1)
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 9},
@@ -217,8 +220,8 @@ func TestConnStateInitial(t *testing.T) {
 				Timeline: []json.RawMessage{newEvent},
 			},
 		},
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: 3,
 			},
 		},
@@ -272,7 +275,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 
 	// request first page
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 2},
@@ -283,8 +286,8 @@ func TestConnStateMultipleRanges(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, true, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(rooms),
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpRange{
@@ -298,7 +301,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	})
 	// add on a different non-overlapping range
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 2}, {4, 6},
@@ -309,8 +312,8 @@ func TestConnStateMultipleRanges(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, true, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(rooms),
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpRange{
@@ -335,7 +338,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	}, 1)
 
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 2}, {4, 6},
@@ -346,8 +349,8 @@ func TestConnStateMultipleRanges(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, true, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(rooms),
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpSingle{
@@ -377,7 +380,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	}, 1)
 	t.Logf("new event %s : %s", roomIDs[9], string(newEvent))
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 2}, {4, 6},
@@ -388,8 +391,8 @@ func TestConnStateMultipleRanges(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, true, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(rooms),
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpSingle{
@@ -448,7 +451,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{})
 	// Ask for A,B
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 1},
@@ -459,8 +462,8 @@ func TestBumpToOutsideRange(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, true, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: 4,
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpRange{
@@ -485,7 +488,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
 	defer cancel()
 	res, err = cs.OnIncomingRequest(ctx, ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 1},
@@ -495,7 +498,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 	if err != nil {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
-	if len(res.Lists[0].Ops) > 0 {
+	if len(res.Lists["a"].Ops) > 0 {
 		t.Errorf("response returned ops, expected none")
 	}
 }
@@ -561,7 +564,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 				TimelineLimit: 20,
 			},
 		},
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 1},
@@ -572,8 +575,8 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, false, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(roomIDs),
 				Ops: []sync3.ResponseOp{
 					&sync3.ResponseOpRange{
@@ -617,7 +620,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	}, 1)
 	// we should get this message even though it's not in the range because we are subscribed to this room.
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 1},
@@ -628,8 +631,8 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, false, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(roomIDs),
 			},
 		},
@@ -651,7 +654,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 			},
 		},
 		UnsubscribeRooms: []string{roomD.RoomID},
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
 			Ranges: sync3.SliceRanges([][2]int64{
 				{0, 1},
@@ -662,8 +665,8 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 		t.Fatalf("OnIncomingRequest returned error : %s", err)
 	}
 	checkResponse(t, false, res, &sync3.Response{
-		Lists: []sync3.ResponseList{
-			{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
 				Count: len(roomIDs),
 			},
 		},
@@ -679,16 +682,103 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	})
 }
 
+// Test that resuming a connection SYNCs the ranges and room subscriptions in the snapshot, and that the
+// snapshot is kept if the first request is rejected.
+func TestConnStateResume(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateResume_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", gomatrixserverlib.Timestamp(timestampNow-1000))
+	roomC := newRoomMetadata("!c:localhost", gomatrixserverlib.Timestamp(timestampNow-2000))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+			roomA.RoomID: &roomA,
+			roomB.RoomID: &roomB,
+			roomC.RoomID: &roomC,
+		}, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{})
+	cs.maxRoomSubscriptions = 1
+	listA := sync3.RequestList{
+		Sort: []string{sync3.SortByRecency},
+		Ranges: sync3.SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	}
+	cs.Resume(&sync3.ConnSnapshot{
+		UserID: userID,
+		Pos:    5,
+		Request: sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": listA},
+			RoomSubscriptions: map[string]sync3.RoomSubscription{
+				roomC.RoomID: {TimelineLimit: 1},
+			},
+		},
+		RoomSubscriptions: []string{roomC.RoomID},
+	})
+
+	// too many room subscriptions once combined with the snapshot
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomB.RoomID: {TimelineLimit: 1},
+		},
+	}, false)
+	if err == nil {
+		t.Fatalf("OnIncomingRequest: want error for too many room subscriptions, got none")
+	}
+
+	// the retried request still resumes from the snapshot
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": listA},
+	}, false)
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     []int64{0, 1},
+						RoomIDs: []string{
+							roomA.RoomID, roomB.RoomID,
+						},
+					},
+				},
+			},
+		},
+		// rooms are sent in full as the snapshot doesn't say what the client has seen
+		Rooms: map[string]sync3.Room{
+			roomA.RoomID: {Initial: true},
+			roomB.RoomID: {Initial: true},
+			roomC.RoomID: {Initial: true},
+		},
+	})
+}
+
 func checkResponse(t *testing.T, checkRoomIDsOnly bool, got, want *sync3.Response) {
 	t.Helper()
 	if len(got.Lists) != len(want.Lists) {
 		t.Errorf("got %v lists, want %v", len(got.Lists), len(want.Lists))
 	}
-	for i := 0; i < len(want.Lists); i++ {
-		wl := want.Lists[i]
-		gl := got.Lists[i]
+	for listKey, wl := range want.Lists {
+		gl := got.Lists[listKey]
 		if wl.Count > 0 && gl.Count != wl.Count {
-			t.Errorf("response list %d got count %d want %d", i, gl.Count, wl.Count)
+			t.Errorf("response list %v got count %d want %d", listKey, gl.Count, wl.Count)
 		}
 
 		if len(wl.Ops) > 0 {
@@ -2,12 +2,14 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
@@ -18,14 +20,15 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
 )
 
 const DefaultSessionID = "default"
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("sync3/handler")
+
+// Pollers are created by this package but log as part of the sync2 subsystem.
+var pollerLogger = internal.NewLogger("sync2")
 
 // This is a net.http Handler for sync v3. It is responsible for pairing requests to Conns and to
 // ensure that the sync v2 poller is running for this client.
@@ -44,25 +47,59 @@ type SyncLiveHandler struct {
 	Dispatcher *sync3.Dispatcher
 
 	GlobalCache *caches.GlobalCache
+
+	// Requests which exceed these limits are rejected.
+	Limits sync3.RequestLimits
+	// Rate limits requests. May be nil, in which case there is no rate limiting.
+	RateLimiter *RateLimiter
+	// The number of consecutive failed requests to the upstream server before this instance reports
+	// itself as not ready. 0 means upstream failures never affect readiness.
+	MaxUpstreamFailures int64
+	// Compresses responses. May be nil, in which case responses are not compressed.
+	Compressor *internal.Compressor
+
+	// the client for the upstream servers, which tracks their health
+	upstream sync2.Client
+	// writes connection snapshots off the request path
+	connPersister *connPersister
+	// wakes up v2 /sync requests when there is new data
+	v2Notifier v2Notifier
+	// set to 1 once StartV2Pollers has started the pollers for all known devices, accessed atomically
+	pollersStarted int32
 }
 
 func NewSync3Handler(v2Client sync2.Client, postgresDBURI, secret string, debug bool) (*SyncLiveHandler, error) {
 	if debug {
-		zerolog.SetGlobalLevel(zerolog.TraceLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+		internal.SetLogLevel(zerolog.TraceLevel)
 	}
 	store := state.NewStorage(postgresDBURI)
+	// the routing client tracks the health of each upstream itself, as one failing doesn't affect the others
+	upstream := v2Client
+	if _, ok := v2Client.(*sync2.RoutingClient); !ok {
+		upstream = sync2.NewHealthTrackingClient(v2Client)
+	}
+	compressor, err := internal.NewCompressor(internal.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	// closed connections can never be resumed, so their snapshots are deleted when they are closed
+	persister := newConnPersister(store.ConnectionsTable)
 	sh := &SyncLiveHandler{
-		V2:          v2Client,
-		Storage:     store,
-		V2Store:     sync2.NewStore(postgresDBURI, secret),
-		ConnMap:     sync3.NewConnMap(),
-		userCaches:  &sync.Map{},
-		Dispatcher:  sync3.NewDispatcher(),
-		GlobalCache: caches.NewGlobalCache(store),
-	}
-	sh.PollerMap = sync2.NewPollerMap(v2Client, sh)
+		V2:                  upstream,
+		Storage:             store,
+		V2Store:             sync2.NewStore(postgresDBURI, secret),
+		ConnMap:             sync3.NewConnMap(persister.Delete),
+		userCaches:          &sync.Map{},
+		Dispatcher:          sync3.NewDispatcher(),
+		GlobalCache:         caches.NewGlobalCache(store),
+		Limits:              sync3.DefaultRequestLimits,
+		RateLimiter:         NewRateLimiter(DefaultRateLimits),
+		MaxUpstreamFailures: DefaultMaxUpstreamFailures,
+		Compressor:          compressor,
+		upstream:            upstream,
+		connPersister:       persister,
+	}
+	sh.PollerMap = sync2.NewPollerMap(upstream, sh)
 	sh.Extensions = &extensions.Handler{
 		Store:       store,
 		E2EEFetcher: sh.PollerMap,
@@ -87,11 +124,17 @@ func NewSync3Handler(v2Client sync2.Client, postgresDBURI, secret string, debug
 		return nil, fmt.Errorf("failed to populate global cache: %s", err)
 	}
 
+	// connections which have been idle for longer than the TTL cannot be resumed
+	if err := store.ConnectionsTable.DeleteOlderThan(time.Now().Add(-sync3.ConnTTL)); err != nil {
+		logger.Warn().Err(err).Msg("failed to delete expired connection snapshots")
+	}
+
 	return sh, nil
 }
 
 // used in tests to close postgres connections
 func (h *SyncLiveHandler) Teardown() {
+	h.connPersister.Stop()
 	h.Storage.Teardown()
 }
 
@@ -122,13 +165,14 @@ func (h *SyncLiveHandler) StartV2Pollers() {
 			defer wg.Done()
 			for d := range ch {
 				h.PollerMap.EnsurePolling(
-					d.AccessToken, d.UserID, d.DeviceID, d.Since,
-					logger.With().Str("user_id", d.UserID).Logger(),
+					d.AccessToken, d.UserID, d.DeviceID, d.Since, "",
+					pollerLogger.With().Str("user_id", d.UserID).Logger(),
 				)
 			}
 		}()
 	}
 	wg.Wait()
+	atomic.StoreInt32(&h.pollersStarted, 1)
 	logger.Info().Msg("StartV2Pollers finished")
 }
 
@@ -137,18 +181,29 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	ctx, task := internal.StartTask(internal.ExtractTraceContext(req.Context(), req.Header), "SlidingSync")
+	defer task.End()
+	req = req.WithContext(ctx)
 	err := h.serve(w, req)
 	if err != nil {
-		herr, ok := err.(*internal.HandlerError)
-		if !ok {
-			herr = &internal.HandlerError{
-				StatusCode: 500,
-				Err:        err,
-			}
+		writeError(w, task, err)
+	}
+}
+
+// writeError sends the error to the client as a Matrix error response.
+func writeError(w http.ResponseWriter, task *internal.TraceTask, err error) {
+	herr, ok := err.(*internal.HandlerError)
+	if !ok {
+		herr = &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
 		}
-		w.WriteHeader(herr.StatusCode)
-		w.Write(herr.JSON())
 	}
+	task.SetAttribute("status", herr.StatusCode)
+	task.SetError(herr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.StatusCode)
+	w.Write(herr.JSON())
 }
 
 // Entry point for sync v3
@@ -161,9 +216,18 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			return &internal.HandlerError{
 				StatusCode: 400,
 				Err:        err,
+				ErrCode:    internal.ErrCodeBadJSON,
 			}
 		}
 	}
+	if err := requestBody.Validate(&h.Limits); err != nil {
+		hlog.FromRequest(req).Warn().Err(err).Msg("rejecting invalid request")
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+			ErrCode:    internal.ErrCodeInvalidParam,
+		}
+	}
 
 	conn, err := h.setupConnection(req, &requestBody, req.URL.Query().Get("pos") != "")
 	if err != nil {
@@ -176,7 +240,13 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		return herr
 	}
 	requestBody.SetPos(cpos)
+	if herr = h.RateLimiter.Allow(conn.UserID(), conn.ConnID.String()); herr != nil {
+		hlog.FromRequest(req).Warn().Str("user", conn.UserID()).Int64("retry_after_ms", herr.RetryAfterMs).Msg("rate limited")
+		return herr
+	}
 	internal.SetRequestContextUserID(req.Context(), conn.UserID())
+	internal.SetTraceAttribute(req.Context(), "user", conn.UserID())
+	internal.SetTraceAttribute(req.Context(), "pos", cpos)
 	log := hlog.FromRequest(req).With().Str("user", conn.UserID()).Int64("pos", cpos).Logger()
 
 	var timeout int
@@ -198,6 +268,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		log.Err(herr).Msg("failed to OnIncomingRequest")
 		return herr
 	}
+	h.persistConn(conn)
 	// for logging
 	var numToDeviceEvents int
 	if resp.Extensions.ToDevice != nil {
@@ -209,9 +280,15 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	}
 	internal.SetRequestContextResponseInfo(req.Context(), cpos, resp.PosInt(), len(resp.Rooms), requestBody.TxnID, numToDeviceEvents, numGlobalAccountData)
 
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if err = h.Compressor.Write(w, req, 200, body); err != nil {
 		return &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
@@ -226,14 +303,16 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Request, containsPos bool) (*sync3.Conn, error) {
 	log := hlog.FromRequest(req)
 	var conn *sync3.Conn
+	var resumeFrom *sync3.ConnSnapshot
 
 	// Identify the device
 	deviceID, accessToken, err := internal.HashedTokenFromRequest(req)
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to get device ID from request")
 		return nil, &internal.HandlerError{
-			StatusCode: 400,
+			StatusCode: 401,
 			Err:        err,
+			ErrCode:    internal.ErrCodeMissingToken,
 		}
 	}
 
@@ -254,15 +333,77 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
 			return conn, nil
 		}
-		// conn doesn't exist, we probably nuked it.
+		// conn doesn't exist, we probably nuked it or restarted. If we restarted, we can resume it.
+		resumeFrom = h.loadConnSnapshot(req, deviceID)
+		if resumeFrom == nil {
+			return nil, &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("session expired"),
+				ErrCode:    internal.ErrCodeUnknownPos,
+			}
+		}
+	}
+
+	// We're going to make a new connection
+	// Ensure we have the v2 side of things hooked up
+	v2device, err := h.identifyDevice(req, deviceID, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if resumeFrom != nil && resumeFrom.UserID != v2device.UserID {
+		log.Warn().Str("user", v2device.UserID).Str("snapshot_user", resumeFrom.UserID).Msg("connection snapshot is for a different user")
 		return nil, &internal.HandlerError{
 			StatusCode: 400,
 			Err:        fmt.Errorf("session expired"),
+			ErrCode:    internal.ErrCodeUnknownPos,
 		}
 	}
 
-	// We're going to make a new connection
-	// Ensure we have the v2 side of things hooked up
+	if err = h.ensurePolling(req, v2device); err != nil {
+		return nil, err
+	}
+
+	userCache, err := h.userCache(v2device.UserID)
+	if err != nil {
+		log.Warn().Err(err).Str("user_id", v2device.UserID).Msg("failed to load user cache")
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+
+	// Now the v2 side of things are running, we can make a v3 live sync conn
+	// NB: this isn't inherently racey (we did the check for an existing conn before EnsurePolling)
+	// because we *either* do the existing check *or* make a new conn. It's important for CreateConn
+	// to check for an existing connection though, as it's possible for the client to call /sync
+	// twice for a new connection.
+	conn, created := h.ConnMap.CreateConn(sync3.ConnID{
+		DeviceID: deviceID,
+	}, func() sync3.ConnHandler {
+		cs := NewConnState(v2device.UserID, v2device.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher)
+		cs.maxRoomSubscriptions = h.Limits.MaxRoomSubscriptions
+		if resumeFrom != nil {
+			cs.Resume(resumeFrom)
+		}
+		return cs
+	})
+	if resumeFrom != nil && created {
+		// only a connection made from the snapshot can resume from it, not one which was already live
+		conn.Resume(resumeFrom.Pos)
+		log.Info().Str("user", v2device.UserID).Str("conn_id", conn.ConnID.String()).Int64("pos", resumeFrom.Pos).Msg("resumed connection")
+	} else if created {
+		log.Info().Str("user", v2device.UserID).Str("conn_id", conn.ConnID.String()).Msg("created new connection")
+	} else {
+		log.Info().Str("user", v2device.UserID).Str("conn_id", conn.ConnID.String()).Msg("using existing connection")
+	}
+	return conn, nil
+}
+
+// identifyDevice returns the v2 device for this access token, asking the upstream server who the user
+// is if this is the first time the token has been seen. Rate limited as it may hit the upstream server.
+func (h *SyncLiveHandler) identifyDevice(req *http.Request, deviceID, accessToken string) (*sync2.Device, error) {
+	log := hlog.FromRequest(req)
 	v2device, err := h.V2Store.InsertDevice(deviceID, accessToken)
 	if err != nil {
 		log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to insert v2 device")
@@ -271,64 +412,94 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 			Err:        err,
 		}
 	}
+	// creating connections may hit the upstream server, so is rate limited separately
+	rateLimitKey := v2device.UserID
+	if rateLimitKey == "" {
+		rateLimitKey = deviceID
+	}
+	if herr := h.RateLimiter.AllowInitial(v2device.UserID, rateLimitKey); herr != nil {
+		log.Warn().Str("user", v2device.UserID).Int64("retry_after_ms", herr.RetryAfterMs).Msg("rate limited new connection")
+		return nil, herr
+	}
 	if v2device.UserID == "" {
-		v2device.UserID, err = h.V2.WhoAmI(accessToken)
+		// the user, and so their homeserver, is unknown for new tokens
+		v2device.UserID, err = h.V2.WhoAmI("", accessToken)
 		if err != nil {
 			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to get user ID from device ID")
-			return nil, &internal.HandlerError{
-				StatusCode: http.StatusBadGateway,
-				Err:        err,
-			}
+			return nil, upstreamError(err)
 		}
 		if err = h.V2Store.UpdateUserIDForDevice(deviceID, v2device.UserID); err != nil {
 			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to persist user ID -> device ID mapping")
 			// non-fatal, we can still work without doing this
 		}
 	}
+	return v2device, nil
+}
 
+// ensurePolling makes sure there is a v2 poller for this device, blocking until it has done its first sync
+// if it was just made. Returns an error if the access token was rejected or the client has given up.
+func (h *SyncLiveHandler) ensurePolling(req *http.Request, v2device *sync2.Device) error {
+	log := hlog.FromRequest(req)
 	log.Trace().Str("user", v2device.UserID).Msg("checking poller exists and is running")
 	h.PollerMap.EnsurePolling(
-		accessToken, v2device.UserID, v2device.DeviceID, v2device.Since,
-		hlog.FromRequest(req).With().Str("user_id", v2device.UserID).Logger(),
+		v2device.AccessToken, v2device.UserID, v2device.DeviceID, v2device.Since, internal.RequestID(req.Context()),
+		pollerLogger.With().Str("user_id", v2device.UserID).Str("device_id", v2device.DeviceID).Logger(),
 	)
 	log.Trace().Str("user", v2device.UserID).Msg("poller exists and is running")
+	if h.PollerMap.Terminated(v2device.DeviceID) {
+		log.Warn().Str("user", v2device.UserID).Msg("access token was rejected by the upstream server")
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        fmt.Errorf("access token has been invalidated"),
+			ErrCode:    internal.ErrCodeUnknownToken,
+		}
+	}
 	// this may take a while so if the client has given up (e.g timed out) by this point, just stop.
 	// We'll be quicker next time as the poller will already exist.
 	if req.Context().Err() != nil {
 		log.Warn().Str("user_id", v2device.UserID).Msg(
 			"client gave up, not creating connection",
 		)
-		return nil, &internal.HandlerError{
+		return &internal.HandlerError{
 			StatusCode: 400,
 			Err:        req.Context().Err(),
 		}
 	}
+	return nil
+}
 
-	userCache, err := h.userCache(v2device.UserID)
+// loadConnSnapshot returns the persisted snapshot for this connection if it can be resumed from the
+// position in the request, else nil.
+func (h *SyncLiveHandler) loadConnSnapshot(req *http.Request, connID string) *sync3.ConnSnapshot {
+	log := hlog.FromRequest(req)
+	pos, herr := parseIntFromQuery(req.URL, "pos")
+	if herr != nil {
+		return nil
+	}
+	_, data, updatedAt, err := h.Storage.ConnectionsTable.Select(connID)
 	if err != nil {
-		log.Warn().Err(err).Str("user_id", v2device.UserID).Msg("failed to load user cache")
-		return nil, &internal.HandlerError{
-			StatusCode: 500,
-			Err:        err,
-		}
+		log.Warn().Err(err).Str("conn_id", connID).Msg("failed to load connection snapshot")
+		return nil
 	}
-
-	// Now the v2 side of things are running, we can make a v3 live sync conn
-	// NB: this isn't inherently racey (we did the check for an existing conn before EnsurePolling)
-	// because we *either* do the existing check *or* make a new conn. It's important for CreateConn
-	// to check for an existing connection though, as it's possible for the client to call /sync
-	// twice for a new connection.
-	conn, created := h.ConnMap.CreateConn(sync3.ConnID{
-		DeviceID: deviceID,
-	}, func() sync3.ConnHandler {
-		return NewConnState(v2device.UserID, v2device.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher)
-	})
-	if created {
-		log.Info().Str("user", v2device.UserID).Str("conn_id", conn.ConnID.String()).Msg("created new connection")
-	} else {
-		log.Info().Str("user", v2device.UserID).Str("conn_id", conn.ConnID.String()).Msg("using existing connection")
+	if data == nil || time.Since(updatedAt) > sync3.ConnTTL {
+		return nil
 	}
-	return conn, nil
+	var snapshot sync3.ConnSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		log.Warn().Err(err).Str("conn_id", connID).Msg("failed to unmarshal connection snapshot")
+		return nil
+	}
+	// we can only resume from the last response sent, as we don't know what earlier responses contained
+	if snapshot.Pos != pos {
+		return nil
+	}
+	return &snapshot
+}
+
+// persistConn stores a snapshot of the connection so it can be resumed if the server restarts. The
+// snapshot is written asynchronously.
+func (h *SyncLiveHandler) persistConn(conn *sync3.Conn) {
+	h.connPersister.Persist(conn)
 }
 
 func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
@@ -337,14 +508,35 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	if ok {
 		return c.(*caches.UserCache), nil
 	}
+	upstream, err := h.upstreamForUser(userID)
+	if err != nil {
+		return nil, err
+	}
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h.PollerMap)
+	uc.Upstream = upstream
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
-	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
-		uc.OnUnreadCounts(roomID, &highlightCount, &notificationCount)
+	err = h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+		uc.OnUnreadCounts(roomID, &highlightCount, &notificationCount, nil)
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to load unread counts: %s", err)
 	}
+	threadCounts := make(map[string]map[string]state.UnreadCounts)
+	err = h.Storage.UnreadTable.SelectAllNonZeroThreadCountsForUser(userID, func(roomID, threadID string, highlightCount, notificationCount int) {
+		if threadCounts[roomID] == nil {
+			threadCounts[roomID] = make(map[string]state.UnreadCounts)
+		}
+		threadCounts[roomID][threadID] = state.UnreadCounts{
+			HighlightCount:    highlightCount,
+			NotificationCount: notificationCount,
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load thread unread counts: %s", err)
+	}
+	for roomID, counts := range threadCounts {
+		uc.OnUnreadCounts(roomID, nil, nil, counts)
+	}
 	// select the DM account data event and set DM room status
 	directEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, "m.direct")
 	if err != nil {
@@ -363,6 +555,33 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(tagEvents)
 	}
 
+	// select the ignored users list. This has to be done before loading invites so we can ignore
+	// invites from ignored users.
+	ignoredEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, "m.ignored_user_list")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ignored users: %s", err)
+	}
+	if ignoredEvent != nil {
+		uc.OnAccountData([]state.AccountData{*ignoredEvent})
+	}
+
+	// select left rooms. This has to be done before loading invites as the user may have been re-invited
+	// to a room they left.
+	leftRooms, err := h.Storage.LeftRoomsTable.SelectAllLeftRoomsForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load left rooms for user: %s", err)
+	}
+	for roomID := range leftRooms {
+		// the user may have rejoined the room since they left
+		if h.Dispatcher.IsUserJoined(userID, roomID) {
+			if err = h.Storage.LeftRoomsTable.RemoveLeftRoom(userID, roomID); err != nil {
+				logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to remove rejoined left room")
+			}
+			delete(leftRooms, roomID)
+		}
+	}
+	uc.MarkLeftRooms(leftRooms)
+
 	// select outstanding invites
 	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
 	if err != nil {
@@ -372,6 +591,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnInvite(roomID, inviteState)
 	}
 
+	// select outstanding knocks
+	knocks, err := h.Storage.KnocksTable.SelectAllKnocksForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outstanding knocks for user: %s", err)
+	}
+	for roomID, knockState := range knocks {
+		uc.OnKnock(roomID, knockState)
+	}
+
 	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
 	// at the same time
 	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
@@ -387,6 +615,36 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	return uc, nil
 }
 
+// UpstreamServers returns the upstream homeserver for each server name, if requests are routed to
+// several homeservers. Returns nil if there is a single upstream.
+func (h *SyncLiveHandler) UpstreamServers() map[string]string {
+	if rc, ok := h.upstream.(*sync2.RoutingClient); ok {
+		return rc.Servers()
+	}
+	return nil
+}
+
+// upstreamForUser returns the base URL of the homeserver for this user if requests are routed to several
+// homeservers, or the empty string if there is a single upstream.
+func (h *SyncLiveHandler) upstreamForUser(userID string) (string, error) {
+	if rc, ok := h.upstream.(*sync2.RoutingClient); ok {
+		return rc.UpstreamForUser(userID)
+	}
+	return "", nil
+}
+
+// upstreamFailures returns the number of consecutive failed requests to each upstream server which affects
+// readiness, keyed by base URL if there are several upstreams.
+func (h *SyncLiveHandler) upstreamFailures() map[string]int64 {
+	switch c := h.upstream.(type) {
+	case *sync2.RoutingClient:
+		return c.ConsecutiveFailures()
+	case *sync2.HealthTrackingClient:
+		return map[string]int64{"": c.ConsecutiveFailures()}
+	}
+	return nil
+}
+
 // Called from the v2 poller, implements V2DataReceiver
 func (h *SyncLiveHandler) UpdateDeviceSince(deviceID, since string) {
 	err := h.V2Store.UpdateDeviceSince(deviceID, since)
@@ -396,12 +654,29 @@ func (h *SyncLiveHandler) UpdateDeviceSince(deviceID, since string) {
 }
 
 // Called from the v2 poller, implements V2DataReceiver
-func (h *SyncLiveHandler) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) {
-	numNew, latestPos, err := h.Storage.Accumulate(roomID, prevBatch, timeline)
+func (h *SyncLiveHandler) Accumulate(userID, roomID, prevBatch string, timeline []json.RawMessage) {
+	upstream, err := h.upstreamForUser(userID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("V2: failed to get upstream for user")
+		return
+	}
+	// prev_batch tokens only work on the homeserver which issued them, so with several upstreams they
+	// are stored separately for each upstream, including for timelines another upstream sent first.
+	accumulatePrevBatch := prevBatch
+	if upstream != "" {
+		accumulatePrevBatch = ""
+	}
+	numNew, latestPos, err := h.Storage.Accumulate(roomID, accumulatePrevBatch, timeline)
 	if err != nil {
 		logger.Err(err).Int("timeline", len(timeline)).Str("room", roomID).Msg("V2: failed to accumulate room")
 		return
 	}
+	if upstream != "" && prevBatch != "" && len(timeline) > 0 {
+		eventID := gjson.GetBytes(timeline[0], "event_id").Str
+		if err = h.Storage.PrevBatchTable.Insert(upstream, roomID, eventID, prevBatch); err != nil {
+			logger.Err(err).Str("upstream", upstream).Str("room", roomID).Msg("V2: failed to store prev_batch")
+		}
+	}
 	if numNew == 0 {
 		// no new events
 		return
@@ -410,6 +685,7 @@ func (h *SyncLiveHandler) Accumulate(roomID, prevBatch string, timeline []json.R
 
 	// we have new events, notify active connections
 	h.Dispatcher.OnNewEvents(roomID, newEvents, latestPos)
+	h.notifyRoom(roomID, newEvents)
 }
 
 // Called from the v2 poller, implements V2DataReceiver
@@ -425,6 +701,7 @@ func (h *SyncLiveHandler) Initialise(roomID string, state []json.RawMessage) {
 	}
 	// we have new state, notify caches
 	h.Dispatcher.OnNewEvents(roomID, state, 0)
+	h.notifyRoom(roomID, state)
 }
 
 // Called from the v2 poller, implements V2DataReceiver
@@ -432,7 +709,9 @@ func (h *SyncLiveHandler) SetTyping(roomID string, userIDs []string) {
 	_, err := h.Storage.TypingTable.SetTyping(roomID, userIDs)
 	if err != nil {
 		logger.Err(err).Strs("users", userIDs).Str("room", roomID).Msg("V2: failed to store typing")
+		return
 	}
+	h.notifyRoom(roomID, nil)
 }
 
 // Called from the v2 poller, implements V2DataReceiver
@@ -442,19 +721,39 @@ func (h *SyncLiveHandler) AddToDeviceMessages(userID, deviceID string, msgs []js
 	_, err := h.Storage.ToDeviceTable.InsertMessages(deviceID, msgs)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Int("msgs", len(msgs)).Msg("V2: failed to store to-device messages")
+		return
 	}
+	h.v2Notifier.notify(userID)
 }
 
-func (h *SyncLiveHandler) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
+func (h *SyncLiveHandler) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int, threadNotifs map[string]sync2.UnreadNotifications) {
 	err := h.Storage.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread counters")
 	}
+	var threadCounts map[string]state.UnreadCounts
+	if threadNotifs != nil {
+		threadCounts = make(map[string]state.UnreadCounts, len(threadNotifs))
+		for threadID, notifs := range threadNotifs {
+			var counts state.UnreadCounts
+			if notifs.HighlightCount != nil {
+				counts.HighlightCount = *notifs.HighlightCount
+			}
+			if notifs.NotificationCount != nil {
+				counts.NotificationCount = *notifs.NotificationCount
+			}
+			threadCounts[threadID] = counts
+		}
+		err = h.Storage.UnreadTable.UpdateThreadUnreadCounters(userID, roomID, threadCounts)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update thread unread counters")
+		}
+	}
 	userCache, ok := h.userCaches.Load(userID)
 	if !ok {
 		return
 	}
-	userCache.(*caches.UserCache).OnUnreadCounts(roomID, highlightCount, notifCount)
+	userCache.(*caches.UserCache).OnUnreadCounts(roomID, highlightCount, notifCount, threadCounts)
 }
 
 func (h *SyncLiveHandler) OnInvite(userID, roomID string, inviteState []json.RawMessage) {
@@ -462,6 +761,12 @@ func (h *SyncLiveHandler) OnInvite(userID, roomID string, inviteState []json.Raw
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert invite")
 	}
+	// the user may have been invited in response to a knock
+	err = h.Storage.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+	}
+	h.v2Notifier.notify(userID)
 	userCache, ok := h.userCaches.Load(userID)
 	if !ok {
 		return
@@ -469,17 +774,64 @@ func (h *SyncLiveHandler) OnInvite(userID, roomID string, inviteState []json.Raw
 	userCache.(*caches.UserCache).OnInvite(roomID, inviteState)
 }
 
-func (h *SyncLiveHandler) OnLeftRoom(userID, roomID string) {
+func (h *SyncLiveHandler) OnKnock(userID, roomID string, knockState []json.RawMessage) {
+	err := h.Storage.KnocksTable.InsertKnock(userID, roomID, knockState)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert knock")
+	}
+	userCache, ok := h.userCaches.Load(userID)
+	if !ok {
+		return
+	}
+	userCache.(*caches.UserCache).OnKnock(roomID, knockState)
+}
+
+func (h *SyncLiveHandler) OnLeftRoom(userID, roomID string, leaveEvent json.RawMessage) {
+	// if the user was never joined, the invite or knock is all they were allowed to see, so keep hold of it
+	strippedState, err := h.Storage.InvitesTable.SelectInvite(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to select invite for left room")
+	}
+	if strippedState == nil {
+		strippedState, err = h.Storage.KnocksTable.SelectKnock(userID, roomID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to select knock for left room")
+		}
+	}
 	// remove any invites for this user if they are rejecting an invite
-	err := h.Storage.InvitesTable.RemoveInvite(userID, roomID)
+	err = h.Storage.InvitesTable.RemoveInvite(userID, roomID)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire invite")
 	}
+	// remove any knocks for this user if their knock was rejected or withdrawn
+	err = h.Storage.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+	}
+	// remember the room state at the leave event if the user was joined, so we don't leak newer state to them
+	var snapshotID int64
+	if leaveEventID := gjson.GetBytes(leaveEvent, "event_id").Str; leaveEventID != "" {
+		snapshotID, err = h.Storage.LeftRoomSnapshotID(userID, leaveEventID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to find state snapshot for left room")
+		}
+	}
+	leftRoom := state.LeftRoom{
+		LeaveEvent: leaveEvent,
+		SnapshotID: snapshotID,
+	}
+	if snapshotID == 0 {
+		leftRoom.StrippedState = strippedState
+	}
+	if err = h.Storage.LeftRoomsTable.InsertLeftRoom(userID, roomID, leftRoom); err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert left room")
+	}
+	h.v2Notifier.notify(userID)
 	userCache, ok := h.userCaches.Load(userID)
 	if !ok {
 		return
 	}
-	userCache.(*caches.UserCache).OnLeftRoom(roomID)
+	userCache.(*caches.UserCache).OnLeftRoom(roomID, snapshotID != 0)
 }
 
 func (h *SyncLiveHandler) OnAccountData(userID, roomID string, events []json.RawMessage) {
@@ -488,6 +840,7 @@ func (h *SyncLiveHandler) OnAccountData(userID, roomID string, events []json.Raw
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update account data")
 		return
 	}
+	h.v2Notifier.notify(userID)
 	userCache, ok := h.userCaches.Load(userID)
 	if !ok {
 		return
@@ -495,6 +848,89 @@ func (h *SyncLiveHandler) OnAccountData(userID, roomID string, events []json.Raw
 	userCache.(*caches.UserCache).OnAccountData(data)
 }
 
+func (h *SyncLiveHandler) OnE2EEData(userID, deviceID string, changed, left []string) {
+	if err := h.Storage.DeviceListTable.Insert(deviceID, changed, left); err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to insert device list changes")
+		return
+	}
+	h.v2Notifier.notify(userID)
+}
+
+// Called when the poller for this device has stopped because the access token was rejected. Closes any
+// connection for this device so the client is told to log out on its next request.
+func (h *SyncLiveHandler) OnTerminated(userID, deviceID string) {
+	logger.Info().Str("user", userID).Str("device", deviceID).Msg("access token invalidated, closing connection")
+	h.closeDeviceConn(deviceID)
+}
+
+func (h *SyncLiveHandler) closeDeviceConn(deviceID string) {
+	connID := sync3.ConnID{DeviceID: deviceID}
+	h.ConnMap.CloseConn(connID)
+	// don't allow the connection to be resumed either. Closing the connection deletes its snapshot, but
+	// the connection may not exist if the server has restarted since it was last used.
+	if err := h.Storage.ConnectionsTable.Delete(connID.String()); err != nil {
+		logger.Warn().Err(err).Str("device", deviceID).Msg("failed to delete connection snapshot")
+	}
+}
+
+// StartTokenRevalidation periodically checks that the access tokens for connections which have been idle
+// for at least the interval are still valid, closing the connection if not. Pollers notice invalidated
+// tokens on their own, but only as often as they sync, which may be infrequent for quiet accounts.
+func (h *SyncLiveHandler) StartTokenRevalidation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.revalidateIdleConns(interval)
+		}
+	}()
+}
+
+func (h *SyncLiveHandler) revalidateIdleConns(idleFor time.Duration) {
+	for _, conn := range h.ConnMap.AllConns() {
+		if time.Since(conn.LastRequestTime()) < idleFor {
+			continue
+		}
+		deviceID := conn.ConnID.DeviceID
+		device, err := h.V2Store.Device(deviceID)
+		if err != nil || device.AccessToken == "" {
+			logger.Warn().Err(err).Str("device", deviceID).Msg("revalidateIdleConns: failed to load device")
+			continue
+		}
+		_, err = h.V2.WhoAmI(sync2.ServerName(conn.UserID()), device.AccessToken)
+		var httpErr *sync2.HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+			logger.Info().Str("user", conn.UserID()).Str("device", deviceID).Msg("access token invalidated, closing idle connection")
+			h.closeDeviceConn(deviceID)
+		} else if err != nil {
+			// the upstream server may be down: don't close connections which may be fine
+			logger.Warn().Err(err).Str("device", deviceID).Msg("revalidateIdleConns: failed to check access token")
+		}
+	}
+}
+
+// upstreamError converts an error from the upstream homeserver into an error for the client. Rejected
+// access tokens are passed through so clients can log out: everything else is a bad gateway.
+func upstreamError(err error) *internal.HandlerError {
+	var httpErr *sync2.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+		errCode := httpErr.ErrCode
+		if errCode == "" {
+			errCode = internal.ErrCodeUnknownToken
+		}
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+			ErrCode:    errCode,
+			SoftLogout: httpErr.SoftLogout,
+		}
+	}
+	return &internal.HandlerError{
+		StatusCode: http.StatusBadGateway,
+		Err:        err,
+	}
+}
+
 func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.HandlerError) {
 	queryPos := u.Query().Get(param)
 	if queryPos != "" {
@@ -504,6 +940,7 @@ func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.Ha
 			return 0, &internal.HandlerError{
 				StatusCode: 400,
 				Err:        fmt.Errorf("invalid %s: %s", param, queryPos),
+				ErrCode:    internal.ErrCodeInvalidParam,
 			}
 		}
 	}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxUpstreamFailures is the default number of consecutive failed requests to the upstream server
+// before this instance reports itself as not ready.
+const DefaultMaxUpstreamFailures = 5
+
+// Ready returns an error if this instance should not be sent traffic, either because it is still
+// starting up or because one of its dependencies is unavailable. The global cache is loaded in
+// NewSync3Handler, so this only needs to wait for the initial batch of pollers from StartV2Pollers.
+func (h *SyncLiveHandler) Ready() error {
+	if atomic.LoadInt32(&h.pollersStarted) == 0 {
+		return fmt.Errorf("v2 pollers are still starting")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Storage.Ping(ctx); err != nil {
+		return fmt.Errorf("database is unreachable: %s", err)
+	}
+	if h.MaxUpstreamFailures > 0 {
+		for baseURL, failures := range h.upstreamFailures() {
+			if failures < h.MaxUpstreamFailures {
+				continue
+			}
+			if baseURL == "" {
+				return fmt.Errorf("upstream server failed the last %d requests", failures)
+			}
+			return fmt.Errorf("upstream server %s failed the last %d requests", baseURL, failures)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package handler
+
+// LazyCache remembers which room members have been sent to the client on this connection when
+// lazy loading members, so they are not sent again.
+type LazyCache struct {
+	cache map[string]map[string]struct{} // room_id -> set of user IDs
+}
+
+func NewLazyCache() *LazyCache {
+	return &LazyCache{
+		cache: make(map[string]map[string]struct{}),
+	}
+}
+
+// IsSet returns true if the membership event for this user has already been sent to the client.
+func (lc *LazyCache) IsSet(roomID, userID string) bool {
+	_, exists := lc.cache[roomID][userID]
+	return exists
+}
+
+// Add remembers that the membership events for these users have been sent to the client.
+func (lc *LazyCache) Add(roomID string, userIDs ...string) {
+	members, exists := lc.cache[roomID]
+	if !exists {
+		members = make(map[string]struct{}, len(userIDs))
+		lc.cache[roomID] = members
+	}
+	for _, userID := range userIDs {
+		members[userID] = struct{}{}
+	}
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"sync"
+
+	"github.com/matrix-org/sync-v3/state"
+	"github.com/matrix-org/sync-v3/sync3"
+)
+
+// connPersister writes connection snapshots to the database in the background, so responses are not
+// delayed by a database write. Only the latest snapshot for each connection is written, so connections
+// which are responding faster than the database can keep up with do not build up a backlog.
+type connPersister struct {
+	table *state.ConnectionsTable
+	// conn ID -> the connection to persist the latest snapshot of. Closed connections have their snapshot
+	// deleted instead, so they cannot be resumed.
+	pending   map[string]*sync3.Conn
+	pendingMu *sync.Mutex
+	wake      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func newConnPersister(table *state.ConnectionsTable) *connPersister {
+	p := &connPersister{
+		table:     table,
+		pending:   make(map[string]*sync3.Conn),
+		pendingMu: &sync.Mutex{},
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Persist the latest snapshot of this connection.
+func (p *connPersister) Persist(conn *sync3.Conn) {
+	if conn.Closed() {
+		return
+	}
+	p.enqueue(conn)
+}
+
+// Delete the snapshot of this connection, which must have been closed.
+func (p *connPersister) Delete(conn *sync3.Conn) {
+	p.enqueue(conn)
+}
+
+// Stop the persister, waiting for pending snapshots to be written.
+func (p *connPersister) Stop() {
+	close(p.stop)
+	<-p.stopped
+}
+
+func (p *connPersister) enqueue(conn *sync3.Conn) {
+	p.pendingMu.Lock()
+	p.pending[conn.ConnID.String()] = conn
+	p.pendingMu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default: // already woken up
+	}
+}
+
+func (p *connPersister) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.wake:
+			p.flush()
+		case <-p.stop:
+			p.flush()
+			return
+		}
+	}
+}
+
+func (p *connPersister) flush() {
+	p.pendingMu.Lock()
+	pending := p.pending
+	p.pending = make(map[string]*sync3.Conn)
+	p.pendingMu.Unlock()
+	for connID, conn := range pending {
+		// the connection may have been closed after it asked to be persisted, in which case it must not be
+		// resurrected.
+		if conn.Closed() {
+			if err := p.table.Delete(connID); err != nil {
+				logger.Warn().Err(err).Str("conn_id", connID).Msg("failed to delete connection snapshot")
+			}
+			continue
+		}
+		snapshot := conn.Snapshot()
+		if snapshot == nil {
+			continue
+		}
+		if err := p.table.Upsert(connID, conn.UserID(), snapshot); err != nil {
+			logger.Warn().Err(err).Str("conn_id", connID).Msg("failed to persist connection snapshot")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/sync-v3/internal"
+)
+
+// RateLimitConfig configures rate limiting on the sliding sync endpoint. A rate of 0 disables that limit.
+type RateLimitConfig struct {
+	// The rate and burst for all requests made by a user, across all their connections.
+	UserRequestsPerSec float64
+	UserBurst          int
+	// The rate and burst for requests on a single connection.
+	ConnRequestsPerSec float64
+	ConnBurst          int
+	// The rate and burst for requests which create connections, keyed by user. These are expensive
+	// as they may hit the upstream homeserver.
+	InitialRequestsPerSec float64
+	InitialBurst          int
+	// Users who are never rate limited.
+	ExemptUserIDs []string
+}
+
+var DefaultRateLimits = RateLimitConfig{
+	UserRequestsPerSec:    20,
+	UserBurst:             100,
+	ConnRequestsPerSec:    10,
+	ConnBurst:             50,
+	InitialRequestsPerSec: 1,
+	InitialBurst:          10,
+}
+
+// RateLimiter rate limits sliding sync requests according to a RateLimitConfig.
+type RateLimiter struct {
+	user    *internal.RateLimiter
+	conn    *internal.RateLimiter
+	initial *internal.RateLimiter
+	exempt  map[string]struct{}
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{
+		exempt: make(map[string]struct{}, len(cfg.ExemptUserIDs)),
+	}
+	if cfg.UserRequestsPerSec > 0 {
+		rl.user = internal.NewRateLimiter(cfg.UserRequestsPerSec, cfg.UserBurst)
+	}
+	if cfg.ConnRequestsPerSec > 0 {
+		rl.conn = internal.NewRateLimiter(cfg.ConnRequestsPerSec, cfg.ConnBurst)
+	}
+	if cfg.InitialRequestsPerSec > 0 {
+		rl.initial = internal.NewRateLimiter(cfg.InitialRequestsPerSec, cfg.InitialBurst)
+	}
+	for _, userID := range cfg.ExemptUserIDs {
+		rl.exempt[userID] = struct{}{}
+	}
+	return rl
+}
+
+// AllowInitial checks if a request which will create a connection is allowed. The key is the user ID if
+// known, else something which identifies the device e.g the hashed access token.
+func (rl *RateLimiter) AllowInitial(userID, key string) *internal.HandlerError {
+	if rl == nil || rl.isExempt(userID) {
+		return nil
+	}
+	return limitExceeded(rl.initial, key, "too many new connections")
+}
+
+// Allow checks if a request on this connection is allowed.
+func (rl *RateLimiter) Allow(userID, connID string) *internal.HandlerError {
+	if rl == nil || rl.isExempt(userID) {
+		return nil
+	}
+	if herr := limitExceeded(rl.user, userID, "too many requests for this user"); herr != nil {
+		return herr
+	}
+	return limitExceeded(rl.conn, connID, "too many requests on this connection")
+}
+
+func (rl *RateLimiter) isExempt(userID string) bool {
+	_, exempt := rl.exempt[userID]
+	return userID != "" && exempt
+}
+
+func limitExceeded(limiter *internal.RateLimiter, key, reason string) *internal.HandlerError {
+	if limiter == nil {
+		return nil
+	}
+	ok, wait := limiter.Allow(key)
+	if ok {
+		return nil
+	}
+	return &internal.HandlerError{
+		StatusCode:   http.StatusTooManyRequests,
+		Err:          fmt.Errorf("%s", reason),
+		ErrCode:      internal.ErrCodeLimitExceeded,
+		RetryAfterMs: int64(wait / time.Millisecond),
+	}
+}
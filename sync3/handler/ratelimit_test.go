@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sync-v3/internal"
+)
+
+func TestRateLimiter(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	rl := NewRateLimiter(RateLimitConfig{
+		UserRequestsPerSec:    0.001,
+		UserBurst:             3,
+		ConnRequestsPerSec:    0.001,
+		ConnBurst:             2,
+		InitialRequestsPerSec: 0.001,
+		InitialBurst:          1,
+		ExemptUserIDs:         []string{bob},
+	})
+
+	// the connection budget runs out first
+	assertNoHandlerError(t, rl.Allow(alice, "conn1"))
+	assertNoHandlerError(t, rl.Allow(alice, "conn1"))
+	assertLimitExceeded(t, rl.Allow(alice, "conn1"))
+	// the user budget is shared across connections: the rejected request above still used a user token
+	assertLimitExceeded(t, rl.Allow(alice, "conn2"))
+
+	assertNoHandlerError(t, rl.AllowInitial(alice, alice))
+	assertLimitExceeded(t, rl.AllowInitial(alice, alice))
+	// unknown users are limited by the key given
+	assertNoHandlerError(t, rl.AllowInitial("", "device"))
+	assertLimitExceeded(t, rl.AllowInitial("", "device"))
+
+	// exempt users are never limited
+	for i := 0; i < 10; i++ {
+		assertNoHandlerError(t, rl.Allow(bob, "conn3"))
+		assertNoHandlerError(t, rl.AllowInitial(bob, bob))
+	}
+
+	// a nil rate limiter allows everything
+	var nilRateLimiter *RateLimiter
+	assertNoHandlerError(t, nilRateLimiter.Allow(alice, "conn1"))
+}
+
+func assertNoHandlerError(t *testing.T, herr *internal.HandlerError) {
+	t.Helper()
+	if herr != nil {
+		t.Fatalf("got error: %s", herr)
+	}
+}
+
+func assertLimitExceeded(t *testing.T, herr *internal.HandlerError) {
+	t.Helper()
+	if herr == nil {
+		t.Fatalf("request was not rate limited")
+	}
+	if herr.StatusCode != 429 || herr.ErrCode != internal.ErrCodeLimitExceeded || herr.RetryAfterMs <= 0 {
+		t.Fatalf("got %d %s retry_after_ms=%d, want 429 M_LIMIT_EXCEEDED with a retry_after_ms", herr.StatusCode, herr.ErrCode, herr.RetryAfterMs)
+	}
+}
@@ -0,0 +1,523 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sync-v3/internal"
+	"github.com/matrix-org/sync-v3/state"
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/rs/zerolog/hlog"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// The timeline limit when the client doesn't give one in its filter, which matches Synapse.
+	v2DefaultTimelineLimit = 10
+	// The max number of to-device messages in a single response.
+	v2ToDeviceLimit    = 100
+	v2SinceTokenPrefix = "v2_"
+)
+
+// v2SinceToken is the position of a v2 /sync response in each of the streams it is made from.
+type v2SinceToken struct {
+	EventNID int64
+	ToDevice int64
+	Typing   int64
+	// the user data stream orders account data, invites and left rooms
+	UserData int64
+	// the device list stream is per device, so only applies to the device which made the request
+	DeviceLists int64
+}
+
+func (t v2SinceToken) String() string {
+	return fmt.Sprintf("%s%d_%d_%d_%d_%d", v2SinceTokenPrefix, t.EventNID, t.ToDevice, t.Typing, t.UserData, t.DeviceLists)
+}
+
+func parseV2SinceToken(since string) (*v2SinceToken, error) {
+	parts := strings.Split(strings.TrimPrefix(since, v2SinceTokenPrefix), "_")
+	// tokens issued before device lists were tracked have 4 parts
+	if !strings.HasPrefix(since, v2SinceTokenPrefix) || (len(parts) != 4 && len(parts) != 5) {
+		return nil, fmt.Errorf("malformed since token: %s", since)
+	}
+	var positions [5]int64
+	for i := range parts {
+		pos, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil || pos < 0 {
+			return nil, fmt.Errorf("malformed since token: %s", since)
+		}
+		positions[i] = pos
+	}
+	return &v2SinceToken{
+		EventNID:    positions[0],
+		ToDevice:    positions[1],
+		Typing:      positions[2],
+		UserData:    positions[3],
+		DeviceLists: positions[4],
+	}, nil
+}
+
+// v2TimelineLimit returns the timeline limit in the filter query param. Only inline JSON filters are
+// supported, as filter IDs refer to filters stored on the upstream server.
+func v2TimelineLimit(filter string, maxLimit int64) int {
+	if !strings.HasPrefix(strings.TrimSpace(filter), "{") {
+		return v2DefaultTimelineLimit
+	}
+	limit := gjson.Get(filter, "room.timeline.limit")
+	if !limit.Exists() || limit.Int() <= 0 {
+		return v2DefaultTimelineLimit
+	}
+	if maxLimit > 0 && limit.Int() > maxLimit {
+		return int(maxLimit)
+	}
+	return int(limit.Int())
+}
+
+// v2Notifier wakes up v2 /sync requests which are waiting for new data for a user.
+type v2Notifier struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+// wait returns a channel which is closed the next time there is new data for this user. Call this
+// before loading data, so nothing which arrives whilst loading is missed.
+func (n *v2Notifier) wait(userID string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.waiters == nil {
+		n.waiters = make(map[string]chan struct{})
+	}
+	ch := n.waiters[userID]
+	if ch == nil {
+		ch = make(chan struct{})
+		n.waiters[userID] = ch
+	}
+	return ch
+}
+
+func (n *v2Notifier) notify(userIDs ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, userID := range userIDs {
+		if ch, ok := n.waiters[userID]; ok {
+			close(ch)
+			delete(n.waiters, userID)
+		}
+	}
+}
+
+// notifyRoom wakes up v2 /sync requests for users joined to this room, and users whose membership
+// changed in these events.
+func (h *SyncLiveHandler) notifyRoom(roomID string, events []json.RawMessage) {
+	userIDs := h.Dispatcher.JoinedUsersForRoom(roomID)
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str == "m.room.member" {
+			userIDs = append(userIDs, parsed.Get("state_key").Str)
+		}
+	}
+	h.v2Notifier.notify(userIDs...)
+}
+
+// ServeV2Sync serves the v2 /sync API from the proxy's own storage, for clients which do not support
+// sliding sync. Since tokens are positions in the proxy's streams rather than upstream since tokens, so
+// clients cannot switch between this and the upstream server without doing an initial sync.
+func (h *SyncLiveHandler) ServeV2Sync(w http.ResponseWriter, req *http.Request) {
+	ctx, task := internal.StartTask(internal.ExtractTraceContext(req.Context(), req.Header), "SyncV2")
+	defer task.End()
+	req = req.WithContext(ctx)
+	if err := h.serveV2Sync(w, req); err != nil {
+		writeError(w, task, err)
+	}
+}
+
+func (h *SyncLiveHandler) serveV2Sync(w http.ResponseWriter, req *http.Request) error {
+	query := req.URL.Query()
+	var since *v2SinceToken
+	if query.Get("since") != "" {
+		var err error
+		since, err = parseV2SinceToken(query.Get("since"))
+		if err != nil {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				Err:        err,
+				ErrCode:    internal.ErrCodeInvalidParam,
+			}
+		}
+	}
+	var timeout int64
+	if query.Get("timeout") != "" {
+		var herr *internal.HandlerError
+		timeout, herr = parseIntFromQuery(req.URL, "timeout")
+		if herr != nil {
+			return herr
+		}
+	}
+	fullState := query.Get("full_state") == "true"
+	timelineLimit := v2TimelineLimit(query.Get("filter"), h.Limits.MaxTimelineLimit)
+
+	deviceID, accessToken, err := internal.HashedTokenFromRequest(req)
+	if err != nil {
+		return &internal.HandlerError{
+			StatusCode: 401,
+			Err:        err,
+			ErrCode:    internal.ErrCodeMissingToken,
+		}
+	}
+	v2device, err := h.identifyDevice(req, deviceID, accessToken)
+	if err != nil {
+		return err
+	}
+	if err = h.ensurePolling(req, v2device); err != nil {
+		return err
+	}
+	if herr := h.RateLimiter.Allow(v2device.UserID, deviceID); herr != nil {
+		hlog.FromRequest(req).Warn().Str("user", v2device.UserID).Int64("retry_after_ms", herr.RetryAfterMs).Msg("rate limited")
+		return herr
+	}
+	internal.SetRequestContextUserID(req.Context(), v2device.UserID)
+	internal.SetTraceAttribute(req.Context(), "user", v2device.UserID)
+	log := hlog.FromRequest(req).With().Str("user", v2device.UserID).Str("since", query.Get("since")).Logger()
+
+	if since != nil {
+		// the client has received everything up to the since token, so acknowledge to-device messages
+		if err = h.Storage.ToDeviceTable.DeleteMessagesUpToAndIncluding(v2device.DeviceID, since.ToDevice); err != nil {
+			log.Err(err).Msg("failed to delete acknowledged to-device messages")
+			// non-fatal
+		}
+		if err = h.Storage.DeviceListTable.DeleteUpToAndIncluding(v2device.DeviceID, since.DeviceLists); err != nil {
+			log.Err(err).Msg("failed to delete acknowledged device list changes")
+			// non-fatal
+		}
+	}
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+	timedOut := false
+	for {
+		woken := h.v2Notifier.wait(v2device.UserID)
+		res, hasData, err := h.buildV2Response(req.Context(), v2device, since, fullState, timelineLimit)
+		if err != nil {
+			log.Err(err).Msg("failed to build v2 sync response")
+			return &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		// initial and full state syncs always return immediately
+		if hasData || timedOut || since == nil || fullState {
+			body, err := json.Marshal(res)
+			if err != nil {
+				return &internal.HandlerError{
+					StatusCode: 500,
+					Err:        err,
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err = h.Compressor.Write(w, req, 200, body); err != nil {
+				return &internal.HandlerError{
+					StatusCode: 500,
+					Err:        err,
+				}
+			}
+			return nil
+		}
+		select {
+		case <-woken:
+		case <-timer.C:
+			timedOut = true
+		case <-req.Context().Done():
+			return nil
+		}
+	}
+}
+
+// buildV2Response loads everything for this device since the since token, or everything if since is nil.
+// Returns true if the response contains new data.
+func (h *SyncLiveHandler) buildV2Response(
+	ctx context.Context, device *sync2.Device, since *v2SinceToken, fullState bool, timelineLimit int,
+) (res *sync2.SyncResponse, hasData bool, err error) {
+	ctx, span := internal.StartSpan(ctx, "buildV2Response")
+	defer span.End()
+	userID := device.UserID
+	initial := since == nil
+	var from v2SinceToken
+	if !initial {
+		from = *since
+	}
+	var to v2SinceToken
+	if to.EventNID, err = h.Storage.LatestEventNID(); err != nil {
+		return nil, false, fmt.Errorf("LatestEventNID: %s", err)
+	}
+	if to.Typing, err = h.Storage.LatestTypingID(); err != nil {
+		return nil, false, fmt.Errorf("LatestTypingID: %s", err)
+	}
+	if to.UserData, err = h.Storage.LatestUserDataID(); err != nil {
+		return nil, false, fmt.Errorf("LatestUserDataID: %s", err)
+	}
+	if to.DeviceLists, err = h.Storage.DeviceListTable.SelectHighestPosition(); err != nil {
+		return nil, false, fmt.Errorf("DeviceListTable.SelectHighestPosition: %s", err)
+	}
+	// positions can go backwards if a client sends a token from another proxy, so never go backwards
+	if to.EventNID < from.EventNID {
+		to.EventNID = from.EventNID
+	}
+	if to.Typing < from.Typing {
+		to.Typing = from.Typing
+	}
+	if to.UserData < from.UserData {
+		to.UserData = from.UserData
+	}
+	if to.DeviceLists < from.DeviceLists {
+		to.DeviceLists = from.DeviceLists
+	}
+
+	res = &sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join:   make(map[string]sync2.SyncV2JoinResponse),
+			Invite: make(map[string]sync2.SyncV2InviteResponse),
+			Leave:  make(map[string]sync2.SyncV2LeaveResponse),
+		},
+	}
+
+	// work out which rooms are in the join and leave sections
+	upstream, err := h.upstreamForUser(userID)
+	if err != nil {
+		return nil, false, err
+	}
+	timelines, err := h.Storage.VisibleTimelinesBetween(ctx, userID, upstream, from.EventNID, to.EventNID, timelineLimit)
+	if err != nil {
+		return nil, false, fmt.Errorf("VisibleTimelinesBetween: %s", err)
+	}
+	joinedRoomIDs, err := h.Storage.JoinedRoomsAfterPosition(userID, to.EventNID)
+	if err != nil {
+		return nil, false, fmt.Errorf("JoinedRoomsAfterPosition: %s", err)
+	}
+	joinedNow := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joinedNow[roomID] = true
+	}
+	joinedBefore := make(map[string]bool)
+	if !initial {
+		roomIDs, err := h.Storage.JoinedRoomsAfterPosition(userID, from.EventNID)
+		if err != nil {
+			return nil, false, fmt.Errorf("JoinedRoomsAfterPosition: %s", err)
+		}
+		for _, roomID := range roomIDs {
+			joinedBefore[roomID] = true
+		}
+	}
+	joinRoom := func(roomID string) sync2.SyncV2JoinResponse {
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			room.Timeline.Events = []json.RawMessage{}
+			room.State.Events = []json.RawMessage{}
+			room.Ephemeral.Events = []json.RawMessage{}
+			room.AccountData.Events = []json.RawMessage{}
+		}
+		return room
+	}
+	// room ID -> NID of the event to load the state before, 0 for the current state
+	stateBefore := make(map[string]int64)
+	for roomID, timeline := range timelines {
+		if !joinedNow[roomID] {
+			// only rooms the user left appear in the leave section: the last event they can see is their leave event
+			if initial || len(timeline.Events) == 0 || !isLeaveEventFor(timeline.Events[len(timeline.Events)-1], userID) {
+				continue
+			}
+			var leave sync2.SyncV2LeaveResponse
+			leave.State.Events = []json.RawMessage{}
+			leave.Timeline.Events = timeline.Events
+			leave.Timeline.Limited = timeline.Limited
+			leave.Timeline.PrevBatch = timeline.PrevBatch
+			res.Rooms.Leave[roomID] = leave
+			continue
+		}
+		room := joinRoom(roomID)
+		room.Timeline.Events = timeline.Events
+		room.Timeline.Limited = timeline.Limited
+		room.Timeline.PrevBatch = timeline.PrevBatch
+		res.Rooms.Join[roomID] = room
+		if initial || fullState || timeline.Limited || !joinedBefore[roomID] {
+			stateBefore[roomID] = timeline.FirstNID
+		}
+	}
+	if initial || fullState {
+		// include rooms without any new events
+		for roomID := range joinedNow {
+			if _, ok := res.Rooms.Join[roomID]; !ok {
+				res.Rooms.Join[roomID] = joinRoom(roomID)
+				stateBefore[roomID] = 0
+			}
+		}
+	}
+	if len(stateBefore) > 0 {
+		roomToState, err := h.Storage.StateBeforeEvents(ctx, stateBefore)
+		if err != nil {
+			return nil, false, fmt.Errorf("StateBeforeEvents: %s", err)
+		}
+		for roomID, stateEvents := range roomToState {
+			room := res.Rooms.Join[roomID]
+			room.State.Events = stateEvents
+			res.Rooms.Join[roomID] = room
+		}
+	}
+
+	// rooms the proxy has no events for e.g rejected invites appear in the left rooms table
+	if !initial {
+		leftRooms, err := h.Storage.LeftRoomsTable.SelectLeftRoomsSince(userID, from.UserData, to.UserData)
+		if err != nil {
+			return nil, false, fmt.Errorf("SelectLeftRoomsSince: %s", err)
+		}
+		for roomID, leaveEvent := range leftRooms {
+			if _, ok := res.Rooms.Leave[roomID]; ok || joinedNow[roomID] {
+				continue
+			}
+			var leave sync2.SyncV2LeaveResponse
+			leave.State.Events = []json.RawMessage{}
+			leave.Timeline.Events = []json.RawMessage{}
+			if len(leaveEvent) > 0 {
+				leave.Timeline.Events = append(leave.Timeline.Events, leaveEvent)
+			}
+			res.Rooms.Leave[roomID] = leave
+		}
+	}
+
+	// invites
+	var invites map[string][]json.RawMessage
+	if initial {
+		invites, err = h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
+	} else {
+		invites, err = h.Storage.InvitesTable.SelectInvitesSince(userID, from.UserData, to.UserData)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to select invites: %s", err)
+	}
+	for roomID, inviteState := range invites {
+		if joinedNow[roomID] {
+			continue
+		}
+		var invite sync2.SyncV2InviteResponse
+		invite.InviteState.Events = inviteState
+		res.Rooms.Invite[roomID] = invite
+	}
+
+	// account data
+	var accountData []state.AccountData
+	if initial {
+		accountData, err = h.Storage.AccountDatas(userID)
+		if err == nil && len(joinedRoomIDs) > 0 {
+			var roomAccountData []state.AccountData
+			roomAccountData, err = h.Storage.AccountDatas(userID, joinedRoomIDs...)
+			accountData = append(accountData, roomAccountData...)
+		}
+	} else {
+		accountData, err = h.Storage.AccountDatasSince(userID, from.UserData, to.UserData)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to select account data: %s", err)
+	}
+	res.AccountData.Events = []json.RawMessage{}
+	for _, ad := range accountData {
+		if ad.RoomID == state.AccountDataGlobalRoom {
+			res.AccountData.Events = append(res.AccountData.Events, ad.Data)
+			continue
+		}
+		if !joinedNow[ad.RoomID] {
+			continue
+		}
+		room := joinRoom(ad.RoomID)
+		room.AccountData.Events = append(room.AccountData.Events, ad.Data)
+		res.Rooms.Join[ad.RoomID] = room
+	}
+
+	// typing notifications
+	typingFrom := from.Typing
+	if fullState {
+		typingFrom = 0
+	}
+	if len(joinedRoomIDs) > 0 {
+		roomToTyping, err := h.Storage.TypingTable.TypingInRooms(joinedRoomIDs, typingFrom, to.Typing)
+		if err != nil {
+			return nil, false, fmt.Errorf("TypingInRooms: %s", err)
+		}
+		for roomID, userIDs := range roomToTyping {
+			if userIDs == nil {
+				userIDs = []string{}
+			}
+			typingEvent, err := json.Marshal(map[string]interface{}{
+				"type": "m.typing",
+				"content": map[string]interface{}{
+					"user_ids": userIDs,
+				},
+			})
+			if err != nil {
+				return nil, false, err
+			}
+			room := joinRoom(roomID)
+			room.Ephemeral.Events = append(room.Ephemeral.Events, typingEvent)
+			res.Rooms.Join[roomID] = room
+		}
+	}
+
+	// notification counts for every room in the response
+	unreadCounts := make(map[string][2]int)
+	err = h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+		unreadCounts[roomID] = [2]int{highlightCount, notificationCount}
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to select unread counts: %s", err)
+	}
+	for roomID, room := range res.Rooms.Join {
+		counts := unreadCounts[roomID]
+		room.UnreadNotifications = sync2.UnreadNotifications{
+			HighlightCount:    &counts[0],
+			NotificationCount: &counts[1],
+		}
+		res.Rooms.Join[roomID] = room
+	}
+
+	// to-device messages and E2EE data
+	res.ToDevice.Events, to.ToDevice, err = h.Storage.ToDeviceTable.Messages(device.DeviceID, from.ToDevice, -1, v2ToDeviceLimit)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to select to-device messages: %s", err)
+	}
+	if res.ToDevice.Events == nil {
+		res.ToDevice.Events = []json.RawMessage{}
+	}
+	if to.ToDevice < from.ToDevice {
+		to.ToDevice = from.ToDevice
+	}
+	res.DeviceListsOTKCount, res.DeviceUnusedFallbackKeyTypes = h.PollerMap.LatestOTKCounts(device.DeviceID)
+	// an initial sync is a snapshot of the current state, so only incremental syncs have device list changes
+	var changed, left []string
+	if !initial {
+		changed, left, err = h.Storage.DeviceListTable.Select(device.DeviceID, from.DeviceLists, to.DeviceLists)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to select device list changes: %s", err)
+		}
+	}
+	res.DeviceLists.Changed = changed
+	res.DeviceLists.Left = left
+
+	res.NextBatch = to.String()
+	hasData = len(res.Rooms.Join) > 0 || len(res.Rooms.Invite) > 0 || len(res.Rooms.Leave) > 0 ||
+		len(res.AccountData.Events) > 0 || len(res.ToDevice.Events) > 0 || len(changed) > 0 || len(left) > 0
+	return res, hasData, nil
+}
+
+// isLeaveEventFor returns true if this event is the user leaving or being banned from the room.
+func isLeaveEventFor(ev json.RawMessage, userID string) bool {
+	parsed := gjson.ParseBytes(ev)
+	if parsed.Get("type").Str != "m.room.member" || parsed.Get("state_key").Str != userID {
+		return false
+	}
+	membership := parsed.Get("content.membership").Str
+	return membership == "leave" || membership == "ban"
+}
@@ -0,0 +1,45 @@
+package handler
+
+import "testing"
+
+func TestV2SinceToken(t *testing.T) {
+	token := v2SinceToken{EventNID: 12, ToDevice: 3, Typing: 45, UserData: 6, DeviceLists: 78}
+	parsed, err := parseV2SinceToken(token.String())
+	if err != nil {
+		t.Fatalf("failed to parse %s: %s", token.String(), err)
+	}
+	if *parsed != token {
+		t.Errorf("got %+v want %+v", *parsed, token)
+	}
+	// older tokens have no device list position
+	parsed, err = parseV2SinceToken("v2_12_3_45_6")
+	if err != nil {
+		t.Fatalf("failed to parse 4 part token: %s", err)
+	}
+	if want := (v2SinceToken{EventNID: 12, ToDevice: 3, Typing: 45, UserData: 6}); *parsed != want {
+		t.Errorf("got %+v want %+v", *parsed, want)
+	}
+	for _, bad := range []string{"s72594_4483_1934", "v2_1_2_3", "v2_1_2_3_x", "v2_1_2_3_-4", "1_2_3_4", "v2_1_2_3_4_5_6"} {
+		if _, err = parseV2SinceToken(bad); err == nil {
+			t.Errorf("parseV2SinceToken(%q) returned no error", bad)
+		}
+	}
+}
+
+func TestV2TimelineLimit(t *testing.T) {
+	testCases := []struct {
+		filter string
+		want   int
+	}{
+		{"", v2DefaultTimelineLimit},
+		{"1234", v2DefaultTimelineLimit},
+		{`{"room":{"timeline":{"limit":5}}}`, 5},
+		{`{"room":{"timeline":{"limit":0}}}`, v2DefaultTimelineLimit},
+		{`{"room":{"timeline":{"limit":5000}}}`, 500},
+	}
+	for _, tc := range testCases {
+		if got := v2TimelineLimit(tc.filter, 500); got != tc.want {
+			t.Errorf("v2TimelineLimit(%q): got %d want %d", tc.filter, got, tc.want)
+		}
+	}
+}
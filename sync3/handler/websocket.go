@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matrix-org/sync-v3/internal"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// How often to ping the client. The connection is closed if nothing is read from the client
+	// for wsReadTimeout, so this must be shorter than that.
+	wsPingInterval = 30 * time.Second
+	wsReadTimeout  = 60 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// The max size of a frame sent by the client.
+	wsMaxFrameBytes = 1024 * 1024
+	// Errors are sent as close codes of this plus the HTTP status code e.g 4400, 4401, 4429.
+	wsCloseCodeBase = 4000
+	// The min ?timeout= in milliseconds. Requests are repeated as soon as the client acknowledges the last
+	// response, so a lower timeout would make the server send empty responses in a tight loop.
+	wsMinTimeoutMSecs = 1000
+)
+
+var upgrader = websocket.Upgrader{
+	EnableCompression: true,
+	// clients authenticate with an access token rather than cookies, so any origin is allowed as per allowCORS
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// WebSocketFrame is sent by clients over a WebSocket connection.
+type WebSocketFrame struct {
+	// The pos of the last response the client received. Every response must be acknowledged before
+	// the next one is sent.
+	Pos string `json:"pos,omitempty"`
+	// The request to process, which replaces the previous request. Must be set in the first frame, and
+	// if omitted afterwards the previous request is used. Sticky parameters behave as they do over HTTP.
+	Request *sync3.Request `json:"request,omitempty"`
+}
+
+// ServeWebSocket serves sliding sync over a WebSocket. The client sends WebSocketFrames and the
+// server sends a sync3.Response as soon as there is new data for the last request, or an error
+// response before closing the socket. Query parameters are the same as for HTTP requests, and the
+// access token may be given as ?access_token= as browsers cannot set headers on WebSockets.
+//
+// Acknowledgements map onto the pos handling in sync3.Conn: the server waits for the client to
+// acknowledge a response before asking the Conn for the next one, so if the socket is dropped
+// the client can reconnect with ?pos= set to the last pos it received, over either transport.
+func (h *SyncLiveHandler) ServeWebSocket(w http.ResponseWriter, req *http.Request) {
+	ctx, task := internal.StartTask(internal.ExtractTraceContext(req.Context(), req.Header), "SlidingSyncWebSocket")
+	defer task.End()
+	req = req.WithContext(ctx)
+	if accessToken := req.URL.Query().Get("access_token"); accessToken != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	// check everything we can before upgrading, so errors can be sent as normal HTTP responses
+	pos, herr := parseIntFromQuery(req.URL, "pos")
+	if herr != nil {
+		writeError(w, task, herr)
+		return
+	}
+	timeout := sync3.DefaultTimeoutMSecs
+	if req.URL.Query().Get("timeout") != "" {
+		timeout64, herr := parseIntFromQuery(req.URL, "timeout")
+		if herr != nil {
+			writeError(w, task, herr)
+			return
+		}
+		timeout = int(timeout64)
+	}
+	if timeout < wsMinTimeoutMSecs {
+		timeout = wsMinTimeoutMSecs
+	}
+	conn, err := h.setupConnection(req, &sync3.Request{}, pos != 0)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("failed to get or create Conn for websocket")
+		writeError(w, task, err)
+		return
+	}
+	internal.SetRequestContextUserID(req.Context(), conn.UserID())
+	internal.SetTraceAttribute(req.Context(), "user", conn.UserID())
+
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already responded to the client
+		hlog.FromRequest(req).Warn().Err(err).Msg("failed to upgrade to websocket")
+		return
+	}
+	defer ws.Close()
+	ws.EnableWriteCompression(h.Compressor != nil)
+	ws.SetReadLimit(wsMaxFrameBytes)
+
+	session := &wsSession{
+		h:        h,
+		ws:       ws,
+		conn:     conn,
+		timeout:  timeout,
+		ackedPos: pos,
+		sentPos:  pos,
+		log:      hlog.FromRequest(req).With().Str("user", conn.UserID()).Logger(),
+	}
+	herr = session.run(ctx)
+	if herr == nil {
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+		return
+	}
+	session.log.Warn().Err(herr).Int("status", herr.StatusCode).Msg("closing websocket")
+	task.SetAttribute("status", herr.StatusCode)
+	task.SetError(herr)
+	// send the error body so clients can handle errors the same way as over HTTP
+	ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	ws.WriteMessage(websocket.TextMessage, herr.JSON())
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(wsCloseCodeBase+herr.StatusCode, herr.ErrCode), time.Now().Add(wsWriteTimeout))
+}
+
+// wsSession is a single WebSocket connection for a sync3.Conn.
+type wsSession struct {
+	h       *SyncLiveHandler
+	ws      *websocket.Conn
+	conn    *sync3.Conn
+	timeout int
+	log     zerolog.Logger
+
+	// the pos of the last response the client has acknowledged
+	ackedPos int64
+	// the pos of the last response sent to the client. If it is ahead of ackedPos, the client has
+	// not acknowledged it yet.
+	sentPos int64
+}
+
+type wsResult struct {
+	resp *sync3.Response
+	herr *internal.HandlerError
+}
+
+// run sends responses until the client goes away or there is an error, which should be sent to the client.
+func (s *wsSession) run(ctx context.Context) *internal.HandlerError {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	frames := make(chan WebSocketFrame)
+	readErrs := make(chan error, 1)
+	go s.readFrames(ctx, frames, readErrs)
+	pinger := time.NewTicker(wsPingInterval)
+	defer pinger.Stop()
+
+	// requests from the client which have not been processed yet. They are processed in order, as
+	// each one may change sticky parameters.
+	var pendingReqs []*sync3.Request
+	// the last request processed, which is repeated to wait for new data
+	var currReq *sync3.Request
+	// set whilst a request is being processed by the Conn
+	var inflight <-chan wsResult
+	var cancelInflight context.CancelFunc
+	defer func() {
+		if cancelInflight != nil {
+			cancelInflight()
+		}
+	}()
+
+	for {
+		// only ask the Conn for the next response once the client has acknowledged the last one,
+		// else the Conn will think the client has missed it and resend it.
+		if inflight == nil && s.ackedPos == s.sentPos && (currReq != nil || len(pendingReqs) > 0) {
+			// the Conn may have been closed e.g the access token was invalidated. Looking it up also
+			// stops it from expiring, as this connection doesn't make HTTP requests.
+			if s.h.ConnMap.Conn(s.conn.ConnID) != s.conn {
+				return &internal.HandlerError{
+					StatusCode: 400,
+					Err:        fmt.Errorf("session expired"),
+					ErrCode:    internal.ErrCodeUnknownPos,
+				}
+			}
+			if len(pendingReqs) > 0 {
+				currReq = pendingReqs[0]
+				pendingReqs = pendingReqs[1:]
+			} else {
+				// the txn ID only applies to the response for the request which set it
+				currReq.TxnID = ""
+			}
+			// every request is rate limited, not just those sent by the client, as the client can make
+			// the server process requests by acknowledging responses.
+			if herr := s.h.RateLimiter.Allow(s.conn.UserID(), s.conn.ConnID.String()); herr != nil {
+				return herr
+			}
+			req := *currReq
+			req.SetPos(s.ackedPos)
+			req.SetTimeoutMSecs(s.timeout)
+			inflight, cancelInflight = s.process(ctx, req)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErrs:
+			if herr, ok := err.(*internal.HandlerError); ok {
+				return herr
+			}
+			s.log.Trace().Err(err).Msg("websocket closed by client")
+			return nil
+		case <-pinger.C:
+			if err := s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				s.log.Trace().Err(err).Msg("failed to ping websocket")
+				return nil
+			}
+		case frame := <-frames:
+			if herr := s.onFrame(frame); herr != nil {
+				return herr
+			}
+			if frame.Request != nil {
+				pendingReqs = append(pendingReqs, frame.Request)
+				// stop waiting for new data so the new request is processed promptly
+				if cancelInflight != nil {
+					cancelInflight()
+				}
+			}
+		case result := <-inflight:
+			inflight = nil
+			cancelInflight()
+			cancelInflight = nil
+			if result.herr != nil {
+				return result.herr
+			}
+			s.h.persistConn(s.conn)
+			if err := s.send(result.resp); err != nil {
+				s.log.Trace().Err(err).Msg("failed to send response on websocket")
+				return nil
+			}
+		}
+	}
+}
+
+// process starts processing the request on the Conn. The result is sent on the returned channel.
+func (s *wsSession) process(ctx context.Context, req sync3.Request) (<-chan wsResult, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan wsResult, 1)
+	go func() {
+		resp, herr := s.conn.OnIncomingRequest(ctx, &req)
+		ch <- wsResult{resp, herr}
+	}()
+	return ch, cancel
+}
+
+// onFrame handles the acknowledgement in the frame and checks any request in it.
+func (s *wsSession) onFrame(frame WebSocketFrame) *internal.HandlerError {
+	if frame.Pos != "" {
+		pos, err := strconv.ParseInt(frame.Pos, 10, 64)
+		if err != nil || pos != s.sentPos {
+			// the client can only have seen the last response we sent
+			return &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("unknown position: %s", frame.Pos),
+				ErrCode:    internal.ErrCodeUnknownPos,
+			}
+		}
+		s.ackedPos = pos
+	}
+	if frame.Request == nil {
+		return nil
+	}
+	if err := frame.Request.Validate(&s.h.Limits); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+			ErrCode:    internal.ErrCodeInvalidParam,
+		}
+	}
+	return nil
+}
+
+func (s *wsSession) send(resp *sync3.Response) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	s.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err = s.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	s.sentPos = resp.PosInt()
+	s.log.Trace().Int64("pos", s.sentPos).Int("rooms", len(resp.Rooms)).Msg("sent response on websocket")
+	return nil
+}
+
+// readFrames reads frames from the client until the socket is closed or a frame is invalid. Pongs from the
+// client are handled here too, as control frames are only processed whilst reading.
+func (s *wsSession) readFrames(ctx context.Context, frames chan<- WebSocketFrame, errs chan<- error) {
+	s.ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	s.ws.SetPongHandler(func(string) error {
+		return s.ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+	for {
+		_, data, err := s.ws.ReadMessage()
+		if err != nil {
+			errs <- err
+			return
+		}
+		s.ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		var frame WebSocketFrame
+		if err = json.Unmarshal(data, &frame); err != nil {
+			errs <- &internal.HandlerError{
+				StatusCode: 400,
+				Err:        err,
+				ErrCode:    internal.ErrCodeBadJSON,
+			}
+			return
+		}
+		select {
+		case frames <- frame:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
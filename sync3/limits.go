@@ -0,0 +1,116 @@
+package sync3
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/sync-v3/internal"
+)
+
+// RequestLimits are the limits the server places on the size of requests, to protect against buggy or
+// abusive clients asking for enormous responses. A limit of 0 means there is no limit.
+type RequestLimits struct {
+	MaxLists                int
+	MaxRangesPerList        int
+	MaxRangeSpan            int64 // the max number of rooms in a single range
+	MaxRoomSubscriptions    int
+	MaxTimelineLimit        int64
+	MaxRequiredStateEntries int
+}
+
+var DefaultRequestLimits = RequestLimits{
+	MaxLists:                100,
+	MaxRangesPerList:        10,
+	MaxRangeSpan:            1000,
+	MaxRoomSubscriptions:    1000,
+	MaxTimelineLimit:        500,
+	MaxRequiredStateEntries: 200,
+}
+
+// Validate this request, returning an error describing the problem if the request is malformed or
+// exceeds the limits given.
+func (r *Request) Validate(limits *RequestLimits) error {
+	if limits.MaxLists > 0 && len(r.Lists) > limits.MaxLists {
+		return fmt.Errorf("too many lists: %d > %d", len(r.Lists), limits.MaxLists)
+	}
+	for listKey, list := range r.Lists {
+		if err := list.validate(limits); err != nil {
+			return fmt.Errorf("list %s: %s", listKey, err)
+		}
+	}
+	if limits.MaxRoomSubscriptions > 0 {
+		if len(r.RoomSubscriptions) > limits.MaxRoomSubscriptions {
+			return fmt.Errorf("too many room subscriptions: %d > %d", len(r.RoomSubscriptions), limits.MaxRoomSubscriptions)
+		}
+		if len(r.UnsubscribeRooms) > limits.MaxRoomSubscriptions {
+			return fmt.Errorf("too many rooms to unsubscribe from: %d > %d", len(r.UnsubscribeRooms), limits.MaxRoomSubscriptions)
+		}
+	}
+	for roomID, sub := range r.RoomSubscriptions {
+		if err := sub.validate(limits); err != nil {
+			return fmt.Errorf("room subscription %s: %s", roomID, err)
+		}
+	}
+	return nil
+}
+
+func (rl *RequestList) validate(limits *RequestLimits) error {
+	// check the number of ranges first as checking for overlapping ranges is O(n^2)
+	if limits.MaxRangesPerList > 0 && len(rl.Ranges) > limits.MaxRangesPerList {
+		return fmt.Errorf("too many ranges: %d > %d", len(rl.Ranges), limits.MaxRangesPerList)
+	}
+	if !rl.Ranges.Valid() {
+		return fmt.Errorf("invalid ranges: %v", rl.Ranges)
+	}
+	if limits.MaxRangeSpan > 0 {
+		for _, r := range rl.Ranges {
+			// valid ranges are non-negative so this cannot overflow, unlike adding 1 to get the span
+			if r[1]-r[0] >= limits.MaxRangeSpan {
+				return fmt.Errorf("range %v spans more than %d rooms", r, limits.MaxRangeSpan)
+			}
+		}
+	}
+	for _, sortBy := range rl.Sort {
+		if !isKnownSort(sortBy) {
+			return fmt.Errorf("unknown sort order: %s", sortBy)
+		}
+	}
+	// timestamps are only tracked for some event types, so others can't be used to sort rooms
+	for _, evType := range rl.BumpEventTypes {
+		if !internal.IsBumpEventType(evType) {
+			return fmt.Errorf("bump_event_types: %s is not tracked by this server", evType)
+		}
+	}
+	return rl.RoomSubscription.validate(limits)
+}
+
+func (rs *RoomSubscription) validate(limits *RequestLimits) error {
+	if rs.TimelineLimit < 0 {
+		return fmt.Errorf("timeline_limit cannot be negative: %d", rs.TimelineLimit)
+	}
+	if limits.MaxTimelineLimit > 0 && rs.TimelineLimit > limits.MaxTimelineLimit {
+		return fmt.Errorf("timeline_limit too large: %d > %d", rs.TimelineLimit, limits.MaxTimelineLimit)
+	}
+	if limits.MaxRequiredStateEntries > 0 && len(rs.RequiredState) > limits.MaxRequiredStateEntries {
+		return fmt.Errorf("too many required_state entries: %d > %d", len(rs.RequiredState), limits.MaxRequiredStateEntries)
+	}
+	for _, tuple := range rs.RequiredState {
+		if tuple[0] == "" {
+			return fmt.Errorf("required_state entries must have an event type")
+		}
+	}
+	if rs.IncludeOldRooms != nil {
+		if err := rs.IncludeOldRooms.validate(limits); err != nil {
+			return fmt.Errorf("include_old_rooms: %s", err)
+		}
+	}
+	return nil
+}
+
+func isKnownSort(sortBy string) bool {
+	for _, s := range SortBy {
+		if s == sortBy {
+			return true
+		}
+	}
+	return false
+}
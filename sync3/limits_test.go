@@ -0,0 +1,159 @@
+package sync3
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestRequestValidate(t *testing.T) {
+	limits := &RequestLimits{
+		MaxLists:                2,
+		MaxRangesPerList:        2,
+		MaxRangeSpan:            100,
+		MaxRoomSubscriptions:    2,
+		MaxTimelineLimit:        50,
+		MaxRequiredStateEntries: 2,
+	}
+	manyRoomSubs := make(map[string]RoomSubscription)
+	for i := 0; i < 3; i++ {
+		manyRoomSubs[fmt.Sprintf("!%d:localhost", i)] = RoomSubscription{}
+	}
+	testCases := []struct {
+		name    string
+		req     Request
+		wantErr bool
+	}{
+		{
+			name: "valid request",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {
+						Ranges: SliceRanges{{0, 20}, {50, 60}},
+						Sort:   []string{SortByHighlightCount, SortByRecency},
+						RoomSubscription: RoomSubscription{
+							TimelineLimit: 50,
+							RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.member", StateKeyLazy}},
+						},
+					},
+				},
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a:localhost": {TimelineLimit: 1},
+				},
+			},
+		},
+		{
+			name: "too many lists",
+			req: Request{
+				Lists: map[string]RequestList{"a": {}, "b": {}, "c": {}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many ranges",
+			req: Request{
+				Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, 1}, {2, 3}, {4, 5}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "overlapping ranges",
+			req: Request{
+				Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, 10}, {5, 15}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "range too large",
+			req: Request{
+				Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, 100}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "range at the limit",
+			req: Request{
+				Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, 99}}}},
+			},
+		},
+		{
+			name: "range too large to add to",
+			req: Request{
+				Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, math.MaxInt64}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown sort",
+			req: Request{
+				Lists: map[string]RequestList{"a": {Sort: []string{"by_vibes"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "tracked bump event types",
+			req: Request{
+				Lists: map[string]RequestList{"a": {BumpEventTypes: []string{"m.room.message", "m.room.create"}}},
+			},
+		},
+		{
+			name: "untracked bump event type",
+			req: Request{
+				Lists: map[string]RequestList{"a": {BumpEventTypes: []string{"m.room.message", "m.reaction"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative timeline limit",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{"!a:localhost": {TimelineLimit: -1}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "timeline limit too large",
+			req: Request{
+				Lists: map[string]RequestList{"a": {RoomSubscription: RoomSubscription{TimelineLimit: 51}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many required state entries",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{"!a:localhost": {
+					RequiredState: [][2]string{{"a", ""}, {"b", ""}, {"c", ""}},
+				}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many room subscriptions",
+			req: Request{
+				RoomSubscriptions: manyRoomSubs,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid include_old_rooms",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{"!a:localhost": {
+					IncludeOldRooms: &RoomSubscription{TimelineLimit: 1000},
+				}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.req.Validate(limits)
+		if tc.wantErr && err == nil {
+			t.Errorf("%s: want error, got none", tc.name)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("%s: got error %s", tc.name, err)
+		}
+	}
+	// zero limits mean no limit
+	if err := (&Request{RoomSubscriptions: manyRoomSubs}).Validate(&RequestLimits{}); err != nil {
+		t.Errorf("Validate with no limits: got error %s", err)
+	}
+}
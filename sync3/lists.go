@@ -26,37 +26,60 @@ var (
 )
 
 type RoomListDelta struct {
-	ListIndex int
-	Op        ListOp
+	ListKey string
+	Op      ListOp
 }
 
 type RoomDelta struct {
 	RoomNameChanged    bool
+	RoomAvatarChanged  bool
+	TopicChanged       bool
 	JoinCountChanged   bool
 	InviteCountChanged bool
 	Lists              []RoomListDelta
+	// set to the predecessor of this room if the user joining/leaving this room may have changed which
+	// lists the predecessor belongs to.
+	StalePredecessorRoomID string
 }
 
-// InternalRequestLists is a list of lists which matches each index position in the request
+// SpaceGraph resolves which spaces a room is in.
+type SpaceGraph interface {
+	AncestorSpaces(roomID string) map[string]struct{}
+	// the rooms beneath this room, not including the room itself
+	Descendants(roomID string) []string
+}
+
+// InternalRequestLists is a set of lists which matches each list key in the request
 // JSON 'lists'. It contains all the internal metadata for rooms and controls access and updatings of said
 // lists.
 type InternalRequestLists struct {
 	allRooms map[string]RoomConnMetadata
-	lists    []*FilteredSortableRooms
+	lists    map[string]*FilteredSortableRooms
+	spaces   SpaceGraph // may be nil
 }
 
-func NewInternalRequestLists() *InternalRequestLists {
+func NewInternalRequestLists(spaces SpaceGraph) *InternalRequestLists {
 	return &InternalRequestLists{
 		allRooms: make(map[string]RoomConnMetadata, 10),
+		lists:    make(map[string]*FilteredSortableRooms),
+		spaces:   spaces,
 	}
 }
 
 func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
+	if r.UpgradedRoomID != nil {
+		r.SuccessorJoined = s.isJoined(*r.UpgradedRoomID)
+	}
+	if s.spaces != nil {
+		r.AncestorSpaces = s.spaces.AncestorSpaces(r.RoomID)
+	}
 	existing, exists := s.allRooms[r.RoomID]
 	if exists {
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
+		delta.RoomAvatarChanged = !existing.SameRoomAvatar(&r.RoomMetadata)
+		delta.TopicChanged = !existing.SameTopic(&r.RoomMetadata)
 		if delta.RoomNameChanged {
 			// update the canonical name to allow room name sorting to continue to work
 			r.CanonicalisedName = strings.ToLower(
@@ -69,46 +92,104 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 			strings.Trim(internal.CalculateRoomName(&r.RoomMetadata, 5), "#!():_@"),
 		)
 	}
-	for i := range s.lists {
-		_, alreadyExists := s.lists[i].roomIDToIndex[r.RoomID]
-		shouldExist := s.lists[i].filter.Include(&r)
-		if shouldExist && r.HasLeft {
-			shouldExist = false
-		}
+	for listKey, list := range s.lists {
+		_, alreadyExists := list.roomIDToIndex[r.RoomID]
+		shouldExist := list.filter.Include(&r)
 		// weird nesting ensures we handle all 4 cases
 		if alreadyExists {
 			if shouldExist { // could be a change
 				delta.Lists = append(delta.Lists, RoomListDelta{
-					ListIndex: i,
-					Op:        ListOpChange,
+					ListKey: listKey,
+					Op:      ListOpChange,
 				})
 			} else { // removal
 				delta.Lists = append(delta.Lists, RoomListDelta{
-					ListIndex: i,
-					Op:        ListOpDel,
+					ListKey: listKey,
+					Op:      ListOpDel,
 				})
 			}
 		} else {
 			if shouldExist { // addition
 				delta.Lists = append(delta.Lists, RoomListDelta{
-					ListIndex: i,
-					Op:        ListOpAdd,
+					ListKey: listKey,
+					Op:      ListOpAdd,
 				})
 			} // else it doesn't exist and it shouldn't exist, so do nothing e.g room isn't relevant to this list
 		}
 	}
 	s.allRooms[r.RoomID] = r
+
+	// if this room replaced an older room, the older room may need to be hidden or shown
+	if r.PredecessorRoomID != nil {
+		pred, ok := s.allRooms[*r.PredecessorRoomID]
+		if ok && pred.UpgradedRoomID != nil && *pred.UpgradedRoomID == r.RoomID && pred.SuccessorJoined != s.isJoined(r.RoomID) {
+			pred.SuccessorJoined = !pred.SuccessorJoined
+			s.allRooms[pred.RoomID] = pred
+			delta.StalePredecessorRoomID = pred.RoomID
+		}
+	}
 	return delta
 }
 
-// Remove a room from all lists e.g retired an invite, left a room
-func (s *InternalRequestLists) RemoveRoom(roomID string) {
+func (s *InternalRequestLists) isJoined(roomID string) bool {
+	r, ok := s.allRooms[roomID]
+	return ok && !r.IsInvite && !r.IsKnock && !r.HasLeft
+}
+
+// RefreshAncestorSpaces recalculates the spaces for this room and every room beneath it, returning the room IDs
+// which changed. Call this when the parents of this room change. Rooms which changed need to be re-set to update
+// the lists.
+func (s *InternalRequestLists) RefreshAncestorSpaces(roomID string) (changed []string) {
+	if s.spaces == nil {
+		return nil
+	}
+	// Only this room and its descendants can be affected, as the edges beneath it have not changed.
+	for _, descendantID := range append([]string{roomID}, s.spaces.Descendants(roomID)...) {
+		r, ok := s.allRooms[descendantID]
+		if !ok {
+			continue
+		}
+		ancestors := s.spaces.AncestorSpaces(descendantID)
+		if sameSet(ancestors, r.AncestorSpaces) {
+			continue
+		}
+		r.AncestorSpaces = ancestors
+		s.allRooms[descendantID] = r
+		changed = append(changed, descendantID)
+	}
+	return changed
+}
+
+func sameSet(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove a room from all lists e.g retired an invite. Returns a ListOpDel delta for each list the room is in.
+// The caller is responsible for removing the room from these lists.
+func (s *InternalRequestLists) RemoveRoom(roomID string) (delta RoomDelta) {
 	delete(s.allRooms, roomID)
-	// TODO: update lists?
+	for listKey, list := range s.lists {
+		if _, exists := list.roomIDToIndex[roomID]; exists {
+			delta.Lists = append(delta.Lists, RoomListDelta{
+				ListKey: listKey,
+				Op:      ListOpDel,
+			})
+		}
+	}
+	return delta
 }
 
-func (s *InternalRequestLists) DeleteList(index int) {
-	// TODO
+// Remove a list from the set of lists e.g the client no longer requests this list.
+func (s *InternalRequestLists) DeleteList(listKey string) {
+	delete(s.lists, listKey)
 }
 
 func (s *InternalRequestLists) Room(roomID string) *RoomConnMetadata {
@@ -116,16 +197,18 @@ func (s *InternalRequestLists) Room(roomID string) *RoomConnMetadata {
 	return &r
 }
 
-func (s *InternalRequestLists) Get(listIndex int) *FilteredSortableRooms {
-	return s.lists[listIndex]
+func (s *InternalRequestLists) Get(listKey string) *FilteredSortableRooms {
+	return s.lists[listKey]
 }
 
-// Assign a new list at the given index. If Overwrite, any existing list is replaced. If DoNotOverwrite, the existing
-// list is returned if one exists, else a new list is created. Returns the list and true if the list was overwritten.
-func (s *InternalRequestLists) AssignList(index int, filters *RequestFilters, sort []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
-	internal.Assert("Set index is at most list size", index <= len(s.lists))
-	if shouldOverwrite == DoNotOverwrite && index < len(s.lists) {
-		return s.lists[index], false
+// Assign a new list with the given key, using the filters and sort order in reqList. If Overwrite, any existing
+// list is replaced. If DoNotOverwrite, the existing list is returned if one exists, else a new list is created.
+// Returns the list and true if the list was overwritten.
+func (s *InternalRequestLists) AssignList(listKey string, reqList *RequestList, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
+	if shouldOverwrite == DoNotOverwrite {
+		if existingList, exists := s.lists[listKey]; exists {
+			return existingList, false
+		}
 	}
 	roomIDs := make([]string, len(s.allRooms))
 	i := 0
@@ -134,24 +217,43 @@ func (s *InternalRequestLists) AssignList(index int, filters *RequestFilters, so
 		i++
 	}
 
-	roomList := NewFilteredSortableRooms(s, roomIDs, filters)
-	if sort != nil {
-		err := roomList.Sort(sort)
+	roomList := NewFilteredSortableRooms(s, roomIDs, reqList.Filters)
+	roomList.SetBumpEventTypes(reqList.BumpEventTypes)
+	roomList.SetExcludeThreadCounts(reqList.ShouldExcludeThreadCounts())
+	if reqList.Sort != nil {
+		err := roomList.Sort(reqList.Sort)
 		if err != nil {
-			logger.Err(err).Strs("sort_by", sort).Msg("failed to sort")
+			logger.Err(err).Strs("sort_by", reqList.Sort).Msg("failed to sort")
 		}
 	}
-	if index == len(s.lists) {
-		s.lists = append(s.lists, roomList)
-		return roomList, true
-	}
-	s.lists[index] = roomList
+	s.lists[listKey] = roomList
 	return roomList, true
 }
 
+// BumpTimestamp returns the timestamp to show clients for this room. This is the most recent timestamp
+// according to the bump_event_types of each list the room is in. If the room isn't in any list, the
+// timestamp of the latest event in the room is returned.
+func (s *InternalRequestLists) BumpTimestamp(roomID string, metadata *internal.RoomMetadata) uint64 {
+	var ts uint64
+	inAnyList := false
+	for _, list := range s.lists {
+		if _, exists := list.IndexOf(roomID); !exists {
+			continue
+		}
+		inAnyList = true
+		if listTs := metadata.BumpTimestamp(list.BumpEventTypes()); listTs > ts {
+			ts = listTs
+		}
+	}
+	if !inAnyList {
+		return metadata.LastMessageTimestamp
+	}
+	return ts
+}
+
 // Count returns the count of total rooms in this list
-func (s *InternalRequestLists) Count(index int) int {
-	return int(s.lists[index].Len())
+func (s *InternalRequestLists) Count(listKey string) int {
+	return int(s.lists[listKey].Len())
 }
 
 func (s *InternalRequestLists) Len() int {
@@ -8,7 +8,7 @@ import (
 type SliceRanges [][2]int64
 
 func (r SliceRanges) Valid() bool {
-	for _, sr := range r {
+	for i, sr := range r {
 		// always goes from start to end
 		if sr[1] < sr[0] {
 			return false
@@ -16,6 +16,12 @@ func (r SliceRanges) Valid() bool {
 		if sr[0] < 0 {
 			return false
 		}
+		// ranges cannot overlap
+		for _, other := range r[:i] {
+			if sr[0] <= other[1] && other[0] <= sr[1] {
+				return false
+			}
+		}
 	}
 	return true
 }
@@ -265,7 +271,7 @@ func (r SliceRanges) Delta(next SliceRanges) (added SliceRanges, removed SliceRa
 // Slice into this range, returning subslices of slice
 func (r SliceRanges) SliceInto(slice Subslicer) []Subslicer {
 	var result []Subslicer
-	// TODO: ensure we don't have overlapping ranges
+	// ranges are checked not to overlap when the request is validated
 	for _, sr := range r {
 		// apply range caps
 		// the range are always index positions hence -1
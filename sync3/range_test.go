@@ -43,6 +43,24 @@ func TestRangeValid(t *testing.T) {
 			}),
 			valid: false,
 		},
+		{
+			input: SliceRanges([][2]int64{
+				{0, 9}, {10, 19},
+			}),
+			valid: true,
+		},
+		{
+			input: SliceRanges([][2]int64{
+				{0, 9}, {9, 19},
+			}),
+			valid: false,
+		},
+		{
+			input: SliceRanges([][2]int64{
+				{10, 19}, {0, 30},
+			}),
+			valid: false,
+		},
 	}
 	for _, tc := range testCases {
 		gotValid := tc.input.Valid()
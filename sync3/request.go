@@ -18,11 +18,17 @@ var (
 
 	DefaultTimelineLimit = int64(20)
 	DefaultTimeoutMSecs  = 10 * 1000 // 10s
+
+	// StateKeyLazy is a special state key which, when used with m.room.member, will only return the
+	// membership events for the senders of events in the timeline.
+	StateKeyLazy = "$LAZY"
+	// StateKeyMe is a special state key which is replaced with the user ID of the requesting user.
+	StateKeyMe = "$ME"
 )
 
 type Request struct {
 	TxnID             string                      `json:"txn_id"`
-	Lists             []RequestList               `json:"lists"`
+	Lists             map[string]RequestList      `json:"lists"`
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
@@ -38,12 +44,21 @@ type RequestList struct {
 	Sort            []string        `json:"sort"`
 	Filters         *RequestFilters `json:"filters"`
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
+	// The event types which count as activity in a room for the purposes of by_recency sorting.
+	// If empty, all events count.
+	BumpEventTypes []string `json:"bump_event_types,omitempty"`
+	// If true, unread counts in threads are not used when sorting by highlight/notification count.
+	ExcludeThreadCounts *bool `json:"exclude_thread_counts,omitempty"`
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+func (rl *RequestList) ShouldExcludeThreadCounts() bool {
+	return rl != nil && rl.ExcludeThreadCounts != nil && *rl.ExcludeThreadCounts
+}
+
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -57,7 +72,16 @@ func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 			return true
 		}
 	}
-	return false
+	// changing what counts as activity changes the by_recency sort order
+	if len(rl.BumpEventTypes) != len(next.BumpEventTypes) {
+		return true
+	}
+	for i := range rl.BumpEventTypes {
+		if rl.BumpEventTypes[i] != next.BumpEventTypes[i] {
+			return true
+		}
+	}
+	return rl.ShouldExcludeThreadCounts() != next.ShouldExcludeThreadCounts()
 }
 
 func (rl *RequestList) FiltersChanged(next *RequestList) bool {
@@ -259,8 +283,8 @@ type RequestDelta struct {
 	Subs []string
 	// room IDs to unsubscribe from
 	Unsubs []string
-	// The complete union of both lists (contains max(a,b) lists)
-	Lists []RequestListDelta
+	// The complete union of both lists (contains max(a,b) lists), keyed by list name
+	Lists map[string]RequestListDelta
 }
 
 // Internal struct used to represent a single list delta.
@@ -288,23 +312,21 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		}
 	}
 
-	delta = &RequestDelta{}
-	lists := make([]RequestList, len(nextReq.Lists))
-	for i := 0; i < len(lists); i++ {
-		var existingList *RequestList
-		if i < len(r.Lists) {
-			existingList = &r.Lists[i]
-		}
+	delta = &RequestDelta{
+		Lists: make(map[string]RequestListDelta, len(nextReq.Lists)),
+	}
+	lists := make(map[string]RequestList, len(nextReq.Lists))
+	for listKey, nextList := range nextReq.Lists {
+		existingList, exists := r.Lists[listKey]
 		// default to recency sort order if missing and there isn't a previous list to draw from
-		if len(nextReq.Lists[i].Sort) == 0 && existingList == nil {
-			nextReq.Lists[i].Sort = []string{SortByRecency}
+		if len(nextList.Sort) == 0 && !exists {
+			nextList.Sort = []string{SortByRecency}
 		}
-		if existingList == nil {
+		if !exists {
 			// we added a list
-			lists[i] = nextReq.Lists[i]
+			lists[listKey] = nextList
 			continue
 		}
-		nextList := nextReq.Lists[i]
 		rooms := nextList.Ranges
 		if rooms == nil {
 			rooms = existingList.Ranges
@@ -330,31 +352,46 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if filters == nil {
 			filters = existingList.Filters
 		}
-		lists[i] = RequestList{
+		bumpEventTypes := nextList.BumpEventTypes
+		if bumpEventTypes == nil {
+			bumpEventTypes = existingList.BumpEventTypes
+		}
+		excludeThreadCounts := nextList.ExcludeThreadCounts
+		if excludeThreadCounts == nil {
+			excludeThreadCounts = existingList.ExcludeThreadCounts
+		}
+		includeOldRooms := nextList.IncludeOldRooms
+		if includeOldRooms == nil {
+			includeOldRooms = existingList.IncludeOldRooms
+		}
+		lists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
-				RequiredState: reqState,
-				TimelineLimit: timelineLimit,
+				RequiredState:   reqState,
+				TimelineLimit:   timelineLimit,
+				IncludeOldRooms: includeOldRooms,
 			},
-			Ranges:          rooms,
-			Sort:            sort,
-			Filters:         filters,
-			SlowGetAllRooms: slowGetAllRooms,
+			Ranges:              rooms,
+			Sort:                sort,
+			Filters:             filters,
+			SlowGetAllRooms:     slowGetAllRooms,
+			BumpEventTypes:      bumpEventTypes,
+			ExcludeThreadCounts: excludeThreadCounts,
 		}
 	}
 	result.Lists = lists
-	// the delta is as large as the longest list of lists
-	maxLen := len(result.Lists)
-	if len(r.Lists) > maxLen {
-		maxLen = len(r.Lists)
-	}
-	delta.Lists = make([]RequestListDelta, maxLen)
-	for i := range result.Lists {
-		delta.Lists[i] = RequestListDelta{
-			Curr: &result.Lists[i],
+	// the delta is the union of both sets of lists: lists which are only in the previous request
+	// have been deleted, so will have a nil Curr.
+	for listKey := range result.Lists {
+		l := result.Lists[listKey]
+		delta.Lists[listKey] = RequestListDelta{
+			Curr: &l,
 		}
 	}
-	for i := range r.Lists {
-		delta.Lists[i].Prev = &r.Lists[i]
+	for listKey := range r.Lists {
+		l := r.Lists[listKey]
+		rld := delta.Lists[listKey]
+		rld.Prev = &l
+		delta.Lists[listKey] = rld
 	}
 
 	// Work out subscriptions. The operations are applied as:
@@ -398,46 +435,66 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 	return
 }
 
-func (r *Request) GetTimelineLimit(listIndex int, roomID string) int64 {
+func (r *Request) GetTimelineLimit(listKey string, roomID string) int64 {
 	if r.RoomSubscriptions != nil {
 		room, ok := r.RoomSubscriptions[roomID]
 		if ok && room.TimelineLimit > 0 {
 			return room.TimelineLimit
 		}
 	}
-	if r.Lists[listIndex].TimelineLimit > 0 {
-		return r.Lists[listIndex].TimelineLimit
+	if r.Lists[listKey].TimelineLimit > 0 {
+		return r.Lists[listKey].TimelineLimit
 	}
 	return DefaultTimelineLimit
 }
 
 type RequestFilters struct {
-	Spaces         []string  `json:"spaces"`
-	IsDM           *bool     `json:"is_dm"`
-	IsEncrypted    *bool     `json:"is_encrypted"`
-	IsInvite       *bool     `json:"is_invite"`
-	IsTombstoned   *bool     `json:"is_tombstoned"`
-	RoomTypes      []*string `json:"room_types"`
-	NotRoomTypes   []*string `json:"not_room_types"`
-	RoomNameFilter string    `json:"room_name_like"`
-	Tags           []string  `json:"tags"`
-	NotTags        []string  `json:"not_tags"`
+	Spaces            []string  `json:"spaces"`
+	SpacesRecursive   []string  `json:"spaces_recursive"`
+	IsDM              *bool     `json:"is_dm"`
+	IsEncrypted       *bool     `json:"is_encrypted"`
+	IsInvite          *bool     `json:"is_invite"`
+	IsKnock           *bool     `json:"is_knock"`
+	IsLeft            *bool     `json:"is_left"`
+	IncludeLeft       *bool     `json:"include_left"`
+	IsTombstoned      *bool     `json:"is_tombstoned"`
+	HideUpgradedRooms *bool     `json:"hide_upgraded_rooms"` // hide upgraded rooms if the user joined the new room
+	RoomTypes         []*string `json:"room_types"`
+	NotRoomTypes      []*string `json:"not_room_types"`
+	RoomNameFilter    string    `json:"room_name_like"`
+	Tags              []string  `json:"tags"`
+	NotTags           []string  `json:"not_tags"`
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
 
 func (rf *RequestFilters) Include(r *RoomConnMetadata) bool {
+	// left rooms are excluded unless explicitly asked for
+	if r.HasLeft {
+		includeLeft := (rf.IsLeft != nil && *rf.IsLeft) || (rf.IncludeLeft != nil && *rf.IncludeLeft)
+		if !includeLeft {
+			return false
+		}
+	} else if rf.IsLeft != nil && *rf.IsLeft {
+		return false
+	}
 	if rf.IsEncrypted != nil && *rf.IsEncrypted != r.Encrypted {
 		return false
 	}
 	if rf.IsTombstoned != nil && *rf.IsTombstoned != (r.UpgradedRoomID != nil) {
 		return false
 	}
+	if rf.HideUpgradedRooms != nil && *rf.HideUpgradedRooms && r.UpgradedRoomID != nil && r.SuccessorJoined {
+		return false
+	}
 	if rf.IsDM != nil && *rf.IsDM != r.IsDM {
 		return false
 	}
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
+	if rf.IsKnock != nil && *rf.IsKnock != r.IsKnock {
+		return false
+	}
 	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(internal.CalculateRoomName(&r.RoomMetadata, 5)), strings.ToLower(rf.RoomNameFilter)) {
 		return false
 	}
@@ -464,14 +521,26 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata) bool {
 	if nullableStringExists(rf.NotRoomTypes, r.RoomType) {
 		return false // explicitly excluded
 	}
-	if len(rf.RoomTypes) > 0 {
-		// either explicitly included or implicitly excluded
-		return nullableStringExists(rf.RoomTypes, r.RoomType)
+	if len(rf.RoomTypes) > 0 && !nullableStringExists(rf.RoomTypes, r.RoomType) {
+		return false // implicitly excluded
 	}
 	if len(rf.Spaces) > 0 {
 		// ensure this room is a member of one of these spaces
+		isInSpace := false
 		for _, s := range rf.Spaces {
 			if _, ok := r.UserRoomData.Spaces[s]; ok {
+				isInSpace = true
+				break
+			}
+		}
+		if !isInSpace {
+			return false
+		}
+	}
+	if len(rf.SpacesRecursive) > 0 {
+		// ensure this room is in one of these spaces or any of their sub-spaces
+		for _, s := range rf.SpacesRecursive {
+			if _, ok := r.AncestorSpaces[s]; ok {
 				return true
 			}
 		}
@@ -483,6 +552,8 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata) bool {
 type RoomSubscription struct {
 	RequiredState [][2]string `json:"required_state"`
 	TimelineLimit int64       `json:"timeline_limit"`
+	// if set, rooms this room replaced which the user was joined to are also returned using this subscription
+	IncludeOldRooms *RoomSubscription `json:"include_old_rooms,omitempty"`
 }
 
 // Combine this subcription with another, returning a union of both as a copy.
@@ -496,6 +567,15 @@ func (rs RoomSubscription) Combine(other RoomSubscription) RoomSubscription {
 	}
 	// combine together required_state fields, we'll union them later
 	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
+	// include old rooms if either subscription wants them
+	if rs.IncludeOldRooms != nil && other.IncludeOldRooms != nil {
+		oldRooms := rs.IncludeOldRooms.Combine(*other.IncludeOldRooms)
+		result.IncludeOldRooms = &oldRooms
+	} else if rs.IncludeOldRooms != nil {
+		result.IncludeOldRooms = rs.IncludeOldRooms
+	} else {
+		result.IncludeOldRooms = other.IncludeOldRooms
+	}
 	return result
 }
 
@@ -516,25 +596,33 @@ func (rs RoomSubscription) Combine(other RoomSubscription) RoomSubscription {
 // The largest set will be used when returning the required state map.
 // For example, [B,2] + [B,*] = [B,*] because [B,*] encompasses [B,2]. This means [*,*] encompasses
 // everything.
-func (rs RoomSubscription) RequiredStateMap() *internal.RequiredStateMap {
+//
+// The special state keys $ME and $LAZY are also handled here: $ME is replaced with the given user ID,
+// and [m.room.member, $LAZY] enables lazy loading of room members.
+func (rs RoomSubscription) RequiredStateMap(userID string) *internal.RequiredStateMap {
 	result := make(map[string][]string)
 	eventTypesWithWildcardStateKeys := make(map[string]struct{})
 	var stateKeysForWildcardEventType []string
+	lazyLoading := false
 	for _, tuple := range rs.RequiredState {
 		if tuple[0] == "*" {
 			if tuple[1] == "*" { // all state
-				return internal.NewRequiredStateMap(nil, nil, nil, true)
+				return internal.NewRequiredStateMap(nil, nil, nil, true, false)
 			}
 			stateKeysForWildcardEventType = append(stateKeysForWildcardEventType, tuple[1])
 			continue
 		}
 		if tuple[1] == "*" { // wildcard state key
 			eventTypesWithWildcardStateKeys[tuple[0]] = struct{}{}
+		} else if tuple[1] == StateKeyLazy && tuple[0] == "m.room.member" {
+			lazyLoading = true
+		} else if tuple[1] == StateKeyMe {
+			result[tuple[0]] = append(result[tuple[0]], userID)
 		} else {
 			result[tuple[0]] = append(result[tuple[0]], tuple[1])
 		}
 	}
-	return internal.NewRequiredStateMap(eventTypesWithWildcardStateKeys, stateKeysForWildcardEventType, result, false)
+	return internal.NewRequiredStateMap(eventTypesWithWildcardStateKeys, stateKeysForWildcardEventType, result, false, lazyLoading)
 }
 
 // helper to find `null` or literal string matches
@@ -9,11 +9,13 @@ import (
 )
 
 func TestRoomSubscriptionUnion(t *testing.T) {
+	alice := "@alice:localhost"
 	testCases := []struct {
 		name              string
 		a                 RoomSubscription
 		b                 *RoomSubscription
 		wantQueryStateMap map[string][]string
+		wantLazyLoading   bool
 		matches           [][2]string
 		noMatches         [][2]string
 	}{
@@ -118,17 +120,44 @@ func TestRoomSubscriptionUnion(t *testing.T) {
 			matches:           [][2]string{{"m.room.name", ""}, {"m.room.name", "foo"}, {"name", "foo"}, {"name", "bar"}},
 			noMatches:         [][2]string{{"name", "baz"}, {"name", ""}},
 		},
+		{
+			name:              "$ME state key",
+			a:                 RoomSubscription{RequiredState: [][2]string{{"m.room.member", StateKeyMe}}},
+			wantQueryStateMap: map[string][]string{"m.room.member": {alice}},
+			matches:           [][2]string{{"m.room.member", alice}},
+			noMatches:         [][2]string{{"m.room.member", StateKeyMe}, {"m.room.member", "@bob:localhost"}},
+		},
+		{
+			name:              "$LAZY members",
+			a:                 RoomSubscription{RequiredState: [][2]string{{"m.room.name", ""}}},
+			b:                 &RoomSubscription{RequiredState: [][2]string{{"m.room.member", StateKeyLazy}}},
+			wantQueryStateMap: map[string][]string{"m.room.name": {""}},
+			wantLazyLoading:   true,
+			matches:           [][2]string{{"m.room.name", ""}},
+			noMatches:         [][2]string{{"m.room.member", StateKeyLazy}, {"m.room.member", alice}},
+		},
+		{
+			name:              "$LAZY members with $ME",
+			a:                 RoomSubscription{RequiredState: [][2]string{{"m.room.member", StateKeyLazy}, {"m.room.member", StateKeyMe}}},
+			wantQueryStateMap: map[string][]string{"m.room.member": {alice}},
+			wantLazyLoading:   true,
+			matches:           [][2]string{{"m.room.member", alice}},
+			noMatches:         [][2]string{{"m.room.member", "@bob:localhost"}},
+		},
 	}
 	for _, tc := range testCases {
 		sub := tc.a
 		if tc.b != nil {
 			sub = tc.a.Combine(*tc.b)
 		}
-		rsm := sub.RequiredStateMap()
+		rsm := sub.RequiredStateMap(alice)
 		got := rsm.QueryStateMap()
 		if !reflect.DeepEqual(got, tc.wantQueryStateMap) {
 			t.Errorf("%s: got query state map %+v want %+v", tc.name, got, tc.wantQueryStateMap)
 		}
+		if rsm.IsLazyLoading() != tc.wantLazyLoading {
+			t.Errorf("%s: got lazy loading %v want %v", tc.name, rsm.IsLazyLoading(), tc.wantLazyLoading)
+		}
 		if tc.matches != nil {
 			for _, match := range tc.matches {
 				if !rsm.Include(match[0], match[1]) {
@@ -176,7 +205,7 @@ func TestRequestApplyDeltas(t *testing.T) {
 							},
 						},
 						want: Request{
-							Lists: []RequestList{},
+							Lists: map[string]RequestList{},
 							RoomSubscriptions: map[string]RoomSubscription{
 								"!foo:bar": {
 									TimelineLimit: 10,
@@ -187,7 +216,7 @@ func TestRequestApplyDeltas(t *testing.T) {
 					wantDelta: func(input *Request, d testData) RequestDelta {
 						return RequestDelta{
 							Subs:  []string{"!foo:bar"},
-							Lists: []RequestListDelta{},
+							Lists: map[string]RequestListDelta{},
 						}
 					},
 				},
@@ -195,16 +224,16 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "initial: list only",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByHighlightCount},
 								},
 							},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByHighlightCount},
 								},
@@ -214,10 +243,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 					},
 					wantDelta: func(input *Request, d testData) RequestDelta {
 						return RequestDelta{
-							Lists: []RequestListDelta{
-								{
+							Lists: map[string]RequestListDelta{
+								"a": {
 									Prev: nil,
-									Curr: &d.want.Lists[0],
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -227,15 +256,15 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "initial: sets sort order to be by_recency if missing",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 								},
 							},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByRecency},
 								},
@@ -245,10 +274,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 					},
 					wantDelta: func(input *Request, d testData) RequestDelta {
 						return RequestDelta{
-							Lists: []RequestListDelta{
-								{
+							Lists: map[string]RequestListDelta{
+								"a": {
 									Prev: nil,
-									Curr: &d.want.Lists[0],
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -258,19 +287,19 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "initial: multiple lists",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByHighlightCount},
 								},
-								{
+								"b": {
 									Ranges: [][2]int64{{0, 10}},
 									Filters: &RequestFilters{
 										IsEncrypted: &boolTrue,
 									},
 									Sort: []string{SortByRecency},
 								},
-								{
+								"c": {
 									Ranges: [][2]int64{{0, 5}},
 									Sort:   []string{SortByRecency, SortByName},
 									RoomSubscription: RoomSubscription{
@@ -283,19 +312,19 @@ func TestRequestApplyDeltas(t *testing.T) {
 							},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByHighlightCount},
 								},
-								{
+								"b": {
 									Ranges: [][2]int64{{0, 10}},
 									Filters: &RequestFilters{
 										IsEncrypted: &boolTrue,
 									},
 									Sort: []string{SortByRecency},
 								},
-								{
+								"c": {
 									Ranges: [][2]int64{{0, 5}},
 									Sort:   []string{SortByRecency, SortByName},
 									RoomSubscription: RoomSubscription{
@@ -311,18 +340,18 @@ func TestRequestApplyDeltas(t *testing.T) {
 					},
 					wantDelta: func(input *Request, d testData) RequestDelta {
 						return RequestDelta{
-							Lists: []RequestListDelta{
-								{
+							Lists: map[string]RequestListDelta{
+								"a": {
 									Prev: nil,
-									Curr: &d.want.Lists[0],
+									Curr: listPtr(d.want.Lists["a"]),
 								},
-								{
+								"b": {
 									Prev: nil,
-									Curr: &d.want.Lists[1],
+									Curr: listPtr(d.want.Lists["b"]),
 								},
-								{
+								"c": {
 									Prev: nil,
-									Curr: &d.want.Lists[2],
+									Curr: listPtr(d.want.Lists["c"]),
 								},
 							},
 						}
@@ -332,8 +361,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "initial: list and sub",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByHighlightCount},
 								},
@@ -345,8 +374,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 							},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Ranges: [][2]int64{{0, 20}},
 									Sort:   []string{SortByHighlightCount},
 								},
@@ -361,10 +390,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 					wantDelta: func(input *Request, d testData) RequestDelta {
 						return RequestDelta{
 							Subs: []string{"!foo:bar"},
-							Lists: []RequestListDelta{
-								{
+							Lists: map[string]RequestListDelta{
+								"a": {
 									Prev: nil,
-									Curr: &d.want.Lists[0],
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -374,8 +403,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 		},
 		{
 			input: &Request{
-				Lists: []RequestList{
-					{
+				Lists: map[string]RequestList{
+					"a": {
 						Sort: []string{SortByName},
 						RoomSubscription: RoomSubscription{
 							TimelineLimit: 5,
@@ -397,8 +426,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "overwriting of sort and updating subs without adding new ones",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 								},
 							},
@@ -409,8 +438,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 							},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 5,
@@ -428,10 +457,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 						return RequestDelta{
 							Subs:   nil,
 							Unsubs: nil,
-							Lists: []RequestListDelta{
-								{
-									Prev: &input.Lists[0],
-									Curr: &d.want.Lists[0],
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -442,8 +471,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "Adding a sub",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 5,
@@ -457,8 +486,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 							},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 5,
@@ -479,10 +508,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 						return RequestDelta{
 							Subs:   []string{"!bar:baz"},
 							Unsubs: nil,
-							Lists: []RequestListDelta{
-								{
-									Prev: &input.Lists[0],
-									Curr: &d.want.Lists[0],
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -493,16 +522,16 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "Unsubscribing",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByName},
 								},
 							},
 							UnsubscribeRooms: []string{"!foo:bar"},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByName},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 5,
@@ -516,10 +545,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 						return RequestDelta{
 							Subs:   nil,
 							Unsubs: []string{"!foo:bar"},
-							Lists: []RequestListDelta{
-								{
-									Prev: &input.Lists[0],
-									Curr: &d.want.Lists[0],
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -530,8 +559,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "Subscribing/Unsubscribing in one request",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 								},
 							},
@@ -543,8 +572,8 @@ func TestRequestApplyDeltas(t *testing.T) {
 							UnsubscribeRooms: []string{"!bar:baz"},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 5,
@@ -562,10 +591,10 @@ func TestRequestApplyDeltas(t *testing.T) {
 						return RequestDelta{
 							Subs:   nil,
 							Unsubs: nil,
-							Lists: []RequestListDelta{
-								{
-									Prev: &input.Lists[0],
-									Curr: &d.want.Lists[0],
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -575,11 +604,11 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "deleting a list",
 						next: Request{
-							Lists:             []RequestList{},
+							Lists:             map[string]RequestList{},
 							RoomSubscriptions: map[string]RoomSubscription{},
 						},
 						want: Request{
-							Lists: []RequestList{},
+							Lists: map[string]RequestList{},
 							RoomSubscriptions: map[string]RoomSubscription{
 								"!foo:bar": {
 									TimelineLimit: 10,
@@ -591,9 +620,9 @@ func TestRequestApplyDeltas(t *testing.T) {
 						return RequestDelta{
 							Subs:   nil,
 							Unsubs: nil,
-							Lists: []RequestListDelta{
-								{
-									Prev: &input.Lists[0],
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
 									Curr: nil,
 								},
 							},
@@ -604,11 +633,11 @@ func TestRequestApplyDeltas(t *testing.T) {
 					testData: testData{
 						name: "adding a list",
 						next: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 								},
-								{
+								"b": {
 									Sort: []string{SortByHighlightCount},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 9000,
@@ -618,14 +647,14 @@ func TestRequestApplyDeltas(t *testing.T) {
 							RoomSubscriptions: map[string]RoomSubscription{},
 						},
 						want: Request{
-							Lists: []RequestList{
-								{
+							Lists: map[string]RequestList{
+								"a": {
 									Sort: []string{SortByRecency},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 5,
 									},
 								},
-								{
+								"b": {
 									Sort: []string{SortByHighlightCount},
 									RoomSubscription: RoomSubscription{
 										TimelineLimit: 9000,
@@ -643,14 +672,71 @@ func TestRequestApplyDeltas(t *testing.T) {
 						return RequestDelta{
 							Subs:   nil,
 							Unsubs: nil,
-							Lists: []RequestListDelta{
-								{
-									Prev: &input.Lists[0],
-									Curr: &d.want.Lists[0],
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
+									Curr: listPtr(d.want.Lists["a"]),
 								},
-								{
+								"b": {
 									Prev: nil,
-									Curr: &d.want.Lists[1],
+									Curr: listPtr(d.want.Lists["b"]),
+								},
+							},
+						}
+					},
+				},
+			},
+		},
+		{
+			input: &Request{
+				Lists: map[string]RequestList{
+					"a": {
+						Sort: []string{SortByRecency},
+						RoomSubscription: RoomSubscription{
+							TimelineLimit: 5,
+							IncludeOldRooms: &RoomSubscription{
+								TimelineLimit: 1,
+							},
+						},
+					},
+				},
+			},
+			tests: []struct {
+				testData
+				wantDelta func(input *Request, d testData) RequestDelta
+			}{
+				{
+					testData: testData{
+						name: "include_old_rooms is sticky",
+						next: Request{
+							Lists: map[string]RequestList{
+								"a": {
+									Ranges: [][2]int64{{0, 20}},
+								},
+							},
+						},
+						want: Request{
+							Lists: map[string]RequestList{
+								"a": {
+									Ranges: [][2]int64{{0, 20}},
+									Sort:   []string{SortByRecency},
+									RoomSubscription: RoomSubscription{
+										TimelineLimit: 5,
+										IncludeOldRooms: &RoomSubscription{
+											TimelineLimit: 1,
+										},
+									},
+								},
+							},
+							RoomSubscriptions: map[string]RoomSubscription{},
+						},
+					},
+					wantDelta: func(input *Request, d testData) RequestDelta {
+						return RequestDelta{
+							Lists: map[string]RequestListDelta{
+								"a": {
+									Prev: listPtr(input.Lists["a"]),
+									Curr: listPtr(d.want.Lists["a"]),
 								},
 							},
 						}
@@ -992,3 +1078,7 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 		t.Errorf("%s\ngot  %s\nwant %s", name, string(aa), string(bb))
 	}
 }
+
+func listPtr(l RequestList) *RequestList {
+	return &l
+}
@@ -9,19 +9,54 @@ import (
 
 type Room struct {
 	Name              string            `json:"name,omitempty"`
+	Avatar            *string           `json:"avatar,omitempty"` // omitted if unset/unchanged, "" if removed
+	Topic             *string           `json:"topic,omitempty"`  // omitted if unset/unchanged, "" if removed
+	Heroes            []internal.Hero   `json:"heroes,omitempty"`
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
 	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
+	KnockState        []json.RawMessage `json:"knock_state,omitempty"`
 	NotificationCount int64             `json:"notification_count"`
 	HighlightCount    int64             `json:"highlight_count"`
-	Initial           bool              `json:"initial,omitempty"`
-	IsDM              bool              `json:"is_dm,omitempty"`
-	JoinedCount       int               `json:"joined_count,omitempty"`
-	InvitedCount      int               `json:"invited_count,omitempty"`
-	PrevBatch         string            `json:"prev_batch,omitempty"`
+	// thread root event ID -> unread counts. Omitted if there are no unread threads.
+	UnreadThreadNotifications map[string]UnreadCounts `json:"unread_thread_notifications,omitempty"`
+	Initial                   bool                    `json:"initial,omitempty"`
+	IsDM                      bool                    `json:"is_dm,omitempty"`
+	JoinedCount               int                     `json:"joined_count,omitempty"`
+	InvitedCount              int                     `json:"invited_count,omitempty"`
+	PrevBatch                 string                  `json:"prev_batch,omitempty"`
+	Timestamp                 uint64                  `json:"timestamp,omitempty"`
+}
+
+type UnreadCounts struct {
+	HighlightCount    int64 `json:"highlight_count"`
+	NotificationCount int64 `json:"notification_count"`
+}
+
+// NewUnreadThreadNotifications returns the non-zero per-thread unread counts for this room, or nil if
+// there are none.
+func NewUnreadThreadNotifications(userRoomData *caches.UserRoomData) map[string]UnreadCounts {
+	var result map[string]UnreadCounts
+	for threadID, counts := range userRoomData.ThreadUnreadCounts {
+		if counts.HighlightCount == 0 && counts.NotificationCount == 0 {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]UnreadCounts)
+		}
+		result[threadID] = UnreadCounts{
+			HighlightCount:    int64(counts.HighlightCount),
+			NotificationCount: int64(counts.NotificationCount),
+		}
+	}
+	return result
 }
 
 type RoomConnMetadata struct {
 	internal.RoomMetadata
 	caches.UserRoomData
+	// true if this room has been upgraded and the user is joined to the upgraded room
+	SuccessorJoined bool
+	// all spaces this room is in, directly or via sub-spaces
+	AncestorSpaces map[string]struct{}
 }
@@ -0,0 +1,14 @@
+package sync3
+
+// ConnSnapshot is the state of a connection as of the last response sent to the client. It is persisted
+// so the connection can be resumed from the same position if the server restarts, meaning the client
+// only sees what has changed rather than having to start again from scratch.
+type ConnSnapshot struct {
+	UserID string `json:"user_id"`
+	// The position of the last response sent to the client.
+	Pos int64 `json:"pos"`
+	// The combined request for this connection.
+	Request Request `json:"request"`
+	// Room subscriptions which were confirmed, as opposed to requested.
+	RoomSubscriptions []string `json:"room_subscriptions,omitempty"`
+}
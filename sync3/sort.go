@@ -17,6 +17,10 @@ type SortableRooms struct {
 	finder        RoomFinder
 	roomIDs       []string
 	roomIDToIndex map[string]int // room_id -> index in rooms
+	// the event types which count as activity when sorting by recency. All events count if empty.
+	bumpEventTypes []string
+	// if true, unread counts in threads are ignored when sorting by highlight/notification count
+	excludeThreadCounts bool
 }
 
 func NewSortableRooms(finder RoomFinder, rooms []string) *SortableRooms {
@@ -27,6 +31,23 @@ func NewSortableRooms(finder RoomFinder, rooms []string) *SortableRooms {
 	}
 }
 
+// SetBumpEventTypes sets the event types which are used to determine recency. Call Sort after setting
+// this to apply the new ordering.
+func (s *SortableRooms) SetBumpEventTypes(eventTypes []string) {
+	s.bumpEventTypes = eventTypes
+}
+
+// BumpEventTypes returns the event types which are used to determine recency.
+func (s *SortableRooms) BumpEventTypes() []string {
+	return s.bumpEventTypes
+}
+
+// SetExcludeThreadCounts controls whether unread counts in threads are used when sorting by highlight
+// or notification count. Call Sort after setting this to apply the new ordering.
+func (s *SortableRooms) SetExcludeThreadCounts(exclude bool) {
+	s.excludeThreadCounts = exclude
+}
+
 func (s *SortableRooms) IndexOf(roomID string) (int, bool) {
 	index, ok := s.roomIDToIndex[roomID]
 	return index, ok
@@ -140,10 +161,12 @@ func (s *SortableRooms) comparatorSortByName(i, j int) int {
 
 func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
-	if ri.LastMessageTimestamp == rj.LastMessageTimestamp {
+	tsi := ri.BumpTimestamp(s.bumpEventTypes)
+	tsj := rj.BumpTimestamp(s.bumpEventTypes)
+	if tsi == tsj {
 		return 0
 	}
-	if ri.LastMessageTimestamp > rj.LastMessageTimestamp {
+	if tsi > tsj {
 		return 1
 	}
 	return -1
@@ -151,10 +174,12 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 
 func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
-	if ri.HighlightCount == rj.HighlightCount {
+	hi := ri.TotalHighlightCount(!s.excludeThreadCounts)
+	hj := rj.TotalHighlightCount(!s.excludeThreadCounts)
+	if hi == hj {
 		return 0
 	}
-	if ri.HighlightCount > rj.HighlightCount {
+	if hi > hj {
 		return 1
 	}
 	return -1
@@ -162,10 +187,12 @@ func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 
 func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
-	if ri.NotificationCount == rj.NotificationCount {
+	ni := ri.TotalNotificationCount(!s.excludeThreadCounts)
+	nj := rj.TotalNotificationCount(!s.excludeThreadCounts)
+	if ni == nj {
 		return 0
 	}
-	if ri.NotificationCount > rj.NotificationCount {
+	if ni > nj {
 		return 1
 	}
 	return -1
@@ -1,9 +1,11 @@
 package sync3
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/matrix-org/sync-v3/internal"
+	"github.com/matrix-org/sync-v3/state"
 	"github.com/matrix-org/sync-v3/sync3/caches"
 )
 
@@ -238,3 +240,136 @@ func TestSortableRoomsRemove(t *testing.T) {
 		t.Errorf("IndexOf room 2 returned %v %v", i, ok)
 	}
 }
+
+func TestSortByRecencyWithBumpEventTypes(t *testing.T) {
+	room1 := "!1:localhost"
+	room2 := "!2:localhost"
+	room3 := "!3:localhost"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               room1,
+				LastMessageTimestamp: 900, // a reaction
+				LastEventTimestamps: map[string]uint64{
+					"m.room.message":   500,
+					"m.reaction":       900,
+					"m.room.member":    100,
+					"m.room.encrypted": 200,
+				},
+			},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               room2,
+				LastMessageTimestamp: 800, // a join
+				LastEventTimestamps: map[string]uint64{
+					"m.room.member":  800,
+					"m.room.message": 300,
+				},
+			},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               room3,
+				LastMessageTimestamp: 700,
+				LastEventTimestamps: map[string]uint64{
+					"m.room.create":    50,
+					"m.room.encrypted": 700,
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		bumpEventTypes []string
+		wantOrder      []string
+	}{
+		{
+			bumpEventTypes: nil,
+			wantOrder:      []string{room1, room2, room3},
+		},
+		{
+			bumpEventTypes: []string{"m.room.message", "m.room.encrypted"},
+			wantOrder:      []string{room3, room1, room2},
+		},
+		{
+			bumpEventTypes: []string{"m.room.message"},
+			// room 3 has no messages so falls back to the creation time, not the latest event
+			wantOrder: []string{room1, room2, room3},
+		},
+		{
+			bumpEventTypes: []string{"m.room.member"},
+			wantOrder:      []string{room2, room1, room3},
+		},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, f.roomIDs)
+	for _, tc := range testCases {
+		sr.SetBumpEventTypes(tc.bumpEventTypes)
+		if err := sr.Sort([]string{SortByRecency}); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if !reflect.DeepEqual(sr.RoomIDs(), tc.wantOrder) {
+			t.Errorf("bump_event_types %v: got %v want %v", tc.bumpEventTypes, sr.RoomIDs(), tc.wantOrder)
+		}
+	}
+}
+
+func TestSortByNotificationCountWithThreads(t *testing.T) {
+	room1 := "!1:localhost"
+	room2 := "!2:localhost"
+	room3 := "!3:localhost"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: room1,
+			},
+			UserRoomData: caches.UserRoomData{
+				NotificationCount: 3,
+			},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: room2,
+			},
+			UserRoomData: caches.UserRoomData{
+				NotificationCount: 1,
+				ThreadUnreadCounts: map[string]state.UnreadCounts{
+					"$thread1": {NotificationCount: 2},
+					"$thread2": {NotificationCount: 2},
+				},
+			},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: room3,
+			},
+			UserRoomData: caches.UserRoomData{
+				NotificationCount: 2,
+			},
+		},
+	}
+	testCases := []struct {
+		excludeThreadCounts bool
+		wantOrder           []string
+	}{
+		{
+			excludeThreadCounts: false,
+			wantOrder:           []string{room2, room1, room3},
+		},
+		{
+			excludeThreadCounts: true,
+			wantOrder:           []string{room1, room3, room2},
+		},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, f.roomIDs)
+	for _, tc := range testCases {
+		sr.SetExcludeThreadCounts(tc.excludeThreadCounts)
+		if err := sr.Sort([]string{SortByNotificationCount}); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if !reflect.DeepEqual(sr.RoomIDs(), tc.wantOrder) {
+			t.Errorf("exclude_thread_counts %v: got %v want %v", tc.excludeThreadCounts, sr.RoomIDs(), tc.wantOrder)
+		}
+	}
+}
@@ -34,8 +34,8 @@ func TestMultipleLists(t *testing.T) {
 
 	// request 2 lists, one set encrypted, one set unencrypted
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Sort: []string{sync3.SortByRecency},
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
@@ -47,7 +47,7 @@ func TestMultipleLists(t *testing.T) {
 					IsEncrypted: &boolTrue,
 				},
 			},
-			{
+			"b": {
 				Sort: []string{sync3.SortByRecency},
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
@@ -63,13 +63,13 @@ func TestMultipleLists(t *testing.T) {
 	})
 
 	m.MatchResponse(t, res,
-		m.MatchLists([]m.ListMatcher{
+		m.MatchLists(map[string][]m.ListMatcher{"a": {
 			m.MatchV3Count(len(encryptedRoomIDs)),
 			m.MatchV3Ops(m.MatchV3SyncOp(0, 2, encryptedRoomIDs[:3])),
-		}, []m.ListMatcher{
+		}, "b": {
 			m.MatchV3Count(len(unencryptedRoomIDs)),
 			m.MatchV3Ops(m.MatchV3SyncOp(0, 2, unencryptedRoomIDs[:3])),
-		}),
+		}}),
 		m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
 			encryptedRoomIDs[0]:   {},
 			encryptedRoomIDs[1]:   {},
@@ -82,13 +82,13 @@ func TestMultipleLists(t *testing.T) {
 
 	// now scroll one of the lists
 	res = alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms still
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
 					[2]int64{3, 5}, // next 3 rooms
@@ -96,14 +96,14 @@ func TestMultipleLists(t *testing.T) {
 			},
 		},
 	}, WithPos(res.Pos))
-	m.MatchResponse(t, res, m.MatchLists([]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{"a": {
 		m.MatchV3Count(len(encryptedRoomIDs)),
-	}, []m.ListMatcher{
+	}, "b": {
 		m.MatchV3Count(len(unencryptedRoomIDs)),
 		m.MatchV3Ops(
 			m.MatchV3SyncOp(3, 5, unencryptedRoomIDs[3:6]),
 		),
-	}), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+	}}), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
 		unencryptedRoomIDs[3]: {},
 		unencryptedRoomIDs[4]: {},
 		unencryptedRoomIDs[5]: {},
@@ -118,13 +118,13 @@ func TestMultipleLists(t *testing.T) {
 	// We are tracking the first few encrypted rooms so we expect list 0 to update
 	// However we do not track old unencrypted rooms so we expect no change in list 1
 	res = alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms still
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
 					[2]int64{3, 5}, // next 3 rooms
@@ -132,15 +132,15 @@ func TestMultipleLists(t *testing.T) {
 			},
 		},
 	}, WithPos(res.Pos))
-	m.MatchResponse(t, res, m.MatchLists([]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{"a": {
 		m.MatchV3Count(len(encryptedRoomIDs)),
 		m.MatchV3Ops(
 			m.MatchV3DeleteOp(2),
 			m.MatchV3InsertOp(0, encryptedRoomIDs[0]),
 		),
-	}, []m.ListMatcher{
+	}, "b": {
 		m.MatchV3Count(len(unencryptedRoomIDs)),
-	}))
+	}}))
 }
 
 // Test that bumps only update a single list and not both. Regression test for when
@@ -171,8 +171,8 @@ func TestMultipleListsDMUpdate(t *testing.T) {
 
 	// request 2 lists, one set DM, one set no DM
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Sort: []string{sync3.SortByRecency},
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
@@ -184,7 +184,7 @@ func TestMultipleListsDMUpdate(t *testing.T) {
 					IsDM: &boolTrue,
 				},
 			},
-			{
+			"b": {
 				Sort: []string{sync3.SortByRecency},
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
@@ -199,13 +199,13 @@ func TestMultipleListsDMUpdate(t *testing.T) {
 		},
 	})
 
-	m.MatchResponse(t, res, m.MatchLists([]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{"a": {
 		m.MatchV3Count(len(dmRoomIDs)),
 		m.MatchV3Ops(m.MatchV3SyncOp(0, 2, dmRoomIDs[:3])),
-	}, []m.ListMatcher{
+	}, "b": {
 		m.MatchV3Count(len(groupRoomIDs)),
 		m.MatchV3Ops(m.MatchV3SyncOp(0, 2, groupRoomIDs[:3])),
-	}))
+	}}))
 
 	// now bring the last DM room to the top with a notif
 	pingEventID := alice.SendEventSynced(t, dmRoomIDs[len(dmRoomIDs)-1], Event{
@@ -217,28 +217,28 @@ func TestMultipleListsDMUpdate(t *testing.T) {
 
 	// now get the delta: only the DM room should change
 	res = alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms still
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms still
 				},
 			},
 		},
 	}, WithPos(res.Pos))
-	m.MatchResponse(t, res, m.MatchLists([]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{"a": {
 		m.MatchV3Count(len(dmRoomIDs)),
 		m.MatchV3Ops(
 			m.MatchV3DeleteOp(2),
 			m.MatchV3InsertOp(0, dmRoomIDs[0]),
 		),
-	}, []m.ListMatcher{
+	}, "b": {
 		m.MatchV3Count(len(groupRoomIDs)),
-	}), m.MatchRoomSubscription(dmRoomIDs[0], MatchRoomTimelineMostRecent(1, []Event{
+	}}), m.MatchRoomSubscription(dmRoomIDs[0], MatchRoomTimelineMostRecent(1, []Event{
 		{
 			Type: "m.room.message",
 			ID:   pingEventID,
@@ -261,14 +261,14 @@ func TestNewListMidConnection(t *testing.T) {
 
 	// first request no list
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{},
+		Lists: map[string]sync3.RequestList{},
 	})
-	m.MatchResponse(t, res, m.MatchLists())
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{}))
 
 	// now add a list
 	res = alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 2}, // first 3 rooms
 				},
@@ -278,7 +278,7 @@ func TestNewListMidConnection(t *testing.T) {
 			},
 		},
 	}, WithPos(res.Pos))
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(roomIDs)), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(roomIDs)), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 2, roomIDs[:3]),
 	)))
 }
@@ -356,8 +356,8 @@ func TestMultipleOverlappingLists(t *testing.T) {
 	//
 	// Rooms with * are union'd
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Sort: []string{sync3.SortByRecency},
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 4}, // first 5 rooms
@@ -372,7 +372,7 @@ func TestMultipleOverlappingLists(t *testing.T) {
 					IsEncrypted: &boolTrue,
 				},
 			},
-			{
+			"b": {
 				Sort: []string{sync3.SortByRecency},
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 4}, // first 5 rooms
@@ -391,8 +391,8 @@ func TestMultipleOverlappingLists(t *testing.T) {
 	})
 
 	m.MatchResponse(t, res,
-		m.MatchList(0, m.MatchV3Ops(m.MatchV3SyncOp(0, 4, encryptedRoomIDs[:5]))),
-		m.MatchList(1, m.MatchV3Ops(m.MatchV3SyncOp(0, 4, dmRoomIDs[:5]))),
+		m.MatchList("a", m.MatchV3Ops(m.MatchV3SyncOp(0, 4, encryptedRoomIDs[:5]))),
+		m.MatchList("b", m.MatchV3Ops(m.MatchV3SyncOp(0, 4, dmRoomIDs[:5]))),
 		m.MatchRoomSubscriptions(map[string][]m.RoomMatcher{
 			// encrypted rooms just come from the encrypted only list
 			encryptedRoomIDs[0]: {
@@ -511,8 +511,8 @@ func TestNot500OnNewRooms(t *testing.T) {
 	mSpace := "m.space"
 	alice := registerNewUser(t)
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				SlowGetAllRooms: &boolTrue,
 				Filters: &sync3.RequestFilters{
 					RoomTypes: []*string{&mSpace},
@@ -522,14 +522,14 @@ func TestNot500OnNewRooms(t *testing.T) {
 	})
 	alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
 	alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				SlowGetAllRooms: &boolTrue,
 				Filters: &sync3.RequestFilters{
 					RoomTypes: []*string{&mSpace},
 				},
 			},
-			{
+			"b": {
 				Filters: &sync3.RequestFilters{
 					IsDM: &boolFalse,
 				},
@@ -539,11 +539,11 @@ func TestNot500OnNewRooms(t *testing.T) {
 	}, WithPos(res.Pos))
 	alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
 	alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				SlowGetAllRooms: &boolTrue,
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{{0, 20}},
 			},
 		},
@@ -555,13 +555,13 @@ func TestNot500OnNewRooms(t *testing.T) {
 func TestNewRoomNameCalculations(t *testing.T) {
 	alice := registerNewUser(t)
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				SlowGetAllRooms: &boolTrue,
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(0)))
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(0)))
 
 	// create 10 room in parallel and at the same time spam sliding sync to ensure we get bits of
 	// rooms before they are fully loaded.
@@ -589,8 +589,8 @@ func TestNewRoomNameCalculations(t *testing.T) {
 	var err error
 	for {
 		res = alice.SlidingSync(t, sync3.Request{
-			Lists: []sync3.RequestList{
-				{
+			Lists: map[string]sync3.RequestList{
+				"a": {
 					SlowGetAllRooms: &boolTrue,
 				},
 			},
@@ -636,8 +636,8 @@ func TestChangeSortOrder(t *testing.T) {
 	alice := registerNewUser(t)
 
 	res := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{{0, 20}},
 				Sort:   []string{sync3.SortByRecency},
 				RoomSubscription: sync3.RoomSubscription{
@@ -661,8 +661,8 @@ func TestChangeSortOrder(t *testing.T) {
 				break
 			}
 			res = alice.SlidingSync(t, sync3.Request{
-				Lists: []sync3.RequestList{
-					{
+				Lists: map[string]sync3.RequestList{
+					"a": {
 						Ranges: sync3.SliceRanges{{0, 20}},
 					},
 				},
@@ -690,8 +690,8 @@ func TestChangeSortOrder(t *testing.T) {
 	txnID := "a"
 	res = alice.SlidingSync(t, sync3.Request{
 		TxnID: "a",
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{{0, 20}},
 				Sort:   []string{sync3.SortByName},
 			},
@@ -699,15 +699,15 @@ func TestChangeSortOrder(t *testing.T) {
 	}, WithPos(res.Pos))
 	for res.TxnID != txnID {
 		res = alice.SlidingSync(t, sync3.Request{
-			Lists: []sync3.RequestList{
-				{
+			Lists: map[string]sync3.RequestList{
+				"a": {
 					Ranges: sync3.SliceRanges{{0, 20}},
 				},
 			},
 		}, WithPos(res.Pos))
 	}
 
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(4), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(4), m.MatchV3Ops(
 		m.MatchV3InvalidateOp(0, 20),
 		m.MatchV3SyncOp(0, 20, []string{gotNameToIDs["Apple"], gotNameToIDs["Kiwi"], gotNameToIDs["Lemon"], gotNameToIDs["Orange"]}),
 	)))
@@ -32,23 +32,23 @@ func TestSecurityLiveStreamEventLeftLeak(t *testing.T) {
 
 	// start sync streams for Alice and Eve
 	aliceRes := alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 10}, // doesn't matter
 			},
 		}},
 	})
-	m.MatchResponse(t, aliceRes, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, aliceRes, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 10, []string{roomID}),
 	)))
 	eveRes := eve.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 10}, // doesn't matter
 			},
 		}},
 	})
-	m.MatchResponse(t, eveRes, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, eveRes, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 10, []string{roomID}),
 	)))
 
@@ -68,7 +68,7 @@ func TestSecurityLiveStreamEventLeftLeak(t *testing.T) {
 
 	// Ensure Alice sees both events
 	aliceRes = alice.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 10}, // doesn't matter
 			},
@@ -105,13 +105,13 @@ func TestSecurityLiveStreamEventLeftLeak(t *testing.T) {
 	kickEvent := lastTwoEvents[0]
 
 	// TODO: WE should be returning updated values for name and required_state
-	m.MatchResponse(t, aliceRes, m.MatchList(0, m.MatchV3Count(1)), m.MatchNoV3Ops(), m.MatchRoomSubscription(
+	m.MatchResponse(t, aliceRes, m.MatchList("a", m.MatchV3Count(1)), m.MatchNoV3Ops(), m.MatchRoomSubscription(
 		roomID, m.MatchRoomTimelineMostRecent(2, []json.RawMessage{kickEvent, sensitiveEvent}),
 	))
 
 	// Ensure Eve doesn't see this message in the timeline, name calc or required_state
 	eveRes = eve.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 10}, // doesn't matter
 			},
@@ -123,7 +123,7 @@ func TestSecurityLiveStreamEventLeftLeak(t *testing.T) {
 		}},
 	}, WithPos(eveRes.Pos))
 	// the room is deleted from eve's point of view and she sees up to and including her kick event
-	m.MatchResponse(t, eveRes, m.MatchList(0, m.MatchV3Count(0), m.MatchV3Ops(m.MatchV3DeleteOp(0))), m.MatchRoomSubscription(
+	m.MatchResponse(t, eveRes, m.MatchList("a", m.MatchV3Count(0), m.MatchV3Ops(m.MatchV3DeleteOp(0))), m.MatchRoomSubscription(
 		roomID, m.MatchRoomName(""), m.MatchRoomRequiredState(nil), m.MatchRoomTimelineMostRecent(1, []json.RawMessage{kickEvent}),
 	))
 }
@@ -155,7 +155,7 @@ func TestSecurityRoomSubscriptionLeak(t *testing.T) {
 
 	// start sync streams for Eve, with a room subscription to alice's private room
 	eveRes := eve.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 10}, // doesn't matter
 			},
@@ -170,7 +170,7 @@ func TestSecurityRoomSubscriptionLeak(t *testing.T) {
 		},
 	})
 	// Assert that Eve doesn't see anything
-	m.MatchResponse(t, eveRes, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, eveRes, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 10, []string{eveUnrelatedRoomID}),
 	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
 		eveUnrelatedRoomID: {},
@@ -185,7 +185,7 @@ func TestSecurityRoomSubscriptionLeak(t *testing.T) {
 		},
 	})
 	eveRes = eve.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 10}, // doesn't matter
 			},
@@ -193,7 +193,7 @@ func TestSecurityRoomSubscriptionLeak(t *testing.T) {
 	}, WithPos(eveRes.Pos))
 
 	// Assert that Eve doesn't see anything
-	m.MatchResponse(t, eveRes, m.MatchList(0, m.MatchV3Count(1)), m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{}))
+	m.MatchResponse(t, eveRes, m.MatchList("a", m.MatchV3Count(1)), m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{}))
 }
 
 // Test that events do not leak via direct space subscriptions.
@@ -229,8 +229,8 @@ func TestSecuritySpaceDataLeak(t *testing.T) {
 
 	// ensure eve sees nothing
 	res := eve.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: [][2]int64{{0, 20}},
 				Filters: &sync3.RequestFilters{
 					Spaces: []string{roomA},
@@ -293,8 +293,8 @@ func TestSecuritySpaceMetadataLeak(t *testing.T) {
 
 	// ensure eve sees nothing
 	res := eve.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: [][2]int64{{0, 20}},
 				Filters: &sync3.RequestFilters{
 					Spaces: []string{roomA},
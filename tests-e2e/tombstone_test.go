@@ -18,8 +18,8 @@ func TestTombstonesFlag(t *testing.T) {
 	roomID := client.CreateRoom(t, map[string]interface{}{})
 
 	res := client.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: [][2]int64{{0, 1}},
 				Filters: &sync3.RequestFilters{
 					IsTombstoned: &boolFalse,
@@ -30,7 +30,7 @@ func TestTombstonesFlag(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 1, []string{roomID}),
 	)))
 	upgradeRes := client.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "upgrade"}, WithJSONBody(t, map[string]interface{}{
@@ -45,15 +45,15 @@ func TestTombstonesFlag(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // let the proxy process it
 
 	res = client.SlidingSync(t, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: [][2]int64{{0, 1}},
 			},
 		},
 	}, WithPos(res.Pos))
 	var tombstoneEventID string
 	// count is 1 as we are auto-joined to the upgraded room
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3DeleteOp(1),
 		m.MatchV3InsertOp(0, newRoomID), // insert new room
 		m.MatchV3DeleteOp(1),            // remove old room
@@ -60,7 +60,7 @@ func benchNumV2Rooms(numRooms int, b *testing.B) {
 	})
 	// do the initial request
 	v3.mustDoV3Request(b, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 20}, // first few rooms
 			},
@@ -75,7 +75,7 @@ func benchNumV2Rooms(numRooms int, b *testing.B) {
 	// these should all take roughly the same amount of time, regardless of the value of `numRooms`
 	for n := 0; n < b.N; n++ {
 		v3.mustDoV3Request(b, aliceToken, sync3.Request{
-			Lists: []sync3.RequestList{{
+			Lists: map[string]sync3.RequestList{"a": {
 				// always use a fixed range else we will scale O(n) with the number of rooms
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // first few rooms
@@ -0,0 +1,137 @@
+package syncv3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/matrix-org/sync-v3/testutils/m"
+)
+
+// Test that connections survive server restarts. Resuming a connection SYNCs the ranges the client was
+// watching, and sends the rooms in them again as the proxy doesn't know what else changed in them.
+func TestConnectionResumesAfterRestart(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomA := "!TestConnectionResumesAfterRestart_a:localhost"
+	roomB := "!TestConnectionResumesAfterRestart_b:localhost"
+	roomC := "!TestConnectionResumesAfterRestart_c:localhost"
+	ts := time.Now()
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomA,
+				events: createRoomState(t, alice, ts.Add(2*time.Second)),
+			}, roomEvents{
+				roomID: roomB,
+				events: createRoomState(t, alice, ts.Add(time.Second)),
+			}, roomEvents{
+				roomID: roomC,
+				events: createRoomState(t, alice, ts),
+			}),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 1}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 1, []string{roomA, roomB}),
+	)))
+
+	// room C is bumped to the top whilst the client isn't syncing
+	newEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "bump"}, testutils.WithTimestamp(ts.Add(time.Minute)))
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomC,
+				events: []json.RawMessage{newEvent},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	v3.restart(t, v2, pqString)
+
+	// positions which were never sent to the client are still rejected
+	_, _, code := v3.doV3Request(t, context.Background(), aliceToken, fmt.Sprintf("%d", res.PosInt()+1), req)
+	if code != 400 {
+		t.Fatalf("resuming with an unknown pos: got HTTP %d want 400", code)
+	}
+
+	// the connection is resumed, returning the rooms now in the range
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 1, []string{roomC, roomA}),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomC: {
+			m.MatchRoomTimelineMostRecent(1, []json.RawMessage{newEvent}),
+		},
+		roomA: {},
+	}))
+
+	// the resumed connection carries on as normal
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3)), m.MatchNoV3Ops())
+}
+
+// Test that connections which were closed by the server e.g because they expired cannot be resumed by
+// presenting their last position.
+func TestConnectionCannotBeResumedAfterClose(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomA := "!TestConnectionCannotBeResumedAfterClose_a:localhost"
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomA,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 1}},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+
+	conns := v3.handler.ConnMap.AllConns()
+	if len(conns) != 1 {
+		t.Fatalf("want 1 connection, got %d", len(conns))
+	}
+	v3.handler.ConnMap.CloseConn(conns[0].ConnID)
+
+	// restarting flushes the snapshot deletion
+	v3.restart(t, v2, pqString)
+
+	_, _, code := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, req)
+	if code != 400 {
+		t.Fatalf("resuming a closed connection: got HTTP %d want 400", code)
+	}
+}
@@ -30,8 +30,8 @@ func TestFiltersEncryption(t *testing.T) {
 
 	// connect and make sure either the encrypted room or not depending on what the filter says
 	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 1}, // all rooms
 				},
@@ -39,7 +39,7 @@ func TestFiltersEncryption(t *testing.T) {
 					IsEncrypted: &boolTrue,
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 1}, // all rooms
 				},
@@ -49,34 +49,34 @@ func TestFiltersEncryption(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(1),
 			m.MatchV3Ops(
 				m.MatchV3SyncOp(0, 1, []string{encryptedRoomID}),
 			),
 		},
-		[]m.ListMatcher{
+		"b": {
 			m.MatchV3Count(1),
 			m.MatchV3Ops(
 				m.MatchV3SyncOp(0, 1, []string{unencryptedRoomID}),
 			),
 		},
-	))
+	}))
 
 	// change the unencrypted room into an encrypted room
 	rig.EncryptRoom(t, alice, unencryptedRoomID)
 
 	// now requesting the encrypted list should include it (added)
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 1}, // all rooms
 				},
 				// sticky; should remember filters
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 1}, // all rooms
 				},
@@ -84,24 +84,24 @@ func TestFiltersEncryption(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(2),
 			m.MatchV3Ops(
 				m.MatchV3DeleteOp(1), m.MatchV3InsertOp(0, unencryptedRoomID),
 			),
 		},
-		[]m.ListMatcher{
+		"b": {
 			m.MatchV3Count(0),
 			m.MatchV3Ops(
 				m.MatchV3DeleteOp(0),
 			),
 		},
-	))
+	}))
 
 	// requesting the encrypted list from scratch returns 2 rooms now
 	res = rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 1}, // all rooms
 			},
@@ -110,18 +110,18 @@ func TestFiltersEncryption(t *testing.T) {
 			},
 		}},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(2),
 			m.MatchV3Ops(
 				m.MatchV3SyncOp(0, 1, []string{unencryptedRoomID, encryptedRoomID}),
 			),
 		},
-	))
+	}))
 
 	// requesting the unencrypted stream from scratch returns 0 rooms
 	res = rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, 1}, // all rooms
 			},
@@ -130,11 +130,11 @@ func TestFiltersEncryption(t *testing.T) {
 			},
 		}},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(0),
 		},
-	))
+	}))
 }
 
 func TestFiltersInvite(t *testing.T) {
@@ -152,8 +152,8 @@ func TestFiltersInvite(t *testing.T) {
 
 	// make sure the is_invite filter works
 	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
 				},
@@ -161,7 +161,7 @@ func TestFiltersInvite(t *testing.T) {
 					IsInvite: &boolTrue,
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
 				},
@@ -171,31 +171,31 @@ func TestFiltersInvite(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(1),
 			m.MatchV3Ops(
 				m.MatchV3SyncOp(0, 20, []string{roomID}),
 			),
 		},
-		[]m.ListMatcher{
+		"b": {
 			m.MatchV3Count(0),
 		},
-	))
+	}))
 
 	// Accept the invite
 	rig.JoinRoom(t, alice, roomID)
 
 	// now the room should move from one room to another
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
 				},
 				// sticky; should remember filters
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
 				},
@@ -204,21 +204,21 @@ func TestFiltersInvite(t *testing.T) {
 		},
 	})
 	// the room swaps from the invite list to the join list
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(0),
 			m.MatchV3Ops(
 				m.MatchV3DeleteOp(0),
 			),
 		},
-		[]m.ListMatcher{
+		"b": {
 			m.MatchV3Count(1),
 			m.MatchV3Ops(
 				m.MatchV3DeleteOp(0),
 				m.MatchV3InsertOp(0, roomID),
 			),
 		},
-	))
+	}))
 }
 
 func TestFiltersRoomName(t *testing.T) {
@@ -258,8 +258,8 @@ func TestFiltersRoomName(t *testing.T) {
 
 	// make sure the room name filter works
 	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
 				},
@@ -269,8 +269,8 @@ func TestFiltersRoomName(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(5),
 			m.MatchV3Ops(
 				m.MatchV3SyncOp(0, 20, []string{
@@ -278,12 +278,12 @@ func TestFiltersRoomName(t *testing.T) {
 				}, true),
 			),
 		},
-	))
+	}))
 
 	// refine the filter
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
 				},
@@ -293,8 +293,8 @@ func TestFiltersRoomName(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(2),
 			m.MatchV3Ops(
 				m.MatchV3InvalidateOp(0, 20),
@@ -303,7 +303,7 @@ func TestFiltersRoomName(t *testing.T) {
 				}, true),
 			),
 		},
-	))
+	}))
 }
 
 func TestFiltersRoomTypes(t *testing.T) {
@@ -328,8 +328,8 @@ func TestFiltersRoomTypes(t *testing.T) {
 
 	// make sure the room_types and not_room_types filters works
 	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			// returns spaceRoomID only due to direct match
+		Lists: map[string]sync3.RequestList{
+			"a": // returns spaceRoomID only due to direct match
 			{
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
@@ -338,7 +338,7 @@ func TestFiltersRoomTypes(t *testing.T) {
 					RoomTypes: []*string{&roomType},
 				},
 			},
-			// returns roomID only due to direct match (null = things without a room type)
+			"b": // returns roomID only due to direct match (null = things without a room type)
 			{
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
@@ -347,7 +347,7 @@ func TestFiltersRoomTypes(t *testing.T) {
 					RoomTypes: []*string{nil},
 				},
 			},
-			// returns roomID and otherRoomID due to exclusion
+			"c": // returns roomID and otherRoomID due to exclusion
 			{
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
@@ -356,7 +356,7 @@ func TestFiltersRoomTypes(t *testing.T) {
 					NotRoomTypes: []*string{&roomType},
 				},
 			},
-			// returns otherRoomID due to otherRoomType inclusive, roomType is excluded (override)
+			"d": // returns otherRoomID due to otherRoomType inclusive, roomType is excluded (override)
 			{
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
@@ -366,7 +366,7 @@ func TestFiltersRoomTypes(t *testing.T) {
 					NotRoomTypes: []*string{&roomType},
 				},
 			},
-			// returns no rooms as filtered room type isn't set on any rooms
+			"e": // returns no rooms as filtered room type isn't set on any rooms
 			{
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
@@ -375,7 +375,7 @@ func TestFiltersRoomTypes(t *testing.T) {
 					RoomTypes: []*string{&invalid},
 				},
 			},
-			// returns all rooms as filtered not room type isn't set on any rooms
+			"f": // returns all rooms as filtered not room type isn't set on any rooms
 			{
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20}, // all rooms
@@ -386,26 +386,26 @@ func TestFiltersRoomTypes(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchLists(
-		[]m.ListMatcher{
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
 			m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 20, []string{spaceRoomID})),
 		},
-		[]m.ListMatcher{
+		"b": {
 			m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 20, []string{roomID})),
 		},
-		[]m.ListMatcher{
+		"c": {
 			m.MatchV3Count(2), m.MatchV3Ops(m.MatchV3SyncOp(0, 20, []string{roomID, otherRoomID}, true)),
 		},
-		[]m.ListMatcher{
+		"d": {
 			m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 20, []string{otherRoomID})),
 		},
-		[]m.ListMatcher{
+		"e": {
 			m.MatchV3Count(0),
 		},
-		[]m.ListMatcher{
+		"f": {
 			m.MatchV3Count(3), m.MatchV3Ops(m.MatchV3SyncOp(0, 20, []string{roomID, otherRoomID, spaceRoomID}, true)),
 		},
-	))
+	}))
 }
 
 func TestFiltersTags(t *testing.T) {
@@ -448,8 +448,8 @@ func TestFiltersTags(t *testing.T) {
 	})
 	aliceToken := rig.Token(alice)
 	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
@@ -457,7 +457,7 @@ func TestFiltersTags(t *testing.T) {
 					Tags: []string{tagFav},
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
@@ -465,7 +465,7 @@ func TestFiltersTags(t *testing.T) {
 					Tags: []string{tagLow},
 				},
 			},
-			{
+			"c": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
@@ -475,21 +475,21 @@ func TestFiltersTags(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(3), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 20, []string{fav1RoomID, fav2RoomID, favAndLowRoomID}, true),
-	)), m.MatchList(1, m.MatchV3Count(3), m.MatchV3Ops(
+	)), m.MatchList("b", m.MatchV3Count(3), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 20, []string{low1RoomID, low2RoomID, favAndLowRoomID}, true),
-	)), m.MatchList(2, m.MatchV3Count(5), m.MatchV3Ops(
+	)), m.MatchList("c", m.MatchV3Count(5), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 20, []string{fav1RoomID, fav2RoomID, favAndLowRoomID, low1RoomID, low2RoomID}, true),
 	)))
 
 	// first bump the fav1 room
 	rig.FlushEvent(t, alice, fav1RoomID, testutils.NewMessageEvent(t, alice, "Hi"))
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{Ranges: sync3.SliceRanges{{0, 20}}},
-			{Ranges: sync3.SliceRanges{{0, 20}}},
-			{Ranges: sync3.SliceRanges{{0, 20}}},
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 20}}},
+			"b": {Ranges: sync3.SliceRanges{{0, 20}}},
+			"c": {Ranges: sync3.SliceRanges{{0, 20}}},
 		},
 	})
 
@@ -511,22 +511,22 @@ func TestFiltersTags(t *testing.T) {
 
 	// we should see DELETEs
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{Ranges: sync3.SliceRanges{{0, 20}}},
-			{Ranges: sync3.SliceRanges{{0, 20}}},
-			{Ranges: sync3.SliceRanges{{0, 20}}},
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 20}}},
+			"b": {Ranges: sync3.SliceRanges{{0, 20}}},
+			"c": {Ranges: sync3.SliceRanges{{0, 20}}},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(2), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
 		m.MatchV3DeleteOp(0),
-	)), m.MatchList(1, m.MatchV3Ops()), m.MatchList(2, m.MatchV3Count(4), m.MatchV3Ops(
+	)), m.MatchList("b", m.MatchV3Ops()), m.MatchList("c", m.MatchV3Count(4), m.MatchV3Ops(
 		m.MatchV3DeleteOp(0),
 	)))
 
 	// check not_tags works
 	res = rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
@@ -534,7 +534,7 @@ func TestFiltersTags(t *testing.T) {
 					Tags: []string{tagFav},
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
@@ -544,9 +544,9 @@ func TestFiltersTags(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(2), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 20, []string{fav2RoomID, favAndLowRoomID}, true),
-	)), m.MatchList(1, m.MatchV3Count(3), m.MatchV3Ops(
+	)), m.MatchList("b", m.MatchV3Count(3), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 20, []string{low1RoomID, low2RoomID, fav1RoomID}, true),
 	)))
 
@@ -568,13 +568,13 @@ func TestFiltersTags(t *testing.T) {
 	})
 	rig.V2.waitUntilEmpty(t, alice)
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
 			},
-			{
+			"b": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, 20},
 				},
@@ -589,10 +589,95 @@ func TestFiltersTags(t *testing.T) {
 	// now we have removed fav tag on FAV2 so new lists are:
 	// FAVLOW
 	// FAV1, LOW2, LOW1, FAV2
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3DeleteOp(1),
-	)), m.MatchList(1, m.MatchV3Count(4), m.MatchV3Ops(
+	)), m.MatchList("b", m.MatchV3Count(4), m.MatchV3Ops(
 		m.MatchV3DeleteOp(3),
 		m.MatchV3InsertOp(3, fav2RoomID),
 	)))
 }
+
+func TestFiltersLeft(t *testing.T) {
+	boolTrue := true
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	roomA := "!TestFiltersLeft_a:localhost"
+	roomB := "!TestFiltersLeft_b:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		roomA: {},
+		roomB: {},
+	})
+	aliceToken := rig.Token(alice)
+
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"joined": {
+				Ranges: sync3.SliceRanges{
+					[2]int64{0, 20}, // all rooms
+				},
+			},
+			"left": {
+				Ranges: sync3.SliceRanges{
+					[2]int64{0, 20}, // all rooms
+				},
+				Filters: &sync3.RequestFilters{
+					IsLeft: &boolTrue,
+				},
+			},
+			"all": {
+				Ranges: sync3.SliceRanges{
+					[2]int64{0, 20}, // all rooms
+				},
+				Filters: &sync3.RequestFilters{
+					IncludeLeft: &boolTrue,
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"joined": {
+			m.MatchV3Count(2),
+		},
+		"left": {
+			m.MatchV3Count(0),
+		},
+		"all": {
+			m.MatchV3Count(2),
+		},
+	}))
+
+	// leave a room: it should move from the joined list to the left list and remain in the all list
+	rig.LeaveRoom(t, alice, roomA)
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"joined": {
+			m.MatchV3Count(1),
+		},
+		"left": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(
+				m.MatchV3InsertOp(0, roomA),
+			),
+		},
+		"all": {
+			m.MatchV3Count(2),
+		},
+	}))
+
+	// new connections should see the left room too
+	res = rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"left": {
+				Ranges: sync3.SliceRanges{
+					[2]int64{0, 20}, // all rooms
+				},
+				Filters: &sync3.RequestFilters{
+					IsLeft: &boolTrue,
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("left", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 20, []string{roomA}),
+	)))
+}
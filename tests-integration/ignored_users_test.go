@@ -0,0 +1,128 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/matrix-org/sync-v3/testutils/m"
+)
+
+// Test that events and invites from users in m.ignored_user_list are not sent to the client.
+func TestIgnoredUsers(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	joinedRoomID := "!TestIgnoredUsers_joined:localhost"
+	inviteRoomID := "!TestIgnoredUsers_invite:localhost"
+	ts := time.Now()
+	state := append(createRoomState(t, alice, ts), testutils.NewJoinEvent(t, bob, testutils.WithTimestamp(ts.Add(time.Second))))
+	aliceMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "alice"}, testutils.WithTimestamp(ts.Add(2*time.Second)))
+	bobMsg := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "bob"}, testutils.WithTimestamp(ts.Add(3*time.Second)))
+
+	inviteState := createRoomState(t, bob, ts)
+	inviteState = append(inviteState, testutils.NewStateEvent(t, "m.room.member", alice, bob, map[string]interface{}{
+		"membership": "invite",
+	}))
+
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewAccountData(t, "m.ignored_user_list", map[string]interface{}{
+					"ignored_users": map[string]interface{}{
+						bob: map[string]interface{}{},
+					},
+				}),
+			},
+		},
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: joinedRoomID,
+				state:  state,
+				events: []json.RawMessage{aliceMsg, bobMsg},
+			}),
+			Invite: map[string]sync2.SyncV2InviteResponse{
+				inviteRoomID: {
+					InviteState: sync2.EventsResponse{
+						Events: inviteState,
+					},
+				},
+			},
+		},
+	})
+
+	// bob's message and invite should be missing
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 10}},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 10,
+			},
+		}},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 10, []string{joinedRoomID}),
+	)), m.MatchRoomSubscription(joinedRoomID, m.MatchRoomTimeline([]json.RawMessage{aliceMsg})))
+
+	// live messages from bob should be dropped
+	bobMsg2 := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "bob 2"}, testutils.WithTimestamp(ts.Add(4*time.Second)))
+	aliceMsg2 := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "alice 2"}, testutils.WithTimestamp(ts.Add(5*time.Second)))
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: joinedRoomID,
+				events: []json.RawMessage{bobMsg2, aliceMsg2},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(joinedRoomID, m.MatchRoomTimeline([]json.RawMessage{aliceMsg2})))
+
+	// unignore bob: the invite should appear
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewAccountData(t, "m.ignored_user_list", map[string]interface{}{
+					"ignored_users": map[string]interface{}{},
+				}),
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2)))
+
+	// ignore bob again: the invite should disappear without the room being treated as left
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewAccountData(t, "m.ignored_user_list", map[string]interface{}{
+					"ignored_users": map[string]interface{}{
+						bob: map[string]interface{}{},
+					},
+				}),
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+	isLeft := true
+	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{"left": {
+			Ranges: sync3.SliceRanges{{0, 10}},
+			Filters: &sync3.RequestFilters{
+				IsLeft: &isLeft,
+			},
+		}},
+	})
+	m.MatchResponse(t, res, m.MatchList("left", m.MatchV3Count(0)))
+}
@@ -1,6 +1,7 @@
 package syncv3
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -42,8 +43,8 @@ func TestStuckInvites(t *testing.T) {
 
 	// initial sync, should see the invite
 	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{{0, 10}},
 				Filters: &sync3.RequestFilters{
 					IsInvite: &boolTrue,
@@ -51,7 +52,7 @@ func TestStuckInvites(t *testing.T) {
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(1), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
 		m.MatchV3SyncOp(0, 10, []string{preSyncInviteRoomID}),
 	)))
 
@@ -74,13 +75,13 @@ func TestStuckInvites(t *testing.T) {
 	v2.waitUntilEmpty(t, alice)
 
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{{0, 10}},
 			},
 		},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(2), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
 		m.MatchV3DeleteOp(1),
 		m.MatchV3InsertOp(0, postSyncInviteRoomID),
 	)))
@@ -112,23 +113,23 @@ func TestStuckInvites(t *testing.T) {
 
 	// the entries are removed
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{{0, 10}},
 			},
 		},
 	})
 	// not asserting the ops here as they could be DELETE 1, DELETE 0 or DELETE 0, DELETE 0 which is hard
 	// to assert.
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(0)))
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(0)))
 
 	// restart the server
 	v3.restart(t, v2, pqString)
 
 	// now query for invites: there should be none if we are clearing the DB correctly.
 	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{
-			{
+		Lists: map[string]sync3.RequestList{
+			"a": {
 				Ranges: sync3.SliceRanges{{0, 10}},
 				Filters: &sync3.RequestFilters{
 					IsInvite: &boolTrue,
@@ -138,3 +139,69 @@ func TestStuckInvites(t *testing.T) {
 	})
 	m.MatchResponse(t, res, m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(nil))
 }
+
+// Test that knocks appear in lists with their knock_state and are retired when the user is let in.
+func TestKnocks(t *testing.T) {
+	boolTrue := true
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomID := "!TestKnocks:localhost"
+	knockState := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "Knock Knock"}),
+		testutils.NewStateEvent(t, "m.room.join_rules", "", bob, map[string]interface{}{"join_rule": "knock"}),
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "knock"}),
+	}
+
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Knock: map[string]sync2.SyncV2KnockResponse{
+				roomID: {
+					KnockState: sync2.EventsResponse{
+						Events: knockState,
+					},
+				},
+			},
+		},
+	})
+
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Filters: &sync3.RequestFilters{
+					IsKnock: &boolTrue,
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 10, []string{roomID}),
+	)), m.MatchRoomSubscription(roomID, m.MatchRoomName("Knock Knock"), m.MatchRoomKnockState(knockState)))
+
+	// the knock is accepted and alice joins the room
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				state:  createRoomState(t, bob, time.Now()),
+				events: []json.RawMessage{
+					testutils.NewJoinEvent(t, alice, testutils.WithUnsigned(map[string]interface{}{
+						"prev_content": map[string]string{
+							"membership": "knock",
+						},
+					})),
+				},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(0), m.MatchV3Ops(
+		m.MatchV3DeleteOp(0),
+	)))
+}
@@ -54,7 +54,7 @@ func TestNotificationsOnTop(t *testing.T) {
 
 	// connect and make sure we get nobing, bing
 	syncRequestBody := sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, int64(len(allRooms) - 1)}, // all rooms
 			},
@@ -66,7 +66,7 @@ func TestNotificationsOnTop(t *testing.T) {
 		}},
 	}
 	res := v3.mustDoV3Request(t, aliceToken, syncRequestBody)
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(allRooms)), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms)), m.MatchV3Ops(
 		m.MatchV3SyncOpFn(func(op *sync3.ResponseOpRange) error {
 			if len(op.RoomIDs) != len(allRooms) {
 				return fmt.Errorf("want %d rooms, got %d", len(allRooms), len(op.RoomIDs))
@@ -103,7 +103,7 @@ func TestNotificationsOnTop(t *testing.T) {
 	})
 	v2.waitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, syncRequestBody)
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(allRooms)),
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms)),
 		m.MatchV3Ops(m.MatchV3DeleteOp(1), m.MatchV3InsertOp(0, bingRoomID)),
 	))
 
@@ -124,14 +124,14 @@ func TestNotificationsOnTop(t *testing.T) {
 	})
 	v2.waitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, syncRequestBody)
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(allRooms))),
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms))),
 		m.MatchNoV3Ops(),
 	)
 
 	// restart the server and sync from fresh again, it should still have the bing room on top
 	v3.restart(t, v2, pqString)
 	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
-		Lists: []sync3.RequestList{{
+		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
 				[2]int64{0, int64(len(allRooms) - 1)}, // all rooms
 			},
@@ -142,7 +142,7 @@ func TestNotificationsOnTop(t *testing.T) {
 			Sort: []string{sync3.SortByHighlightCount, sync3.SortByNotificationCount, sync3.SortByRecency},
 		}},
 	})
-	m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(allRooms)), m.MatchV3Ops(
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms)), m.MatchV3Ops(
 		m.MatchV3SyncOpFn(func(op *sync3.ResponseOpRange) error {
 			if len(op.RoomIDs) != len(allRooms) {
 				return fmt.Errorf("want %d rooms, got %d", len(allRooms), len(op.RoomIDs))
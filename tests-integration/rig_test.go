@@ -158,6 +158,23 @@ func (r *testRig) JoinRoom(t *testing.T, userID, roomID string) {
 	r.FlushEvent(t, userID, roomID, testutils.NewJoinEvent(t, userID))
 }
 
+func (r *testRig) LeaveRoom(t *testing.T, userID, roomID string) {
+	var leave sync2.SyncV2LeaveResponse
+	leave.Timeline.Events = []json.RawMessage{testutils.NewStateEvent(
+		t, "m.room.member", userID, userID, map[string]interface{}{
+			"membership": "leave",
+		},
+	)}
+	r.V2.queueResponse(userID, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Leave: map[string]sync2.SyncV2LeaveResponse{
+				roomID: leave,
+			},
+		},
+	})
+	r.V2.waitUntilEmpty(t, userID)
+}
+
 func (r *testRig) EncryptRoom(t *testing.T, userID, roomID string) {
 	r.FlushEvent(t, userID, roomID, testutils.NewStateEvent(
 		t, "m.room.encryption", "", userID, map[string]interface{}{
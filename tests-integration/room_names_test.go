@@ -71,7 +71,7 @@ func TestRoomNames(t *testing.T) {
 		t.Helper()
 		// do a sync, make sure room names are sensible
 		res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
-			Lists: []sync3.RequestList{{
+			Lists: map[string]sync3.RequestList{"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, int64(len(allRooms) - 1)}, // all rooms
 				},
@@ -80,7 +80,7 @@ func TestRoomNames(t *testing.T) {
 				},
 			}},
 		})
-		m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(allRooms)), m.MatchV3Ops(
+		m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms)), m.MatchV3Ops(
 			m.MatchV3SyncOpFn(func(op *sync3.ResponseOpRange) error {
 				if len(op.RoomIDs) != len(allRooms) {
 					return fmt.Errorf("want %d rooms, got %d", len(allRooms), len(op.RoomIDs))
@@ -109,7 +109,7 @@ func TestRoomNames(t *testing.T) {
 		t.Helper()
 		// do a sync, make sure room names are sensible
 		res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
-			Lists: []sync3.RequestList{{
+			Lists: map[string]sync3.RequestList{"a": {
 				Ranges: sync3.SliceRanges{
 					[2]int64{0, int64(len(allRooms) - 1)}, // all rooms
 				},
@@ -126,7 +126,7 @@ func TestRoomNames(t *testing.T) {
 				m.MatchRoomName(wantRooms[i].name),
 			}
 		}
-		m.MatchResponse(t, res, m.MatchList(0, m.MatchV3Count(len(wantRooms)), m.MatchV3Ops(
+		m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(wantRooms)), m.MatchV3Ops(
 			m.MatchV3SyncOp(0, int64(len(allRooms)-1), wantRoomIDs),
 		)), m.MatchRoomSubscriptions(matchers))
 	}
@@ -196,3 +196,83 @@ func TestRoomNameUpdates(t *testing.T) {
 		},
 	}))
 }
+
+// Test that room avatars and topics come through, both initially and when they change. DMs without
+// an avatar should use the other user's avatar.
+func TestRoomAvatarsAndTopics(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	// setup code
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	bob := "@TestRoomAvatarsAndTopics_bob:localhost"
+	latestTimestamp := time.Now()
+	roomID := "!TestRoomAvatarsAndTopics_room:localhost"
+	dmRoomID := "!TestRoomAvatarsAndTopics_dm:localhost"
+	allRooms := []roomEvents{
+		{
+			roomID: roomID,
+			events: append(createRoomState(t, alice, latestTimestamp), []json.RawMessage{
+				testutils.NewStateEvent(t, "m.room.avatar", "", alice, map[string]interface{}{"url": "mxc://localhost/room"}, testutils.WithTimestamp(latestTimestamp.Add(time.Second))),
+				testutils.NewStateEvent(t, "m.room.topic", "", alice, map[string]interface{}{"topic": "The Topic"}, testutils.WithTimestamp(latestTimestamp.Add(time.Second))),
+			}...),
+		},
+		{
+			roomID: dmRoomID,
+			events: append(createRoomState(t, alice, latestTimestamp), []json.RawMessage{
+				testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+					"membership": "join", "displayname": "Bob", "avatar_url": "mxc://localhost/bob",
+				}, testutils.WithTimestamp(latestTimestamp.Add(2*time.Second))),
+			}...),
+		},
+	}
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewEvent(t, "m.direct", alice, map[string]interface{}{
+					bob: []string{dmRoomID},
+				}),
+			},
+		},
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(allRooms...),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{
+				[2]int64{0, int64(len(allRooms) - 1)}, // all rooms
+			},
+		}},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptions(map[string][]m.RoomMatcher{
+		roomID: {
+			m.MatchRoomAvatar("mxc://localhost/room"),
+			m.MatchRoomTopic("The Topic"),
+		},
+		dmRoomID: {
+			m.MatchRoomAvatar("mxc://localhost/bob"),
+		},
+	}))
+
+	// now change the avatar and topic, and make sure we see the new values
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{
+					testutils.NewStateEvent(t, "m.room.avatar", "", alice, map[string]interface{}{"url": "mxc://localhost/room2"}, testutils.WithTimestamp(latestTimestamp.Add(3*time.Second))),
+					testutils.NewStateEvent(t, "m.room.topic", "", alice, map[string]interface{}{"topic": "The New Topic"}, testutils.WithTimestamp(latestTimestamp.Add(3*time.Second))),
+				},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID,
+		m.MatchRoomAvatar("mxc://localhost/room2"),
+		m.MatchRoomTopic("The New Topic"),
+	))
+}
@@ -2,6 +2,7 @@ package syncv3
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/matrix-org/sync-v3/sync3"
 	"github.com/matrix-org/sync-v3/testutils"
 	"github.com/matrix-org/sync-v3/testutils/m"
+	"github.com/tidwall/gjson"
 )
 
 // Test that if you /join a room and then immediately add a room subscription for said room before the
@@ -67,3 +69,111 @@ func TestRoomSubscriptionJoinRoomRace(t *testing.T) {
 		},
 	}))
 }
+
+// Test that users can subscribe to world_readable rooms they are not joined to, and that they receive
+// live updates for them. Rooms which are not world_readable must not be previewable.
+func TestRoomSubscriptionPreviewWorldReadable(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	ts := time.Now()
+	worldReadableRoom := roomEvents{
+		roomID: "!TestRoomSubscriptionPreviewWorldReadable_wr:localhost",
+		events: append(createRoomState(t, bob, ts), testutils.NewStateEvent(
+			t, "m.room.history_visibility", "", bob, map[string]interface{}{"history_visibility": "world_readable"},
+			testutils.WithTimestamp(ts),
+		)),
+	}
+	sharedRoom := roomEvents{
+		roomID: "!TestRoomSubscriptionPreviewWorldReadable_shared:localhost",
+		events: append(createRoomState(t, bob, ts), testutils.NewStateEvent(
+			t, "m.room.history_visibility", "", bob, map[string]interface{}{"history_visibility": "shared"},
+			testutils.WithTimestamp(ts),
+		)),
+	}
+	v2.addAccount(alice, aliceToken)
+	v2.addAccount(bob, bobToken)
+	v2.queueResponse(bob, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(worldReadableRoom, sharedRoom),
+		},
+	})
+	v3.mustDoV3Request(t, bobToken, sync3.Request{})
+	v2.waitUntilEmpty(t, bob)
+
+	// alice isn't joined to either room, but can see the world_readable one
+	v2.queueResponse(alice, sync2.SyncResponse{})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			worldReadableRoom.roomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.create", ""}},
+			},
+			sharedRoom.roomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.create", ""}},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		worldReadableRoom.roomID: {
+			m.MatchRoomRequiredState([]json.RawMessage{worldReadableRoom.events[0]}),
+			m.MatchRoomTimeline([]json.RawMessage{worldReadableRoom.events[len(worldReadableRoom.events)-1]}),
+		},
+	}))
+
+	// live events in the world_readable room are sent to alice
+	bobMsg := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "hello"}, testutils.WithTimestamp(ts.Add(time.Second)))
+	v2.queueResponse(bob, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: worldReadableRoom.roomID,
+				events: []json.RawMessage{bobMsg},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, bob)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		worldReadableRoom.roomID: {
+			m.MatchRoomTimeline([]json.RawMessage{bobMsg}),
+		},
+	}))
+}
+
+// Test that lazily loaded members are returned for rooms the user has left, using the state when
+// they left the room.
+func TestRoomSubscriptionLazyMembersLeftRoom(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	roomID := "!TestRoomSubscriptionLazyMembersLeftRoom:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		roomID: {},
+	})
+	aliceToken := rig.Token(alice)
+	rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	rig.LeaveRoom(t, alice, roomID)
+
+	// the leave event is the only event in the timeline, so alice's membership is lazily loaded
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.member", "$LAZY"}},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, func(r sync3.Room) error {
+		if len(r.RequiredState) != 1 {
+			return fmt.Errorf("got %d required state events, want 1", len(r.RequiredState))
+		}
+		ev := gjson.ParseBytes(r.RequiredState[0])
+		if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != alice {
+			return fmt.Errorf("got required state %s, want alice's membership", ev.Raw)
+		}
+		return nil
+	}))
+}
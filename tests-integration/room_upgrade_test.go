@@ -0,0 +1,174 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/matrix-org/sync-v3/testutils/m"
+	"github.com/tidwall/gjson"
+)
+
+// Test that upgraded rooms are hidden from lists once the user joins the new room, and that their
+// history can be fetched using include_old_rooms.
+func TestRoomUpgrade(t *testing.T) {
+	boolTrue := true
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	oldRoomID := "!TestRoomUpgrade_old:localhost"
+	newRoomID := "!TestRoomUpgrade_new:localhost"
+	ts := time.Now()
+	oldRoomMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "old"}, testutils.WithTimestamp(ts.Add(time.Second)))
+	tombstone := testutils.NewStateEvent(t, "m.room.tombstone", "", alice, map[string]interface{}{
+		"body":             "upgraded",
+		"replacement_room": newRoomID,
+	}, testutils.WithTimestamp(ts.Add(2*time.Second)))
+	newRoomCreate := testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{
+		"creator": alice,
+		"predecessor": map[string]interface{}{
+			"room_id":  oldRoomID,
+			"event_id": gjson.GetBytes(tombstone, "event_id").Str,
+		},
+	}, testutils.WithTimestamp(ts.Add(3*time.Second)))
+	newRoomMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "new"}, testutils.WithTimestamp(ts.Add(4*time.Second)))
+
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: oldRoomID,
+				state:  createRoomState(t, alice, ts),
+				events: []json.RawMessage{oldRoomMsg, tombstone},
+			}),
+		},
+	})
+	listReq := sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 10}},
+			Filters: &sync3.RequestFilters{
+				HideUpgradedRooms: &boolTrue,
+			},
+		}},
+	}
+	// the old room is shown as the user hasn't joined the new room yet
+	res := v3.mustDoV3Request(t, aliceToken, listReq)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 10, []string{oldRoomID}),
+	)))
+
+	// join the new room: the old room should be replaced by the new room
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: newRoomID,
+				state:  createRoomStateWithCreateEvent(t, alice, newRoomCreate, ts.Add(3*time.Second)),
+				events: []json.RawMessage{newRoomMsg},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, listReq)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+
+	// a new connection only sees the new room, and can pull in the old room with include_old_rooms
+	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: listReq.Lists,
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			newRoomID: {
+				TimelineLimit: 1,
+				IncludeOldRooms: &sync3.RoomSubscription{
+					TimelineLimit: 1,
+					RequiredState: [][2]string{{"m.room.tombstone", ""}},
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 10, []string{newRoomID}),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		newRoomID: {
+			m.MatchRoomTimeline([]json.RawMessage{newRoomMsg}),
+		},
+		oldRoomID: {
+			m.MatchRoomRequiredState([]json.RawMessage{tombstone}),
+			m.MatchRoomTimeline([]json.RawMessage{tombstone}),
+		},
+	}))
+}
+
+// Test that include_old_rooms does not return predecessor rooms which the user was never joined to.
+func TestRoomUpgradeOldRoomNeverJoined(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	oldRoomID := "!TestRoomUpgradeOldRoomNeverJoined_old:localhost"
+	newRoomID := "!TestRoomUpgradeOldRoomNeverJoined_new:localhost"
+	ts := time.Now()
+	inviteState := createRoomState(t, bob, ts)
+	inviteState = append(inviteState, testutils.NewStateEvent(t, "m.room.member", alice, bob, map[string]interface{}{
+		"membership": "invite",
+	}))
+	newRoomCreate := testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{
+		"creator": alice,
+		"predecessor": map[string]interface{}{
+			"room_id":  oldRoomID,
+			"event_id": "$tombstone",
+		},
+	}, testutils.WithTimestamp(ts.Add(time.Second)))
+
+	// alice is invited to the old room but rejects the invite
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Invite: map[string]sync2.SyncV2InviteResponse{
+				oldRoomID: {
+					InviteState: sync2.EventsResponse{
+						Events: inviteState,
+					},
+				},
+			},
+		},
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	var leave sync2.SyncV2LeaveResponse
+	leave.Timeline.Events = []json.RawMessage{testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+		"membership": "leave",
+	})}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Leave: map[string]sync2.SyncV2LeaveResponse{
+				oldRoomID: leave,
+			},
+			Join: v2JoinTimeline(roomEvents{
+				roomID: newRoomID,
+				state:  createRoomStateWithCreateEvent(t, alice, newRoomCreate, ts.Add(time.Second)),
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	// the old room is not returned as alice was never joined to it
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			newRoomID: {
+				TimelineLimit: 1,
+				IncludeOldRooms: &sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		newRoomID: {},
+	}))
+}
@@ -0,0 +1,145 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/matrix-org/sync-v3/sync3/extensions"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/matrix-org/sync-v3/testutils/m"
+)
+
+// Test that spaces_recursive includes rooms in sub-spaces, and that the spaces extension returns the
+// space hierarchy, both initially, when m.space.child events change and when the user leaves a space.
+//
+//	parent -> child -> room1
+//	room2 (not in a space, later added to child)
+func TestSpacesRecursive(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	parentSpace := "!TestSpacesRecursive_parent:localhost"
+	childSpace := "!TestSpacesRecursive_child:localhost"
+	room1 := "!TestSpacesRecursive_room1:localhost"
+	room2 := "!TestSpacesRecursive_room2:localhost"
+	spaceType := "m.space"
+	ts := time.Now()
+	spaceState := func(children ...string) []json.RawMessage {
+		state := createRoomStateWithCreateEvent(t, alice, testutils.NewStateEvent(
+			t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "type": spaceType}, testutils.WithTimestamp(ts),
+		), ts)
+		for _, child := range children {
+			state = append(state, testutils.NewStateEvent(t, "m.space.child", child, alice, map[string]interface{}{
+				"via": []string{"localhost"},
+			}, testutils.WithTimestamp(ts)))
+		}
+		return state
+	}
+
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: parentSpace,
+				events: spaceState(childSpace),
+			}, roomEvents{
+				roomID: childSpace,
+				events: spaceState(room1),
+			}, roomEvents{
+				roomID: room1,
+				events: createRoomState(t, alice, ts),
+			}, roomEvents{
+				roomID: room2,
+				events: createRoomState(t, alice, ts),
+			}),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"recursive": {
+				Ranges:  sync3.SliceRanges{{0, 10}},
+				Filters: &sync3.RequestFilters{SpacesRecursive: []string{parentSpace}},
+			},
+			"direct": {
+				Ranges:  sync3.SliceRanges{{0, 10}},
+				Filters: &sync3.RequestFilters{Spaces: []string{parentSpace}},
+			},
+			// room types and spaces filters are both applied
+			"subspaces": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Filters: &sync3.RequestFilters{
+					RoomTypes:       []*string{&spaceType},
+					SpacesRecursive: []string{parentSpace},
+				},
+			},
+		},
+		Extensions: extensions.Request{
+			Spaces: &extensions.SpacesRequest{
+				Enabled: true,
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"recursive": {
+			m.MatchV3Count(2),
+			m.MatchV3Ops(m.MatchV3SyncOp(0, 10, []string{childSpace, room1}, true)),
+		},
+		"direct": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3SyncOp(0, 10, []string{childSpace})),
+		},
+		"subspaces": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3SyncOp(0, 10, []string{childSpace})),
+		},
+	}), m.MatchSpaces(map[string][]string{
+		parentSpace: {childSpace},
+		childSpace:  {room1},
+	}))
+
+	// add room2 to the child space: it should now appear in the recursive list
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: childSpace,
+				events: []json.RawMessage{
+					testutils.NewStateEvent(t, "m.space.child", room2, alice, map[string]interface{}{
+						"via":   []string{"localhost"},
+						"order": "a",
+					}, testutils.WithTimestamp(ts.Add(time.Second))),
+				},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("recursive", m.MatchV3Count(3)), m.MatchList("direct", m.MatchV3Count(1)),
+		m.MatchList("subspaces", m.MatchV3Count(1)),
+		m.MatchSpaces(map[string][]string{
+			childSpace: {room2, room1}, // room2 has an order so comes first
+		}),
+	)
+
+	// leave the child space: the spaces extension tells the client to forget it
+	var leave sync2.SyncV2LeaveResponse
+	leave.Timeline.Events = []json.RawMessage{testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+		"membership": "leave",
+	}, testutils.WithTimestamp(ts.Add(2*time.Second)))}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Leave: map[string]sync2.SyncV2LeaveResponse{
+				childSpace: leave,
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchSpaces(map[string][]string{}), m.MatchSpacesLeft([]string{childSpace}))
+}
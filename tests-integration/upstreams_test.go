@@ -0,0 +1,106 @@
+package syncv3
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/matrix-org/sync-v3/testutils/m"
+)
+
+// Test that users on different homeservers are polled from their own homeserver, and that a room
+// which both homeservers are in is only stored once, with each user getting prev_batch tokens from their
+// own homeserver.
+func TestMultipleUpstreams(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2Local := runTestV2Server(t)
+	v2Other := runTestV2Server(t)
+	v3 := runTestServerWithClient(t, sync2.NewRoutingClient(&http.Client{Timeout: 5 * time.Minute}, sync2.UpstreamConfig{
+		Default: v2Local.url(),
+		Servers: map[string]string{
+			"localhost": v2Local.url(),
+			"other":     v2Other.url(),
+		},
+	}), pqString)
+	defer v2Local.close()
+	defer v2Other.close()
+	defer v3.close()
+
+	charlie := "@charlie:other"
+	charlieToken := "CHARLIE_BEARER_TOKEN_TestMultipleUpstreams"
+	roomID := "!TestMultipleUpstreams:localhost"
+	charlieJoin := testutils.NewJoinEvent(t, charlie)
+	msg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hello other"})
+	timeline := append(createRoomState(t, alice, time.Now()), charlieJoin, msg)
+
+	// each homeserver sends the same room, as both have a user in it, with its own prev_batch token
+	v2Local.addAccount(alice, aliceToken)
+	v2Other.addAccount(charlie, charlieToken)
+	for _, v2 := range []struct {
+		server    *testV2Server
+		userID    string
+		prevBatch string
+	}{{v2Local, alice, "prev_batch_localhost"}, {v2Other, charlie, "prev_batch_other"}} {
+		v2.server.queueResponse(v2.userID, sync2.SyncResponse{
+			Rooms: sync2.SyncRoomsResponse{
+				Join: v2JoinTimeline(roomEvents{
+					roomID:    roomID,
+					events:    timeline,
+					prevBatch: v2.prevBatch,
+				}),
+			},
+		})
+	}
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: int64(len(timeline) + 5),
+				},
+			},
+		},
+	}
+	v3.mustDoV3Request(t, aliceToken, req)
+	v2Local.waitUntilEmpty(t, alice)
+	// new tokens are only checked against the default upstream, so charlie's device must already be known
+	charlieDeviceID := fmt.Sprintf("%x", sha256.Sum256([]byte(charlieToken)))
+	if _, err := v3.handler.V2Store.InsertDevice(charlieDeviceID, charlieToken); err != nil {
+		t.Fatalf("InsertDevice: %s", err)
+	}
+	if err := v3.handler.V2Store.UpdateUserIDForDevice(charlieDeviceID, charlie); err != nil {
+		t.Fatalf("UpdateUserIDForDevice: %s", err)
+	}
+	v3.mustDoV3Request(t, charlieToken, req)
+	v2Other.waitUntilEmpty(t, charlie)
+
+	// the events are not duplicated even though both homeservers sent them
+	aliceRes := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, aliceRes, m.MatchList("a", m.MatchV3Count(1)), m.MatchRoomSubscription(
+		roomID, m.MatchRoomTimeline(timeline), m.MatchRoomPrevBatch("prev_batch_localhost"),
+	))
+	res := v3.mustDoV3Request(t, charlieToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)), m.MatchRoomSubscription(
+		roomID, m.MatchRoomTimeline(timeline), m.MatchRoomPrevBatch("prev_batch_other"),
+	))
+
+	// new events from either homeserver reach users on both
+	reply := testutils.NewEvent(t, "m.room.message", charlie, map[string]interface{}{"body": "hello localhost"})
+	v2Other.queueResponse(charlie, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{reply},
+			}),
+		},
+	})
+	v2Other.waitUntilEmpty(t, charlie)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{reply})))
+}
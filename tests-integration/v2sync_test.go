@@ -0,0 +1,135 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/tidwall/gjson"
+)
+
+func (s *testV3Server) doV2SyncRequest(t *testing.T, token string, query url.Values) (int, *sync2.SyncResponse) {
+	t.Helper()
+	req, err := http.NewRequest("GET", s.srv.URL+"/_matrix/client/v3/sync?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to do request: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, nil
+	}
+	var res sync2.SyncResponse
+	if err = json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("failed to decode response body: %s", err)
+	}
+	return resp.StatusCode, &res
+}
+
+// Test that legacy clients can GET /sync and get v2 responses served from the proxy's storage.
+func TestV2SyncCompatibility(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomID := "!TestV2SyncCompatibility:localhost"
+	roomState := createRoomState(t, alice, time.Now())
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewAccountData(t, "m.direct", map[string]interface{}{}),
+			},
+		},
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: roomState,
+			}),
+		},
+	})
+
+	// an initial sync returns the room, limited to the filter's timeline limit, with the state before the timeline
+	filter := `{"room":{"timeline":{"limit":2}}}`
+	code, res := v3.doV2SyncRequest(t, aliceToken, url.Values{"filter": {filter}})
+	if code != 200 {
+		t.Fatalf("initial sync: got status %d", code)
+	}
+	room, ok := res.Rooms.Join[roomID]
+	if !ok {
+		t.Fatalf("initial sync: room %s missing from join section", roomID)
+	}
+	if len(room.Timeline.Events) != 2 || !room.Timeline.Limited {
+		t.Errorf("initial sync: got %d timeline events limited=%v, want 2 limited=true", len(room.Timeline.Events), room.Timeline.Limited)
+	}
+	if string(room.Timeline.Events[1]) != string(roomState[len(roomState)-1]) {
+		t.Errorf("initial sync: last timeline event is %s want %s", room.Timeline.Events[1], roomState[len(roomState)-1])
+	}
+	if len(room.State.Events) == 0 {
+		t.Errorf("initial sync: no state events")
+	}
+	if len(res.AccountData.Events) != 1 || gjson.GetBytes(res.AccountData.Events[0], "type").Str != "m.direct" {
+		t.Errorf("initial sync: got global account data %v", res.AccountData.Events)
+	}
+
+	// an incremental sync waits for new events and only returns those
+	event := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "incremental"})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		v2.queueResponse(alice, sync2.SyncResponse{
+			Rooms: sync2.SyncRoomsResponse{
+				Join: v2JoinTimeline(roomEvents{
+					roomID: roomID,
+					events: []json.RawMessage{event},
+				}),
+			},
+		})
+	}()
+	code, res = v3.doV2SyncRequest(t, aliceToken, url.Values{"filter": {filter}, "since": {res.NextBatch}, "timeout": {"5000"}})
+	if code != 200 {
+		t.Fatalf("incremental sync: got status %d", code)
+	}
+	room = res.Rooms.Join[roomID]
+	if len(room.Timeline.Events) != 1 || string(room.Timeline.Events[0]) != string(event) || room.Timeline.Limited {
+		t.Errorf("incremental sync: got timeline %v limited=%v want just %s", room.Timeline.Events, room.Timeline.Limited, event)
+	}
+	if len(room.State.Events) != 0 {
+		t.Errorf("incremental sync: got %d state events, want none", len(room.State.Events))
+	}
+	if len(res.AccountData.Events) != 0 {
+		t.Errorf("incremental sync: got account data %v, want none", res.AccountData.Events)
+	}
+
+	// nothing new returns an empty response when the timeout expires
+	code, res2 := v3.doV2SyncRequest(t, aliceToken, url.Values{"since": {res.NextBatch}, "timeout": {"100"}})
+	if code != 200 {
+		t.Fatalf("empty sync: got status %d", code)
+	}
+	if len(res2.Rooms.Join) != 0 {
+		t.Errorf("empty sync: got rooms %v", res2.Rooms.Join)
+	}
+	if res2.NextBatch != res.NextBatch {
+		t.Errorf("empty sync: got next_batch %s want %s", res2.NextBatch, res.NextBatch)
+	}
+
+	// since tokens from elsewhere are rejected
+	code, _ = v3.doV2SyncRequest(t, aliceToken, url.Values{"since": {"s123_456"}})
+	if code != 400 {
+		t.Errorf("bad since token: got status %d want 400", code)
+	}
+}
@@ -132,7 +132,8 @@ func runTestV2Server(t testutils.TestBenchInterface) *testV2Server {
 	r.HandleFunc("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, req *http.Request) {
 		userID := server.userID(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
 		if userID == "" {
-			w.WriteHeader(403)
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unrecognised access token"}`))
 			return
 		}
 		w.WriteHeader(200)
@@ -175,6 +176,7 @@ func (s *testV3Server) restart(t *testing.T, v2 *testV2Server, pq string) {
 	s.close()
 	ss := runTestServer(t, v2, pq)
 	s.srv = ss.srv
+	s.handler = ss.handler
 	v2.srv.CloseClientConnections() // kick-over v2 conns
 }
 
@@ -234,21 +236,28 @@ func (s *testV3Server) doV3Request(t testutils.TestBenchInterface, ctx context.C
 
 func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postgresConnectionString string) *testV3Server {
 	t.Helper()
-	if postgresConnectionString == "" {
-		postgresConnectionString = testutils.PrepareDBConnectionString()
-	}
-	h, err := handler.NewSync3Handler(&sync2.HTTPClient{
+	return runTestServerWithClient(t, &sync2.HTTPClient{
 		Client: &http.Client{
 			Timeout: 5 * time.Minute,
 		},
 		DestinationServer: v2Server.url(),
-	}, postgresConnectionString, os.Getenv("SYNCV3_SECRET"), true)
+	}, postgresConnectionString)
+}
+
+func runTestServerWithClient(t testutils.TestBenchInterface, v2Client sync2.Client, postgresConnectionString string) *testV3Server {
+	t.Helper()
+	if postgresConnectionString == "" {
+		postgresConnectionString = testutils.PrepareDBConnectionString()
+	}
+	h, err := handler.NewSync3Handler(v2Client, postgresConnectionString, os.Getenv("SYNCV3_SECRET"), true)
 	if err != nil {
 		t.Fatalf("cannot make v3 handler: %s", err)
 	}
 	r := mux.NewRouter()
+	r.HandleFunc("/_matrix/client/v3/sync", h.ServeV2Sync).Methods("GET")
 	r.Handle("/_matrix/client/v3/sync", h)
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", h)
+	r.HandleFunc("/_matrix/client/unstable/org.matrix.msc3575/sync/ws", h.ServeWebSocket)
 	srv := httptest.NewServer(r)
 	return &testV3Server{
 		srv:     srv,
@@ -0,0 +1,131 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/matrix-org/sync-v3/sync3"
+	"github.com/matrix-org/sync-v3/sync3/handler"
+	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/matrix-org/sync-v3/testutils/m"
+)
+
+func (s *testV3Server) mustDialWebSocket(t *testing.T, token, query string) *websocket.Conn {
+	t.Helper()
+	url := strings.Replace(s.srv.URL, "http", "ws", 1) + "/_matrix/client/unstable/org.matrix.msc3575/sync/ws?timeout=500" + query
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("failed to dial websocket: %s", err)
+	}
+	resp.Body.Close()
+	return ws
+}
+
+func mustSendFrame(t *testing.T, ws *websocket.Conn, frame handler.WebSocketFrame) {
+	t.Helper()
+	if err := ws.WriteJSON(frame); err != nil {
+		t.Fatalf("failed to send websocket frame: %s", err)
+	}
+}
+
+// mustReadResponse reads responses until one has data, acknowledging any empty ones.
+func mustReadResponse(t *testing.T, ws *websocket.Conn) *sync3.Response {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var res sync3.Response
+		if err := ws.ReadJSON(&res); err != nil {
+			t.Fatalf("failed to read websocket response: %s", err)
+		}
+		if len(res.Rooms) > 0 || res.ListOps() > 0 {
+			return &res
+		}
+		mustSendFrame(t, ws, handler.WebSocketFrame{Pos: res.Pos})
+	}
+}
+
+// Test that responses are pushed over a WebSocket as new data arrives, and that a dropped WebSocket
+// can be resumed over HTTP from the last response received.
+func TestWebSocket(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomID := "!TestWebSocket:localhost"
+	v2.addAccount(alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		TxnID: "first",
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	}
+	ws := v3.mustDialWebSocket(t, aliceToken, "")
+	mustSendFrame(t, ws, handler.WebSocketFrame{Request: &req})
+	res := mustReadResponse(t, ws)
+	m.MatchResponse(t, res, m.MatchTxnID("first"), m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 10, []string{roomID}),
+	)))
+
+	// new events are pushed without sending the request again
+	mustSendFrame(t, ws, handler.WebSocketFrame{Pos: res.Pos})
+	event := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "pushed"})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{event},
+			}),
+		},
+	})
+	res = mustReadResponse(t, ws)
+	m.MatchResponse(t, res, m.MatchTxnID(""), m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{event})))
+
+	// the socket is dropped before acknowledging the response, and the client carries on over HTTP
+	ws.Close()
+	httpRes := v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if httpRes.PosInt() <= res.PosInt() {
+		t.Fatalf("HTTP request after websocket got pos %s want > %s", httpRes.Pos, res.Pos)
+	}
+	res = httpRes
+
+	// acknowledging a response which was never sent closes the socket with an error
+	ws = v3.mustDialWebSocket(t, aliceToken, "&pos="+res.Pos)
+	defer ws.Close()
+	mustSendFrame(t, ws, handler.WebSocketFrame{Pos: "9999", Request: &req})
+	var errBody struct {
+		ErrCode string `json:"errcode"`
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ws.ReadJSON(&errBody); err != nil {
+		t.Fatalf("failed to read error: %s", err)
+	}
+	if errBody.ErrCode != "M_UNKNOWN_POS" {
+		t.Errorf("got errcode %s want M_UNKNOWN_POS", errBody.ErrCode)
+	}
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, 4400) {
+		t.Errorf("got %v want close code 4400", err)
+	}
+}
@@ -0,0 +1,599 @@
+package fakehs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultMessagesLimit is used when /messages is called without a limit
+const defaultMessagesLimit = 10
+
+type authedHandler func(w http.ResponseWriter, req *http.Request, d *device)
+
+func (s *Server) router() *mux.Router {
+	r := mux.NewRouter()
+	r.UseEncodedPath()
+	r.HandleFunc("/_matrix/client/versions", s.versions).Methods("GET")
+	for _, version := range []string{"r0", "v3"} {
+		c := r.PathPrefix("/_matrix/client/" + version).Subrouter()
+		c.HandleFunc("/register", s.register).Methods("POST")
+		c.HandleFunc("/login", s.login).Methods("POST")
+		c.HandleFunc("/logout", s.authed(s.logout)).Methods("POST")
+		c.HandleFunc("/account/whoami", s.authed(s.whoami)).Methods("GET")
+		c.HandleFunc("/capabilities", s.authed(s.capabilities)).Methods("GET")
+		c.HandleFunc("/sync", s.authed(s.sync)).Methods("GET")
+		c.HandleFunc("/createRoom", s.authed(s.createRoom)).Methods("POST")
+		c.HandleFunc("/join/{roomIDOrAlias}", s.authed(s.join)).Methods("POST")
+		c.HandleFunc("/rooms/{roomIDOrAlias}/join", s.authed(s.join)).Methods("POST")
+		c.HandleFunc("/rooms/{roomID}/leave", s.authed(s.membership("leave"))).Methods("POST")
+		c.HandleFunc("/rooms/{roomID}/invite", s.authed(s.membership("invite"))).Methods("POST")
+		c.HandleFunc("/rooms/{roomID}/kick", s.authed(s.membership("leave"))).Methods("POST")
+		c.HandleFunc("/rooms/{roomID}/ban", s.authed(s.membership("ban"))).Methods("POST")
+		c.HandleFunc("/rooms/{roomID}/send/{eventType}/{txnID}", s.authed(s.send)).Methods("PUT")
+		c.HandleFunc("/rooms/{roomID}/state", s.authed(s.roomState)).Methods("GET")
+		c.HandleFunc("/rooms/{roomID}/state/{eventType}", s.authed(s.sendState)).Methods("PUT")
+		c.HandleFunc("/rooms/{roomID}/state/{eventType}/{stateKey:.*}", s.authed(s.sendState)).Methods("PUT")
+		c.HandleFunc("/rooms/{roomID}/messages", s.authed(s.messages)).Methods("GET")
+		c.HandleFunc("/rooms/{roomID}/typing/{userID}", s.authed(s.typing)).Methods("PUT")
+		c.HandleFunc("/rooms/{roomID}/upgrade", s.authed(s.upgrade)).Methods("POST")
+		c.HandleFunc("/user/{userID}/account_data/{eventType}", s.authed(s.accountData)).Methods("GET", "PUT")
+		c.HandleFunc("/user/{userID}/rooms/{roomID}/account_data/{eventType}", s.authed(s.accountData)).Methods("GET", "PUT")
+		c.HandleFunc("/user/{userID}/filter", s.authed(s.createFilter)).Methods("POST")
+		c.HandleFunc("/user/{userID}/filter/{filterID}", s.authed(s.getFilter)).Methods("GET")
+		c.HandleFunc("/sendToDevice/{eventType}/{txnID}", s.authed(s.sendToDevice)).Methods("PUT")
+		c.HandleFunc("/keys/upload", s.authed(s.uploadKeys)).Methods("POST")
+	}
+	for _, version := range []string{"r0", "v3"} {
+		m := r.PathPrefix("/_matrix/media/" + version).Subrouter()
+		m.HandleFunc("/upload", s.authed(s.uploadMedia)).Methods("POST")
+		m.HandleFunc("/download/{serverName}/{mediaID}", s.downloadMedia).Methods("GET")
+	}
+	// things which can't be done via the client-server API, for scripting from outside Go
+	r.HandleFunc("/_fakehs/device_lists/{userID}", s.deviceListChanged).Methods("POST")
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, newError(404, "M_UNRECOGNIZED", "unrecognised request %s %s", req.Method, req.URL.Path))
+	})
+	return r
+}
+
+func (s *Server) authed(h authedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		accessToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if accessToken == "" {
+			accessToken = req.URL.Query().Get("access_token")
+		}
+		if accessToken == "" {
+			writeError(w, newError(401, "M_MISSING_TOKEN", "missing access token"))
+			return
+		}
+		d, err := s.deviceForToken(accessToken)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h(w, req, d)
+	}
+}
+
+func (s *Server) versions(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"versions": []string{"r0.6.1", "v1.1", "v1.2", "v1.3"},
+	})
+}
+
+func (s *Server) register(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		DeviceID string `json:"device_id"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	acc, err := s.RegisterUser(body.Username, body.Password, body.DeviceID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, acc)
+}
+
+func (s *Server) login(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		User       string `json:"user"`
+		Identifier struct {
+			User string `json:"user"`
+		} `json:"identifier"`
+		Password string `json:"password"`
+		DeviceID string `json:"device_id"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	userID := body.Identifier.User
+	if userID == "" {
+		userID = body.User
+	}
+	acc, err := s.Login(userID, body.Password, body.DeviceID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, acc)
+}
+
+func (s *Server) logout(w http.ResponseWriter, req *http.Request, d *device) {
+	s.Logout(d.accessToken)
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) whoami(w http.ResponseWriter, req *http.Request, d *device) {
+	writeJSON(w, 200, map[string]interface{}{
+		"user_id":   d.userID,
+		"device_id": d.deviceID,
+	})
+}
+
+func (s *Server) capabilities(w http.ResponseWriter, req *http.Request, d *device) {
+	writeJSON(w, 200, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"m.room_versions": map[string]interface{}{
+				"default": DefaultRoomVersion,
+				"available": map[string]string{
+					"1": "stable", "2": "stable", "3": "stable", "4": "stable", "5": "stable",
+					"6": "stable", "7": "stable", "8": "stable", "9": "stable", "10": "stable",
+				},
+			},
+			"m.change_password": map[string]interface{}{
+				"enabled": false,
+			},
+		},
+	})
+}
+
+func (s *Server) sync(w http.ResponseWriter, req *http.Request, d *device) {
+	query := req.URL.Query()
+	var timeout time.Duration
+	if t := query.Get("timeout"); t != "" {
+		ms, err := strconv.Atoi(t)
+		if err != nil {
+			writeError(w, newError(400, "M_INVALID_PARAM", "invalid timeout %s", t))
+			return
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	res, err := s.Sync(d.accessToken, query.Get("since"), timeout, query.Get("filter"), query.Get("full_state") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, res)
+}
+
+func (s *Server) createRoom(w http.ResponseWriter, req *http.Request, d *device) {
+	var body CreateRoomRequest
+	if !readJSON(w, req, &body) {
+		return
+	}
+	roomID, err := s.CreateRoom(d.userID, body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]string{"room_id": roomID})
+}
+
+func (s *Server) join(w http.ResponseWriter, req *http.Request, d *device) {
+	roomID, err := s.ResolveAlias(pathVar(req, "roomIDOrAlias"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err = s.SetMembership(roomID, d.userID, d.userID, "join", ""); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]string{"room_id": roomID})
+}
+
+// membership handles /leave, /invite, /kick and /ban
+func (s *Server) membership(membership string) authedHandler {
+	return func(w http.ResponseWriter, req *http.Request, d *device) {
+		var body struct {
+			UserID string `json:"user_id"`
+			Reason string `json:"reason"`
+		}
+		if !readJSON(w, req, &body) {
+			return
+		}
+		if body.UserID == "" {
+			body.UserID = d.userID
+		}
+		if _, err := s.SetMembership(pathVar(req, "roomID"), d.userID, body.UserID, membership, body.Reason); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, 200, struct{}{})
+	}
+}
+
+func (s *Server) send(w http.ResponseWriter, req *http.Request, d *device) {
+	var content map[string]interface{}
+	if !readJSON(w, req, &content) {
+		return
+	}
+	eventID, err := s.sendEvent(pathVar(req, "roomID"), Event{
+		Type:    pathVar(req, "eventType"),
+		Sender:  d.userID,
+		Content: content,
+	}, d.accessToken, pathVar(req, "txnID"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]string{"event_id": eventID})
+}
+
+func (s *Server) sendState(w http.ResponseWriter, req *http.Request, d *device) {
+	var content map[string]interface{}
+	if !readJSON(w, req, &content) {
+		return
+	}
+	roomID := pathVar(req, "roomID")
+	evType := pathVar(req, "eventType")
+	stateKey := pathVar(req, "stateKey")
+	var eventID string
+	var err error
+	if evType == "m.room.member" {
+		// go via the membership checks rather than letting clients write any membership
+		membership, _ := content["membership"].(string)
+		reason, _ := content["reason"].(string)
+		eventID, err = s.SetMembership(roomID, d.userID, stateKey, membership, reason)
+	} else {
+		eventID, err = s.SendEvent(roomID, Event{
+			Type:     evType,
+			Sender:   d.userID,
+			StateKey: &stateKey,
+			Content:  content,
+		})
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]string{"event_id": eventID})
+}
+
+func (s *Server) roomState(w http.ResponseWriter, req *http.Request, d *device) {
+	roomID := pathVar(req, "roomID")
+	s.mu.Lock()
+	r, ok := s.rooms[roomID]
+	if !ok || r.membership(d.userID) != "join" {
+		s.mu.Unlock()
+		writeError(w, newError(403, "M_FORBIDDEN", "%s is not joined to %s", d.userID, roomID))
+		return
+	}
+	state := r.stateAt(len(r.events))
+	s.mu.Unlock()
+	writeJSON(w, 200, state)
+}
+
+func (s *Server) messages(w http.ResponseWriter, req *http.Request, d *device) {
+	roomID := pathVar(req, "roomID")
+	query := req.URL.Query()
+	limit := defaultMessagesLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			writeError(w, newError(400, "M_INVALID_PARAM", "invalid limit %s", l))
+			return
+		}
+	}
+	backwards := query.Get("dir") != "f"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomID]
+	if !ok {
+		writeError(w, newError(404, "M_NOT_FOUND", "unknown room %s", roomID))
+		return
+	}
+	membershipIndex, ok := r.state[stateTuple("m.room.member", d.userID)]
+	if !ok {
+		writeError(w, newError(403, "M_FORBIDDEN", "%s has never been in %s", d.userID, roomID))
+		return
+	}
+	// users who are no longer joined only see up to when they left
+	end := len(r.events)
+	if membership := membershipOf(r.events[membershipIndex].event); membership != "join" && membership != "invite" {
+		end = membershipIndex + 1
+	}
+	var from int
+	if token := query.Get("from"); token != "" {
+		// both sync and prev_batch tokens are stream positions
+		pos, err := parseToken(strings.TrimPrefix(token, "t"), "s")
+		if err != nil {
+			writeError(w, newError(400, "M_INVALID_PARAM", "invalid from token %s", token))
+			return
+		}
+		from = r.indexAfter(pos)
+	} else if backwards {
+		from = end
+	}
+	if from > end {
+		from = end
+	}
+	res := map[string]interface{}{
+		"start": "t" + strconv.FormatInt(positionBefore(r, from), 10),
+	}
+	chunk := []json.RawMessage{}
+	i := from
+	if backwards {
+		for ; i > 0 && len(chunk) < limit; i-- {
+			chunk = append(chunk, r.events[i-1].clientEvent(d.accessToken))
+		}
+		if i > 0 {
+			res["end"] = "t" + strconv.FormatInt(positionBefore(r, i), 10)
+		}
+	} else {
+		for ; i < end && len(chunk) < limit; i++ {
+			chunk = append(chunk, r.events[i].clientEvent(d.accessToken))
+		}
+		if i < end {
+			res["end"] = "t" + strconv.FormatInt(positionBefore(r, i), 10)
+		}
+	}
+	res["chunk"] = chunk
+	writeJSON(w, 200, res)
+}
+
+func (s *Server) typing(w http.ResponseWriter, req *http.Request, d *device) {
+	var body struct {
+		Typing bool `json:"typing"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	if pathVar(req, "userID") != d.userID {
+		writeError(w, newError(403, "M_FORBIDDEN", "cannot set typing for another user"))
+		return
+	}
+	if err := s.SetTyping(pathVar(req, "roomID"), d.userID, body.Typing); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) upgrade(w http.ResponseWriter, req *http.Request, d *device) {
+	var body struct {
+		NewVersion string `json:"new_version"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	newRoomID, err := s.UpgradeRoom(pathVar(req, "roomID"), d.userID, body.NewVersion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]string{"replacement_room": newRoomID})
+}
+
+func (s *Server) accountData(w http.ResponseWriter, req *http.Request, d *device) {
+	if pathVar(req, "userID") != d.userID {
+		writeError(w, newError(403, "M_FORBIDDEN", "cannot access account data for another user"))
+		return
+	}
+	roomID := pathVar(req, "roomID")
+	evType := pathVar(req, "eventType")
+	if req.Method == "GET" {
+		content := s.AccountData(d.userID, roomID, evType)
+		if content == nil {
+			writeError(w, newError(404, "M_NOT_FOUND", "no account data for %s", evType))
+			return
+		}
+		writeJSON(w, 200, content)
+		return
+	}
+	var content map[string]interface{}
+	if !readJSON(w, req, &content) {
+		return
+	}
+	if err := s.SetAccountData(d.userID, roomID, evType, content); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) createFilter(w http.ResponseWriter, req *http.Request, d *device) {
+	filter, err := ioutil.ReadAll(req.Body)
+	if err != nil || !json.Valid(filter) {
+		writeError(w, newError(400, "M_NOT_JSON", "filter is not JSON"))
+		return
+	}
+	s.mu.Lock()
+	filterID := s.genID("")
+	s.filters[filterID] = string(filter)
+	s.mu.Unlock()
+	writeJSON(w, 200, map[string]string{"filter_id": filterID})
+}
+
+func (s *Server) getFilter(w http.ResponseWriter, req *http.Request, d *device) {
+	s.mu.Lock()
+	filter, ok := s.filters[pathVar(req, "filterID")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, newError(404, "M_NOT_FOUND", "unknown filter"))
+		return
+	}
+	writeJSON(w, 200, json.RawMessage(filter))
+}
+
+func (s *Server) sendToDevice(w http.ResponseWriter, req *http.Request, d *device) {
+	var body struct {
+		Messages map[string]map[string]map[string]interface{} `json:"messages"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	evType := pathVar(req, "eventType")
+	for userID, devices := range body.Messages {
+		for deviceID, content := range devices {
+			if err := s.SendToDevice(d.userID, userID, deviceID, evType, content); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+	}
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) uploadKeys(w http.ResponseWriter, req *http.Request, d *device) {
+	var body struct {
+		DeviceKeys   json.RawMessage            `json:"device_keys"`
+		OneTimeKeys  map[string]json.RawMessage `json:"one_time_keys"`
+		FallbackKeys map[string]json.RawMessage `json:"fallback_keys"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	s.mu.Lock()
+	counts := make(map[string]int, len(d.otkCounts))
+	for algorithm, count := range d.otkCounts {
+		counts[algorithm] = count
+	}
+	fallbackKeyTypes := d.fallbackKeyTypes
+	s.mu.Unlock()
+	// keys are named algorithm:key_id
+	for keyID := range body.OneTimeKeys {
+		counts[strings.SplitN(keyID, ":", 2)[0]]++
+	}
+	if len(body.FallbackKeys) > 0 {
+		fallbackKeyTypes = nil
+		for keyID := range body.FallbackKeys {
+			fallbackKeyTypes = append(fallbackKeyTypes, strings.SplitN(keyID, ":", 2)[0])
+		}
+		sort.Strings(fallbackKeyTypes)
+	}
+	if err := s.SetOneTimeKeyCounts(d.userID, d.deviceID, counts, fallbackKeyTypes); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(body.DeviceKeys) > 0 {
+		if err := s.DeviceListChanged(d.userID); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	writeJSON(w, 200, map[string]interface{}{"one_time_key_counts": counts})
+}
+
+func (s *Server) uploadMedia(w http.ResponseWriter, req *http.Request, d *device) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, newError(400, "M_UNKNOWN", "failed to read body: %s", err))
+		return
+	}
+	s.mu.Lock()
+	mediaID := s.genID("media")
+	s.media[mediaID] = media{
+		contentType: req.Header.Get("Content-Type"),
+		data:        data,
+	}
+	s.mu.Unlock()
+	writeJSON(w, 200, map[string]string{"content_uri": "mxc://" + s.ServerName + "/" + mediaID})
+}
+
+func (s *Server) downloadMedia(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	m, ok := s.media[pathVar(req, "mediaID")]
+	s.mu.Unlock()
+	if !ok || pathVar(req, "serverName") != s.ServerName {
+		writeError(w, newError(404, "M_NOT_FOUND", "unknown media"))
+		return
+	}
+	if m.contentType != "" {
+		w.Header().Set("Content-Type", m.contentType)
+	}
+	w.WriteHeader(200)
+	w.Write(m.data)
+}
+
+func (s *Server) deviceListChanged(w http.ResponseWriter, req *http.Request) {
+	if err := s.DeviceListChanged(pathVar(req, "userID")); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct{}{})
+}
+
+// positionBefore returns the stream position just before the event at this index, which is a token
+// for /messages which starts at that event.
+func positionBefore(r *room, index int) int64 {
+	if index < len(r.events) {
+		return r.events[index].pos - 1
+	}
+	if len(r.events) == 0 {
+		return 0
+	}
+	return r.events[len(r.events)-1].pos
+}
+
+// pathVar returns the unescaped path variable, as the router matches on the escaped path so that
+// IDs can contain slashes.
+func pathVar(req *http.Request, name string) string {
+	v := mux.Vars(req)[name]
+	unescaped, err := url.PathUnescape(v)
+	if err != nil {
+		return v
+	}
+	return unescaped
+}
+
+func readJSON(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, newError(400, "M_UNKNOWN", "failed to read body: %s", err))
+		return false
+	}
+	// many endpoints allow an empty body
+	if len(body) == 0 {
+		return true
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		writeError(w, newError(400, "M_NOT_JSON", "invalid JSON: %s", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	matrixErr, ok := err.(*Error)
+	if !ok {
+		matrixErr = newError(500, "M_UNKNOWN", "%s", err)
+	}
+	body, _ := json.Marshal(matrixErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(matrixErr.StatusCode)
+	w.Write(body)
+}
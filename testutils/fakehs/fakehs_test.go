@@ -0,0 +1,182 @@
+package fakehs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/tidwall/gjson"
+)
+
+func doRequest(t *testing.T, srv *httptest.Server, method, path, token string, body interface{}) gjson.Result {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to marshal body: %s", err)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, path, err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("%s %s returned HTTP %d: %s", method, path, res.StatusCode, string(resBody))
+	}
+	return gjson.ParseBytes(resBody)
+}
+
+func timelineHas(events []json.RawMessage, eventID string) bool {
+	for _, ev := range events {
+		if gjson.GetBytes(ev, "event_id").Str == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFakeHomeserver(t *testing.T) {
+	hs := New("localhost")
+	srv := httptest.NewServer(hs.Handler())
+	defer srv.Close()
+	client := &sync2.HTTPClient{
+		Client:            srv.Client(),
+		DestinationServer: srv.URL,
+	}
+
+	alice := doRequest(t, srv, "POST", "/_matrix/client/v3/register", "", map[string]interface{}{"username": "alice"})
+	aliceID, aliceToken := alice.Get("user_id").Str, alice.Get("access_token").Str
+	bob, err := hs.RegisterUser("bob", "", "BOBDEVICE")
+	if err != nil {
+		t.Fatalf("RegisterUser: %s", err)
+	}
+	userID, err := client.WhoAmI("", aliceToken)
+	if err != nil || userID != "@alice:localhost" || aliceID != userID {
+		t.Fatalf("WhoAmI: got %s %v want @alice:localhost", userID, err)
+	}
+	if _, err = client.WhoAmI("", "unknown_token"); err == nil || err.(*sync2.HTTPError).StatusCode != 401 {
+		t.Fatalf("WhoAmI with unknown token: got %v want HTTP 401", err)
+	}
+
+	// invites include stripped state
+	roomID := doRequest(t, srv, "POST", "/_matrix/client/v3/createRoom", aliceToken, map[string]interface{}{
+		"name":   "The Room",
+		"invite": []string{bob.UserID},
+	}).Get("room_id").Str
+	res, _, err := client.DoSyncV2(bob.UserID, bob.AccessToken, "", true)
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	invite, ok := res.Rooms.Invite[roomID]
+	if !ok {
+		t.Fatalf("initial sync: room %s missing from invite section: %+v", roomID, res.Rooms)
+	}
+	var gotName bool
+	for _, ev := range invite.InviteState.Events {
+		gotName = gotName || gjson.GetBytes(ev, "content.name").Str == "The Room"
+	}
+	if !gotName {
+		t.Errorf("initial sync: invite state has no room name: %v", invite.InviteState.Events)
+	}
+
+	// joining returns the room from the start, and new events wake up waiting syncs
+	joinEventID := doRequest(t, srv, "PUT", "/_matrix/client/v3/rooms/"+roomID+"/state/m.room.member/"+bob.UserID, bob.AccessToken, map[string]interface{}{
+		"membership": "join",
+	}).Get("event_id").Str
+	res, _, err = client.DoSyncV2(bob.UserID, bob.AccessToken, res.NextBatch, false)
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	if timeline := res.Rooms.Join[roomID].Timeline.Events; len(timeline) == 0 || gjson.GetBytes(timeline[0], "type").Str != "m.room.create" || !timelineHas(timeline, joinEventID) {
+		t.Errorf("sync after join: got timeline %v want the whole room", timeline)
+	}
+	eventIDs := make(chan string, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		eventIDs <- doRequest(t, srv, "PUT", "/_matrix/client/v3/rooms/"+roomID+"/send/m.room.message/txn1", aliceToken, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "hello",
+		}).Get("event_id").Str
+	}()
+	res, _, err = client.DoSyncV2(bob.UserID, bob.AccessToken, res.NextBatch, false)
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	eventID := <-eventIDs
+	if timeline := res.Rooms.Join[roomID].Timeline.Events; len(timeline) != 1 || !timelineHas(timeline, eventID) {
+		t.Errorf("incremental sync: got timeline %v want just %s", timeline, eventID)
+	}
+
+	// only the sending device sees the transaction ID
+	aliceRes, err := hs.Sync(aliceToken, "", 0, `{"room":{"timeline":{"limit":1}}}`, false)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	timeline := aliceRes.Rooms.Join[roomID].Timeline
+	if len(timeline.Events) != 1 || gjson.GetBytes(timeline.Events[0], "unsigned.transaction_id").Str != "txn1" || !timeline.Limited {
+		t.Errorf("sender sync: got timeline %+v want %s with transaction ID", timeline, eventID)
+	}
+	if gjson.GetBytes(res.Rooms.Join[roomID].Timeline.Events[0], "unsigned.transaction_id").Exists() {
+		t.Errorf("incremental sync: other user saw transaction ID")
+	}
+
+	// to-device messages are sent until acknowledged by a later since token
+	if err = hs.SendToDevice(aliceID, bob.UserID, "*", "m.room_key_request", map[string]interface{}{"action": "request"}); err != nil {
+		t.Fatalf("SendToDevice: %s", err)
+	}
+	res, err = hs.Sync(bob.AccessToken, res.NextBatch, 0, "", false)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if len(res.ToDevice.Events) != 1 {
+		t.Errorf("sync after to-device: got %d to-device events want 1", len(res.ToDevice.Events))
+	}
+	res, err = hs.Sync(bob.AccessToken, res.NextBatch, 0, "", false)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if len(res.ToDevice.Events) != 0 {
+		t.Errorf("sync after ack: got %d to-device events want 0", len(res.ToDevice.Events))
+	}
+
+	// kicked users see the room in the leave section, ending with the kick
+	doRequest(t, srv, "POST", "/_matrix/client/v3/rooms/"+roomID+"/kick", aliceToken, map[string]interface{}{"user_id": bob.UserID})
+	res, err = hs.Sync(bob.AccessToken, res.NextBatch, 0, "", false)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	left, ok := res.Rooms.Leave[roomID]
+	if !ok || len(left.Timeline.Events) != 1 || gjson.GetBytes(left.Timeline.Events[0], "content.membership").Str != "leave" {
+		t.Errorf("sync after kick: got leave section %+v", res.Rooms.Leave)
+	}
+	if _, err = hs.SendEvent(roomID, Event{Type: "m.room.message", Sender: bob.UserID}); err == nil {
+		t.Errorf("SendEvent after kick: want error")
+	}
+
+	// /messages paginates backwards from the prev_batch token
+	page := doRequest(t, srv, "GET", "/_matrix/client/v3/rooms/"+roomID+"/messages?dir=b&limit=1&from="+timeline.PrevBatch, aliceToken, nil)
+	chunk := page.Get("chunk").Array()
+	if len(chunk) != 1 || chunk[0].Get("state_key").Str != bob.UserID || !page.Get("end").Exists() {
+		t.Errorf("/messages: got %s want bob's join", page.Raw)
+	}
+	page = doRequest(t, srv, "GET", "/_matrix/client/v3/rooms/"+roomID+"/messages?dir=b&limit=100&from="+page.Get("end").Str, aliceToken, nil)
+	chunk = page.Get("chunk").Array()
+	if len(chunk) == 0 || chunk[len(chunk)-1].Get("type").Str != "m.room.create" || page.Get("end").Exists() {
+		t.Errorf("/messages: got %s want up to the create event", page.Raw)
+	}
+}
@@ -0,0 +1,720 @@
+// Package fakehs is an in-memory homeserver which implements enough of the client-server API to run
+// the proxy, its tests and clients against without a real homeserver. It does no federation, no
+// authorisation beyond basic membership checks and no event signing: it exists to be scripted.
+//
+// State can be set up over HTTP using the normal client-server API, or directly from Go using the
+// methods on Server, which is useful for creating situations which are awkward to reach over HTTP.
+package fakehs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/sjson"
+)
+
+// DefaultRoomVersion is the room version of rooms created without an explicit version.
+const DefaultRoomVersion = "9"
+
+// Error is a Matrix error returned by the client-server API. Methods on Server return these so the
+// HTTP handlers can surface them with the right status code.
+type Error struct {
+	StatusCode int    `json:"-"`
+	ErrCode    string `json:"errcode"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("HTTP %d %s: %s", e.StatusCode, e.ErrCode, e.Message)
+}
+
+func newError(statusCode int, errcode, format string, args ...interface{}) *Error {
+	return &Error{
+		StatusCode: statusCode,
+		ErrCode:    errcode,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+// Account is a registered device for a user.
+type Account struct {
+	UserID      string `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	AccessToken string `json:"access_token"`
+}
+
+// Event is an event to send into a room. StateKey is nil for message events.
+type Event struct {
+	Type     string
+	Sender   string
+	StateKey *string
+	Content  map[string]interface{}
+}
+
+// Server is an in-memory homeserver. The zero value is not usable, use New.
+type Server struct {
+	ServerName string
+
+	mu sync.Mutex
+	// incremented on every change which may appear in a sync response
+	pos     int64
+	nextID  int64
+	users   map[string]*user
+	devices map[string]*device // access token -> device
+	rooms   map[string]*room
+	aliases map[string]string // alias -> room ID
+	media   map[string]media  // media ID -> content
+	filters map[string]string // filter ID -> filter JSON
+	changed chan struct{}     // closed and replaced whenever pos changes
+	clock   func() time.Time
+}
+
+type user struct {
+	userID   string
+	password string
+	devices  map[string]*device
+	// (room ID or "" for global) -> event type -> account data
+	accountData map[string]map[string]streamEvent
+	// the last position this user's device list changed at
+	deviceListPos int64
+}
+
+type device struct {
+	userID           string
+	deviceID         string
+	accessToken      string
+	toDevice         []streamEvent
+	otkCounts        map[string]int
+	fallbackKeyTypes []string
+	keysPos          int64
+}
+
+type room struct {
+	roomID string
+	events []roomEvent
+	// "type\x00state_key" -> index into events
+	state map[string]int
+	// users who are currently typing
+	typing    map[string]bool
+	typingPos int64
+}
+
+type roomEvent struct {
+	pos   int64
+	event json.RawMessage
+	// set for events sent via /send so the sending device sees its transaction ID
+	accessToken string
+	txnID       string
+}
+
+type streamEvent struct {
+	pos   int64
+	event json.RawMessage
+}
+
+type media struct {
+	contentType string
+	data        []byte
+}
+
+// New makes an empty homeserver for this server name.
+func New(serverName string) *Server {
+	return &Server{
+		ServerName: serverName,
+		users:      make(map[string]*user),
+		devices:    make(map[string]*device),
+		rooms:      make(map[string]*room),
+		aliases:    make(map[string]string),
+		media:      make(map[string]media),
+		filters:    make(map[string]string),
+		changed:    make(chan struct{}),
+		clock:      time.Now,
+	}
+}
+
+// advance moves the stream position forwards and wakes up any waiting syncs. Must be called with
+// the lock held.
+func (s *Server) advance() int64 {
+	s.pos++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.pos
+}
+
+// genID returns a new unique ID with this prefix. Must be called with the lock held.
+func (s *Server) genID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%d", prefix, s.nextID)
+}
+
+// RegisterUser makes a new user with a single device. If deviceID is empty one is generated.
+func (s *Server) RegisterUser(localpart, password, deviceID string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if localpart == "" {
+		localpart = s.genID("user")
+	}
+	userID := "@" + strings.ToLower(localpart) + ":" + s.ServerName
+	if _, exists := s.users[userID]; exists {
+		return nil, newError(400, "M_USER_IN_USE", "%s is already registered", userID)
+	}
+	s.users[userID] = &user{
+		userID:      userID,
+		password:    password,
+		devices:     make(map[string]*device),
+		accountData: make(map[string]map[string]streamEvent),
+	}
+	return s.addDevice(userID, deviceID), nil
+}
+
+// Login makes a new device for an existing user.
+func (s *Server) Login(userID, password, deviceID string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(userID, "@") {
+		userID = "@" + userID + ":" + s.ServerName
+	}
+	u, ok := s.users[userID]
+	if !ok || u.password != password {
+		return nil, newError(403, "M_FORBIDDEN", "invalid username or password")
+	}
+	return s.addDevice(userID, deviceID), nil
+}
+
+// addDevice makes a new device for this user. Must be called with the lock held.
+func (s *Server) addDevice(userID, deviceID string) *Account {
+	if deviceID == "" {
+		deviceID = s.genID("DEVICE")
+	}
+	d := &device{
+		userID:      userID,
+		deviceID:    deviceID,
+		accessToken: s.genID("syt_"),
+		otkCounts:   make(map[string]int),
+	}
+	u := s.users[userID]
+	if old, ok := u.devices[deviceID]; ok {
+		delete(s.devices, old.accessToken)
+	}
+	u.devices[deviceID] = d
+	s.devices[d.accessToken] = d
+	u.deviceListPos = s.advance()
+	return &Account{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		AccessToken: d.accessToken,
+	}
+}
+
+// Logout invalidates this access token, so requests using it return 401 M_UNKNOWN_TOKEN.
+func (s *Server) Logout(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[accessToken]
+	if !ok {
+		return
+	}
+	delete(s.devices, accessToken)
+	u := s.users[d.userID]
+	delete(u.devices, d.deviceID)
+	u.deviceListPos = s.advance()
+}
+
+// deviceForToken returns the device for this access token or a 401 error.
+func (s *Server) deviceForToken(accessToken string) (*device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[accessToken]
+	if !ok {
+		return nil, newError(401, "M_UNKNOWN_TOKEN", "unknown access token")
+	}
+	return d, nil
+}
+
+// CreateRoomRequest is the body of /createRoom.
+type CreateRoomRequest struct {
+	Preset          string                   `json:"preset"`
+	Visibility      string                   `json:"visibility"`
+	Name            string                   `json:"name"`
+	Topic           string                   `json:"topic"`
+	RoomAliasName   string                   `json:"room_alias_name"`
+	RoomVersion     string                   `json:"room_version"`
+	Invite          []string                 `json:"invite"`
+	IsDirect        bool                     `json:"is_direct"`
+	CreationContent map[string]interface{}   `json:"creation_content"`
+	InitialState    []map[string]interface{} `json:"initial_state"`
+}
+
+// CreateRoom makes a new room as this user, returning the room ID.
+func (s *Server) CreateRoom(creator string, req CreateRoomRequest) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[creator]; !ok {
+		return "", newError(404, "M_NOT_FOUND", "unknown user %s", creator)
+	}
+	var alias string
+	if req.RoomAliasName != "" {
+		alias = "#" + req.RoomAliasName + ":" + s.ServerName
+		if _, exists := s.aliases[alias]; exists {
+			return "", newError(400, "M_ROOM_IN_USE", "alias %s is already in use", alias)
+		}
+	}
+	roomID := "!" + s.genID("room") + ":" + s.ServerName
+	s.rooms[roomID] = &room{
+		roomID: roomID,
+		state:  make(map[string]int),
+	}
+	if req.RoomVersion == "" {
+		req.RoomVersion = DefaultRoomVersion
+	}
+	createContent := map[string]interface{}{
+		"creator":      creator,
+		"room_version": req.RoomVersion,
+	}
+	for k, v := range req.CreationContent {
+		createContent[k] = v
+	}
+	joinRule := "invite"
+	if req.Preset == "public_chat" || (req.Preset == "" && req.Visibility == "public") {
+		joinRule = "public"
+	}
+	events := []Event{
+		{Type: "m.room.create", StateKey: ptr(""), Content: createContent},
+		{Type: "m.room.member", StateKey: ptr(creator), Content: map[string]interface{}{"membership": "join"}},
+		{Type: "m.room.power_levels", StateKey: ptr(""), Content: map[string]interface{}{
+			"users": map[string]interface{}{creator: 100},
+		}},
+		{Type: "m.room.join_rules", StateKey: ptr(""), Content: map[string]interface{}{"join_rule": joinRule}},
+		{Type: "m.room.history_visibility", StateKey: ptr(""), Content: map[string]interface{}{"history_visibility": "shared"}},
+	}
+	if alias != "" {
+		events = append(events, Event{Type: "m.room.canonical_alias", StateKey: ptr(""), Content: map[string]interface{}{"alias": alias}})
+	}
+	for _, ev := range req.InitialState {
+		stateKey, _ := ev["state_key"].(string)
+		evType, _ := ev["type"].(string)
+		content, _ := ev["content"].(map[string]interface{})
+		events = append(events, Event{Type: evType, StateKey: ptr(stateKey), Content: content})
+	}
+	if req.Name != "" {
+		events = append(events, Event{Type: "m.room.name", StateKey: ptr(""), Content: map[string]interface{}{"name": req.Name}})
+	}
+	if req.Topic != "" {
+		events = append(events, Event{Type: "m.room.topic", StateKey: ptr(""), Content: map[string]interface{}{"topic": req.Topic}})
+	}
+	for _, invitee := range req.Invite {
+		content := map[string]interface{}{"membership": "invite"}
+		if req.IsDirect {
+			content["is_direct"] = true
+		}
+		events = append(events, Event{Type: "m.room.member", StateKey: ptr(invitee), Content: content})
+	}
+	for _, ev := range events {
+		ev.Sender = creator
+		s.appendEvent(s.rooms[roomID], ev, "", "")
+	}
+	if alias != "" {
+		s.aliases[alias] = roomID
+	}
+	return roomID, nil
+}
+
+// UpgradeRoom replaces this room with a new room, tombstoning the old one. Returns the new room ID.
+func (s *Server) UpgradeRoom(roomID, sender, newVersion string) (string, error) {
+	s.mu.Lock()
+	r, ok := s.rooms[roomID]
+	if !ok || r.membership(sender) != "join" {
+		s.mu.Unlock()
+		return "", newError(403, "M_FORBIDDEN", "%s is not in room %s", sender, roomID)
+	}
+	// the last event in the old room, as required by m.room.create predecessor
+	lastEventID := eventID(r.events[len(r.events)-1].event)
+	s.mu.Unlock()
+	newRoomID, err := s.CreateRoom(sender, CreateRoomRequest{
+		RoomVersion: newVersion,
+		CreationContent: map[string]interface{}{
+			"predecessor": map[string]interface{}{
+				"room_id":  roomID,
+				"event_id": lastEventID,
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = s.SendEvent(roomID, Event{
+		Type:     "m.room.tombstone",
+		Sender:   sender,
+		StateKey: ptr(""),
+		Content: map[string]interface{}{
+			"body":             "This room has been replaced",
+			"replacement_room": newRoomID,
+		},
+	})
+	return newRoomID, err
+}
+
+// ResolveAlias returns the room ID for this room ID or alias.
+func (s *Server) ResolveAlias(roomIDOrAlias string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		roomID, ok := s.aliases[roomIDOrAlias]
+		if !ok {
+			return "", newError(404, "M_NOT_FOUND", "unknown alias %s", roomIDOrAlias)
+		}
+		return roomID, nil
+	}
+	if _, ok := s.rooms[roomIDOrAlias]; !ok {
+		return "", newError(404, "M_NOT_FOUND", "unknown room %s", roomIDOrAlias)
+	}
+	return roomIDOrAlias, nil
+}
+
+// SendEvent sends an event into a room, returning the event ID. The sender must be joined to the
+// room. Membership events should be sent with SetMembership, which checks the transition is allowed.
+func (s *Server) SendEvent(roomID string, ev Event) (string, error) {
+	return s.sendEvent(roomID, ev, "", "")
+}
+
+func (s *Server) sendEvent(roomID string, ev Event, accessToken, txnID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return "", newError(404, "M_NOT_FOUND", "unknown room %s", roomID)
+	}
+	if r.membership(ev.Sender) != "join" {
+		return "", newError(403, "M_FORBIDDEN", "%s is not joined to %s", ev.Sender, roomID)
+	}
+	if txnID != "" {
+		// retransmissions of the same transaction return the original event
+		for _, re := range r.events {
+			if re.accessToken == accessToken && re.txnID == txnID {
+				return eventID(re.event), nil
+			}
+		}
+	}
+	return eventID(s.appendEvent(r, ev, accessToken, txnID)), nil
+}
+
+// SetMembership changes the membership of target in this room as sender, returning the event ID.
+// Joins and invites are checked against the join rules and bans; sender == target for joins/leaves.
+func (s *Server) SetMembership(roomID, sender, target, membership, reason string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return "", newError(404, "M_NOT_FOUND", "unknown room %s", roomID)
+	}
+	if _, ok := s.users[target]; !ok && strings.HasSuffix(target, ":"+s.ServerName) {
+		return "", newError(404, "M_NOT_FOUND", "unknown user %s", target)
+	}
+	current := r.membership(target)
+	switch membership {
+	case "join":
+		if current == "ban" {
+			return "", newError(403, "M_FORBIDDEN", "%s is banned from %s", target, roomID)
+		}
+		if current != "invite" && current != "join" && r.joinRule() != "public" {
+			return "", newError(403, "M_FORBIDDEN", "%s is not invited to %s", target, roomID)
+		}
+	case "invite":
+		if r.membership(sender) != "join" {
+			return "", newError(403, "M_FORBIDDEN", "%s is not joined to %s", sender, roomID)
+		}
+		if current == "join" || current == "ban" {
+			return "", newError(403, "M_FORBIDDEN", "%s cannot be invited to %s, membership is %s", target, roomID, current)
+		}
+	case "leave":
+		if sender != target && r.membership(sender) != "join" {
+			return "", newError(403, "M_FORBIDDEN", "%s is not joined to %s", sender, roomID)
+		}
+		if current == "" || current == "leave" || (current == "ban" && sender == target) {
+			return "", newError(403, "M_FORBIDDEN", "%s is not in %s", target, roomID)
+		}
+	case "ban":
+		if r.membership(sender) != "join" {
+			return "", newError(403, "M_FORBIDDEN", "%s is not joined to %s", sender, roomID)
+		}
+	default:
+		return "", newError(400, "M_INVALID_PARAM", "unknown membership %s", membership)
+	}
+	content := map[string]interface{}{"membership": membership}
+	if reason != "" {
+		content["reason"] = reason
+	}
+	return eventID(s.appendEvent(r, Event{
+		Type:     "m.room.member",
+		Sender:   sender,
+		StateKey: ptr(target),
+		Content:  content,
+	}, "", "")), nil
+}
+
+// appendEvent adds an event to the end of the room, updating the current state. Must be called with
+// the lock held.
+func (s *Server) appendEvent(r *room, ev Event, accessToken, txnID string) json.RawMessage {
+	content := ev.Content
+	if content == nil {
+		content = map[string]interface{}{}
+	}
+	j := map[string]interface{}{
+		"event_id":         "$" + s.genID("event") + ":" + s.ServerName,
+		"room_id":          r.roomID,
+		"type":             ev.Type,
+		"sender":           ev.Sender,
+		"content":          content,
+		"origin_server_ts": s.clock().UnixNano() / int64(time.Millisecond),
+	}
+	if ev.StateKey != nil {
+		j["state_key"] = *ev.StateKey
+		if i, ok := r.state[stateTuple(ev.Type, *ev.StateKey)]; ok {
+			var prev struct {
+				Content json.RawMessage `json:"content"`
+			}
+			json.Unmarshal(r.events[i].event, &prev)
+			j["unsigned"] = map[string]interface{}{"prev_content": prev.Content}
+		}
+	}
+	event, err := json.Marshal(j)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal event: %s", err))
+	}
+	r.events = append(r.events, roomEvent{
+		pos:         s.advance(),
+		event:       event,
+		accessToken: accessToken,
+		txnID:       txnID,
+	})
+	if ev.StateKey != nil {
+		r.state[stateTuple(ev.Type, *ev.StateKey)] = len(r.events) - 1
+	}
+	return event
+}
+
+// SetAccountData sets global account data for this user, or room account data if roomID is set.
+func (s *Server) SetAccountData(userID, roomID, evType string, content map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return newError(404, "M_NOT_FOUND", "unknown user %s", userID)
+	}
+	event, err := json.Marshal(map[string]interface{}{
+		"type":    evType,
+		"content": content,
+	})
+	if err != nil {
+		return err
+	}
+	if u.accountData[roomID] == nil {
+		u.accountData[roomID] = make(map[string]streamEvent)
+	}
+	u.accountData[roomID][evType] = streamEvent{
+		pos:   s.advance(),
+		event: event,
+	}
+	return nil
+}
+
+// AccountData returns the content of this account data, or nil if it is not set.
+func (s *Server) AccountData(userID, roomID, evType string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return nil
+	}
+	ad, ok := u.accountData[roomID][evType]
+	if !ok {
+		return nil
+	}
+	var event struct {
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(ad.event, &event)
+	return event.Content
+}
+
+// SendToDevice queues a to-device message for this device, or all of the user's devices if deviceID
+// is "*".
+func (s *Server) SendToDevice(sender, userID, deviceID, evType string, content map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return newError(404, "M_NOT_FOUND", "unknown user %s", userID)
+	}
+	event, err := json.Marshal(map[string]interface{}{
+		"type":    evType,
+		"sender":  sender,
+		"content": content,
+	})
+	if err != nil {
+		return err
+	}
+	pos := s.advance()
+	for _, d := range u.devices {
+		if deviceID == "*" || d.deviceID == deviceID {
+			d.toDevice = append(d.toDevice, streamEvent{
+				pos:   pos,
+				event: event,
+			})
+		}
+	}
+	return nil
+}
+
+// DeviceListChanged marks this user's device list as changed, so users who share a room with them
+// see them in device_lists.changed.
+func (s *Server) DeviceListChanged(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return newError(404, "M_NOT_FOUND", "unknown user %s", userID)
+	}
+	u.deviceListPos = s.advance()
+	return nil
+}
+
+// SetOneTimeKeyCounts sets the one-time key counts and unused fallback key types for this device.
+func (s *Server) SetOneTimeKeyCounts(userID, deviceID string, counts map[string]int, fallbackKeyTypes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return newError(404, "M_NOT_FOUND", "unknown user %s", userID)
+	}
+	d, ok := u.devices[deviceID]
+	if !ok {
+		return newError(404, "M_NOT_FOUND", "unknown device %s", deviceID)
+	}
+	d.otkCounts = make(map[string]int, len(counts))
+	for algorithm, count := range counts {
+		d.otkCounts[algorithm] = count
+	}
+	d.fallbackKeyTypes = fallbackKeyTypes
+	d.keysPos = s.advance()
+	return nil
+}
+
+// RoomState returns the current state events in this room, sorted by type then state key.
+func (s *Server) RoomState(roomID string) []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return r.stateAt(len(r.events))
+}
+
+// Handler returns the HTTP handler for the client-server API.
+func (s *Server) Handler() http.Handler {
+	return s.router()
+}
+
+func (r *room) membership(userID string) string {
+	i, ok := r.state[stateTuple("m.room.member", userID)]
+	if !ok {
+		return ""
+	}
+	return membershipOf(r.events[i].event)
+}
+
+func (r *room) joinRule() string {
+	i, ok := r.state[stateTuple("m.room.join_rules", "")]
+	if !ok {
+		return "invite"
+	}
+	var ev struct {
+		Content struct {
+			JoinRule string `json:"join_rule"`
+		} `json:"content"`
+	}
+	json.Unmarshal(r.events[i].event, &ev)
+	return ev.Content.JoinRule
+}
+
+// joinedUsers returns the users currently joined to this room.
+func (r *room) joinedUsers() []string {
+	var userIDs []string
+	for tuple, i := range r.state {
+		if strings.HasPrefix(tuple, "m.room.member\x00") && membershipOf(r.events[i].event) == "join" {
+			userIDs = append(userIDs, strings.TrimPrefix(tuple, "m.room.member\x00"))
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// stateAt returns the state before the event at this index, sorted by type then state key.
+func (r *room) stateAt(index int) []json.RawMessage {
+	state := make(map[string]int)
+	for i := 0; i < index && i < len(r.events); i++ {
+		var ev struct {
+			Type     string  `json:"type"`
+			StateKey *string `json:"state_key"`
+		}
+		json.Unmarshal(r.events[i].event, &ev)
+		if ev.StateKey != nil {
+			state[stateTuple(ev.Type, *ev.StateKey)] = i
+		}
+	}
+	tuples := make([]string, 0, len(state))
+	for tuple := range state {
+		tuples = append(tuples, tuple)
+	}
+	sort.Strings(tuples)
+	events := make([]json.RawMessage, 0, len(tuples))
+	for _, tuple := range tuples {
+		events = append(events, r.events[state[tuple]].event)
+	}
+	return events
+}
+
+// clientEvent returns the event as seen by this device, which includes the transaction ID if the
+// device sent it.
+func (re roomEvent) clientEvent(accessToken string) json.RawMessage {
+	if re.txnID == "" || re.accessToken != accessToken {
+		return re.event
+	}
+	event, err := sjson.SetBytes(re.event, "unsigned.transaction_id", re.txnID)
+	if err != nil {
+		return re.event
+	}
+	return event
+}
+
+func stateTuple(evType, stateKey string) string {
+	return evType + "\x00" + stateKey
+}
+
+func eventID(event json.RawMessage) string {
+	var ev struct {
+		EventID string `json:"event_id"`
+	}
+	json.Unmarshal(event, &ev)
+	return ev.EventID
+}
+
+func membershipOf(event json.RawMessage) string {
+	var ev struct {
+		Content struct {
+			Membership string `json:"membership"`
+		} `json:"content"`
+	}
+	json.Unmarshal(event, &ev)
+	return ev.Content.Membership
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,341 @@
+package fakehs
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/sync-v3/sync2"
+	"github.com/tidwall/gjson"
+)
+
+// defaultTimelineLimit is used when the sync filter doesn't set room.timeline.limit
+const defaultTimelineLimit = 10
+
+// strippedStateTypes are the state events included in invites
+var strippedStateTypes = []string{
+	"m.room.create", "m.room.join_rules", "m.room.name", "m.room.avatar", "m.room.canonical_alias", "m.room.encryption",
+}
+
+// SetTyping sets whether this user is typing in this room.
+func (s *Server) SetTyping(roomID, userID string, typing bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return newError(404, "M_NOT_FOUND", "unknown room %s", roomID)
+	}
+	if r.membership(userID) != "join" {
+		return newError(403, "M_FORBIDDEN", "%s is not joined to %s", userID, roomID)
+	}
+	if r.typing == nil {
+		r.typing = make(map[string]bool)
+	}
+	if typing {
+		r.typing[userID] = true
+	} else {
+		delete(r.typing, userID)
+	}
+	r.typingPos = s.advance()
+	return nil
+}
+
+// Sync performs a v2 sync for the device with this access token. If there is nothing new since the
+// since token, waits up to timeout for something to happen.
+func (s *Server) Sync(accessToken, since string, timeout time.Duration, filter string, fullState bool) (*sync2.SyncResponse, error) {
+	var sincePos int64
+	if since != "" {
+		var err error
+		sincePos, err = parseToken(since, "s")
+		if err != nil {
+			return nil, newError(400, "M_INVALID_PARAM", "invalid since token %s", since)
+		}
+	}
+	timelineLimit := defaultTimelineLimit
+	if filter != "" {
+		if !strings.HasPrefix(filter, "{") {
+			s.mu.Lock()
+			filter = s.filters[filter]
+			s.mu.Unlock()
+		}
+		if limit := gjson.Get(filter, "room.timeline.limit"); limit.Exists() {
+			timelineLimit = int(limit.Int())
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		d, ok := s.devices[accessToken]
+		if !ok {
+			s.mu.Unlock()
+			return nil, newError(401, "M_UNKNOWN_TOKEN", "unknown access token")
+		}
+		res, hasData := s.buildSync(d, sincePos, timelineLimit, fullState)
+		changed := s.changed
+		s.mu.Unlock()
+		// initial syncs always return immediately, as the client has nothing
+		if hasData || since == "" {
+			return res, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return res, nil
+		}
+		select {
+		case <-changed:
+		case <-time.After(wait):
+			return res, nil
+		}
+	}
+}
+
+// buildSync makes a sync response for everything after since for this device, returning whether it
+// has anything new in it. Must be called with the lock held.
+func (s *Server) buildSync(d *device, since int64, timelineLimit int, fullState bool) (*sync2.SyncResponse, bool) {
+	u := s.users[d.userID]
+	res := &sync2.SyncResponse{
+		NextBatch: "s" + strconv.FormatInt(s.pos, 10),
+		Rooms: sync2.SyncRoomsResponse{
+			Join:   make(map[string]sync2.SyncV2JoinResponse),
+			Invite: make(map[string]sync2.SyncV2InviteResponse),
+			Leave:  make(map[string]sync2.SyncV2LeaveResponse),
+		},
+	}
+	hasData := false
+	deviceListChanges := make(map[string]bool)
+
+	roomIDs := make([]string, 0, len(s.rooms))
+	for roomID := range s.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	for _, roomID := range roomIDs {
+		r := s.rooms[roomID]
+		membershipIndex, ok := r.state[stateTuple("m.room.member", d.userID)]
+		if !ok {
+			continue
+		}
+		membership := membershipOf(r.events[membershipIndex].event)
+		membershipChanged := r.events[membershipIndex].pos > since
+		switch membership {
+		case "join":
+			// rooms are sent in full if the client hasn't seen them, else just what is new
+			newlyJoined := since == 0 || (membershipChanged && r.membershipAt(d.userID, since) != "join")
+			start := 0
+			if !newlyJoined {
+				start = r.indexAfter(since)
+			}
+			jr := sync2.SyncV2JoinResponse{}
+			jr.Timeline, start = r.timeline(d, start, len(r.events), timelineLimit)
+			if newlyJoined || fullState {
+				jr.State.Events = r.stateAt(start)
+			} else if jr.Timeline.Limited {
+				// only the state which changed in the gap between since and the timeline
+				for _, ev := range r.stateAt(start) {
+					if r.posOf(ev) > since {
+						jr.State.Events = append(jr.State.Events, ev)
+					}
+				}
+			}
+			if since == 0 || r.typingPos > since {
+				jr.Ephemeral.Events = append(jr.Ephemeral.Events, r.typingEvent())
+			}
+			jr.AccountData.Events = accountDataSince(u.accountData[roomID], since)
+			if newlyJoined || len(jr.Timeline.Events) > 0 || len(jr.State.Events) > 0 ||
+				len(jr.Ephemeral.Events) > 0 || len(jr.AccountData.Events) > 0 {
+				res.Rooms.Join[roomID] = jr
+				hasData = true
+			}
+			if since > 0 {
+				for _, userID := range r.joinedUsers() {
+					if s.users[userID] != nil && s.users[userID].deviceListPos > since {
+						deviceListChanges[userID] = true
+					}
+				}
+				// new members may have devices the client needs to know about
+				for i := r.indexAfter(since); i < len(r.events); i++ {
+					ev := gjson.ParseBytes(r.events[i].event)
+					if ev.Get("type").Str == "m.room.member" && ev.Get("content.membership").Str == "join" {
+						deviceListChanges[ev.Get("state_key").Str] = true
+					}
+				}
+			}
+		case "invite":
+			if since == 0 || membershipChanged {
+				res.Rooms.Invite[roomID] = sync2.SyncV2InviteResponse{
+					InviteState: sync2.EventsResponse{
+						Events: r.strippedState(membershipIndex),
+					},
+				}
+				hasData = true
+			}
+		case "leave", "ban":
+			// left rooms are only sent to clients which saw the room before they left
+			if since == 0 || !membershipChanged {
+				continue
+			}
+			lr := sync2.SyncV2LeaveResponse{}
+			start := r.indexAfter(since)
+			if r.membershipAt(d.userID, since) != "join" {
+				// they never saw the room so only see their membership change
+				start = membershipIndex
+			}
+			timeline, start := r.timeline(d, start, membershipIndex+1, timelineLimit)
+			lr.Timeline.Events = timeline.Events
+			lr.Timeline.Limited = timeline.Limited
+			lr.Timeline.PrevBatch = timeline.PrevBatch
+			if timeline.Limited {
+				lr.State.Events = r.stateAt(start)
+			}
+			res.Rooms.Leave[roomID] = lr
+			hasData = true
+		}
+	}
+
+	res.AccountData.Events = accountDataSince(u.accountData[""], since)
+	if len(res.AccountData.Events) > 0 {
+		hasData = true
+	}
+
+	// to-device messages are deleted once the client syncs with a token after them
+	if since > 0 {
+		remaining := d.toDevice[:0]
+		for _, msg := range d.toDevice {
+			if msg.pos > since {
+				remaining = append(remaining, msg)
+			}
+		}
+		d.toDevice = remaining
+	}
+	for _, msg := range d.toDevice {
+		res.ToDevice.Events = append(res.ToDevice.Events, msg.event)
+		if msg.pos > since {
+			hasData = true
+		}
+	}
+
+	for userID := range deviceListChanges {
+		res.DeviceLists.Changed = append(res.DeviceLists.Changed, userID)
+	}
+	sort.Strings(res.DeviceLists.Changed)
+	if len(res.DeviceLists.Changed) > 0 {
+		hasData = true
+	}
+	res.DeviceListsOTKCount = map[string]int{"signed_curve25519": 0}
+	for algorithm, count := range d.otkCounts {
+		res.DeviceListsOTKCount[algorithm] = count
+	}
+	res.DeviceUnusedFallbackKeyTypes = d.fallbackKeyTypes
+	if d.keysPos > since {
+		hasData = true
+	}
+	return res, hasData
+}
+
+// timeline returns the last events in [start, end) up to limit as seen by this device, along with
+// the index of the first returned event.
+func (r *room) timeline(d *device, start, end, limit int) (sync2.TimelineResponse, int) {
+	var tr sync2.TimelineResponse
+	if end-start > limit {
+		start = end - limit
+		tr.Limited = true
+	}
+	for i := start; i < end; i++ {
+		tr.Events = append(tr.Events, r.events[i].clientEvent(d.accessToken))
+	}
+	if start < len(r.events) {
+		tr.PrevBatch = "t" + strconv.FormatInt(r.events[start].pos-1, 10)
+	} else if len(r.events) > 0 {
+		tr.PrevBatch = "t" + strconv.FormatInt(r.events[len(r.events)-1].pos, 10)
+	}
+	return tr, start
+}
+
+// indexAfter returns the index of the first event after this stream position.
+func (r *room) indexAfter(pos int64) int {
+	return sort.Search(len(r.events), func(i int) bool {
+		return r.events[i].pos > pos
+	})
+}
+
+// posOf returns the stream position of this event.
+func (r *room) posOf(event json.RawMessage) int64 {
+	id := eventID(event)
+	for _, re := range r.events {
+		if eventID(re.event) == id {
+			return re.pos
+		}
+	}
+	return 0
+}
+
+// membershipAt returns the membership of this user at this stream position.
+func (r *room) membershipAt(userID string, pos int64) string {
+	membership := ""
+	for i := 0; i < r.indexAfter(pos); i++ {
+		ev := gjson.ParseBytes(r.events[i].event)
+		if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID {
+			membership = ev.Get("content.membership").Str
+		}
+	}
+	return membership
+}
+
+// strippedState returns the stripped state sent with an invite, including the invite itself.
+func (r *room) strippedState(inviteIndex int) []json.RawMessage {
+	var events []json.RawMessage
+	for _, evType := range strippedStateTypes {
+		if i, ok := r.state[stateTuple(evType, "")]; ok {
+			events = append(events, stripped(r.events[i].event))
+		}
+	}
+	return append(events, r.events[inviteIndex].event)
+}
+
+func (r *room) typingEvent() json.RawMessage {
+	userIDs := []string{}
+	for userID := range r.typing {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	event, _ := json.Marshal(map[string]interface{}{
+		"type": "m.typing",
+		"content": map[string]interface{}{
+			"user_ids": userIDs,
+		},
+	})
+	return event
+}
+
+func stripped(event json.RawMessage) json.RawMessage {
+	ev := gjson.ParseBytes(event)
+	j, _ := json.Marshal(map[string]interface{}{
+		"type":      ev.Get("type").Str,
+		"state_key": ev.Get("state_key").Str,
+		"sender":    ev.Get("sender").Str,
+		"content":   json.RawMessage(ev.Get("content").Raw),
+	})
+	return j
+}
+
+func accountDataSince(accountData map[string]streamEvent, since int64) []json.RawMessage {
+	evTypes := make([]string, 0, len(accountData))
+	for evType, ad := range accountData {
+		if ad.pos > since {
+			evTypes = append(evTypes, evType)
+		}
+	}
+	sort.Strings(evTypes)
+	events := make([]json.RawMessage, 0, len(evTypes))
+	for _, evType := range evTypes {
+		events = append(events, accountData[evType].event)
+	}
+	return events
+}
+
+// parseToken parses a stream position token with this prefix, e.g s123.
+func parseToken(token, prefix string) (int64, error) {
+	return strconv.ParseInt(strings.TrimPrefix(token, prefix), 10, 64)
+}
@@ -16,6 +16,30 @@ type ListMatcher func(list sync3.ResponseList) error
 type OpMatcher func(op sync3.ResponseOp) error
 type RoomMatcher func(r sync3.Room) error
 
+func MatchRoomAvatar(avatar string) RoomMatcher {
+	return func(r sync3.Room) error {
+		if r.Avatar == nil {
+			return fmt.Errorf("avatar mismatch, got nil want %s", avatar)
+		}
+		if *r.Avatar != avatar {
+			return fmt.Errorf("avatar mismatch, got %s want %s", *r.Avatar, avatar)
+		}
+		return nil
+	}
+}
+
+func MatchRoomTopic(topic string) RoomMatcher {
+	return func(r sync3.Room) error {
+		if r.Topic == nil {
+			return fmt.Errorf("topic mismatch, got nil want %s", topic)
+		}
+		if *r.Topic != topic {
+			return fmt.Errorf("topic mismatch, got %s want %s", *r.Topic, topic)
+		}
+		return nil
+	}
+}
+
 func MatchRoomName(name string) RoomMatcher {
 	return func(r sync3.Room) error {
 		if name == "" {
@@ -89,6 +113,28 @@ func MatchRoomInviteState(events []json.RawMessage) RoomMatcher {
 	}
 }
 
+func MatchRoomKnockState(events []json.RawMessage) RoomMatcher {
+	return func(r sync3.Room) error {
+		if len(r.KnockState) != len(events) {
+			return fmt.Errorf("knock state length mismatch, got %d want %d", len(r.KnockState), len(events))
+		}
+		// allow any ordering for knock state
+		for _, want := range events {
+			found := false
+			for _, got := range r.KnockState {
+				if bytes.Equal(got, want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("knock state want event %v but it does not exist", string(want))
+			}
+		}
+		return nil
+	}
+}
+
 // Similar to MatchRoomTimeline but takes the last n events of `events` and only checks with the last
 // n events of the timeline.
 func MatchRoomTimelineMostRecent(n int, events []json.RawMessage) RoomMatcher {
@@ -357,9 +403,9 @@ func MatchV3InvalidateOp(start, end int64) OpMatcher {
 
 func MatchNoV3Ops() RespMatcher {
 	return func(res *sync3.Response) error {
-		for i, l := range res.Lists {
+		for listKey, l := range res.Lists {
 			if len(l.Ops) > 0 {
-				return fmt.Errorf("MatchNoV3Ops: list %d got %d ops", i, len(l.Ops))
+				return fmt.Errorf("MatchNoV3Ops: list %v got %d ops", listKey, len(l.Ops))
 			}
 		}
 		return nil
@@ -409,15 +455,53 @@ func MatchAccountData(globals []json.RawMessage, rooms map[string][]json.RawMess
 	}
 }
 
-func CheckList(i int, res sync3.ResponseList, matchers ...ListMatcher) error {
+func CheckList(listKey string, res sync3.ResponseList, matchers ...ListMatcher) error {
 	for _, m := range matchers {
 		if err := m(res); err != nil {
-			return fmt.Errorf("MatchList[%d]: %v", i, err)
+			return fmt.Errorf("MatchList[%v]: %v", listKey, err)
 		}
 	}
 	return nil
 }
 
+// MatchSpaces checks the spaces extension returned the given ordered children for each space.
+func MatchSpaces(spaceToChildren map[string][]string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Spaces == nil {
+			return fmt.Errorf("MatchSpaces: no spaces extension")
+		}
+		if len(spaceToChildren) != len(res.Extensions.Spaces.Spaces) {
+			return fmt.Errorf("MatchSpaces: got %d spaces, want %d", len(res.Extensions.Spaces.Spaces), len(spaceToChildren))
+		}
+		for spaceRoomID, wantChildren := range spaceToChildren {
+			gotChildren, ok := res.Extensions.Spaces.Spaces[spaceRoomID]
+			if !ok {
+				return fmt.Errorf("MatchSpaces: missing space %s", spaceRoomID)
+			}
+			gotRoomIDs := make([]string, len(gotChildren))
+			for i := range gotChildren {
+				gotRoomIDs[i] = gotChildren[i].RoomID
+			}
+			if !reflect.DeepEqual(gotRoomIDs, wantChildren) {
+				return fmt.Errorf("MatchSpaces[%s]: got %v want %v", spaceRoomID, gotRoomIDs, wantChildren)
+			}
+		}
+		return nil
+	}
+}
+
+func MatchSpacesLeft(spaceRoomIDs []string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Spaces == nil {
+			return fmt.Errorf("MatchSpacesLeft: no spaces extension")
+		}
+		if !reflect.DeepEqual(res.Extensions.Spaces.Left, spaceRoomIDs) {
+			return fmt.Errorf("MatchSpacesLeft: got %v want %v", res.Extensions.Spaces.Left, spaceRoomIDs)
+		}
+		return nil
+	}
+}
+
 func MatchTxnID(txnID string) RespMatcher {
 	return func(res *sync3.Response) error {
 		if txnID != res.TxnID {
@@ -427,24 +511,28 @@ func MatchTxnID(txnID string) RespMatcher {
 	}
 }
 
-func MatchList(i int, matchers ...ListMatcher) RespMatcher {
+func MatchList(listKey string, matchers ...ListMatcher) RespMatcher {
 	return func(res *sync3.Response) error {
-		if i >= len(res.Lists) {
-			return fmt.Errorf("MatchSingleList: index %d does not exist, got %d lists", i, len(res.Lists))
+		list, exists := res.Lists[listKey]
+		if !exists {
+			return fmt.Errorf("MatchSingleList: list '%v' does not exist, got %d lists", listKey, len(res.Lists))
 		}
-		list := res.Lists[i]
-		return CheckList(i, list, matchers...)
+		return CheckList(listKey, list, matchers...)
 	}
 }
 
-func MatchLists(matchers ...[]ListMatcher) RespMatcher {
+func MatchLists(matchers map[string][]ListMatcher) RespMatcher {
 	return func(res *sync3.Response) error {
 		if len(matchers) != len(res.Lists) {
 			return fmt.Errorf("MatchLists: got %d matchers for %d lists", len(matchers), len(res.Lists))
 		}
-		for i := range matchers {
-			if err := CheckList(i, res.Lists[i], matchers[i]...); err != nil {
-				return fmt.Errorf("MatchLists[%d]: %v", i, err)
+		for listKey, listMatchers := range matchers {
+			list, exists := res.Lists[listKey]
+			if !exists {
+				return fmt.Errorf("MatchLists: list '%v' does not exist", listKey)
+			}
+			if err := CheckList(listKey, list, listMatchers...); err != nil {
+				return fmt.Errorf("MatchLists[%v]: %v", listKey, err)
 			}
 		}
 		return nil
@@ -4,20 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/sync-v3/internal"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("server")
 var Version string
 
 type server struct {
@@ -46,24 +41,135 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 	}
 }
 
+// HealthChecker is implemented by handlers which can report whether they are ready to serve traffic.
+type HealthChecker interface {
+	Ready() error
+}
+
+// HealthHandler returns an http.Handler which responds with 200 if check returns nil, else 503.
+func HealthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Status string `json:"status"`
+			Error  string `json:"error,omitempty"`
+		}
+		statusCode := http.StatusOK
+		body.Status = "ok"
+		if err := check(); err != nil {
+			statusCode = http.StatusServiceUnavailable
+			body.Status = "unavailable"
+			body.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// WebSocketHandler is implemented by handlers which can serve sliding sync over a WebSocket.
+type WebSocketHandler interface {
+	ServeWebSocket(w http.ResponseWriter, req *http.Request)
+}
+
+// V2SyncHandler is implemented by handlers which can serve the v2 /sync API to clients which do not
+// support sliding sync.
+type V2SyncHandler interface {
+	ServeV2Sync(w http.ResponseWriter, req *http.Request)
+}
+
+// UpstreamLister is implemented by handlers which route requests to several upstream homeservers.
+type UpstreamLister interface {
+	// Returns the CS API URL for each server name.
+	UpstreamServers() map[string]string
+}
+
+// ServerOptions configures how a listener serves HTTP.
+type ServerOptions struct {
+	// If set, serve HTTPS and HTTP/2 with this certificate and key, which are reloaded on SIGHUP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// If set, clients must present a certificate signed by a CA in this file. Requires TLS.
+	TLSClientCAFile string
+	// How long clients have to send request headers.
+	ReadHeaderTimeout time.Duration
+	// How long to keep idle keep-alive connections open.
+	IdleTimeout time.Duration
+}
+
+// DefaultServerOptions serves plain HTTP. There is deliberately no write timeout, as that would cut
+// off long-polling requests.
+var DefaultServerOptions = ServerOptions{
+	ReadHeaderTimeout: 10 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+}
+
+// ListenAndServe serves HTTP requests on bindAddr until the listener fails.
+func ListenAndServe(bindAddr string, h http.Handler, opts ServerOptions) error {
+	srv := &http.Server{
+		Addr:              bindAddr,
+		Handler:           h,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+	}
+	if opts.TLSCertFile == "" {
+		if opts.TLSClientCAFile != "" {
+			return fmt.Errorf("a client CA requires a TLS certificate and key")
+		}
+		return srv.ListenAndServe()
+	}
+	reloader, err := internal.NewCertReloader(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	reloader.ReloadOnSIGHUP()
+	srv.TLSConfig, err = internal.TLSConfig(reloader, opts.TLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	// the certificate comes from the TLS config
+	return srv.ListenAndServeTLS("", "")
+}
+
 // RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server string) {
+func RunSyncV3Server(h http.Handler, bindAddr, destV2Server string, opts ServerOptions) {
 	// HTTP path routing
 	r := mux.NewRouter()
+	// v2 /sync is a GET, sliding sync is a POST to the same path
+	if v2h, ok := h.(V2SyncHandler); ok {
+		r.Handle("/_matrix/client/v3/sync", allowCORS(http.HandlerFunc(v2h.ServeV2Sync))).Methods("GET")
+		r.Handle("/_matrix/client/r0/sync", allowCORS(http.HandlerFunc(v2h.ServeV2Sync))).Methods("GET")
+	}
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	if wsh, ok := h.(WebSocketHandler); ok {
+		r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync/ws", http.HandlerFunc(wsh.ServeWebSocket))
+	}
 
-	serverJSON, _ := json.Marshal(struct {
-		Server  string `json:"server"`
-		Version string `json:"version"`
-	}{
-		Server:  destV2Server,
-		Version: Version,
-	})
+	// liveness only checks that we are serving HTTP requests: readiness checks dependencies
+	r.Handle("/health/live", HealthHandler(func() error { return nil }))
+	if hc, ok := h.(HealthChecker); ok {
+		r.Handle("/health/ready", HealthHandler(hc.Ready))
+	} else {
+		r.Handle("/health/ready", HealthHandler(func() error { return nil }))
+	}
+
+	upstreams, _ := h.(UpstreamLister)
 	r.Handle("/client/server.json", allowCORS(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		serverJSON := struct {
+			Server string `json:"server"`
+			// server name -> CS API URL, if there are several upstreams. May grow as servers are discovered.
+			Servers map[string]string `json:"servers,omitempty"`
+			Version string            `json:"version"`
+		}{
+			Server:  destV2Server,
+			Version: Version,
+		}
+		if upstreams != nil {
+			serverJSON.Servers = upstreams.UpstreamServers()
+		}
 		rw.Header().Set("Content-Type", "application/json")
 		rw.WriteHeader(200)
-		rw.Write(serverJSON)
+		json.NewEncoder(rw).Encode(serverJSON)
 	})))
 	r.PathPrefix("/client/").HandlerFunc(
 		allowCORS(
@@ -81,7 +187,8 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server string) {
 				})
 			},
 			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-				if r.Method == "OPTIONS" {
+				// don't spam the logs with load balancer probes
+				if r.Method == "OPTIONS" || strings.HasPrefix(r.URL.Path, "/health/") {
 					return
 				}
 				entry := internal.DecorateLogger(r.Context(), hlog.FromRequest(r).Info())
@@ -98,27 +205,11 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server string) {
 	}
 
 	// Block forever
-	logger.Info().Msgf("listening on %s", bindAddr)
-	if err := http.ListenAndServe(bindAddr, srv); err != nil {
+	logger.Info().Bool("tls", opts.TLSCertFile != "").Msgf("listening on %s", bindAddr)
+	if err := ListenAndServe(bindAddr, srv, opts); err != nil {
 		logger.Fatal().Err(err).Msg("failed to listen and serve")
 	}
 }
 
-type HandlerError struct {
-	StatusCode int
-	Err        error
-}
-
-func (e *HandlerError) Error() string {
-	return fmt.Sprintf("HTTP %d : %s", e.StatusCode, e.Err.Error())
-}
-
-type jsonError struct {
-	Err string `json:"error"`
-}
-
-func (e HandlerError) JSON() []byte {
-	je := jsonError{e.Error()}
-	b, _ := json.Marshal(je)
-	return b
-}
+// HandlerError is an error which is returned to clients as a Matrix error response.
+type HandlerError = internal.HandlerError